@@ -0,0 +1,121 @@
+// Package avro writes Avro object container files
+// (https://avro.apache.org/docs/1.11.1/specification/) of flat records whose
+// fields are all nullable.
+package avro
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Type is the type of a record field (or of the elements of an array field)
+type Type int
+
+const (
+	String Type = iota
+	UUID        // string with logicalType uuid
+	Long
+	Double
+	Boolean
+	Bytes
+	Date           // int with logicalType date (days since the epoch)
+	Timestamp      // long with logicalType timestamp-micros
+	LocalTimestamp // long with logicalType local-timestamp-micros
+)
+
+var nameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Field is a nullable record field
+type Field struct {
+	Name string
+	Type Type
+
+	// Array of (nullable) Type elements
+	Array bool
+}
+
+// Schema is a record schema
+type Schema struct {
+	Name   string
+	Fields []*Field
+
+	index map[string]int
+}
+
+// NewSchema returns the schema of record name with fields
+func NewSchema(name string, fields []*Field) (*Schema, error) {
+	if !nameRegex.MatchString(name) {
+		return nil, errors.Errorf("'%s' is not a valid record name", name)
+	}
+
+	s := &Schema{
+		Name:   name,
+		Fields: fields,
+		index:  make(map[string]int, len(fields)),
+	}
+
+	for i, f := range fields {
+		if !nameRegex.MatchString(f.Name) {
+			return nil, errors.Errorf("'%s' is not a valid field name", f.Name)
+		}
+
+		if _, ok := s.index[f.Name]; ok {
+			return nil, errors.Errorf("field '%s' is duplicated", f.Name)
+		}
+
+		s.index[f.Name] = i
+	}
+
+	return s, nil
+}
+
+// MarshalJSON returns the schema in Avro's JSON notation
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	type field struct {
+		Name    string      `json:"name"`
+		Type    interface{} `json:"type"`
+		Default interface{} `json:"default"`
+	}
+
+	fields := make([]field, 0, len(s.Fields))
+
+	for _, f := range s.Fields {
+		t := f.Type.schema()
+		if f.Array {
+			t = map[string]interface{}{"type": "array", "items": []interface{}{"null", t}}
+		}
+
+		fields = append(fields, field{Name: f.Name, Type: []interface{}{"null", t}})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"type":   "record",
+		"name":   s.Name,
+		"fields": fields,
+	})
+}
+
+func (t Type) schema() interface{} {
+	switch t {
+	case UUID:
+		return map[string]string{"type": "string", "logicalType": "uuid"}
+	case Long:
+		return "long"
+	case Double:
+		return "double"
+	case Boolean:
+		return "boolean"
+	case Bytes:
+		return "bytes"
+	case Date:
+		return map[string]string{"type": "int", "logicalType": "date"}
+	case Timestamp:
+		return map[string]string{"type": "long", "logicalType": "timestamp-micros"}
+	case LocalTimestamp:
+		return map[string]string{"type": "long", "logicalType": "local-timestamp-micros"}
+	default:
+		return "string"
+	}
+}
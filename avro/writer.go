@@ -0,0 +1,305 @@
+package avro
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Values for the codec of a Writer
+	CodecNull    = "null"
+	CodecDeflate = "deflate"
+
+	// Records are written in blocks of (about) this many uncompressed bytes
+	blockSize = 64 << 10
+)
+
+var magic = []byte{'O', 'b', 'j', 1}
+
+// Writer writes records to an object container file
+type Writer struct {
+	w      io.Writer
+	schema *Schema
+	codec  string
+	sync   [16]byte
+
+	// Encoded records that were not written yet
+	block []byte
+	count int64
+
+	// Bytes written to w
+	size int64
+
+	record []interface{}
+	zbuf   bytes.Buffer
+	zw     *flate.Writer
+}
+
+// NewWriter writes the file header (schema, codec and sync marker) to w and
+// returns a Writer for the file's records
+func NewWriter(w io.Writer, schema *Schema, codec string) (*Writer, error) {
+	aw := &Writer{
+		w:      w,
+		schema: schema,
+		codec:  codec,
+		record: make([]interface{}, len(schema.Fields)),
+	}
+
+	switch codec {
+	case CodecNull:
+	case CodecDeflate:
+		zw, err := flate.NewWriter(&aw.zbuf, flate.DefaultCompression)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create deflate writer")
+		}
+
+		aw.zw = zw
+	default:
+		return nil, errors.Errorf("unsupported codec '%s'", codec)
+	}
+
+	if _, err := rand.Read(aw.sync[:]); err != nil {
+		return nil, errors.Wrap(err, "unable to generate sync marker")
+	}
+
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal schema")
+	}
+
+	// Header: magic, metadata (a map of bytes), sync marker
+	header := append([]byte{}, magic...)
+	header = appendLong(header, 2)
+	header = appendBytes(header, []byte("avro.schema"))
+	header = appendBytes(header, schemaJSON)
+	header = appendBytes(header, []byte("avro.codec"))
+	header = appendBytes(header, []byte(codec))
+	header = appendLong(header, 0)
+	header = append(header, aw.sync[:]...)
+
+	if err := aw.write(header); err != nil {
+		return nil, errors.Wrap(err, "unable to write header")
+	}
+
+	return aw, nil
+}
+
+// Append adds a record; fields that are not in columns are null
+func (w *Writer) Append(columns []string, values []interface{}) error {
+	for i := range w.record {
+		w.record[i] = nil
+	}
+
+	for i, c := range columns {
+		idx, ok := w.schema.index[c]
+		if !ok {
+			return errors.Errorf("record '%s' has no field '%s'", w.schema.Name, c)
+		}
+
+		w.record[idx] = values[i]
+	}
+
+	start := len(w.block)
+
+	for i, f := range w.schema.Fields {
+		var err error
+
+		w.block, err = appendField(w.block, f, w.record[i])
+		if err != nil {
+			w.block = w.block[:start]
+			return errors.Wrapf(err, "unable to encode field '%s'", f.Name)
+		}
+	}
+
+	w.count++
+
+	if len(w.block) >= blockSize {
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// Size returns the size of the file so far, including records that were not
+// written yet (uncompressed)
+func (w *Writer) Size() int64 {
+	return w.size + int64(len(w.block))
+}
+
+// Flush writes the pending records as a block
+func (w *Writer) Flush() error {
+	if w.count == 0 {
+		return nil
+	}
+
+	data := w.block
+
+	if w.zw != nil {
+		w.zbuf.Reset()
+		w.zw.Reset(&w.zbuf)
+
+		if _, err := w.zw.Write(data); err != nil {
+			return errors.Wrap(err, "unable to compress block")
+		}
+
+		if err := w.zw.Close(); err != nil {
+			return errors.Wrap(err, "unable to compress block")
+		}
+
+		data = w.zbuf.Bytes()
+	}
+
+	block := appendLong(nil, w.count)
+	block = appendLong(block, int64(len(data)))
+	block = append(block, data...)
+	block = append(block, w.sync[:]...)
+
+	if err := w.write(block); err != nil {
+		return errors.Wrap(err, "unable to write block")
+	}
+
+	w.block = w.block[:0]
+	w.count = 0
+
+	return nil
+}
+
+func (w *Writer) write(data []byte) error {
+	n, err := w.w.Write(data)
+	w.size += int64(n)
+
+	return err
+}
+
+func appendField(buf []byte, f *Field, v interface{}) ([]byte, error) {
+	// Union index: 0 is null
+	if v == nil {
+		return appendLong(buf, 0), nil
+	}
+
+	buf = appendLong(buf, 1)
+
+	if !f.Array {
+		return appendValue(buf, f.Type, v)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, errors.Errorf("unable to encode %T as an array", v)
+	}
+
+	if rv.Len() > 0 {
+		buf = appendLong(buf, int64(rv.Len()))
+
+		for i := 0; i < rv.Len(); i++ {
+			el := rv.Index(i).Interface()
+
+			if el == nil {
+				buf = appendLong(buf, 0)
+				continue
+			}
+
+			var err error
+
+			buf, err = appendValue(appendLong(buf, 1), f.Type, el)
+			if err != nil {
+				return nil, errors.Wrapf(err, "element %d", i)
+			}
+		}
+	}
+
+	return appendLong(buf, 0), nil
+}
+
+func appendValue(buf []byte, t Type, v interface{}) ([]byte, error) {
+	switch t {
+	case String, UUID:
+		switch s := v.(type) {
+		case string:
+			return appendBytes(buf, []byte(s)), nil
+		case []byte:
+			return appendBytes(buf, s), nil
+		}
+	case Bytes:
+		switch b := v.(type) {
+		case []byte:
+			return appendBytes(buf, b), nil
+		case string:
+			return appendBytes(buf, []byte(b)), nil
+		}
+	case Long:
+		switch n := v.(type) {
+		case int64:
+			return appendLong(buf, n), nil
+		case int:
+			return appendLong(buf, int64(n)), nil
+		case int32:
+			return appendLong(buf, int64(n)), nil
+		}
+	case Double:
+		switch n := v.(type) {
+		case float64:
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(n)), nil
+		case float32:
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(float64(n))), nil
+		case int64:
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(float64(n))), nil
+		}
+	case Boolean:
+		if b, ok := v.(bool); ok {
+			if b {
+				return append(buf, 1), nil
+			}
+
+			return append(buf, 0), nil
+		}
+	case Date, Timestamp, LocalTimestamp:
+		tm, ok := v.(time.Time)
+		if !ok {
+			break
+		}
+
+		switch t {
+		case Date:
+			days := tm.Unix() / 86400
+			if tm.Unix() < 0 && tm.Unix()%86400 != 0 {
+				days--
+			}
+
+			return appendLong(buf, days), nil
+		case LocalTimestamp:
+			wall := time.Date(tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute(), tm.Second(), tm.Nanosecond(), time.UTC)
+			return appendLong(buf, wall.UnixMicro()), nil
+		default:
+			return appendLong(buf, tm.UnixMicro()), nil
+		}
+	}
+
+	return nil, errors.Errorf("unable to encode %T as %s", v, t.name())
+}
+
+func (t Type) name() string {
+	if s, ok := t.schema().(string); ok {
+		return s
+	}
+
+	return t.schema().(map[string]string)["logicalType"]
+}
+
+// appendLong appends n as a zig-zag encoded varint
+func appendLong(buf []byte, n int64) []byte {
+	return binary.AppendVarint(buf, n)
+}
+
+func appendBytes(buf, b []byte) []byte {
+	return append(appendLong(buf, int64(len(b))), b...)
+}
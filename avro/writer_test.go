@@ -0,0 +1,418 @@
+package avro
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// decoder is a minimal object container file reader written from the Avro
+// specification, independent of Writer's encoding helpers
+type decoder struct {
+	t    *testing.T
+	data []byte
+	pos  int
+}
+
+func (d *decoder) long() int64 {
+	d.t.Helper()
+
+	var (
+		u     uint64
+		shift uint
+	)
+
+	for {
+		if d.pos >= len(d.data) {
+			d.t.Fatal("truncated long")
+		}
+
+		b := d.data[d.pos]
+		d.pos++
+
+		u |= uint64(b&0x7f) << shift
+		shift += 7
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	// Zig-zag: 0, -1, 1, -2, ... are encoded as 0, 1, 2, 3, ...
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (d *decoder) bytes() []byte {
+	d.t.Helper()
+
+	n := int(d.long())
+	if n < 0 || d.pos+n > len(d.data) {
+		d.t.Fatalf("invalid bytes length %d", n)
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+
+	return b
+}
+
+// value decodes a value of the JSON schema t
+func (d *decoder) value(t interface{}) interface{} {
+	d.t.Helper()
+
+	switch s := t.(type) {
+	case []interface{}:
+		branch := d.long()
+		if branch < 0 || int(branch) >= len(s) {
+			d.t.Fatalf("invalid union branch %d", branch)
+		}
+
+		return d.value(s[branch])
+	case map[string]interface{}:
+		if s["type"] == "array" {
+			items := make([]interface{}, 0)
+
+			for {
+				n := d.long()
+				if n == 0 {
+					return items
+				}
+
+				for i := int64(0); i < n; i++ {
+					items = append(items, d.value(s["items"]))
+				}
+			}
+		}
+
+		return d.value(s["type"])
+	case string:
+		switch s {
+		case "null":
+			return nil
+		case "boolean":
+			b := d.data[d.pos]
+			d.pos++
+
+			return b == 1
+		case "int", "long":
+			return d.long()
+		case "double":
+			bits := uint64(0)
+			for i := 7; i >= 0; i-- {
+				bits = bits<<8 | uint64(d.data[d.pos+i])
+			}
+
+			d.pos += 8
+
+			return math.Float64frombits(bits)
+		case "string":
+			return string(d.bytes())
+		case "bytes":
+			return append([]byte{}, d.bytes()...)
+		}
+	}
+
+	d.t.Fatalf("unsupported schema %v", t)
+
+	return nil
+}
+
+// readFile decodes an object container file into its schema and records
+func readFile(t *testing.T, data []byte) (map[string]interface{}, []map[string]interface{}) {
+	t.Helper()
+
+	if !bytes.HasPrefix(data, []byte("Obj\x01")) {
+		t.Fatalf("invalid magic %q", data[:4])
+	}
+
+	d := &decoder{t: t, data: data, pos: 4}
+
+	meta := make(map[string]string)
+
+	for {
+		n := d.long()
+		if n == 0 {
+			break
+		}
+
+		for i := int64(0); i < n; i++ {
+			k := string(d.bytes())
+			meta[k] = string(d.bytes())
+		}
+	}
+
+	sync := data[d.pos : d.pos+16]
+	d.pos += 16
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(meta["avro.schema"]), &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+
+	var records []map[string]interface{}
+
+	for d.pos < len(data) {
+		count := d.long()
+		block := d.bytes()
+
+		if !bytes.Equal(data[d.pos:d.pos+16], sync) {
+			t.Fatal("block is not followed by the sync marker")
+		}
+
+		d.pos += 16
+
+		switch meta["avro.codec"] {
+		case "null":
+		case "deflate":
+			var err error
+
+			block, err = io.ReadAll(flate.NewReader(bytes.NewReader(block)))
+			if err != nil {
+				t.Fatalf("invalid deflate block: %v", err)
+			}
+		default:
+			t.Fatalf("unexpected codec %q", meta["avro.codec"])
+		}
+
+		bd := &decoder{t: t, data: block}
+
+		for i := int64(0); i < count; i++ {
+			record := make(map[string]interface{})
+
+			for _, f := range schema["fields"].([]interface{}) {
+				field := f.(map[string]interface{})
+				record[field["name"].(string)] = bd.value(field["type"])
+			}
+
+			records = append(records, record)
+		}
+
+		if bd.pos != len(block) {
+			t.Fatalf("%d trailing bytes in block", len(block)-bd.pos)
+		}
+	}
+
+	return schema, records
+}
+
+func testSchema(t *testing.T) *Schema {
+	s, err := NewSchema("users", []*Field{
+		{Name: "id", Type: Long},
+		{Name: "name", Type: String},
+		{Name: "uid", Type: UUID},
+		{Name: "score", Type: Double},
+		{Name: "ok", Type: Boolean},
+		{Name: "raw", Type: Bytes},
+		{Name: "day", Type: Date},
+		{Name: "at", Type: Timestamp},
+		{Name: "local", Type: LocalTimestamp},
+		{Name: "tags", Type: String, Array: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	columns := []string{"id", "name", "uid", "score", "ok", "raw", "day", "at", "local", "tags"}
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.FixedZone("", 2*3600))
+
+	for _, codec := range []string{CodecNull, CodecDeflate} {
+		t.Run(codec, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+
+			w, err := NewWriter(buf, testSchema(t), codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Enough records for several blocks
+			const n = 5000
+
+			for i := 0; i < n; i++ {
+				values := []interface{}{
+					int64(i - n/2),
+					"héllo",
+					"0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b",
+					float64(i) / 3,
+					i%2 == 0,
+					[]byte{byte(i), 0},
+					time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC),
+					at,
+					at,
+					[]interface{}{"a", nil},
+				}
+
+				if err := w.Append(columns, values); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Missing fields are null
+			if err := w.Append([]string{"id", "tags"}, []interface{}{int64(math.MaxInt64), []interface{}{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Size() != int64(buf.Len()) {
+				t.Fatalf("Size() = %d, wrote %d bytes", w.Size(), buf.Len())
+			}
+
+			schema, records := readFile(t, buf.Bytes())
+
+			if schema["name"] != "users" || len(schema["fields"].([]interface{})) != len(columns) {
+				t.Fatalf("unexpected schema %v", schema)
+			}
+
+			if len(records) != n+1 {
+				t.Fatalf("got %d records, want %d", len(records), n+1)
+			}
+
+			want := map[string]interface{}{
+				"id":    int64(1 - n/2),
+				"name":  "héllo",
+				"uid":   "0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b",
+				"score": 1.0 / 3,
+				"ok":    false,
+				"raw":   []byte{1, 0},
+				"day":   int64(-1),
+				"at":    at.UnixMicro(),
+				"local": time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC).UnixMicro(),
+				"tags":  []interface{}{"a", nil},
+			}
+
+			if !reflect.DeepEqual(records[1], want) {
+				t.Fatalf("got %#v, want %#v", records[1], want)
+			}
+
+			last := map[string]interface{}{
+				"id": int64(math.MaxInt64), "name": nil, "uid": nil, "score": nil, "ok": nil,
+				"raw": nil, "day": nil, "at": nil, "local": nil, "tags": []interface{}{},
+			}
+
+			if !reflect.DeepEqual(records[n], last) {
+				t.Fatalf("got %#v, want %#v", records[n], last)
+			}
+		})
+	}
+}
+
+func TestWriterEncoding(t *testing.T) {
+	s, err := NewSchema("r", []*Field{{Name: "v", Type: Long}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arr, err := NewSchema("r", []*Field{{Name: "v", Type: Long, Array: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		schema *Schema
+		value  interface{}
+		want   []byte // union branch followed by the value
+	}{
+		{"null", s, nil, []byte{0x00}},
+		{"zero", s, int64(0), []byte{0x02, 0x00}},
+		{"minus one", s, int64(-1), []byte{0x02, 0x01}},
+		{"one", s, int64(1), []byte{0x02, 0x02}},
+		{"63", s, int64(63), []byte{0x02, 0x7e}},
+		{"-64", s, int64(-64), []byte{0x02, 0x7f}},
+		{"64", s, int64(64), []byte{0x02, 0x80, 0x01}},
+		{"min int64", s, int64(math.MinInt64), []byte{0x02, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"int", s, 3, []byte{0x02, 0x06}},
+		{"empty array", arr, []interface{}{}, []byte{0x02, 0x00}},
+		{"array", arr, []interface{}{int64(1), nil}, []byte{0x02, 0x04, 0x02, 0x02, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+
+			w, err := NewWriter(buf, tt.schema, CodecNull)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := buf.Len()
+
+			if err := w.Append([]string{"v"}, []interface{}{tt.value}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Block: count 1, size, data, sync marker
+			want := append([]byte{0x02, byte(len(tt.want) * 2)}, tt.want...)
+			if got := buf.Bytes()[header : buf.Len()-16]; !bytes.Equal(got, want) {
+				t.Fatalf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	s := testSchema(t)
+
+	if _, err := NewWriter(&bytes.Buffer{}, s, "snappy"); err == nil {
+		t.Fatal("NewWriter with an unsupported codec did not fail")
+	}
+
+	buf := &bytes.Buffer{}
+
+	w, err := NewWriter(buf, s, CodecNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		column string
+		value  interface{}
+	}{
+		{"missing", int64(1)},
+		{"id", "1"},
+		{"ok", 1},
+		{"day", "2024-01-01"},
+		{"tags", "a"},
+		{"tags", []interface{}{1}},
+	} {
+		if err := w.Append([]string{tt.column}, []interface{}{tt.value}); err == nil {
+			t.Errorf("Append(%s = %#v) did not fail", tt.column, tt.value)
+		}
+	}
+
+	// Failed appends leave no partial record behind
+	if err := w.Append([]string{"id"}, []interface{}{int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, records := readFile(t, buf.Bytes()); len(records) != 1 || records[0]["id"] != int64(1) {
+		t.Fatalf("got %v, want a single record", records)
+	}
+
+	if _, err := NewSchema("1table", nil); err == nil {
+		t.Error("NewSchema with an invalid name did not fail")
+	}
+
+	if _, err := NewSchema("t", []*Field{{Name: "a"}, {Name: "a"}}); err == nil {
+		t.Error("NewSchema with duplicate fields did not fail")
+	}
+}
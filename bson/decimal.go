@@ -0,0 +1,229 @@
+package bson
+
+import (
+	"encoding/json"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	decimal128ExpBias   = 6176
+	decimal128MinExp    = -6176
+	decimal128MaxExp    = 6111
+	decimal128MaxDigits = 34
+)
+
+var (
+	decimalRegex = regexp.MustCompile(`^([+-]?)(\d*)(?:\.(\d*))?(?:[eE]([+-]?\d+))?$`)
+
+	// 10^34 - 1; largest representable coefficient
+	maxCoefficient = new(big.Int).Sub(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimal128MaxDigits), nil), big.NewInt(1))
+)
+
+// Decimal128 is an IEEE 754-2008 128-bit decimal floating point number as used
+// by BSON (BID encoding). It converts to and from strings without any loss of
+// precision.
+type Decimal128 struct {
+	H uint64
+	L uint64
+}
+
+// IsNaN reports whether d is NaN
+func (d Decimal128) IsNaN() bool {
+	return (d.H>>58)&0x1F == 0x1F
+}
+
+// IsInf returns 1 for +Inf, -1 for -Inf and 0 otherwise
+func (d Decimal128) IsInf() int {
+	if (d.H>>58)&0x1F != 0x1E {
+		return 0
+	}
+
+	if d.H>>63 == 1 {
+		return -1
+	}
+
+	return 1
+}
+
+// coefficient returns the sign, coefficient and exponent of a finite d
+func (d Decimal128) coefficient() (bool, *big.Int, int) {
+	negative := d.H>>63 == 1
+
+	var (
+		exp    int
+		sigHig uint64
+	)
+
+	if (d.H>>61)&3 == 3 {
+		// Second form; coefficient is always larger than the max and so
+		// (per the spec) is treated as zero.
+		exp = int((d.H >> 47) & (1<<14 - 1))
+		return negative, new(big.Int), exp - decimal128ExpBias
+	}
+
+	exp = int((d.H >> 49) & (1<<14 - 1))
+	sigHig = d.H & (1<<49 - 1)
+
+	coef := new(big.Int).SetUint64(sigHig)
+	coef.Lsh(coef, 64)
+	coef.Or(coef, new(big.Int).SetUint64(d.L))
+
+	if coef.Cmp(maxCoefficient) > 0 {
+		coef.SetUint64(0)
+	}
+
+	return negative, coef, exp - decimal128ExpBias
+}
+
+// String formats d per the BSON Decimal128 specification
+func (d Decimal128) String() string {
+	if d.IsNaN() {
+		return "NaN"
+	}
+
+	switch d.IsInf() {
+	case 1:
+		return "Infinity"
+	case -1:
+		return "-Infinity"
+	}
+
+	negative, coef, exp := d.coefficient()
+
+	digits := coef.String()
+	adjusted := exp + len(digits) - 1
+
+	var sb strings.Builder
+
+	if negative {
+		sb.WriteByte('-')
+	}
+
+	switch {
+	case exp > 0 || adjusted < -6:
+		// Scientific notation
+		sb.WriteByte(digits[0])
+
+		if len(digits) > 1 {
+			sb.WriteByte('.')
+			sb.WriteString(digits[1:])
+		}
+
+		sb.WriteByte('E')
+
+		if adjusted >= 0 {
+			sb.WriteByte('+')
+		}
+
+		sb.WriteString(strconv.Itoa(adjusted))
+	case exp == 0:
+		sb.WriteString(digits)
+	default:
+		// Plain notation with a decimal point
+		point := len(digits) + exp
+
+		if point <= 0 {
+			sb.WriteString("0.")
+			sb.WriteString(strings.Repeat("0", -point))
+			sb.WriteString(digits)
+		} else {
+			sb.WriteString(digits[:point])
+			sb.WriteByte('.')
+			sb.WriteString(digits[point:])
+		}
+	}
+
+	return sb.String()
+}
+
+func (d Decimal128) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"$numberDecimal": d.String()})
+}
+
+// ParseDecimal128 parses a decimal string (ie. "1.23", "-4E+10", "NaN",
+// "Infinity") without rounding; values that need more than 34 significant
+// digits are rejected.
+func ParseDecimal128(s string) (Decimal128, error) {
+	switch strings.ToLower(strings.TrimPrefix(s, "+")) {
+	case "nan":
+		return Decimal128{H: 0x7C00000000000000}, nil
+	case "inf", "infinity":
+		return Decimal128{H: 0x7800000000000000}, nil
+	case "-inf", "-infinity":
+		return Decimal128{H: 0xF800000000000000}, nil
+	}
+
+	m := decimalRegex.FindStringSubmatch(s)
+	if m == nil || (m[2] == "" && m[3] == "") {
+		return Decimal128{}, errors.Errorf("invalid decimal '%s'", s)
+	}
+
+	exp := 0
+
+	if m[4] != "" {
+		e, err := strconv.Atoi(m[4])
+		if err != nil {
+			return Decimal128{}, errors.Errorf("invalid decimal exponent in '%s'", s)
+		}
+
+		exp = e
+	}
+
+	digits := strings.TrimLeft(m[2]+m[3], "0")
+	exp -= len(m[3])
+
+	if digits == "" {
+		digits = "0"
+	}
+
+	// Drop trailing zeros if there are too many digits or the exponent is
+	// too large (does not change the value)
+	for len(digits) > 1 && strings.HasSuffix(digits, "0") && (len(digits) > decimal128MaxDigits || exp < decimal128MinExp) {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+
+	// Pad with zeros if the exponent is too large
+	for exp > decimal128MaxExp && len(digits) < decimal128MaxDigits && digits != "0" {
+		digits += "0"
+		exp--
+	}
+
+	if digits == "0" {
+		exp = clampExp(exp)
+	}
+
+	if len(digits) > decimal128MaxDigits || exp < decimal128MinExp || exp > decimal128MaxExp {
+		return Decimal128{}, errors.Errorf("decimal '%s' cannot be represented as Decimal128 without rounding", s)
+	}
+
+	coef, _ := new(big.Int).SetString(digits, 10)
+
+	l := new(big.Int).And(coef, new(big.Int).SetUint64(^uint64(0))).Uint64()
+	h := new(big.Int).Rsh(coef, 64).Uint64()
+
+	h |= uint64(exp+decimal128ExpBias) << 49
+
+	if m[1] == "-" {
+		h |= 1 << 63
+	}
+
+	return Decimal128{H: h, L: l}, nil
+}
+
+func clampExp(exp int) int {
+	if exp < decimal128MinExp {
+		return decimal128MinExp
+	}
+
+	if exp > decimal128MaxExp {
+		return decimal128MaxExp
+	}
+
+	return exp
+}
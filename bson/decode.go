@@ -0,0 +1,307 @@
+package bson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinDocumentSize is the size of an empty BSON document
+	MinDocumentSize = 5
+
+	// MaxDocumentSize is the largest document we are willing to read. MongoDB
+	// limits documents to 16MB; leave some headroom for dumps from old servers.
+	MaxDocumentSize = 64 * 1024 * 1024
+)
+
+// Unmarshal decodes a single BSON document. Values are decoded as:
+//
+//	double -> float64, string/symbol -> string, document -> map[string]interface{},
+//	array -> []interface{}, binary -> Binary, undefined/null -> nil,
+//	ObjectId -> ObjectID, bool -> bool, UTC datetime -> time.Time, regex -> Regex,
+//	DBPointer -> {"$ref": ..., "$id": ...}, JavaScript (with scope) -> JavaScript,
+//	int32 -> int32, timestamp -> Timestamp, int64 -> int64,
+//	decimal128 -> Decimal128, min/max key -> MinKey/MaxKey
+func Unmarshal(data []byte) (map[string]interface{}, error) {
+	doc, n, err := readDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if n != len(data) {
+		return nil, errors.Errorf("unexpected %d trailing bytes after document", len(data)-n)
+	}
+
+	return doc, nil
+}
+
+// ReadDocument reads the next raw BSON document from r. Returns io.EOF if r
+// is at EOF before any bytes are read.
+func ReadDocument(r io.Reader) ([]byte, error) {
+	var size [4]byte
+
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated document length")
+		}
+
+		return nil, err
+	}
+
+	length := int(int32(binary.LittleEndian.Uint32(size[:])))
+
+	if length < MinDocumentSize || length > MaxDocumentSize {
+		return nil, errors.Errorf("invalid document length %d", length)
+	}
+
+	data := make([]byte, length)
+	copy(data, size[:])
+
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		return nil, errors.Wrap(err, "truncated document")
+	}
+
+	return data, nil
+}
+
+func readDocument(data []byte) (map[string]interface{}, int, error) {
+	doc := make(map[string]interface{})
+
+	n, err := readElements(data, func(key string, v interface{}) {
+		doc[key] = v
+	})
+
+	return doc, n, err
+}
+
+func readArray(data []byte) ([]interface{}, int, error) {
+	arr := make([]interface{}, 0)
+
+	n, err := readElements(data, func(_ string, v interface{}) {
+		arr = append(arr, v)
+	})
+
+	return arr, n, err
+}
+
+// readElements reads a document (or array) and calls set for every element;
+// returns the number of bytes read.
+func readElements(data []byte, set func(key string, v interface{})) (int, error) {
+	if len(data) < MinDocumentSize {
+		return 0, errors.New("document too short")
+	}
+
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+
+	if length < MinDocumentSize || length > len(data) {
+		return 0, errors.Errorf("invalid document length %d", length)
+	}
+
+	if data[length-1] != 0 {
+		return 0, errors.New("document is not null terminated")
+	}
+
+	pos := 4
+
+	for pos < length-1 {
+		t := data[pos]
+		pos++
+
+		// The key must end before the document's terminating zero
+		key, n, err := readCString(data[pos : length-1])
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid element name")
+		}
+
+		pos += n
+
+		v, n, err := readValue(t, data[pos:length-1])
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid element '%s'", key)
+		}
+
+		pos += n
+
+		set(key, v)
+	}
+
+	return length, nil
+}
+
+func readValue(t byte, data []byte) (interface{}, int, error) {
+	need := func(n int) error {
+		if len(data) < n {
+			return errors.Errorf("need %d bytes, have %d", n, len(data))
+		}
+
+		return nil
+	}
+
+	switch t {
+	case TypeDouble:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+	case TypeString, TypeSymbol:
+		return readString(data)
+	case TypeJavaScript:
+		s, n, err := readString(data)
+		return JavaScript(s), n, err
+	case TypeDocument:
+		return readDocument(data)
+	case TypeArray:
+		return readArray(data)
+	case TypeBinary:
+		if err := need(5); err != nil {
+			return nil, 0, err
+		}
+
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		subtype := data[4]
+
+		if length < 0 || 5+length > len(data) {
+			return nil, 0, errors.Errorf("invalid binary length %d", length)
+		}
+
+		b := make([]byte, length)
+		copy(b, data[5:5+length])
+
+		// Old binary subtype has a redundant inner length
+		if subtype == 0x02 && length >= 4 {
+			b = b[4:]
+		}
+
+		return Binary{Subtype: subtype, Data: b}, 5 + length, nil
+	case TypeUndefined, TypeNull:
+		return nil, 0, nil
+	case TypeObjectID:
+		if err := need(12); err != nil {
+			return nil, 0, err
+		}
+
+		var oid ObjectID
+		copy(oid[:], data)
+
+		return oid, 12, nil
+	case TypeBoolean:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+
+		return data[0] != 0, 1, nil
+	case TypeDateTime:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+
+		return time.UnixMilli(int64(binary.LittleEndian.Uint64(data))).UTC(), 8, nil
+	case TypeRegex:
+		pattern, n1, err := readCString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		options, n2, err := readCString(data[n1:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return Regex{Pattern: pattern, Options: options}, n1 + n2, nil
+	case TypeDBPointer:
+		ns, n, err := readString(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if len(data) < n+12 {
+			return nil, 0, errors.New("truncated DBPointer")
+		}
+
+		var oid ObjectID
+		copy(oid[:], data[n:])
+
+		return map[string]interface{}{"$ref": ns, "$id": oid}, n + 12, nil
+	case TypeCodeWScope:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+
+		length := int(int32(binary.LittleEndian.Uint32(data)))
+		if length < 4 || length > len(data) {
+			return nil, 0, errors.Errorf("invalid code with scope length %d", length)
+		}
+
+		code, _, err := readString(data[4:length])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return JavaScript(code), length, nil
+	case TypeInt32:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+
+		return int32(binary.LittleEndian.Uint32(data)), 4, nil
+	case TypeTimestamp:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+
+		return Timestamp{
+			I: binary.LittleEndian.Uint32(data),
+			T: binary.LittleEndian.Uint32(data[4:]),
+		}, 8, nil
+	case TypeInt64:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+
+		return int64(binary.LittleEndian.Uint64(data)), 8, nil
+	case TypeDecimal128:
+		if err := need(16); err != nil {
+			return nil, 0, err
+		}
+
+		return Decimal128{
+			L: binary.LittleEndian.Uint64(data),
+			H: binary.LittleEndian.Uint64(data[8:]),
+		}, 16, nil
+	case TypeMinKey:
+		return MinKey{}, 0, nil
+	case TypeMaxKey:
+		return MaxKey{}, 0, nil
+	default:
+		return nil, 0, errors.Errorf("unknown element type 0x%02x", t)
+	}
+}
+
+func readCString(data []byte) (string, int, error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", 0, errors.New("unterminated cstring")
+	}
+
+	return string(data[:i]), i + 1, nil
+}
+
+func readString(data []byte) (string, int, error) {
+	if len(data) < 4 {
+		return "", 0, errors.New("truncated string length")
+	}
+
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+
+	if length < 1 || 4+length > len(data) || data[4+length-1] != 0 {
+		return "", 0, errors.Errorf("invalid string length %d", length)
+	}
+
+	return string(data[4 : 4+length-1]), 4 + length, nil
+}
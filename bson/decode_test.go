@@ -0,0 +1,204 @@
+package bson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Documents are built by hand (not with Marshal) so that the decoder is
+// tested against the BSON spec rather than against the encoder
+
+func le32(n int32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(n))
+}
+
+func le64(n int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(n))
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func bstring(s string) []byte {
+	return append(le32(int32(len(s)+1)), cstring(s)...)
+}
+
+func element(t byte, key string, value ...[]byte) []byte {
+	b := append([]byte{t}, cstring(key)...)
+	for _, v := range value {
+		b = append(b, v...)
+	}
+
+	return b
+}
+
+func document(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	return append(append(le32(int32(len(body)+5)), body...), 0)
+}
+
+func TestUnmarshal(t *testing.T) {
+	oid := ObjectID{0x50, 0x7f, 0x1f, 0x77, 0xbc, 0xf8, 0x6c, 0xd7, 0x99, 0x43, 0x90, 0x11}
+
+	dec, err := ParseDecimal128("-12.345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scope := document(element(TypeInt32, "x", le32(1)))
+	code := bstring("return x")
+	codeWScope := append(le32(int32(4+len(code)+len(scope))), append(code, scope...)...)
+
+	tests := []struct {
+		name string
+		el   []byte
+		want interface{}
+	}{
+		{"double", element(TypeDouble, "v", le64(int64(math.Float64bits(-1.5)))), -1.5},
+		{"string", element(TypeString, "v", bstring("héllo")), "héllo"},
+		{"empty string", element(TypeString, "v", bstring("")), ""},
+		{"document", element(TypeDocument, "v", document(element(TypeString, "a", bstring("b")))), map[string]interface{}{"a": "b"}},
+		{"empty document", element(TypeDocument, "v", document()), map[string]interface{}{}},
+		{"array", element(TypeArray, "v", document(element(TypeInt32, "0", le32(1)), element(TypeNull, "1"))), []interface{}{int32(1), nil}},
+		{"empty array", element(TypeArray, "v", document()), []interface{}{}},
+		{"binary", element(TypeBinary, "v", le32(2), []byte{BinaryGeneric, 0xde, 0xad}), Binary{Subtype: BinaryGeneric, Data: []byte{0xde, 0xad}}},
+		{"binary uuid", element(TypeBinary, "v", le32(16), []byte{BinaryUUID}, bytes.Repeat([]byte{0xab}, 16)), Binary{Subtype: BinaryUUID, Data: bytes.Repeat([]byte{0xab}, 16)}},
+		{"binary old", element(TypeBinary, "v", le32(6), []byte{0x02}, le32(2), []byte{1, 2}), Binary{Subtype: 0x02, Data: []byte{1, 2}}},
+		{"undefined", element(TypeUndefined, "v"), nil},
+		{"objectid", element(TypeObjectID, "v", oid[:]), oid},
+		{"true", element(TypeBoolean, "v", []byte{1}), true},
+		{"false", element(TypeBoolean, "v", []byte{0}), false},
+		{"datetime", element(TypeDateTime, "v", le64(1700000000123)), time.UnixMilli(1700000000123).UTC()},
+		{"datetime before epoch", element(TypeDateTime, "v", le64(-1)), time.UnixMilli(-1).UTC()},
+		{"null", element(TypeNull, "v"), nil},
+		{"regex", element(TypeRegex, "v", cstring("^a.*"), cstring("i")), Regex{Pattern: "^a.*", Options: "i"}},
+		{"dbpointer", element(TypeDBPointer, "v", bstring("db.coll"), oid[:]), map[string]interface{}{"$ref": "db.coll", "$id": oid}},
+		{"javascript", element(TypeJavaScript, "v", bstring("function() {}")), JavaScript("function() {}")},
+		{"symbol", element(TypeSymbol, "v", bstring("sym")), "sym"},
+		{"code with scope", element(TypeCodeWScope, "v", codeWScope), JavaScript("return x")},
+		{"int32", element(TypeInt32, "v", le32(-7)), int32(-7)},
+		{"timestamp", element(TypeTimestamp, "v", le32(3), le32(1700000000)), Timestamp{T: 1700000000, I: 3}},
+		{"int64", element(TypeInt64, "v", le64(math.MinInt64)), int64(math.MinInt64)},
+		{"decimal128", element(TypeDecimal128, "v", le64(int64(dec.L)), le64(int64(dec.H))), dec},
+		{"min key", element(TypeMinKey, "v"), MinKey{}},
+		{"max key", element(TypeMaxKey, "v"), MaxKey{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Surrounding elements check that the value's size is consumed exactly
+			data := document(element(TypeInt32, "before", le32(1)), tt.el, element(TypeString, "after", bstring("x")))
+
+			doc, err := Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]interface{}{"before": int32(1), "v": tt.want, "after": "x"}
+			if !reflect.DeepEqual(doc, want) {
+				t.Fatalf("got %#v, want %#v", doc, want)
+			}
+
+			// Every truncation of the document fails instead of panicking
+			for n := 0; n < len(data); n++ {
+				if _, err := Unmarshal(data[:n]); err == nil {
+					t.Fatalf("Unmarshal of %d/%d bytes did not fail", n, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalDecimal128(t *testing.T) {
+	dec, err := ParseDecimal128("1234567890123456789012345678901234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Unmarshal(document(element(TypeDecimal128, "v", le64(int64(dec.L)), le64(int64(dec.H)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := doc["v"].(Decimal128).String(); s != "1234567890123456789012345678901234" {
+		t.Fatalf("got %s", s)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte{5, 0, 0, 0}},
+		{"length too large", append(le32(6), 0, 0)},
+		{"length too small", append(le32(4), 0, 0, 0, 0, 0)},
+		{"negative length", append(le32(-1), 0)},
+		{"not null terminated", append(le32(5), 1)},
+		{"trailing bytes", append(document(), 0)},
+		{"unknown type", document(element(0x20, "v"))},
+		{"unterminated key", append(le32(7), TypeNull, 'a', 0)},
+		{"string length too large", document(element(TypeString, "v", le32(100), cstring("x")))},
+		{"string length zero", document(element(TypeString, "v", le32(0), []byte{0}))},
+		{"string not null terminated", document(element(TypeString, "v", le32(2), []byte("ab")))},
+		{"binary length too large", document(element(TypeBinary, "v", le32(100), []byte{0, 1}))},
+		{"binary negative length", document(element(TypeBinary, "v", le32(-1), []byte{0}))},
+		{"embedded document too long", document(element(TypeDocument, "v", le32(100), []byte{0}))},
+		{"code with scope length too large", document(element(TypeCodeWScope, "v", le32(100), bstring("x")))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Unmarshal(tt.data); err == nil {
+				t.Fatal("Unmarshal did not fail")
+			}
+		})
+	}
+}
+
+func TestReadDocument(t *testing.T) {
+	first := document(element(TypeInt32, "a", le32(1)))
+	second := document()
+
+	r := bytes.NewReader(append(append([]byte{}, first...), second...))
+
+	for _, want := range [][]byte{first, second} {
+		got, err := ReadDocument(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %x, want %x", got, want)
+		}
+	}
+
+	if _, err := ReadDocument(r); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated length", []byte{5, 0}},
+		{"truncated document", first[:len(first)-1]},
+		{"length too small", le32(4)},
+		{"length too large", le32(MaxDocumentSize + 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadDocument(bytes.NewReader(tt.data)); err == nil || err == io.EOF {
+				t.Fatalf("got %v, want an error", err)
+			}
+		})
+	}
+}
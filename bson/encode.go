@@ -0,0 +1,189 @@
+package bson
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Element types
+const (
+	TypeDouble     byte = 0x01
+	TypeString     byte = 0x02
+	TypeDocument   byte = 0x03
+	TypeArray      byte = 0x04
+	TypeBinary     byte = 0x05
+	TypeUndefined  byte = 0x06
+	TypeObjectID   byte = 0x07
+	TypeBoolean    byte = 0x08
+	TypeDateTime   byte = 0x09
+	TypeNull       byte = 0x0A
+	TypeRegex      byte = 0x0B
+	TypeDBPointer  byte = 0x0C
+	TypeJavaScript byte = 0x0D
+	TypeSymbol     byte = 0x0E
+	TypeCodeWScope byte = 0x0F
+	TypeInt32      byte = 0x10
+	TypeTimestamp  byte = 0x11
+	TypeInt64      byte = 0x12
+	TypeDecimal128 byte = 0x13
+	TypeMinKey     byte = 0xFF
+	TypeMaxKey     byte = 0x7F
+)
+
+// Marshal encodes doc as a BSON document. Since maps are unordered, keys are
+// written in sorted order.
+func Marshal(doc map[string]interface{}) ([]byte, error) {
+	return appendDocument(nil, doc)
+}
+
+func appendDocument(buf []byte, doc map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+
+	for _, k := range keys {
+		var err error
+
+		buf, err = appendElement(buf, k, doc[k])
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to encode field '%s'", k)
+		}
+	}
+
+	buf = append(buf, 0)
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start))
+
+	return buf, nil
+}
+
+func appendArray(buf []byte, arr []interface{}) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+
+	for i, v := range arr {
+		var err error
+
+		buf, err = appendElement(buf, strconv.Itoa(i), v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to encode array element %d", i)
+		}
+	}
+
+	buf = append(buf, 0)
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start))
+
+	return buf, nil
+}
+
+func appendElement(buf []byte, key string, v interface{}) ([]byte, error) {
+	header := func(t byte) {
+		buf = append(buf, t)
+		buf = append(buf, key...)
+		buf = append(buf, 0)
+	}
+
+	switch t := v.(type) {
+	case nil:
+		header(TypeNull)
+	case bool:
+		header(TypeBoolean)
+
+		if t {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	case string:
+		header(TypeString)
+		buf = appendString(buf, t)
+	case int32:
+		header(TypeInt32)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(t))
+	case int:
+		return appendElement(buf, key, int64(t))
+	case int64:
+		if t >= math.MinInt32 && t <= math.MaxInt32 {
+			return appendElement(buf, key, int32(t))
+		}
+
+		header(TypeInt64)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t))
+	case float64:
+		header(TypeDouble)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(t))
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return appendElement(buf, key, i)
+		}
+
+		f, err := t.Float64()
+		if err != nil {
+			return nil, errors.Errorf("invalid number '%s'", t)
+		}
+
+		return appendElement(buf, key, f)
+	case time.Time:
+		header(TypeDateTime)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.UnixMilli()))
+	case map[string]interface{}:
+		header(TypeDocument)
+		return appendDocument(buf, t)
+	case []interface{}:
+		header(TypeArray)
+		return appendArray(buf, t)
+	case []byte:
+		return appendElement(buf, key, Binary{Subtype: BinaryGeneric, Data: t})
+	case ObjectID:
+		header(TypeObjectID)
+		buf = append(buf, t[:]...)
+	case Binary:
+		header(TypeBinary)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(t.Data)))
+		buf = append(buf, t.Subtype)
+		buf = append(buf, t.Data...)
+	case Decimal128:
+		header(TypeDecimal128)
+		buf = binary.LittleEndian.AppendUint64(buf, t.L)
+		buf = binary.LittleEndian.AppendUint64(buf, t.H)
+	case Timestamp:
+		header(TypeTimestamp)
+		buf = binary.LittleEndian.AppendUint32(buf, t.I)
+		buf = binary.LittleEndian.AppendUint32(buf, t.T)
+	case Regex:
+		header(TypeRegex)
+		buf = append(buf, t.Pattern...)
+		buf = append(buf, 0)
+		buf = append(buf, t.Options...)
+		buf = append(buf, 0)
+	case JavaScript:
+		header(TypeJavaScript)
+		buf = appendString(buf, string(t))
+	case MinKey:
+		header(TypeMinKey)
+	case MaxKey:
+		header(TypeMaxKey)
+	default:
+		return nil, errors.Errorf("unsupported type '%T'", v)
+	}
+
+	return buf, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)+1))
+	buf = append(buf, s...)
+
+	return append(buf, 0)
+}
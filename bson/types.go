@@ -0,0 +1,119 @@
+// Package bson contains the BSON types that mmmbop understands along with a
+// minimal encoder. Types marshal to (relaxed) MongoDB Extended JSON.
+package bson
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Binary subtypes
+const (
+	BinaryGeneric   byte = 0x00
+	BinaryUUIDOld   byte = 0x03
+	BinaryUUID      byte = 0x04
+	BinaryMD5       byte = 0x05
+	BinaryEncrypted byte = 0x06
+)
+
+// ObjectID is a 12-byte MongoDB ObjectId
+type ObjectID [12]byte
+
+// ObjectIDFromHex parses a 24 character hex string
+func ObjectIDFromHex(s string) (ObjectID, error) {
+	var oid ObjectID
+
+	if len(s) != 24 {
+		return oid, errors.Errorf("invalid ObjectId '%s': must be 24 hex characters", s)
+	}
+
+	if _, err := hex.Decode(oid[:], []byte(s)); err != nil {
+		return oid, errors.Errorf("invalid ObjectId '%s': %s", s, err)
+	}
+
+	return oid, nil
+}
+
+func (o ObjectID) Hex() string {
+	return hex.EncodeToString(o[:])
+}
+
+func (o ObjectID) String() string {
+	return o.Hex()
+}
+
+func (o ObjectID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"$oid": o.Hex()})
+}
+
+// Binary is BSON binary data (BinData)
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+func (b Binary) String() string {
+	return fmt.Sprintf("BinData(%d, %s)", b.Subtype, base64.StdEncoding.EncodeToString(b.Data))
+}
+
+func (b Binary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"$binary": map[string]string{
+			"base64":  base64.StdEncoding.EncodeToString(b.Data),
+			"subType": fmt.Sprintf("%02x", b.Subtype),
+		},
+	})
+}
+
+// Timestamp is the internal MongoDB timestamp type (seconds + ordinal)
+type Timestamp struct {
+	T uint32
+	I uint32
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"$timestamp": map[string]uint32{"t": t.T, "i": t.I},
+	})
+}
+
+// Regex is a BSON regular expression
+type Regex struct {
+	Pattern string
+	Options string
+}
+
+func (r Regex) String() string {
+	return "/" + r.Pattern + "/" + r.Options
+}
+
+func (r Regex) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"$regularExpression": map[string]string{"pattern": r.Pattern, "options": r.Options},
+	})
+}
+
+// JavaScript is BSON JavaScript code
+type JavaScript string
+
+func (j JavaScript) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"$code": string(j)})
+}
+
+// MinKey and MaxKey are special BSON values that compare lower/higher than
+// all other values
+type MinKey struct{}
+
+func (MinKey) MarshalJSON() ([]byte, error) {
+	return []byte(`{"$minKey":1}`), nil
+}
+
+type MaxKey struct{}
+
+func (MaxKey) MarshalJSON() ([]byte, error) {
+	return []byte(`{"$maxKey":1}`), nil
+}
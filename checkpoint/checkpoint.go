@@ -12,6 +12,7 @@ import (
 	"github.com/timpalpant/gzran"
 
 	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/dump"
 	"github.com/dselans/mmmbop/validate"
 )
 
@@ -19,7 +20,12 @@ const (
 	IndexSuffix = ".index"
 )
 
-func Load(checkpointFile, sourceFile, sourceFileType string) (*types.Checkpoint, error) {
+// Load loads the checkpoint file or creates it (and the source's index) if it
+// does not exist. Stream sources (see config.TOMLSource.IsStream) are not
+// indexed; their checkpoints count documents instead of bytes. Directory
+// sources (mongodump output) record their collection files instead of an
+// index. Plain (uncompressed) files are not indexed either.
+func Load(checkpointFile, sourceFile, sourceFileType string, stream bool) (*types.Checkpoint, error) {
 	startedAt := time.Now()
 	logrus.Debugf("Checkpoint loading started at '%s'", startedAt)
 
@@ -43,14 +49,16 @@ func Load(checkpointFile, sourceFile, sourceFileType string) (*types.Checkpoint,
 
 	if createCheckpoint {
 		logrus.Debugf("Creating checkpoint file '%s'", checkpointFile)
-		return create(checkpointFile, sourceFile, sourceFileType)
+		return create(checkpointFile, sourceFile, sourceFileType, stream)
 	} else {
 		logrus.Debugf("Loading checkpoint file '%s'", checkpointFile)
 		return load(checkpointFile)
 	}
 }
 
-func load(checkpointFile string) (*types.Checkpoint, error) {
+// Read reads a checkpoint file without loading its index; unlike Load it
+// also returns completed checkpoints.
+func Read(checkpointFile string) (*types.Checkpoint, error) {
 	data, err := os.ReadFile(checkpointFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to read checkpoint file")
@@ -68,24 +76,31 @@ func load(checkpointFile string) (*types.Checkpoint, error) {
 		return nil, errors.Wrap(err, "failed checkpoint validation")
 	}
 
-	if cp.CompletedAt != nil && !cp.CompletedAt.IsZero() {
-		return nil, errors.New("migration already completed")
-	}
+	return cp, nil
+}
 
-	// Open index file
-	indexFile, err := os.Open(cp.IndexFile)
+func load(checkpointFile string) (*types.Checkpoint, error) {
+	cp, err := Read(checkpointFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to open checkpoint index file")
+		return nil, err
 	}
-	defer indexFile.Close()
 
-	// Load index
-	index, err := readGzipIndex(indexFile)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to read gzip index")
+	// Completed migrations can still be loaded to recreate deferred indexes,
+	// delete rows missing from a delta migration's source and apply the
+	// events of a newer change stream export
+	if cp.CompletedAt != nil && !cp.CompletedAt.IsZero() && !cp.HasDeferredDDL() && !cp.DeltaDeletePending && cp.ResumeToken == "" {
+		return nil, errors.New("migration already completed")
 	}
 
-	cp.Index = index
+	// Streams have no index
+	if cp.IndexFile != "" {
+		index, err := LoadIndex(cp.IndexFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read gzip index")
+		}
+
+		cp.Index = index
+	}
 
 	// Re-create mutex
 	cp.Mutex = &sync.Mutex{}
@@ -93,15 +108,108 @@ func load(checkpointFile string) (*types.Checkpoint, error) {
 	return cp, nil
 }
 
-func create(checkpointFile, sourceFile, sourceFileType string) (*types.Checkpoint, error) {
-	// Create the index
+func create(checkpointFile, sourceFile, sourceFileType string, stream bool) (*types.Checkpoint, error) {
+	cp := &types.Checkpoint{
+		IndexOffset: 0,
+		SourceFile:  sourceFile,
+		Stream:      stream,
+		StartedAt:   time.Now(),
+		LastUpdated: time.Now(),
+		Mutex:       &sync.Mutex{},
+	}
+
+	info, err := os.Stat(sourceFile)
+	if err != nil && !stream {
+		return nil, errors.Wrap(err, "unable to stat source file")
+	}
+
+	switch {
+	case stream:
+		// Streams can only be read once, so they are not indexed
+	case info.IsDir():
+		cp.DumpFiles, err = dumpFiles(sourceFile)
+		if err != nil {
+			return nil, err
+		}
+	case sourceFileType != "gzip":
+		// Plain files are seeked directly, so they need no index
+	default:
+		index, err := createIndex(checkpointFile+IndexSuffix, sourceFile, sourceFileType)
+		if err != nil {
+			return nil, err
+		}
+
+		cp.IndexFile = checkpointFile + IndexSuffix
+		cp.Index = index
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal checkpoint file")
+	}
+
+	// Try to write checkpoint file
+	if err := os.WriteFile(checkpointFile, data, 0644); err != nil {
+		return nil, errors.Wrap(err, "unable to write checkpoint file")
+	}
+
+	return cp, nil
+}
+
+// dumpFiles lists the collection files of a mongodump directory, together
+// with their uncompressed sizes (see types.DumpFile)
+func dumpFiles(dir string) ([]*types.DumpFile, error) {
+	collections, err := dump.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(collections) == 0 {
+		return nil, errors.Errorf("source directory '%s' contains no collections", dir)
+	}
+
+	files := make([]*types.DumpFile, 0, len(collections))
+
+	for _, c := range collections {
+		f := &types.DumpFile{
+			Namespace: c.Namespace(),
+			File:      c.File,
+			Gzip:      c.Gzip,
+			Size:      -1,
+		}
+
+		if c.Gzip {
+			f.SizeHint, err = dump.SizeHint(c.File)
+		} else {
+			f.Size, err = fileSize(c.File)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func fileSize(file string) (int64, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to stat collection file")
+	}
+
+	return info.Size(), nil
+}
+
+// createIndex generates the index of the source and writes it to indexFilename
+func createIndex(indexFilename, sourceFile, sourceFileType string) (gzran.Index, error) {
 	index, err := generateIndex(sourceFileType, sourceFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to generate gzip index")
 	}
 
-	indexFilename := checkpointFile + IndexSuffix
-
 	indexFile, err := os.Create(indexFilename)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to create checkpoint index file %s", indexFilename)
@@ -113,28 +221,18 @@ func create(checkpointFile, sourceFile, sourceFileType string) (*types.Checkpoin
 		return nil, errors.Wrap(err, "error writing index to file")
 	}
 
-	// Generate checkpoint JSON file
-	cp := &types.Checkpoint{
-		IndexFile:   checkpointFile + IndexSuffix,
-		IndexOffset: 0,
-		SourceFile:  sourceFile,
-		StartedAt:   time.Now(),
-		LastUpdated: time.Now(),
-		Index:       index,
-		Mutex:       &sync.Mutex{},
-	}
+	return index, nil
+}
 
-	data, err := json.MarshalIndent(cp, "", "  ")
+// LoadIndex loads the gzip index written alongside a checkpoint file
+func LoadIndex(indexFile string) (gzran.Index, error) {
+	f, err := os.Open(indexFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to marshal checkpoint file")
-	}
-
-	// Try to write checkpoint file
-	if err := os.WriteFile(checkpointFile, data, 0644); err != nil {
-		return nil, errors.Wrap(err, "unable to write checkpoint file")
+		return nil, errors.Wrap(err, "unable to open checkpoint index file")
 	}
+	defer f.Close()
 
-	return cp, nil
+	return readGzipIndex(f)
 }
 
 func readGzipIndex(f *os.File) (gzran.Index, error) {
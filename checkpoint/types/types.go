@@ -3,6 +3,7 @@ package types
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -19,12 +20,82 @@ type Checkpoint struct {
 	LastUpdated time.Time  `json:"last_updated"`
 	CompletedAt *time.Time `json:"completed_at,omitempty"`
 
+	// Set for stream sources (stdin, named pipes); IndexOffset is then the
+	// number of documents written rather than a byte offset and there is no
+	// index
+	Stream bool `json:"stream,omitempty"`
+
+	// Indexes and foreign keys dropped for the duration of the load (see
+	// destination.defer_indexes); recreated after the migration completes.
+	DeferredDDL *DeferredDDL `json:"deferred_ddl,omitempty"`
+
+	// Order-independent checksums of the rows built from all documents up to
+	// IndexOffset, per destination table
+	Checksums map[string]*TableChecksum `json:"checksums,omitempty"`
+
+	// Set while rows that are missing from a delta migration's source still
+	// need to be deleted (see delta.delete_missing)
+	DeltaDeletePending bool `json:"delta_delete_pending,omitempty"`
+
+	// Resume token of the last applied change stream event; a resumed run
+	// continues after the event with this token
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	// Namespace of the archive block IndexOffset is in (archive sources)
+	ArchiveNamespace string `json:"archive_namespace,omitempty"`
+
+	// Collection files of a mongodump directory source, in reading order;
+	// IndexOffset is an offset into their (uncompressed) concatenation
+	DumpFiles []*DumpFile `json:"dump_files,omitempty"`
+
 	// Not marshalled
 	Index gzran.Index `json:"-"`
 
 	*sync.Mutex
 }
 
+// DeferredDDL holds the definitions of dropped indexes and foreign keys
+type DeferredDDL struct {
+	Indexes     []*DeferredObject `json:"indexes,omitempty"`
+	ForeignKeys []*DeferredObject `json:"foreign_keys,omitempty"`
+}
+
+// DeferredObject is a single dropped index or foreign key
+type DeferredObject struct {
+	Table      string `json:"table"`
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+// DumpFile is a single collection file of a mongodump directory source
+type DumpFile struct {
+	Namespace string `json:"namespace"`
+	File      string `json:"file"`
+	Gzip      bool   `json:"gzip,omitempty"`
+
+	// Uncompressed size; gzipped files are not decompressed up front, so
+	// theirs is -1 until the migration has read them
+	Size int64 `json:"size"`
+
+	// Estimated uncompressed size of gzipped files (see dump.SizeHint)
+	SizeHint int64 `json:"size_hint,omitempty"`
+}
+
+// TableChecksum is the number of rows and the sum (mod 2^64) of the row
+// hashes of a single table
+type TableChecksum struct {
+	// Hashed columns, in hashing order
+	Columns []string `json:"columns"`
+	Rows    int64    `json:"rows"`
+	Sum     uint64   `json:"sum,string"`
+}
+
+// HasDeferredDDL reports whether there are indexes or foreign keys that still
+// need to be recreated
+func (cp *Checkpoint) HasDeferredDDL() bool {
+	return cp.DeferredDDL != nil && (len(cp.DeferredDDL.Indexes) > 0 || len(cp.DeferredDDL.ForeignKeys) > 0)
+}
+
 func (cp *Checkpoint) Save(checkpointFile string) error {
 	cp.Lock()
 	defer cp.Unlock()
@@ -34,10 +105,50 @@ func (cp *Checkpoint) Save(checkpointFile string) error {
 		return errors.Wrap(err, "unable to marshal checkpoint file")
 	}
 
-	// TODO: Improve writing to file by first writing to temp file and renaming
-	if err := os.WriteFile(checkpointFile, data, 0644); err != nil {
+	// Write to a temp file in the same directory and rename it over the
+	// checkpoint so that a crash mid-write never leaves a truncated checkpoint
+	tmp, err := os.CreateTemp(filepath.Dir(checkpointFile), filepath.Base(checkpointFile)+".tmp*")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temp checkpoint file")
+	}
+
+	tmpName := tmp.Name()
+
+	if err := writeSynced(tmp, data); err != nil {
+		os.Remove(tmpName)
 		return errors.Wrap(err, "unable to write checkpoint file")
 	}
 
+	if err := os.Rename(tmpName, checkpointFile); err != nil {
+		os.Remove(tmpName)
+		return errors.Wrap(err, "unable to rename temp checkpoint file")
+	}
+
+	// Persist the rename; not every platform supports syncing directories
+	if dir, err := os.Open(filepath.Dir(checkpointFile)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
 	return nil
 }
+
+// writeSynced writes data to f, flushes it to disk and closes f
+func writeSynced(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
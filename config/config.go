@@ -1,7 +1,9 @@
 package config
 
 import (
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -10,17 +12,65 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/DataDog/dd-trace-go/contrib/database/sql/parsedsn"
+
+	"github.com/dselans/mmmbop/conv"
+	"github.com/dselans/mmmbop/docpath"
+	"github.com/dselans/mmmbop/expr"
 )
 
 const (
 	EnvVarPrefix          = "MMMBOP"
 	CheckpointIndexSuffix = ".index"
 
+	// SrcParentPrefix is used in a mapping entry's src to copy a column from
+	// the parent row (ie. "$parent.id") into a child row.
+	SrcParentPrefix = "$parent."
+
+	// Policies for on_missing and on_conv_error
+	OnMissingSkip    = "skip"     // omit the column (destination default applies)
+	OnMissingNull    = "null"     // write NULL
+	OnMissingDefault = "default"  // write the entry's default value
+	OnMissingSkipDoc = "skip_doc" // skip the whole document
+	OnMissingFail    = "fail"     // fail the migration
+
+	// SourceStdin is the source.file that reads the source from stdin
+	SourceStdin = "-"
+
+	// SrcIndex is used in a mapping entry's src to refer to the position of
+	// the exploded array element that a child row was created from.
+	SrcIndex = "$index"
+
+	// Values for destination.schema_mode
+	SchemaModeValidate = "validate" // fail if tables or columns are missing
+	SchemaModeCreate   = "create"   // create missing tables + add missing (nullable) columns
+	SchemaModeMigrate  = "migrate"  // create + add dupe check indexes to existing tables
+
+	// Values for tables.<name>.on_delete
+	OnDeleteDelete = "delete" // DELETE the row
+	OnDeleteSoft   = "soft"   // set the table's soft_delete_column
+
+	// File destinations (destination.path) write rows to files instead of a
+	// database
+	DestinationAvro = "avro"
+
+	// Values for destination.codec
+	CodecNull    = "null"
+	CodecDeflate = "deflate"
+
+	DefaultMaxFileBytes = 128 << 20
+
+	// Values for destination.dupe_check_index
+	DupeCheckIndexUnique     = "unique"
+	DupeCheckIndexPrimaryKey = "primary_key"
+
 	DefaultBatchSize          = 10
 	DefaultNumWorkers         = 2
 	DefaultNumWriters         = 2
 	DefaultCheckpointInterval = duration(5 * time.Second)
 	DefaultCheckpointFile     = "checkpoint.json"
+	DefaultMaxInflightBytes   = 256 << 20
+	DefaultDrainTimeout       = duration(1 * time.Minute)
+	DefaultShutdownTimeout    = duration(10 * time.Second)
 
 	MinBatchSize          = 1
 	MaxBatchSize          = 10_000
@@ -28,6 +78,19 @@ const (
 	MaxNumWorkers         = 100
 	MinCheckpointInterval = duration(1 * time.Millisecond)
 	MaxCheckpointInterval = duration(1 * time.Hour)
+
+	DefaultAdaptiveInterval      = duration(10 * time.Second)
+	DefaultAdaptiveTargetLatency = duration(1 * time.Second)
+	MinAdaptiveInterval          = duration(100 * time.Millisecond)
+	MaxAdaptiveWriters           = 1_000
+
+	DefaultRetryMaxRetries     = 10
+	DefaultRetryInitialBackoff = duration(500 * time.Millisecond)
+	DefaultRetryMaxBackoff     = duration(1 * time.Minute)
+	DefaultRetryMultiplier     = 2.0
+	DefaultRetryJitter         = 0.2
+
+	DefaultDeltaKeysTable = "mmmbop_delta_keys"
 )
 
 var (
@@ -40,21 +103,63 @@ var (
 	}
 
 	validFileContents = map[string]struct{}{
-		"json": {},
-		"csv":  {},
-		"bson": {},
+		"json":  {},
+		"ejson": {},
+		"csv":   {},
+		"bson":  {},
+
+		// MongoDB change stream events, one (extended) JSON event per line
+		"changestream": {},
+
+		// mongodump --archive; documents are routed to mappings by collection
+		"archive": {},
+	}
+
+	validSchemaModes = map[string]struct{}{
+		SchemaModeValidate: {},
+		SchemaModeCreate:   {},
+		SchemaModeMigrate:  {},
+	}
+
+	validDupeCheckIndexes = map[string]struct{}{
+		DupeCheckIndexUnique:     {},
+		DupeCheckIndexPrimaryKey: {},
+	}
+
+	validOnMissing = map[string]struct{}{
+		OnMissingSkip:    {},
+		OnMissingNull:    {},
+		OnMissingDefault: {},
+		OnMissingSkipDoc: {},
+		OnMissingFail:    {},
+	}
+
+	validOnConvError = map[string]struct{}{
+		OnMissingNull:    {},
+		OnMissingDefault: {},
+		OnMissingSkipDoc: {},
+		OnMissingFail:    {},
 	}
 
 	validConvs = map[string]struct{}{
-		"string":    {},
-		"int":       {},
-		"float":     {},
-		"bool":      {},
-		"time":      {},
-		"json":      {},
-		"date":      {},
-		"datetime":  {},
-		"timestamp": {},
+		"string":      {},
+		"int":         {},
+		"float":       {},
+		"bool":        {},
+		"time":        {},
+		"json":        {},
+		"date":        {},
+		"datetime":    {},
+		"timestamp":   {},
+		"timestamptz": {},
+		"uuid":        {},
+		"numeric":     {},
+		"jsonb":       {},
+		"bytea":       {},
+		"base64":      {},
+		"bson":        {},
+		"inet":        {},
+		"enum":        {},
 	}
 )
 
@@ -68,6 +173,8 @@ type TOML struct {
 	Source      *TOMLSource      `toml:"source"`
 	Destination *TOMLDestination `toml:"destination"`
 	Mapping     *TOMLMapping     `toml:"mapping"`
+	Tables      *TOMLTables      `toml:"tables"`
+	Delta       *TOMLDelta       `toml:"delta"`
 }
 
 type TOMLConfig struct {
@@ -80,6 +187,41 @@ type TOMLConfig struct {
 	CheckpointInterval   duration `toml:"checkpoint_interval"`
 	DisableCheckpointing bool     `toml:"disable_checkpointing"`
 	DisableDupecheck     bool     `toml:"disable_dupecheck"`
+
+	// Maximum number of bytes of documents that have been read but not yet
+	// written; the reader blocks once this is reached
+	MaxInflightBytes int64 `toml:"max_inflight_bytes"`
+
+	// On SIGINT/SIGTERM, how long processors and writers may keep writing
+	// documents that were already read before they are stopped
+	DrainTimeout duration `toml:"drain_timeout"`
+
+	// How long to wait for writers and the checkpointer to exit once they
+	// have been told to stop
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+
+	Adaptive *TOMLAdaptive `toml:"adaptive"`
+}
+
+// TOMLAdaptive configures the controller that tunes the number of active
+// writers and the batch size while the migration is running
+type TOMLAdaptive struct {
+	Enabled bool `toml:"enabled"`
+
+	// How often the controller re-evaluates its settings
+	Interval duration `toml:"interval"`
+
+	// Per-batch (transaction) latency the controller aims for
+	TargetLatency duration `toml:"target_latency"`
+
+	MinWriters   int `toml:"min_writers"`
+	MaxWriters   int `toml:"max_writers"`
+	MinBatchSize int `toml:"min_batch_size"`
+	MaxBatchSize int `toml:"max_batch_size"`
+
+	// Back off while replication lag (as reported by pg_stat_replication on
+	// the destination) exceeds this; 0 disables the check
+	MaxReplicationLag duration `toml:"max_replication_lag"`
 }
 
 type CheckpointFile struct {
@@ -88,24 +230,167 @@ type CheckpointFile struct {
 }
 
 type TOMLSource struct {
+	// Path of the source file; "-" (SourceStdin) reads from stdin
 	File         string `toml:"file"`
 	FileType     string `toml:"file_type"`
 	FileContents string `toml:"file_contents"`
 }
 
+// IsStream reports whether the source can only be read sequentially (ie.
+// stdin or a named pipe); streams are neither indexed nor seeked.
+func (s *TOMLSource) IsStream() bool {
+	if s.File == SourceStdin {
+		return true
+	}
+
+	info, err := os.Stat(s.File)
+
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// IsDir reports whether the source is a mongodump output directory; its
+// collections are read one after the other and routed to the mapping named
+// after them.
+func (s *TOMLSource) IsDir() bool {
+	if s.File == SourceStdin {
+		return false
+	}
+
+	info, err := os.Stat(s.File)
+
+	return err == nil && info.IsDir()
+}
+
 type TOMLDestination struct {
 	Type string `toml:"type"`
 	DSN  string `toml:"dsn"`
+
+	// How missing destination tables/columns are handled; one of "validate"
+	// (default), "create" or "migrate".
+	SchemaMode string `toml:"schema_mode"`
+
+	// Optionally create a "unique" index or "primary_key" on dupe-check
+	// columns of tables created (or migrated) by schema_mode.
+	DupeCheckIndex string `toml:"dupe_check_index"`
+
+	// Drop non-essential indexes and foreign keys of the mapped tables before
+	// the load and recreate them after it completes.
+	DeferIndexes bool `toml:"defer_indexes"`
+
+	// Limits shared by all writers; 0 = unlimited. Can be changed while the
+	// migration is running via the control endpoint (--control-addr).
+	MaxRowsPerSec  int64 `toml:"max_rows_per_sec"`
+	MaxBytesPerSec int64 `toml:"max_bytes_per_sec"`
+
+	Retry *TOMLRetry `toml:"retry"`
+
+	// File destinations (type "avro"): directory that gets one sub-directory
+	// of files per table, the size at which files are rolled and the
+	// compression codec of their blocks ("null" or "deflate")
+	Path         string `toml:"path"`
+	MaxFileBytes int64  `toml:"max_file_bytes"`
+	Codec        string `toml:"codec"`
+}
+
+// IsFile reports whether rows are written to files (under path) rather than
+// a database
+func (d *TOMLDestination) IsFile() bool {
+	return d.Type == DestinationAvro
+}
+
+// TOMLRetry configures retries of batches that failed with a transient error
+// (ie. connection reset, deadlock, serialization failure, failover)
+type TOMLRetry struct {
+	Disable bool `toml:"disable"`
+
+	// Number of retries after the first attempt
+	MaxRetries int `toml:"max_retries"`
+
+	// Backoff before retry n is initial_backoff * multiplier^(n-1), capped at
+	// max_backoff and randomized by +/- jitter (fraction of the backoff)
+	InitialBackoff duration `toml:"initial_backoff"`
+	MaxBackoff     duration `toml:"max_backoff"`
+	Multiplier     float64  `toml:"multiplier"`
+	Jitter         float64  `toml:"jitter"`
+}
+
+// TOMLDelta configures delta migrations: documents of a newer source are
+// upserted by their dupe check key, skipping documents whose rows did not
+// change
+type TOMLDelta struct {
+	Enabled bool `toml:"enabled"`
+
+	// Delete rows of root tables whose dupe check key is not in the source
+	// (plus their children) once the migration completes
+	DeleteMissing bool `toml:"delete_missing"`
+
+	// Destination table that records the dupe check keys seen in the source
+	// (only used with delete_missing)
+	KeysTable string `toml:"keys_table"`
 }
 
 type TOMLMapping map[string][]*TOMLMappingEntry
 
+// TOMLTables holds optional per-table settings, keyed by destination table name
+type TOMLTables map[string]*TOMLTable
+
+type TOMLTable struct {
+	// Parent is the table whose rows this table's rows are children of. Child
+	// rows are always written after (and in the same transaction as) their
+	// parent row.
+	Parent string `toml:"parent"`
+
+	// Explode is the path (relative to the parent row's source element) of an
+	// array; every element in the array produces one row in this table.
+	Explode string `toml:"explode"`
+
+	// OnDelete is what deleting a row (ie. a change stream delete event or
+	// delta.delete_missing) does: "delete" (default) or "soft".
+	OnDelete string `toml:"on_delete"`
+
+	// SoftDeleteColumn is set when a row is soft deleted; it is NULL for rows
+	// that are not deleted. SoftDeleteValue is what it is set to (default: the
+	// current timestamp).
+	SoftDeleteColumn string      `toml:"soft_delete_column"`
+	SoftDeleteValue  interface{} `toml:"soft_delete_value"`
+}
+
 type TOMLMappingEntry struct {
 	Src       string `toml:"src"`
+	Expr      string `toml:"expr,omitempty"`
 	Dst       string `toml:"dst"`
 	Conv      string `toml:"conv"`
 	Required  *bool  `toml:"required,omitempty"`
 	DupeCheck *bool  `toml:"dupe_check,omitempty"`
+
+	// Allowed values for conv = "enum"
+	Values []string `toml:"values,omitempty"`
+
+	// Time parsing options for date/datetime/timestamp/timestamptz/time convs.
+	// Format is either a single layout or a list of layouts (Go or strftime-like)
+	// that are tried in order.
+	Format   interface{} `toml:"format,omitempty"`
+	Unit     string      `toml:"unit,omitempty"`
+	Timezone string      `toml:"timezone,omitempty"`
+
+	// Value used when on_missing or on_conv_error is "default"
+	Default interface{} `toml:"default,omitempty"`
+
+	// Source values (compared as strings) that are treated as NULL
+	NullIf []string `toml:"null_if,omitempty"`
+
+	// What to do when the field is missing (or NULL); one of "skip", "null",
+	// "default", "skip_doc" or "fail". If unset, missing fields are skipped
+	// (or fail if required = true) and NULL values are written as NULL.
+	OnMissing string `toml:"on_missing,omitempty"`
+
+	// What to do when conv fails; one of "fail" (default), "null", "default"
+	// or "skip_doc".
+	OnConvError string `toml:"on_conv_error,omitempty"`
+
+	// Compiled Expr and Conv; set during validation
+	Program   *expr.Program   `toml:"-"`
+	Converter *conv.Converter `toml:"-"`
 }
 
 type CLI struct {
@@ -116,6 +401,23 @@ type CLI struct {
 	ReportOutput   string        `kong:"help='Output file for progress reports',short='o'"`
 	DisableResume  bool          `kong:"help='Disable resuming from checkpoint',short='R'"`
 	DisableColor   bool          `kong:"help='Disable color output',short='C'"`
+	RestoreIndexes bool          `kong:"help='Recreate indexes and foreign keys dropped by destination.defer_indexes and exit'"`
+	ControlAddr    string        `kong:"help='Loopback address (ie. 127.0.0.1:8750) to serve the unauthenticated control endpoint on'"`
+
+	Infer            bool   `kong:"help='Infer a draft mapping and DDL from sampled source documents',short='i'"`
+	InferSamples     int    `kong:"help='Number of documents to sample when inferring',default='1000'"`
+	InferTable       string `kong:"help='Destination table name used when inferring (default: source file name)'"`
+	InferMappingFile string `kong:"help='Output file for the inferred mapping (default: stdout)',type='path'"`
+	InferDDLFile     string `kong:"help='Output file for the inferred DDL (default: stdout)',type='path'"`
+	InferIndexes     bool   `kong:"help='Use the indexes of a mongodump directory source for dupe-check columns and destination indexes'"`
+
+	Verify            bool   `kong:"help='Compare rows built from the source with the destination and exit',short='V'"`
+	VerifySample      int    `kong:"help='Number of random source documents to verify (default: all)'"`
+	VerifyOutput      string `kong:"help='Output file for the verify result (default: stdout)',type='path'"`
+	VerifyMaxReported int    `kong:"help='Maximum number of missing and mismatched rows listed per table',default='100'"`
+
+	Checksum       bool   `kong:"help='Compare the checkpoint checksums with checksums computed over the destination (PostgreSQL 13+) and exit'"`
+	ChecksumOutput string `kong:"help='Output file for the checksum result (default: stdout)',type='path'"`
 
 	Debug   bool             `kong:"help='Enable debug output',short='d'"`
 	Quiet   bool             `kong:"help='Disable showing pre/post output',short='q'"`
@@ -170,17 +472,35 @@ func setTOMLDefaults(t *TOML) error {
 		t.Mapping = &TOMLMapping{}
 	}
 
+	if t.Tables == nil {
+		t.Tables = &TOMLTables{}
+	}
+
+	if t.Delta == nil {
+		t.Delta = &TOMLDelta{}
+	}
+
 	// Set defaults for [config]
 	if t.Config.BatchSize == 0 {
 		t.Config.BatchSize = DefaultBatchSize
 	}
 
+	// Serial pipelines default to (and are validated to have) a single
+	// processor and writer; see validateTOMLSerial
 	if t.Config.NumProcessors == 0 {
 		t.Config.NumProcessors = DefaultNumWorkers
+
+		if isSerial(t) {
+			t.Config.NumProcessors = 1
+		}
 	}
 
 	if t.Config.NumWriters == 0 {
 		t.Config.NumWriters = DefaultNumWriters
+
+		if isSerial(t) {
+			t.Config.NumWriters = 1
+		}
 	}
 
 	if t.Config.CheckpointInterval == 0 {
@@ -195,6 +515,98 @@ func setTOMLDefaults(t *TOML) error {
 		t.Config.CheckpointIndex = t.Config.CheckpointFile + CheckpointIndexSuffix
 	}
 
+	if t.Config.MaxInflightBytes == 0 {
+		t.Config.MaxInflightBytes = DefaultMaxInflightBytes
+	}
+
+	if t.Config.DrainTimeout == 0 {
+		t.Config.DrainTimeout = DefaultDrainTimeout
+	}
+
+	if t.Config.ShutdownTimeout == 0 {
+		t.Config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	if t.Config.Adaptive == nil {
+		t.Config.Adaptive = &TOMLAdaptive{}
+	}
+
+	if t.Config.Adaptive.Interval == 0 {
+		t.Config.Adaptive.Interval = DefaultAdaptiveInterval
+	}
+
+	if t.Config.Adaptive.TargetLatency == 0 {
+		t.Config.Adaptive.TargetLatency = DefaultAdaptiveTargetLatency
+	}
+
+	if t.Config.Adaptive.MinWriters == 0 {
+		t.Config.Adaptive.MinWriters = 1
+	}
+
+	if t.Config.Adaptive.MaxWriters == 0 {
+		t.Config.Adaptive.MaxWriters = max(t.Config.NumWriters*4, t.Config.Adaptive.MinWriters)
+	}
+
+	if t.Config.Adaptive.MinBatchSize == 0 {
+		t.Config.Adaptive.MinBatchSize = MinBatchSize
+	}
+
+	if t.Config.Adaptive.MaxBatchSize == 0 {
+		t.Config.Adaptive.MaxBatchSize = MaxBatchSize
+	}
+
+	// Set defaults for [destination]
+	if t.Destination.SchemaMode == "" {
+		t.Destination.SchemaMode = SchemaModeValidate
+	}
+
+	if t.Destination.IsFile() {
+		if t.Destination.MaxFileBytes == 0 {
+			t.Destination.MaxFileBytes = DefaultMaxFileBytes
+		}
+
+		if t.Destination.Codec == "" {
+			t.Destination.Codec = CodecDeflate
+		}
+	}
+
+	if t.Destination.Retry == nil {
+		// Errors are only classified for postgres destinations
+		t.Destination.Retry = &TOMLRetry{Disable: t.Destination.Type == "mysql"}
+	}
+
+	if t.Destination.Retry.MaxRetries == 0 {
+		t.Destination.Retry.MaxRetries = DefaultRetryMaxRetries
+	}
+
+	if t.Destination.Retry.InitialBackoff == 0 {
+		t.Destination.Retry.InitialBackoff = DefaultRetryInitialBackoff
+	}
+
+	if t.Destination.Retry.MaxBackoff == 0 {
+		t.Destination.Retry.MaxBackoff = DefaultRetryMaxBackoff
+	}
+
+	if t.Destination.Retry.Multiplier == 0 {
+		t.Destination.Retry.Multiplier = DefaultRetryMultiplier
+	}
+
+	if t.Destination.Retry.Jitter == 0 {
+		t.Destination.Retry.Jitter = DefaultRetryJitter
+	}
+
+	// Set defaults for [tables]
+	for _, table := range *t.Tables {
+		if table != nil && table.OnDelete == "" {
+			table.OnDelete = OnDeleteDelete
+		}
+	}
+
+	// Set defaults for [delta]
+	if t.Delta.KeysTable == "" {
+		t.Delta.KeysTable = DefaultDeltaKeysTable
+	}
+
 	return nil
 }
 
@@ -252,6 +664,45 @@ func validateTOML(t *TOML) error {
 		return errors.Wrap(err, "mapping error(s)")
 	}
 
+	// Validate [tables]
+	if err := validateTOMLTables(t.Tables, t.Mapping); err != nil {
+		return errors.Wrap(err, "tables error(s)")
+	}
+
+	// Validate [delta]
+	if err := validateTOMLDelta(t); err != nil {
+		return errors.Wrap(err, "delta error(s)")
+	}
+
+	if err := validateTOMLSerial(t); err != nil {
+		return errors.Wrap(err, "config error(s)")
+	}
+
+	return nil
+}
+
+// isSerial reports whether documents must go through a single processor and
+// writer: change stream events must be applied in the order they were
+// recorded, and file destinations commit files in source order so that
+// checkpoints always fall between committed files.
+func isSerial(t *TOML) bool {
+	return t.Source.FileContents == "changestream" || t.Destination.IsFile()
+}
+
+func validateTOMLSerial(t *TOML) error {
+	if !isSerial(t) {
+		return nil
+	}
+
+	switch {
+	case t.Config.NumProcessors > 1:
+		return errors.New("config.num_processors cannot be greater than 1 for changestream sources and file destinations")
+	case t.Config.NumWriters > 1:
+		return errors.New("config.num_writers cannot be greater than 1 for changestream sources and file destinations")
+	case t.Config.Adaptive.Enabled:
+		return errors.New("config.adaptive cannot be enabled for changestream sources and file destinations")
+	}
+
 	return nil
 }
 
@@ -269,7 +720,8 @@ func validateTOMLConfig(c *TOMLConfig) error {
 	}
 
 	if c.CheckpointInterval < MinCheckpointInterval || c.CheckpointInterval > MaxCheckpointInterval {
-		return errors.Errorf("config.checkpoint_interval must be between %s and %s", MinCheckpointInterval, MaxCheckpointInterval)
+		return errors.Errorf("config.checkpoint_interval must be between %s and %s",
+			time.Duration(MinCheckpointInterval), time.Duration(MaxCheckpointInterval))
 	}
 
 	if c.CheckpointFile == "" {
@@ -280,6 +732,51 @@ func validateTOMLConfig(c *TOMLConfig) error {
 		return errors.New("config.checkpoint_index cannot be empty")
 	}
 
+	if c.DrainTimeout < 0 {
+		return errors.New("config.drain_timeout cannot be negative")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.New("config.shutdown_timeout cannot be negative")
+	}
+
+	if c.MaxInflightBytes < 0 {
+		return errors.New("config.max_inflight_bytes cannot be negative")
+	}
+
+	if err := validateTOMLAdaptive(c.Adaptive); err != nil {
+		return errors.Wrap(err, "config.adaptive error(s)")
+	}
+
+	return nil
+}
+
+func validateTOMLAdaptive(a *TOMLAdaptive) error {
+	if a == nil {
+		return errors.New("adaptive cannot be empty")
+	}
+
+	if a.Interval < MinAdaptiveInterval {
+		return errors.Errorf("config.adaptive.interval must be at least %s", time.Duration(MinAdaptiveInterval))
+	}
+
+	if a.TargetLatency <= 0 {
+		return errors.New("config.adaptive.target_latency must be positive")
+	}
+
+	if a.MinWriters < 1 || a.MaxWriters > MaxAdaptiveWriters || a.MinWriters > a.MaxWriters {
+		return errors.Errorf("config.adaptive.min_writers and max_writers must be between 1 and %d (min <= max)", MaxAdaptiveWriters)
+	}
+
+	if a.MinBatchSize < MinBatchSize || a.MaxBatchSize > MaxBatchSize || a.MinBatchSize > a.MaxBatchSize {
+		return errors.Errorf("config.adaptive.min_batch_size and max_batch_size must be between %d and %d (min <= max)",
+			MinBatchSize, MaxBatchSize)
+	}
+
+	if a.MaxReplicationLag < 0 {
+		return errors.New("config.adaptive.max_replication_lag cannot be negative")
+	}
+
 	return nil
 }
 
@@ -292,14 +789,17 @@ func validateTOMLSource(s *TOMLSource) error {
 		return errors.New("source.file cannot be empty")
 	}
 
-	// Check if .File exists
-	info, err := os.Stat(s.File)
-	if os.IsNotExist(err) {
-		return errors.Errorf("source.file %s does not exist", s.File)
-	}
+	// Check if .File exists (stdin always does)
+	if s.File != SourceStdin {
+		info, err := os.Stat(s.File)
+		if os.IsNotExist(err) {
+			return errors.Errorf("source.file %s does not exist", s.File)
+		}
 
-	if info.IsDir() {
-		return errors.Errorf("source.file %s is a directory", s.File)
+		// Directories are read as mongodump output (<db>/<collection>.bson)
+		if info.IsDir() && s.FileContents != "bson" {
+			return errors.Errorf("source.file %s is a directory; directory sources require file_contents 'bson'", s.File)
+		}
 	}
 
 	// Check if .FileType is valid
@@ -320,14 +820,18 @@ func validateTOMLDestination(d *TOMLDestination) error {
 		return errors.New("destination cannot be empty")
 	}
 
-	if d.DSN == "" {
-		return errors.New("destination.dsn cannot be empty")
-	}
-
 	if d.Type == "" {
 		return errors.New("destination.type cannot be empty")
 	}
 
+	if d.IsFile() {
+		return validateTOMLFileDestination(d)
+	}
+
+	if d.DSN == "" {
+		return errors.New("destination.dsn cannot be empty")
+	}
+
 	var err error
 
 	switch d.Type {
@@ -343,6 +847,97 @@ func validateTOMLDestination(d *TOMLDestination) error {
 		return errors.Wrap(err, "error validating destination.dsn")
 	}
 
+	if _, ok := validSchemaModes[d.SchemaMode]; !ok {
+		return errors.Errorf("destination.schema_mode %s is invalid", d.SchemaMode)
+	}
+
+	if d.MaxRowsPerSec < 0 {
+		return errors.New("destination.max_rows_per_sec cannot be negative")
+	}
+
+	if d.MaxBytesPerSec < 0 {
+		return errors.New("destination.max_bytes_per_sec cannot be negative")
+	}
+
+	if err := validateTOMLRetry(d.Retry); err != nil {
+		return errors.Wrap(err, "destination.retry error(s)")
+	}
+
+	if d.Type == "mysql" && !d.Retry.Disable {
+		return errors.New("destination.retry is not supported for mysql destinations")
+	}
+
+	if d.DupeCheckIndex != "" {
+		if _, ok := validDupeCheckIndexes[d.DupeCheckIndex]; !ok {
+			return errors.Errorf("destination.dupe_check_index %s is invalid", d.DupeCheckIndex)
+		}
+
+		if d.SchemaMode == SchemaModeValidate {
+			return errors.New("destination.dupe_check_index requires destination.schema_mode 'create' or 'migrate'")
+		}
+	}
+
+	return nil
+}
+
+func validateTOMLFileDestination(d *TOMLDestination) error {
+	if d.Path == "" {
+		return errors.Errorf("destination.path cannot be empty for destination.type %s", d.Type)
+	}
+
+	if info, err := os.Stat(d.Path); err == nil && !info.IsDir() {
+		return errors.Errorf("destination.path %s is not a directory", d.Path)
+	}
+
+	if d.MaxFileBytes < 0 {
+		return errors.New("destination.max_file_bytes cannot be negative")
+	}
+
+	if d.Codec != CodecNull && d.Codec != CodecDeflate {
+		return errors.Errorf("destination.codec %s is invalid", d.Codec)
+	}
+
+	// Nothing to create, validate or index in a directory of files
+	if d.SchemaMode != SchemaModeValidate {
+		return errors.Errorf("destination.schema_mode %s cannot be used with destination.type %s", d.SchemaMode, d.Type)
+	}
+
+	if d.DupeCheckIndex != "" || d.DeferIndexes {
+		return errors.Errorf("destination.dupe_check_index and defer_indexes cannot be used with destination.type %s", d.Type)
+	}
+
+	if d.MaxRowsPerSec < 0 {
+		return errors.New("destination.max_rows_per_sec cannot be negative")
+	}
+
+	if d.MaxBytesPerSec < 0 {
+		return errors.New("destination.max_bytes_per_sec cannot be negative")
+	}
+
+	return nil
+}
+
+func validateTOMLRetry(r *TOMLRetry) error {
+	if r == nil {
+		return errors.New("retry cannot be empty")
+	}
+
+	if r.MaxRetries < 0 {
+		return errors.New("destination.retry.max_retries cannot be negative")
+	}
+
+	if r.InitialBackoff <= 0 || r.MaxBackoff < r.InitialBackoff {
+		return errors.New("destination.retry.initial_backoff must be positive and not exceed max_backoff")
+	}
+
+	if r.Multiplier < 1 {
+		return errors.New("destination.retry.multiplier must be at least 1")
+	}
+
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return errors.New("destination.retry.jitter must be between 0 and 1")
+	}
+
 	return nil
 }
 
@@ -380,25 +975,364 @@ func validateMappingEntry(e *TOMLMappingEntry) error {
 		return errors.New("mapping entry cannot be nil")
 	}
 
-	if e.Src == "" {
-		return errors.New("mapping entry.src cannot be empty")
+	if e.Src == "" && e.Expr == "" {
+		return errors.New("mapping entry must set either src or expr")
+	}
+
+	if e.Src != "" && e.Expr != "" {
+		return errors.Errorf("mapping entry for '%s' cannot set both src and expr", e.Dst)
+	}
+
+	if e.Expr != "" {
+		program, err := expr.Compile(e.Expr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid mapping entry.expr for '%s'", e.Dst)
+		}
+
+		// Field references are paths too
+		for _, field := range program.Fields() {
+			if _, err := docpath.Compile(field); err != nil {
+				return errors.Wrapf(err, "invalid mapping entry.expr for '%s'", e.Dst)
+			}
+		}
+
+		e.Program = program
 	}
 
 	if e.Dst == "" {
 		return errors.New("mapping entry.dst cannot be empty")
 	}
 
+	if table, column := ParseDst(e.Dst); table == "" || column == "" {
+		return errors.Errorf("mapping entry.dst '%s' must be in 'table.column' format", e.Dst)
+	}
+
+	// Tables are written to unqualified and resolved through the search_path
+	if table, _ := ParseDst(e.Dst); strings.Contains(table, ".") {
+		return errors.Errorf("mapping entry.dst '%s' cannot be schema-qualified; set the schema with the destination's search_path", e.Dst)
+	}
+
+	if strings.HasPrefix(e.Src, SrcParentPrefix) && len(e.Src) == len(SrcParentPrefix) {
+		return errors.Errorf("mapping entry.src '%s' is missing a parent column", e.Src)
+	}
+
+	if e.Src != "" && e.Src != SrcIndex && !strings.HasPrefix(e.Src, SrcParentPrefix) {
+		if _, err := docpath.Compile(e.Src); err != nil {
+			return errors.Wrap(err, "invalid mapping entry.src")
+		}
+	}
+
 	if e.Conv == "" {
 		return errors.New("mapping entry.conv cannot be empty")
 	}
 
-	if _, ok := validConvs[e.Conv]; !ok {
+	if _, ok := validConvs[strings.TrimSuffix(e.Conv, conv.ArraySuffix)]; !ok {
 		return errors.Errorf("unknown conv '%s'", e.Conv)
 	}
 
+	formats, err := stringList(e.Format)
+	if err != nil {
+		return errors.Wrapf(err, "invalid mapping entry.format for '%s'", e.Dst)
+	}
+
+	converter, err := conv.New(e.Conv, &conv.Options{
+		Values:   e.Values,
+		Formats:  formats,
+		Unit:     e.Unit,
+		Timezone: e.Timezone,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "invalid mapping entry.conv for '%s'", e.Dst)
+	}
+
+	e.Converter = converter
+
+	if e.OnMissing != "" {
+		if _, ok := validOnMissing[e.OnMissing]; !ok {
+			return errors.Errorf("mapping entry.on_missing '%s' for '%s' is invalid", e.OnMissing, e.Dst)
+		}
+
+		if e.Required != nil && *e.Required && e.OnMissing != OnMissingFail {
+			return errors.Errorf("mapping entry for '%s' sets required = true but on_missing = '%s'", e.Dst, e.OnMissing)
+		}
+	}
+
+	if e.OnConvError != "" {
+		if _, ok := validOnConvError[e.OnConvError]; !ok {
+			return errors.Errorf("mapping entry.on_conv_error '%s' for '%s' is invalid", e.OnConvError, e.Dst)
+		}
+	}
+
+	if e.OnMissing == OnMissingDefault || e.OnConvError == OnMissingDefault {
+		if e.Default == nil {
+			return errors.Errorf("mapping entry for '%s' uses the 'default' policy but does not set default", e.Dst)
+		}
+	}
+
+	if e.Default != nil {
+		if _, err := e.Converter.Convert(e.Default); err != nil {
+			return errors.Wrapf(err, "mapping entry.default for '%s' cannot be converted to '%s'", e.Dst, e.Conv)
+		}
+	}
+
 	return nil
 }
 
+// validateTOMLDelta checks that every root table can be looked up by its dupe
+// check columns; change stream sources are applied like delta migrations.
+func validateTOMLDelta(t *TOML) error {
+	d := t.Delta
+
+	if d == nil {
+		return nil
+	}
+
+	var mode string
+
+	switch {
+	case d.Enabled:
+		mode = "delta.enabled"
+	case t.Source.FileContents == "changestream":
+		mode = "source.file_contents 'changestream'"
+
+		if d.DeleteMissing {
+			return errors.New("delta.delete_missing cannot be used with change stream sources")
+		}
+	default:
+		return nil
+	}
+
+	if d.Enabled && t.Source.FileContents == "changestream" {
+		return errors.New("delta.enabled cannot be used with change stream sources")
+	}
+
+	if t.Config.DisableDupecheck {
+		return errors.Errorf("%s cannot be used with config.disable_dupecheck", mode)
+	}
+
+	if t.Destination.Type != "postgres" {
+		return errors.Errorf("%s requires destination.type 'postgres'", mode)
+	}
+
+	if d.KeysTable == "" {
+		return errors.New("delta.keys_table cannot be empty")
+	}
+
+	dupeCheck := make(map[string]bool)
+
+	for _, entries := range *t.Mapping {
+		for _, e := range entries {
+			table, _ := ParseDst(e.Dst)
+			dupeCheck[table] = dupeCheck[table] || (e.DupeCheck != nil && *e.DupeCheck)
+		}
+	}
+
+	for table, ok := range dupeCheck {
+		if tc, child := (*t.Tables)[table]; child && tc != nil && tc.Parent != "" {
+			continue
+		}
+
+		if !ok {
+			return errors.Errorf("%s requires table '%s' to have dupe_check columns", mode, table)
+		}
+	}
+
+	return nil
+}
+
+func validateTOMLTables(t *TOMLTables, m *TOMLMapping) error {
+	if t == nil {
+		return errors.New("tables cannot be nil")
+	}
+
+	// Tables referenced by mapping entries
+	mapped := make(map[string]struct{})
+
+	for _, entries := range *m {
+		for _, e := range entries {
+			table, _ := ParseDst(e.Dst)
+			mapped[table] = struct{}{}
+		}
+	}
+
+	for name, table := range *t {
+		if table == nil {
+			return errors.Errorf("tables.%s cannot be empty", name)
+		}
+
+		if _, ok := mapped[name]; !ok {
+			return errors.Errorf("tables.%s is not used by any mapping entry", name)
+		}
+
+		if err := validateTOMLTableDelete(name, table, m); err != nil {
+			return err
+		}
+
+		if (table.Parent == "") != (table.Explode == "") {
+			return errors.Errorf("tables.%s must set both 'parent' and 'explode' (or neither)", name)
+		}
+
+		if table.Parent == "" {
+			continue
+		}
+
+		if _, err := docpath.Compile(table.Explode); err != nil {
+			return errors.Wrapf(err, "invalid tables.%s.explode", name)
+		}
+
+		if _, ok := mapped[table.Parent]; !ok {
+			return errors.Errorf("tables.%s.parent '%s' is not used by any mapping entry", name, table.Parent)
+		}
+
+		// Walk up the parent chain to detect cycles
+		seen := map[string]struct{}{name: {}}
+
+		for parent := table.Parent; parent != ""; {
+			if _, ok := seen[parent]; ok {
+				return errors.Errorf("tables.%s has a parent cycle via '%s'", name, parent)
+			}
+
+			seen[parent] = struct{}{}
+
+			p, ok := (*t)[parent]
+			if !ok || p == nil {
+				break
+			}
+
+			parent = p.Parent
+		}
+	}
+
+	// Parent references and array indexes only make sense for exploded tables
+	for _, entries := range *m {
+		for _, e := range entries {
+			table, _ := ParseDst(e.Dst)
+
+			if !strings.HasPrefix(e.Src, SrcParentPrefix) && e.Src != SrcIndex {
+				continue
+			}
+
+			if tc, ok := (*t)[table]; !ok || tc == nil || tc.Parent == "" {
+				return errors.Errorf("mapping entry.src '%s' requires tables.%s to have a parent", e.Src, table)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateTOMLTableDelete checks the on_delete settings of a table
+func validateTOMLTableDelete(name string, table *TOMLTable, m *TOMLMapping) error {
+	switch table.OnDelete {
+	case "", OnDeleteDelete:
+		if table.SoftDeleteColumn != "" || table.SoftDeleteValue != nil {
+			return errors.Errorf("tables.%s.soft_delete_column and soft_delete_value require on_delete = '%s'", name, OnDeleteSoft)
+		}
+
+		return nil
+	case OnDeleteSoft:
+	default:
+		return errors.Errorf("tables.%s.on_delete '%s' is invalid", name, table.OnDelete)
+	}
+
+	if table.SoftDeleteColumn == "" {
+		return errors.Errorf("tables.%s.soft_delete_column cannot be empty with on_delete = '%s'", name, OnDeleteSoft)
+	}
+
+	if _, ok := softDeleteConv(table.SoftDeleteValue); !ok {
+		return errors.Errorf("tables.%s.soft_delete_value must be a string, number or boolean", name)
+	}
+
+	// Children without own dupe check columns are replaced as a set, so they
+	// cannot be kept around as soft deleted rows
+	var keyed bool
+
+	for _, entries := range *m {
+		for _, e := range entries {
+			tStr, cStr := ParseDst(e.Dst)
+			if tStr != name {
+				continue
+			}
+
+			if cStr == table.SoftDeleteColumn {
+				return errors.Errorf("tables.%s.soft_delete_column '%s' cannot be mapped", name, cStr)
+			}
+
+			if e.DupeCheck != nil && *e.DupeCheck && !strings.HasPrefix(e.Src, SrcParentPrefix) {
+				keyed = true
+			}
+		}
+	}
+
+	if !keyed {
+		return errors.Errorf("tables.%s with on_delete = '%s' requires dupe_check columns", name, OnDeleteSoft)
+	}
+
+	return nil
+}
+
+// SoftDeleteConv returns the conv of the table's soft_delete_column as implied
+// by soft_delete_value
+func (t *TOMLTable) SoftDeleteConv() string {
+	conv, _ := softDeleteConv(t.SoftDeleteValue)
+	return conv
+}
+
+// softDeleteConv returns the conv of a tables.<name>.soft_delete_value
+func softDeleteConv(v interface{}) (string, bool) {
+	switch v.(type) {
+	case nil:
+		return "timestamptz", true
+	case string:
+		return "string", true
+	case int64:
+		return "int", true
+	case float64:
+		return "float", true
+	case bool:
+		return "bool", true
+	}
+
+	return "", false
+}
+
+// stringList normalizes a TOML value that is either a string or a list of strings
+func stringList(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{t}, nil
+	case []string:
+		return t, nil
+	case []interface{}:
+		list := make([]string, 0, len(t))
+
+		for _, e := range t {
+			s, ok := e.(string)
+			if !ok {
+				return nil, errors.Errorf("expected a string, got '%v'", e)
+			}
+
+			list = append(list, s)
+		}
+
+		return list, nil
+	default:
+		return nil, errors.Errorf("expected a string or a list of strings, got '%v'", v)
+	}
+}
+
+// ParseDst splits a mapping entry's dst in the format "table.column"
+func ParseDst(dst string) (string, string) {
+	i := strings.LastIndex(dst, ".")
+	if i < 0 {
+		return "", ""
+	}
+
+	return dst[:i], dst[i+1:]
+}
+
 func readCLIArgs() (*CLI, error) {
 	cli := &CLI{}
 	cli.Ctx = kong.Parse(cli,
@@ -452,6 +1386,43 @@ func validateCLIArgs(cli *CLI) error {
 		return errors.New("config cannot be nil")
 	}
 
+	if cli.Infer && cli.InferSamples < 1 {
+		return errors.New("--infer-samples must be at least 1")
+	}
+
+	if cli.VerifySample < 0 {
+		return errors.New("--verify-sample cannot be negative")
+	}
+
+	if cli.VerifyMaxReported < 0 {
+		return errors.New("--verify-max-reported cannot be negative")
+	}
+
+	if cli.ControlAddr != "" {
+		if err := validateControlAddr(cli.ControlAddr); err != nil {
+			return errors.Wrap(err, "invalid --control-addr")
+		}
+	}
+
+	return nil
+}
+
+// validateControlAddr only allows loopback addresses; the control endpoint is
+// unauthenticated
+func validateControlAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.Errorf("'%s' is not a loopback address (ie. 127.0.0.1:8750); the control endpoint is unauthenticated", addr)
+	}
+
 	return nil
 }
 
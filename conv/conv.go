@@ -0,0 +1,343 @@
+// Package conv converts values read from a source document into values that
+// can be written to the destination database.
+package conv
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+const (
+	// ArraySuffix turns any scalar conv into a Postgres array conv (ie. "int[]")
+	ArraySuffix = "[]"
+)
+
+// Options are conv specific settings from a mapping entry
+type Options struct {
+	// Allowed values for the "enum" conv
+	Values []string
+
+	// Layouts (Go or strftime-like) tried in order when parsing time strings
+	Formats []string
+
+	// Unit of epoch numbers for time convs; "s" (default), "ms", "us" or "ns"
+	Unit string
+
+	// Location (ie. "America/New_York") used for inputs without a zone;
+	// defaults to UTC
+	Timezone string
+}
+
+// Converter converts values using a single (validated) conv
+type Converter struct {
+	name    string
+	array   bool
+	opts    Options
+	layouts []string
+	loc     *time.Location
+}
+
+// New validates conv (and its options) and returns a Converter for it
+func New(conv string, opts *Options) (*Converter, error) {
+	c := &Converter{
+		name: strings.TrimSuffix(conv, ArraySuffix),
+	}
+
+	c.array = c.name != conv
+
+	if opts != nil {
+		c.opts = *opts
+	}
+
+	if _, ok := scalarConvs[c.name]; !ok {
+		return nil, errors.Errorf("unknown conv '%s'", conv)
+	}
+
+	if c.array && (c.name == "json" || c.name == "jsonb" || c.name == "bson") {
+		return nil, errors.Errorf("conv '%s' cannot be used as an array", conv)
+	}
+
+	if c.name == "enum" && len(c.opts.Values) == 0 {
+		return nil, errors.New("conv 'enum' requires a list of values")
+	}
+
+	if c.name != "enum" && len(c.opts.Values) > 0 {
+		return nil, errors.Errorf("values can only be set for conv 'enum', not '%s'", conv)
+	}
+
+	if err := c.setTimeOptions(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Name returns the conv name (ie. "int[]")
+func (c *Converter) Name() string {
+	if c.array {
+		return c.name + ArraySuffix
+	}
+
+	return c.name
+}
+
+// Convert converts v; a nil v is always converted to nil (ie. NULL)
+func (c *Converter) Convert(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	if c.array {
+		return c.toArray(v)
+	}
+
+	return c.convertScalar(v)
+}
+
+// Convert converts v using the conversion named by conv with default options.
+// A nil v is always converted to nil (ie. NULL).
+func Convert(conv string, v interface{}) (interface{}, error) {
+	c, err := New(conv, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Convert(v)
+}
+
+// scalarConvs are all supported (non-array) convs
+var scalarConvs = map[string]struct{}{
+	"string":      {},
+	"int":         {},
+	"float":       {},
+	"bool":        {},
+	"time":        {},
+	"json":        {},
+	"jsonb":       {},
+	"date":        {},
+	"datetime":    {},
+	"timestamp":   {},
+	"timestamptz": {},
+	"uuid":        {},
+	"numeric":     {},
+	"bytea":       {},
+	"base64":      {},
+	"bson":        {},
+	"inet":        {},
+	"enum":        {},
+}
+
+func (c *Converter) convertScalar(v interface{}) (interface{}, error) {
+	switch c.name {
+	case "string":
+		return toString(v)
+	case "int":
+		return toInt(v)
+	case "float":
+		return toFloat(v)
+	case "bool":
+		return toBool(v)
+	case "json", "jsonb":
+		return toJSON(v)
+	case "uuid":
+		return toUUID(v)
+	case "numeric":
+		return toNumeric(v)
+	case "bytea":
+		return toBytes(v)
+	case "base64":
+		return fromBase64(v)
+	case "bson":
+		return toBSON(v)
+	case "inet":
+		return toInet(v)
+	case "enum":
+		return c.toEnum(v)
+	case "date":
+		t, err := c.toTime(v)
+		if err != nil {
+			return nil, err
+		}
+
+		t = t.In(c.loc)
+
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	case "datetime", "timestamp":
+		// Written to "timestamp without time zone" columns as UTC wall time
+		t, err := c.toTime(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.UTC().Round(time.Microsecond), nil
+	case "timestamptz":
+		// Postgres keeps microseconds and rounds the rest; pgx would
+		// truncate, so round here
+		t, err := c.toTime(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.Round(time.Microsecond), nil
+	case "time":
+		t, err := c.toTime(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return t.Round(time.Microsecond).In(c.loc).Format("15:04:05.999999"), nil
+	default:
+		return nil, errors.Errorf("unknown conv '%s'", c.name)
+	}
+}
+
+func toString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case int, int32, int64, float32, float64:
+		return fmt.Sprint(t), nil
+	case time.Time:
+		return t.Format(time.RFC3339Nano), nil
+	case fmt.Stringer:
+		return t.String(), nil
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(t)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to marshal value to string")
+		}
+
+		return string(data), nil
+	default:
+		return fmt.Sprint(t), nil
+	}
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case bson.Decimal128:
+		return toInt(json.Number(t.String()))
+	case int:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+
+		f, err := t.Float64()
+		if err != nil {
+			return 0, errors.Errorf("unable to convert '%s' to int", t)
+		}
+
+		return floatToInt(f)
+	case float64:
+		return floatToInt(t)
+	case float32:
+		return floatToInt(float64(t))
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("unable to convert '%s' to int", t)
+		}
+
+		return i, nil
+	case bool:
+		if t {
+			return 1, nil
+		}
+
+		return 0, nil
+	default:
+		return 0, errors.Errorf("unable to convert type '%T' to int", v)
+	}
+}
+
+func floatToInt(f float64) (int64, error) {
+	// float64(math.MaxInt64) is 2^63, which does not fit
+	if f != math.Trunc(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+		return 0, errors.Errorf("unable to convert '%v' to int without losing precision", f)
+	}
+
+	return int64(f), nil
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case bson.Decimal128:
+		return strconv.ParseFloat(t.String(), 64)
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	case int32:
+		return float64(t), nil
+	case int64:
+		return float64(t), nil
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return 0, errors.Errorf("unable to convert '%s' to float", t)
+		}
+
+		return f, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		if err != nil {
+			return 0, errors.Errorf("unable to convert '%s' to float", t)
+		}
+
+		return f, nil
+	default:
+		return 0, errors.Errorf("unable to convert type '%T' to float", v)
+	}
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(t))
+		if err != nil {
+			return false, errors.Errorf("unable to convert '%s' to bool", t)
+		}
+
+		return b, nil
+	case json.Number, int, int32, int64, float32, float64:
+		f, err := toFloat(t)
+		if err != nil {
+			return false, err
+		}
+
+		return f != 0, nil
+	default:
+		return false, errors.Errorf("unable to convert type '%T' to bool", v)
+	}
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal value to json")
+	}
+
+	return string(data), nil
+}
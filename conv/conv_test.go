@@ -0,0 +1,597 @@
+package conv
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgtype"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+func mustConvert(t *testing.T, conv string, opts *Options, v interface{}) interface{} {
+	t.Helper()
+
+	c, err := New(conv, opts)
+	if err != nil {
+		t.Fatalf("New(%q): %v", conv, err)
+	}
+
+	converted, err := c.Convert(v)
+	if err != nil {
+		t.Fatalf("Convert(%q, %#v): %v", conv, v, err)
+	}
+
+	return converted
+}
+
+func TestInt(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want int64
+	}{
+		{json.Number("9223372036854775807"), math.MaxInt64},
+		{json.Number("-9223372036854775808"), math.MinInt64},
+		{json.Number("1e3"), 1000},
+		{json.Number("-2.0"), -2},
+		{float64(-1 << 63), math.MinInt64},
+		{math.Nextafter(1<<63, 0), 1<<63 - 1024},
+		{float32(1.5e9), 1500000000},
+		{" 42 ", 42},
+		{true, 1},
+	}
+
+	for _, tt := range tests {
+		if got := mustConvert(t, "int", nil, tt.in); got != tt.want {
+			t.Errorf("Convert(%#v): got %v, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	c, _ := New("int", nil)
+
+	for _, in := range []interface{}{
+		float64(1 << 63), // float64(math.MaxInt64) rounds up to 2^63
+		json.Number("9223372036854775808"),
+		json.Number("9.223372036854775807e18"),
+		math.Nextafter(-1<<63, math.Inf(-1)),
+		1.5,
+		math.NaN(),
+		math.Inf(1),
+		"1.0",
+		"x",
+	} {
+		if v, err := c.Convert(in); err == nil {
+			t.Errorf("Convert(%#v) = %v, want an error", in, v)
+		}
+	}
+}
+
+func TestUUID(t *testing.T) {
+	data := []byte{0x0b, 0x0e, 0x8a, 0x2c, 0x6f, 0x0e, 0x4b, 0x8e, 0x9a, 0x8e, 0x1c, 0x2d, 0x3e, 0x4f, 0x5a, 0x6b}
+
+	oid, err := bson.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{"string", "0B0E8A2C-6F0E-4B8E-9A8E-1C2D3E4F5A6B", "0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b"},
+		{"braces without dashes", "{0b0e8a2c6f0e4b8e9a8e1c2d3e4f5a6b}", "0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b"},
+		{"bindata subtype 4", bson.Binary{Subtype: bson.BinaryUUID, Data: data}, "0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b"},
+		{"bindata subtype 3", bson.Binary{Subtype: bson.BinaryUUIDOld, Data: data}, "0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b"},
+		{"objectid", oid, "507f1f77-bcf8-6cd7-9943-901100000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustConvert(t, "uuid", nil, tt.in)
+			if got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			// pgx parses the value and encodes it back unchanged
+			var u pgtype.UUID
+			if err := u.DecodeText(nil, []byte(got.(string))); err != nil {
+				t.Fatalf("pgtype.UUID rejected %q: %v", got, err)
+			}
+
+			text, err := u.EncodeText(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(text) != tt.want {
+				t.Fatalf("pgtype.UUID encoded %q, want %q", text, tt.want)
+			}
+		})
+	}
+
+	for _, in := range []interface{}{"not-a-uuid", bson.Binary{Subtype: bson.BinaryGeneric, Data: data}, bson.Binary{Subtype: bson.BinaryUUID, Data: data[:8]}, 42} {
+		c, _ := New("uuid", nil)
+		if _, err := c.Convert(in); err == nil {
+			t.Errorf("Convert(%#v) did not fail", in)
+		}
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	dec := func(s string) bson.Decimal128 {
+		d, err := bson.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d
+	}
+
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{"34 digit decimal128", dec("1234567890123456789012345678901234"), "1234567890123456789012345678901234"},
+		{"decimal128 fraction", dec("-0.000000000000000000000000000000001"), "-1E-33"},
+		{"decimal128 trailing zeros", dec("1.50"), "1.50"},
+		{"json number", json.Number("12345678901234567890.123456789012345"), "12345678901234567890.123456789012345"},
+		{"string", " 0.1 ", "0.1"},
+		{"int64", int64(-9007199254740993), "-9007199254740993"},
+		{"float64", 0.1, "0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustConvert(t, "numeric", nil, tt.in)
+			if got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			want, _ := new(big.Rat).SetString(tt.want)
+			if v, ok := new(big.Rat).SetString(got.(string)); !ok || v.Cmp(want) != 0 {
+				t.Fatalf("%q is not exactly %s", got, tt.want)
+			}
+
+			// pgx sends strings as text, which Postgres also parses in
+			// exponent notation; pgtype.Numeric only parses plain notation
+			if strings.ContainsAny(got.(string), "eE") {
+				return
+			}
+
+			var n pgtype.Numeric
+			if err := n.DecodeText(nil, []byte(got.(string))); err != nil {
+				t.Fatalf("pgtype.Numeric rejected %q: %v", got, err)
+			}
+
+			text, err := n.EncodeText(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v, _ := new(big.Rat).SetString(string(text)); v.Cmp(want) != 0 {
+				t.Fatalf("pgtype.Numeric encoded %q as %s", got, text)
+			}
+		})
+	}
+
+	for _, in := range []interface{}{dec("NaN"), "NaN"} {
+		got := mustConvert(t, "numeric", nil, in)
+
+		var n pgtype.Numeric
+		if err := n.DecodeText(nil, []byte(got.(string))); err != nil || !n.NaN {
+			t.Errorf("pgtype.Numeric did not decode %q as NaN: %v", got, err)
+		}
+	}
+
+	c, _ := New("numeric", nil)
+	if _, err := c.Convert("12abc"); err == nil {
+		t.Error("Convert(\"12abc\") did not fail")
+	}
+}
+
+func TestArrayEncodeText(t *testing.T) {
+	tests := []struct {
+		name string
+		arr  Array
+		want string
+	}{
+		{"empty", Array{}, `{}`},
+		{"null elements", Array{"a", nil, "b"}, `{"a",NULL,"b"}`},
+		{"quoting", Array{`say "hi"`, `back\slash`, "a,b", "{x}", " padded ", "NULL", ""}, `{"say \"hi\"","back\\slash","a,b","{x}"," padded ","NULL",""}`},
+		{"ints", Array{int64(1), nil, int64(-2)}, `{"1",NULL,"-2"}`},
+		{"bools", Array{true, false}, `{"true","false"}`},
+		{"bytes", Array{[]byte{0xde, 0xad}, []byte{}}, `{"\\xdead","\\x"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := tt.arr.EncodeText(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(text) != tt.want {
+				t.Fatalf("got %s, want %s", text, tt.want)
+			}
+
+			// pgx decodes the literal back into the original elements
+			var decoded pgtype.TextArray
+			if err := decoded.DecodeText(nil, text); err != nil {
+				t.Fatalf("pgtype.TextArray rejected %s: %v", text, err)
+			}
+
+			if len(decoded.Elements) != len(tt.arr) {
+				t.Fatalf("pgtype.TextArray decoded %d elements, want %d", len(decoded.Elements), len(tt.arr))
+			}
+
+			for i, el := range tt.arr {
+				got := decoded.Elements[i]
+
+				if el == nil {
+					if got.Status != pgtype.Null {
+						t.Errorf("element %d: got %q, want NULL", i, got.String)
+					}
+
+					continue
+				}
+
+				want, err := textValue(el)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got.Status != pgtype.Present || got.String != want {
+					t.Errorf("element %d: got %q, want %q", i, got.String, want)
+				}
+			}
+		})
+	}
+}
+
+func TestArrayConvert(t *testing.T) {
+	got := mustConvert(t, "int[]", nil, []interface{}{json.Number("1"), nil, int32(3)})
+
+	text, err := got.(Array).EncodeText(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded pgtype.Int8Array
+	if err := decoded.DecodeText(nil, text); err != nil {
+		t.Fatalf("pgtype.Int8Array rejected %s: %v", text, err)
+	}
+
+	var ints []*int64
+	if err := decoded.AssignTo(&ints); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ints) != 3 || *ints[0] != 1 || ints[1] != nil || *ints[2] != 3 {
+		t.Fatalf("pgtype.Int8Array decoded %s as %v", text, ints)
+	}
+
+	// Scalars are single element arrays
+	if got := mustConvert(t, "string[]", nil, "a"); len(got.(Array)) != 1 {
+		t.Fatalf("got %v, want a single element", got)
+	}
+
+	if _, err := New("json[]", nil); err == nil {
+		t.Fatal("New(\"json[]\") did not fail")
+	}
+}
+
+func TestBytea(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want []byte
+	}{
+		{"hex string", `\x01ff`, []byte{0x01, 0xff}},
+		{"plain string", "ab", []byte("ab")},
+		{"bindata", bson.Binary{Subtype: bson.BinaryGeneric, Data: []byte{1, 2}}, []byte{1, 2}},
+		{"bytes", []byte{3}, []byte{3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustConvert(t, "bytea", nil, tt.in)
+
+			var b pgtype.Bytea
+			if err := b.Set(got); err != nil {
+				t.Fatalf("pgtype.Bytea rejected %#v: %v", got, err)
+			}
+
+			if string(b.Bytes) != string(tt.want) {
+				t.Fatalf("got %x, want %x", b.Bytes, tt.want)
+			}
+		})
+	}
+
+	c, _ := New("bytea", nil)
+	if _, err := c.Convert(`\xzz`); err == nil {
+		t.Fatal("Convert(`\\xzz`) did not fail")
+	}
+}
+
+func TestBase64(t *testing.T) {
+	want := []byte{0xfb, 0xff, 0xbf}
+
+	for _, in := range []string{"+/+/", "-_-_", " +/+/ "} {
+		got := mustConvert(t, "base64", nil, in)
+		if string(got.([]byte)) != string(want) {
+			t.Errorf("Convert(%q): got %x, want %x", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"aGk=", "aGk"} {
+		if got := mustConvert(t, "base64", nil, in); string(got.([]byte)) != "hi" {
+			t.Errorf("Convert(%q): got %q, want \"hi\"", in, got)
+		}
+	}
+
+	c, _ := New("base64", nil)
+	if _, err := c.Convert("!!"); err == nil {
+		t.Fatal("Convert(\"!!\") did not fail")
+	}
+}
+
+func TestInet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.168.0.1", "192.168.0.1"},
+		{" 10.1.2.3/8 ", "10.1.2.3/8"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"2001:db8::/32", "2001:db8::/32"},
+	}
+
+	for _, tt := range tests {
+		got := mustConvert(t, "inet", nil, tt.in)
+		if got != tt.want {
+			t.Errorf("Convert(%q): got %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+
+		var inet pgtype.Inet
+		if err := inet.DecodeText(nil, []byte(got.(string))); err != nil {
+			t.Errorf("pgtype.Inet rejected %q: %v", got, err)
+		}
+	}
+
+	c, _ := New("inet", nil)
+	for _, in := range []interface{}{"300.1.1.1", "host", int64(1)} {
+		if _, err := c.Convert(in); err == nil {
+			t.Errorf("Convert(%#v) did not fail", in)
+		}
+	}
+}
+
+func TestEnum(t *testing.T) {
+	opts := &Options{Values: []string{"new", "done"}}
+
+	if got := mustConvert(t, "enum", opts, "done"); got != "done" {
+		t.Fatalf("got %v, want done", got)
+	}
+
+	c, _ := New("enum", opts)
+	if _, err := c.Convert("Done"); err == nil {
+		t.Fatal("Convert(\"Done\") did not fail")
+	}
+
+	if _, err := New("enum", nil); err == nil {
+		t.Fatal("New(\"enum\") without values did not fail")
+	}
+
+	if _, err := New("string", opts); err == nil {
+		t.Fatal("New(\"string\") with values did not fail")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%Y-%m-%d %H:%M:%S", "2006-01-02 15:04:05"},
+		{"%d/%m/%y", "02/01/06"},
+		{"%F %T", "2006-01-02 15:04:05"},
+		{"%e %b %Y %I:%M %p", "_2 Jan 2006 03:04 PM"},
+		{"%A, %B %d", "Monday, January 02"},
+		{"%a %h %j", "Mon Jan 002"},
+		{"%H:%M:%S.%f", "15:04:05.999999999"},
+		{"%z %Z", "-0700 MST"},
+		{"100%%", "100%"},
+		{"2006-01-02", "2006-01-02"},
+	}
+
+	for _, tt := range tests {
+		got, err := Layout(tt.format)
+		if err != nil {
+			t.Errorf("Layout(%q): %v", tt.format, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Layout(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+
+	for _, format := range []string{"", "%Y-%", "%Q"} {
+		if _, err := Layout(format); err == nil {
+			t.Errorf("Layout(%q) did not fail", format)
+		}
+	}
+}
+
+// pgText encodes v the way pgx sends it to a column of type dst
+func pgText(t *testing.T, dst interface {
+	Set(interface{}) error
+	EncodeText(*pgtype.ConnInfo, []byte) ([]byte, error)
+}, v interface{}) string {
+	t.Helper()
+
+	if err := dst.Set(v); err != nil {
+		t.Fatalf("%T rejected %#v: %v", dst, v, err)
+	}
+
+	text, err := dst.EncodeText(nil, nil)
+	if err != nil {
+		t.Fatalf("%T could not encode %#v: %v", dst, v, err)
+	}
+
+	return string(text)
+}
+
+func TestTime(t *testing.T) {
+	tests := []struct {
+		name string
+		conv string
+		opts *Options
+		in   interface{}
+		want string // pgtype text encoding
+	}{
+		// timestamptz keeps the instant
+		{"rfc3339", "timestamptz", nil, "2024-05-06T07:08:09.123456789+02:00", "2024-05-06 05:08:09.123457Z"},
+		{"rfc3339 rounds down", "timestamptz", nil, "2024-05-06T07:08:09.1234564Z", "2024-05-06 07:08:09.123456Z"},
+		{"rfc3339 rounds to second", "timestamptz", nil, "2024-05-06T07:08:09.9999995Z", "2024-05-06 07:08:10Z"},
+		{"no zone is utc", "timestamptz", nil, "2024-05-06 07:08:09", "2024-05-06 07:08:09Z"},
+		{"no zone in timezone", "timestamptz", &Options{Timezone: "Europe/Berlin"}, "2024-05-06 07:08:09", "2024-05-06 05:08:09Z"},
+		{"no zone in timezone (winter)", "timestamptz", &Options{Timezone: "Europe/Berlin"}, "2024-01-06 07:08:09", "2024-01-06 06:08:09Z"},
+		{"zone wins over timezone", "timestamptz", &Options{Timezone: "Europe/Berlin"}, "2024-05-06T07:08:09Z", "2024-05-06 07:08:09Z"},
+		{"date only", "timestamptz", nil, "2024-05-06", "2024-05-06 00:00:00Z"},
+		{"strftime", "timestamptz", &Options{Formats: []string{"%d/%m/%Y %H:%M"}, Timezone: "America/New_York"}, "06/05/2024 07:08", "2024-05-06 11:08:00Z"},
+		{"second format", "timestamptz", &Options{Formats: []string{"%Y", "%d.%m.%Y"}}, "06.05.2024", "2024-05-06 00:00:00Z"},
+		{"go layout", "timestamptz", &Options{Formats: []string{"Jan 2 2006 3:04PM"}}, "May 6 2024 7:08PM", "2024-05-06 19:08:00Z"},
+
+		// Epochs
+		{"epoch seconds", "timestamptz", nil, json.Number("1714979289"), "2024-05-06 07:08:09Z"},
+		{"epoch fractional seconds", "timestamptz", nil, json.Number("1714979289.5"), "2024-05-06 07:08:09.5Z"},
+		{"epoch before 1970", "timestamptz", nil, int64(-1), "1969-12-31 23:59:59Z"},
+		{"epoch ms", "timestamptz", &Options{Unit: "ms"}, json.Number("1714979289123"), "2024-05-06 07:08:09.123Z"},
+		{"epoch ms before 1970", "timestamptz", &Options{Unit: "ms"}, int64(-1), "1969-12-31 23:59:59.999Z"},
+		{"epoch us", "timestamptz", &Options{Unit: "us"}, int64(1714979289123456), "2024-05-06 07:08:09.123456Z"},
+		{"epoch ns", "timestamptz", &Options{Unit: "ns"}, json.Number("1714979289123456789"), "2024-05-06 07:08:09.123457Z"},
+		{"epoch string with unit", "timestamptz", &Options{Unit: "s"}, "1714979289", "2024-05-06 07:08:09Z"},
+		{"epoch ignores timezone", "timestamptz", &Options{Timezone: "Asia/Tokyo"}, int64(0), "1970-01-01 00:00:00Z"},
+
+		// Extended JSON and BSON
+		{"$date iso", "timestamptz", nil, map[string]interface{}{"$date": "2024-05-06T07:08:09.123Z"}, "2024-05-06 07:08:09.123Z"},
+		{"$date numberLong", "timestamptz", nil, map[string]interface{}{"$date": map[string]interface{}{"$numberLong": "1714979289123"}}, "2024-05-06 07:08:09.123Z"},
+		{"$date millis", "timestamptz", nil, map[string]interface{}{"$date": json.Number("1714979289123")}, "2024-05-06 07:08:09.123Z"},
+		{"bson timestamp", "timestamptz", nil, bson.Timestamp{T: 1714979289, I: 7}, "2024-05-06 07:08:09Z"},
+
+		// timestamp (without time zone) gets the UTC wall time
+		{"timestamp", "timestamp", nil, "2024-05-06T07:08:09.5+02:00", "2024-05-06 05:08:09.5"},
+		{"timestamp rounds", "timestamp", nil, "2024-05-06T07:08:09.0000005Z", "2024-05-06 07:08:09.000001"},
+		{"timestamp in timezone", "timestamp", &Options{Timezone: "Europe/Berlin"}, "2024-05-06 07:08:09", "2024-05-06 05:08:09"},
+		{"datetime", "datetime", &Options{Unit: "ms"}, int64(1714979289123), "2024-05-06 07:08:09.123"},
+
+		// date is the day in timezone
+		{"date", "date", nil, "2024-05-06", "2024-05-06"},
+		{"date in timezone", "date", &Options{Timezone: "America/New_York"}, "2024-05-06T23:30:00Z", "2024-05-06"},
+		{"date in timezone next day", "date", &Options{Timezone: "Asia/Tokyo"}, "2024-05-06T23:30:00Z", "2024-05-07"},
+		{"date epoch", "date", nil, int64(-1), "1969-12-31"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustConvert(t, tt.conv, tt.opts, tt.in)
+
+			var text string
+
+			switch tt.conv {
+			case "timestamptz":
+				text = pgText(t, &pgtype.Timestamptz{}, got)
+			case "date":
+				text = pgText(t, &pgtype.Date{}, got)
+			default:
+				text = pgText(t, &pgtype.Timestamp{}, got)
+			}
+
+			if text != tt.want {
+				t.Fatalf("got %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeOfDay(t *testing.T) {
+	tests := []struct {
+		opts *Options
+		in   interface{}
+		want string // conv output
+		pg   string // pgtype.Time text encoding
+	}{
+		{nil, "2024-05-06T07:08:09.5Z", "07:08:09.5", "07:08:09.500000"},
+		{nil, "2024-05-06T07:08:09.1234567Z", "07:08:09.123457", "07:08:09.123457"},
+		{nil, "2024-05-06 23:59:59", "23:59:59", "23:59:59.000000"},
+		{&Options{Timezone: "Europe/Berlin"}, int64(0), "01:00:00", "01:00:00.000000"},
+		{&Options{Formats: []string{"%I:%M %p"}}, "07:08 PM", "19:08:00", "19:08:00.000000"},
+	}
+
+	for _, tt := range tests {
+		got := mustConvert(t, "time", tt.opts, tt.in)
+		if got != tt.want {
+			t.Errorf("Convert(%#v): got %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+
+		var tm pgtype.Time
+		if err := tm.DecodeText(nil, []byte(got.(string))); err != nil {
+			t.Errorf("pgtype.Time rejected %q: %v", got, err)
+			continue
+		}
+
+		if text, _ := tm.EncodeText(nil, nil); string(text) != tt.pg {
+			t.Errorf("pgtype.Time encoded %q, want %q", text, tt.pg)
+		}
+	}
+}
+
+func TestTimeErrors(t *testing.T) {
+	for _, tt := range []struct {
+		conv string
+		opts *Options
+	}{
+		{"int", &Options{Unit: "s"}},
+		{"string", &Options{Timezone: "UTC"}},
+		{"string", &Options{Formats: []string{"%Y"}}},
+		{"timestamptz", &Options{Unit: "m"}},
+		{"timestamptz", &Options{Timezone: "Mars/Olympus_Mons"}},
+		{"timestamptz", &Options{Formats: []string{"%Q"}}},
+		{"timestamptz", &Options{Formats: []string{""}}},
+	} {
+		if _, err := New(tt.conv, tt.opts); err == nil {
+			t.Errorf("New(%q, %+v) did not fail", tt.conv, tt.opts)
+		}
+	}
+
+	for _, tt := range []struct {
+		opts *Options
+		in   interface{}
+	}{
+		{nil, "not a time"},
+		{nil, "1714979289"},
+		{&Options{Formats: []string{"%d/%m/%Y"}}, "2024-05-06"},
+		{nil, true},
+		{nil, map[string]interface{}{"$date": "yesterday"}},
+		{nil, map[string]interface{}{"$date": map[string]interface{}{"$oid": "1"}}},
+		{nil, map[string]interface{}{"date": "2024-05-06"}},
+		{nil, json.Number("1e400")},
+	} {
+		c, err := New("timestamptz", tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, err := c.Convert(tt.in); err == nil {
+			t.Errorf("Convert(%#v) = %v, want an error", tt.in, v)
+		}
+	}
+}
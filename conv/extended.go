@@ -0,0 +1,302 @@
+package conv
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+// toUUID accepts UUID strings (with or without dashes/braces), BinData
+// subtype 3/4 and ObjectIds. ObjectIds are converted by appending 4 zero bytes
+// to the 12-byte ObjectId so that the original id can be recovered.
+//
+// The result is the canonical (lowercase, dashed) UUID string which Postgres
+// parses for both uuid and text columns.
+func toUUID(v interface{}) (string, error) {
+	var b []byte
+
+	switch t := v.(type) {
+	case string:
+		s := strings.Trim(strings.TrimSpace(t), "{}")
+		s = strings.ReplaceAll(s, "-", "")
+
+		decoded, err := hex.DecodeString(s)
+		if err != nil || len(decoded) != 16 {
+			return "", errors.Errorf("unable to convert '%s' to uuid", t)
+		}
+
+		b = decoded
+	case bson.Binary:
+		if t.Subtype != bson.BinaryUUID && t.Subtype != bson.BinaryUUIDOld {
+			return "", errors.Errorf("unable to convert BinData subtype %d to uuid", t.Subtype)
+		}
+
+		b = t.Data
+	case bson.ObjectID:
+		b = append(t[:], 0, 0, 0, 0)
+	case []byte:
+		b = t
+	default:
+		return "", errors.Errorf("unable to convert type '%T' to uuid", v)
+	}
+
+	if len(b) != 16 {
+		return "", errors.Errorf("unable to convert %d bytes to uuid", len(b))
+	}
+
+	h := hex.EncodeToString(b)
+
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// toNumeric returns a decimal string that is parsed by Postgres without any
+// loss of precision (unlike going through float64).
+func toNumeric(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case json.Number:
+		if _, ok := new(big.Float).SetString(t.String()); !ok {
+			return "", errors.Errorf("unable to convert '%s' to numeric", t)
+		}
+
+		return t.String(), nil
+	case bson.Decimal128:
+		return t.String(), nil
+	case int, int32, int64:
+		i, err := toInt(t)
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatInt(i, 10), nil
+	case float32, float64:
+		f, err := toFloat(t)
+		if err != nil {
+			return "", err
+		}
+
+		if math.IsNaN(f) {
+			return "NaN", nil
+		}
+
+		if math.IsInf(f, 0) {
+			if f > 0 {
+				return "Infinity", nil
+			}
+
+			return "-Infinity", nil
+		}
+
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case string:
+		s := strings.TrimSpace(t)
+
+		// Goes through Decimal128 parsing to validate (and to support NaN/Infinity)
+		if _, err := bson.ParseDecimal128(s); err != nil {
+			if _, ok := new(big.Float).SetString(s); !ok {
+				return "", errors.Errorf("unable to convert '%s' to numeric", t)
+			}
+		}
+
+		return s, nil
+	default:
+		return "", errors.Errorf("unable to convert type '%T' to numeric", v)
+	}
+}
+
+// toBytes returns raw bytes (for bytea columns). Strings in Postgres hex
+// format (ie. "\x0102") are decoded, other strings are used as-is.
+func toBytes(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case bson.Binary:
+		return t.Data, nil
+	case bson.ObjectID:
+		return t[:], nil
+	case string:
+		if strings.HasPrefix(t, `\x`) {
+			b, err := hex.DecodeString(t[2:])
+			if err != nil {
+				return nil, errors.Errorf("unable to decode hex bytea '%s'", t)
+			}
+
+			return b, nil
+		}
+
+		return []byte(t), nil
+	case map[string]interface{}:
+		return toBSON(t)
+	default:
+		return nil, errors.Errorf("unable to convert type '%T' to bytea", v)
+	}
+}
+
+// fromBase64 decodes standard or URL-safe (padded or not) base64 strings
+func fromBase64(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case string:
+		s := strings.TrimSpace(t)
+
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+			if b, err := enc.DecodeString(s); err == nil {
+				return b, nil
+			}
+		}
+
+		return nil, errors.Errorf("unable to decode base64 '%s'", t)
+	case []byte, bson.Binary:
+		return toBytes(t)
+	default:
+		return nil, errors.Errorf("unable to convert type '%T' from base64", v)
+	}
+}
+
+// toBSON encodes (sub)documents as BSON bytes
+func toBSON(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return bson.Marshal(t)
+	case bson.Binary:
+		return t.Data, nil
+	case []byte:
+		return t, nil
+	default:
+		return nil, errors.Errorf("unable to convert type '%T' to bson; must be a document", v)
+	}
+}
+
+// toInet accepts IP addresses and CIDR networks
+func toInet(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.Errorf("unable to convert type '%T' to inet", v)
+	}
+
+	s = strings.TrimSpace(s)
+
+	if ip, network, err := net.ParseCIDR(s); err == nil {
+		ones, _ := network.Mask.Size()
+		return ip.String() + "/" + strconv.Itoa(ones), nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", errors.Errorf("unable to convert '%s' to inet", s)
+	}
+
+	return ip.String(), nil
+}
+
+func (c *Converter) toEnum(v interface{}) (string, error) {
+	s, err := toString(v)
+	if err != nil {
+		return "", err
+	}
+
+	for _, allowed := range c.opts.Values {
+		if s == allowed {
+			return s, nil
+		}
+	}
+
+	return "", errors.Errorf("'%s' is not one of the allowed enum values %q", s, c.opts.Values)
+}
+
+// Array is a converted array. It encodes itself as a Postgres array literal
+// (ie. {1,2,NULL}) in text format so that it can be written to an array
+// column of any element type.
+type Array []interface{}
+
+var _ pgtype.TextEncoder = Array{}
+
+func (c *Converter) toArray(v interface{}) (Array, error) {
+	elements, ok := v.([]interface{})
+	if !ok {
+		// Treat scalars as single element arrays
+		elements = []interface{}{v}
+	}
+
+	arr := make(Array, len(elements))
+
+	for i, el := range elements {
+		converted, err := c.convertElement(el)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to convert array element %d", i)
+		}
+
+		arr[i] = converted
+	}
+
+	return arr, nil
+}
+
+func (c *Converter) convertElement(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	return c.convertScalar(v)
+}
+
+// EncodeText implements pgtype.TextEncoder
+func (a Array) EncodeText(_ *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	return a.AppendText(buf)
+}
+
+// AppendText appends the Postgres array literal for a to buf
+func (a Array) AppendText(buf []byte) ([]byte, error) {
+	buf = append(buf, '{')
+
+	for i, el := range a {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		if el == nil {
+			buf = append(buf, "NULL"...)
+			continue
+		}
+
+		s, err := textValue(el)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, '"')
+		buf = append(buf, strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)...)
+		buf = append(buf, '"')
+	}
+
+	return append(buf, '}'), nil
+}
+
+// textValue returns the Postgres text representation of a converted value
+func textValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05.999999Z07:00"), nil
+	case []byte:
+		return `\x` + hex.EncodeToString(t), nil
+	default:
+		return "", errors.Errorf("unable to encode type '%T' as text", v)
+	}
+}
@@ -0,0 +1,246 @@
+package conv
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones must work on hosts without zoneinfo
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+var (
+	// Layouts that are tried (in order) when converting strings to time and
+	// no formats are configured
+	defaultTimeLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05Z07:00",
+		"2006-01-02 15:04:05",
+		"2006-01-02",
+	}
+
+	// Nanoseconds per epoch unit
+	epochUnits = map[string]int64{
+		"s":  int64(time.Second),
+		"ms": int64(time.Millisecond),
+		"us": int64(time.Microsecond),
+		"ns": 1,
+	}
+
+	// strftime directives -> Go layout
+	strftimeDirectives = map[byte]string{
+		'Y': "2006",
+		'y': "06",
+		'm': "01",
+		'd': "02",
+		'e': "_2",
+		'j': "002",
+		'H': "15",
+		'I': "03",
+		'M': "04",
+		'S': "05",
+		'f': "999999999",
+		'p': "PM",
+		'b': "Jan",
+		'h': "Jan",
+		'B': "January",
+		'a': "Mon",
+		'A': "Monday",
+		'z': "-0700",
+		'Z': "MST",
+		'F': "2006-01-02",
+		'T': "15:04:05",
+		'%': "%",
+	}
+
+	timeConvs = map[string]struct{}{
+		"date":        {},
+		"datetime":    {},
+		"timestamp":   {},
+		"timestamptz": {},
+		"time":        {},
+	}
+)
+
+// setTimeOptions validates and compiles Formats, Unit and Timezone
+func (c *Converter) setTimeOptions() error {
+	_, isTime := timeConvs[c.name]
+
+	if !isTime && (len(c.opts.Formats) > 0 || c.opts.Unit != "" || c.opts.Timezone != "") {
+		return errors.Errorf("format, unit and timezone can only be set for time convs, not '%s'", c.Name())
+	}
+
+	if c.opts.Unit != "" {
+		if _, ok := epochUnits[c.opts.Unit]; !ok {
+			return errors.Errorf("unit '%s' is invalid; must be one of 's', 'ms', 'us', 'ns'", c.opts.Unit)
+		}
+	}
+
+	c.loc = time.UTC
+
+	if c.opts.Timezone != "" {
+		loc, err := time.LoadLocation(c.opts.Timezone)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timezone '%s'", c.opts.Timezone)
+		}
+
+		c.loc = loc
+	}
+
+	c.layouts = defaultTimeLayouts
+
+	if len(c.opts.Formats) > 0 {
+		c.layouts = make([]string, 0, len(c.opts.Formats))
+
+		for _, f := range c.opts.Formats {
+			layout, err := Layout(f)
+			if err != nil {
+				return err
+			}
+
+			c.layouts = append(c.layouts, layout)
+		}
+	}
+
+	return nil
+}
+
+// Layout returns the Go time layout for format. Formats containing '%' are
+// treated as strftime-like (ie. "%Y-%m-%d %H:%M:%S"), anything else is
+// expected to already be a Go layout (ie. "2006-01-02 15:04:05").
+func Layout(format string) (string, error) {
+	if format == "" {
+		return "", errors.New("format cannot be empty")
+	}
+
+	if !strings.Contains(format, "%") {
+		return format, nil
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+
+		if i+1 >= len(format) {
+			return "", errors.Errorf("format '%s' ends with an incomplete directive", format)
+		}
+
+		i++
+
+		directive, ok := strftimeDirectives[format[i]]
+		if !ok {
+			return "", errors.Errorf("format '%s' contains unsupported directive '%%%c'", format, format[i])
+		}
+
+		sb.WriteString(directive)
+	}
+
+	return sb.String(), nil
+}
+
+// toTime converts time values, strings (see Options.Formats), epoch numbers
+// (see Options.Unit), Extended JSON dates ({"$date": ...}) and BSON timestamps.
+// Inputs without a zone are interpreted in Options.Timezone.
+func (c *Converter) toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case bson.Timestamp:
+		return time.Unix(int64(t.T), 0).UTC(), nil
+	case string:
+		s := strings.TrimSpace(t)
+
+		for _, layout := range c.layouts {
+			if parsed, err := time.ParseInLocation(layout, s, c.loc); err == nil {
+				return parsed, nil
+			}
+		}
+
+		// Numeric strings are epochs when a unit is set
+		if c.opts.Unit != "" {
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				return c.fromEpoch(json.Number(s), c.opts.Unit)
+			}
+		}
+
+		return time.Time{}, errors.Errorf("unable to convert '%s' to time", t)
+	case json.Number, int, int32, int64, float32, float64:
+		unit := c.opts.Unit
+		if unit == "" {
+			unit = "s"
+		}
+
+		return c.fromEpoch(t, unit)
+	case map[string]interface{}:
+		return c.fromExtendedJSONDate(t)
+	default:
+		return time.Time{}, errors.Errorf("unable to convert type '%T' to time", v)
+	}
+}
+
+// fromExtendedJSONDate handles {"$date": "<iso-8601>"}, {"$date": <millis>}
+// and {"$date": {"$numberLong": "<millis>"}}
+func (c *Converter) fromExtendedJSONDate(m map[string]interface{}) (time.Time, error) {
+	date, ok := m["$date"]
+	if !ok || len(m) != 1 {
+		return time.Time{}, errors.New("unable to convert document to time; expected {\"$date\": ...}")
+	}
+
+	switch t := date.(type) {
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return time.Time{}, errors.Errorf("unable to parse $date '%s'", t)
+		}
+
+		return parsed, nil
+	case map[string]interface{}:
+		millis, ok := t["$numberLong"].(string)
+		if !ok {
+			return time.Time{}, errors.New("unable to convert $date; expected {\"$numberLong\": \"...\"}")
+		}
+
+		return c.fromEpoch(json.Number(millis), "ms")
+	default:
+		return c.fromEpoch(t, "ms")
+	}
+}
+
+func (c *Converter) fromEpoch(v interface{}, unit string) (time.Time, error) {
+	perUnit := epochUnits[unit]
+	unitsPerSec := int64(time.Second) / perUnit
+
+	// Integers are converted exactly; everything else goes through big.Float
+	// so that (ie.) fractional seconds are preserved.
+	if i, err := toInt(v); err == nil {
+		return time.Unix(i/unitsPerSec, (i%unitsPerSec)*perUnit).UTC(), nil
+	}
+
+	s, err := toString(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	f, ok := new(big.Float).SetString(s)
+	if !ok || f.IsInf() {
+		return time.Time{}, errors.Errorf("unable to convert '%v' to time", v)
+	}
+
+	nanos, _ := f.Mul(f, new(big.Float).SetInt64(perUnit)).Int(nil)
+	sec, nsec := new(big.Int).QuoRem(nanos, big.NewInt(int64(time.Second)), new(big.Int))
+
+	if !sec.IsInt64() {
+		return time.Time{}, errors.Errorf("unable to convert '%v' to time; out of range", v)
+	}
+
+	return time.Unix(sec.Int64(), nsec.Int64()).UTC(), nil
+}
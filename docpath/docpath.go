@@ -0,0 +1,419 @@
+// Package docpath implements gjson-style paths (https://github.com/tidwall/gjson)
+// for documents decoded into map[string]interface{} / []interface{} values,
+// so that paths behave the same for JSON, BSON and CSV sources.
+//
+// Supported syntax:
+//
+//	name.first              nested keys
+//	children.1              array index
+//	fav\.movie              escaped dot (also \* and \?)
+//	child*.na?e             wildcards in keys (first matching key in sorted order)
+//	children.#              array length
+//	friends.#.first         "first" of every element
+//	friends.#(last=="Lee")  first element matching a query
+//	friends.#(age>40)#      all elements matching a query
+//	children.@reverse       modifiers: @reverse, @keys, @values, @flatten, @this
+//
+// Query operators are ==, =, !=, <, <=, >, >=, % (like) and !% (not like).
+// The right-hand side is a JSON literal (string, number, true, false, null);
+// omitting the operator checks that the left-hand side path exists. An empty
+// left-hand side (ie. #(=="foo")) compares the element itself.
+package docpath
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type kind int
+
+const (
+	kindKey kind = iota
+	kindWildcard
+	kindCount    // #
+	kindQuery    // #(...)
+	kindQueryAll // #(...)#
+	kindModifier // @name
+)
+
+var (
+	cache = &sync.Map{}
+
+	modifiers = map[string]func(v interface{}) (interface{}, bool){
+		"this":    modThis,
+		"reverse": modReverse,
+		"keys":    modKeys,
+		"values":  modValues,
+		"flatten": modFlatten,
+	}
+)
+
+type component struct {
+	kind  kind
+	key   string
+	query *query
+}
+
+// Path is a compiled path
+type Path struct {
+	src        string
+	components []component
+}
+
+// Compile parses path
+func Compile(path string) (*Path, error) {
+	if path == "" {
+		return nil, errors.New("path cannot be empty")
+	}
+
+	parts, err := split(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid path '%s'", path)
+	}
+
+	p := &Path{src: path}
+
+	for _, part := range parts {
+		c, err := parseComponent(part)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid path '%s'", path)
+		}
+
+		p.components = append(p.components, c)
+	}
+
+	return p, nil
+}
+
+// Get compiles (with caching) and resolves path in doc. Paths are expected
+// to have been validated with Compile beforehand; invalid paths are not found.
+func Get(doc interface{}, path string) (interface{}, bool) {
+	if p, ok := cache.Load(path); ok {
+		return p.(*Path).Get(doc)
+	}
+
+	p, err := Compile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	cache.Store(path, p)
+
+	return p.Get(doc)
+}
+
+// Get resolves the path in doc
+func (p *Path) Get(doc interface{}) (interface{}, bool) {
+	return get(doc, p.components)
+}
+
+func (p *Path) String() string {
+	return p.src
+}
+
+func get(v interface{}, components []component) (interface{}, bool) {
+	if len(components) == 0 {
+		return v, true
+	}
+
+	c, rest := components[0], components[1:]
+
+	switch c.kind {
+	case kindKey:
+		switch t := v.(type) {
+		case map[string]interface{}:
+			child, ok := t[c.key]
+			if !ok {
+				return nil, false
+			}
+
+			return get(child, rest)
+		case []interface{}:
+			i, ok := index(c.key)
+			if !ok || i >= len(t) {
+				return nil, false
+			}
+
+			return get(t[i], rest)
+		}
+	case kindWildcard:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		for _, k := range sortedKeys(m) {
+			if match(c.key, k) {
+				return get(m[k], rest)
+			}
+		}
+	case kindCount:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if len(rest) == 0 {
+			return int64(len(arr)), true
+		}
+
+		results := make([]interface{}, 0, len(arr))
+
+		for _, el := range arr {
+			if r, ok := get(el, rest); ok {
+				results = append(results, r)
+			}
+		}
+
+		return results, true
+	case kindQuery:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		for _, el := range arr {
+			if c.query.matches(el) {
+				return get(el, rest)
+			}
+		}
+	case kindQueryAll:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		results := make([]interface{}, 0)
+
+		for _, el := range arr {
+			if !c.query.matches(el) {
+				continue
+			}
+
+			if r, ok := get(el, rest); ok {
+				results = append(results, r)
+			}
+		}
+
+		return results, true
+	case kindModifier:
+		r, ok := modifiers[c.key](v)
+		if !ok {
+			return nil, false
+		}
+
+		return get(r, rest)
+	}
+
+	return nil, false
+}
+
+// split splits path on unescaped dots that are not inside a query
+func split(path string) ([]string, error) {
+	parts := make([]string, 0)
+
+	var (
+		sb      strings.Builder
+		depth   int
+		inQuote bool
+	)
+
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+
+		switch {
+		case ch == '\\':
+			if i+1 >= len(path) {
+				return nil, errors.New("path ends with an escape character")
+			}
+
+			// Keep escapes; components unescape keys themselves
+			sb.WriteByte(ch)
+			sb.WriteByte(path[i+1])
+			i++
+		case inQuote:
+			if ch == '"' {
+				inQuote = false
+			}
+
+			sb.WriteByte(ch)
+		case ch == '"' && depth > 0:
+			inQuote = true
+			sb.WriteByte(ch)
+		case ch == '(':
+			depth++
+			sb.WriteByte(ch)
+		case ch == ')':
+			depth--
+
+			if depth < 0 {
+				return nil, errors.New("unbalanced ')'")
+			}
+
+			sb.WriteByte(ch)
+		case ch == '.' && depth == 0:
+			parts = append(parts, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+
+	if depth != 0 || inQuote {
+		return nil, errors.New("unterminated query")
+	}
+
+	parts = append(parts, sb.String())
+
+	for _, p := range parts {
+		if p == "" {
+			return nil, errors.New("empty path component")
+		}
+	}
+
+	return parts, nil
+}
+
+func parseComponent(part string) (component, error) {
+	switch {
+	case part == "#":
+		return component{kind: kindCount}, nil
+	case strings.HasPrefix(part, "#("):
+		all := strings.HasSuffix(part, ")#")
+
+		end := len(part) - 1
+		if all {
+			end--
+		}
+
+		if part[end] != ')' {
+			return component{}, errors.Errorf("invalid query '%s'", part)
+		}
+
+		q, err := parseQuery(part[2:end])
+		if err != nil {
+			return component{}, errors.Wrapf(err, "invalid query '%s'", part)
+		}
+
+		if all {
+			return component{kind: kindQueryAll, query: q}, nil
+		}
+
+		return component{kind: kindQuery, query: q}, nil
+	case strings.HasPrefix(part, "@"):
+		if _, ok := modifiers[part[1:]]; !ok {
+			return component{}, errors.Errorf("unknown modifier '%s'", part)
+		}
+
+		return component{kind: kindModifier, key: part[1:]}, nil
+	}
+
+	key, wildcard := unescape(part)
+
+	if wildcard {
+		// Keep the (escaped) pattern; match() handles escapes
+		return component{kind: kindWildcard, key: part}, nil
+	}
+
+	return component{kind: kindKey, key: key}, nil
+}
+
+// unescape removes escapes from a key and reports whether it contains
+// unescaped wildcards
+func unescape(part string) (string, bool) {
+	var (
+		sb       strings.Builder
+		wildcard bool
+	)
+
+	for i := 0; i < len(part); i++ {
+		switch {
+		case part[i] == '\\' && i+1 < len(part):
+			i++
+			sb.WriteByte(part[i])
+		case part[i] == '*' || part[i] == '?':
+			wildcard = true
+			sb.WriteByte(part[i])
+		default:
+			sb.WriteByte(part[i])
+		}
+	}
+
+	return sb.String(), wildcard
+}
+
+// match matches s against a pattern containing * and ? wildcards (which can
+// be escaped with \)
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Collapse consecutive stars
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if pattern == "" {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if match(pattern, s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+
+			_, size := firstRune(s)
+			pattern, s = pattern[1:], s[size:]
+		default:
+			ch := pattern[0]
+
+			if ch == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+				ch = pattern[0]
+			}
+
+			if s == "" || s[0] != ch {
+				return false
+			}
+
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return s == ""
+}
+
+func firstRune(s string) (rune, int) {
+	for _, r := range s {
+		return r, len(string(r))
+	}
+
+	return 0, 0
+}
+
+func index(s string) (int, bool) {
+	if s == "" || len(s) > 9 {
+		return 0, false
+	}
+
+	i := 0
+
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+
+		i = i*10 + int(ch-'0')
+	}
+
+	return i, true
+}
@@ -0,0 +1,190 @@
+package docpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const testDoc = `{
+	"name": {"first": "Tom", "last": "Anderson"},
+	"age": 37,
+	"children": ["Sara", "Alex", "Jack"],
+	"fav.movie": "Deer Hunter",
+	"a*b": "star",
+	"q?": "question",
+	"back\\slash": "slash",
+	"friends": [
+		{"first": "Dale", "last": "Murphy", "age": 44, "nets": ["ig", "fb", "tw"]},
+		{"first": "Roger", "last": "Craig", "age": 68, "nets": ["fb", "tw"]},
+		{"first": "Jane", "last": "Murphy", "age": 47, "nets": ["ig", "tw"]}
+	],
+	"matrix": [[1, 2], [3], 4],
+	"empty": [],
+	"nothing": null
+}`
+
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func TestGet(t *testing.T) {
+	doc := decode(t, testDoc)
+
+	tests := []struct {
+		path  string
+		want  string // JSON; ignored when not found
+		found bool
+	}{
+		// Keys
+		{`age`, `37`, true},
+		{`name.last`, `"Anderson"`, true},
+		{`name`, `{"first": "Tom", "last": "Anderson"}`, true},
+		{`nothing`, `null`, true},
+		{`missing`, ``, false},
+		{`name.middle`, ``, false},
+		{`age.value`, ``, false},
+
+		// Array indexes
+		{`children.0`, `"Sara"`, true},
+		{`children.2`, `"Jack"`, true},
+		{`children.3`, ``, false},
+		{`children.-1`, ``, false},
+		{`children.first`, ``, false},
+		{`friends.1.first`, `"Roger"`, true},
+		{`friends.1.nets.0`, `"fb"`, true},
+		{`matrix.0.1`, `2`, true},
+		{`empty.0`, ``, false},
+
+		// Escapes
+		{`fav\.movie`, `"Deer Hunter"`, true},
+		{`fav.movie`, ``, false},
+		{`a\*b`, `"star"`, true},
+		{`q\?`, `"question"`, true},
+		{`back\\slash`, `"slash"`, true},
+
+		// Wildcards match the first key in sorted order
+		{`child*`, `["Sara", "Alex", "Jack"]`, true},
+		{`c*n.1`, `"Alex"`, true},
+		{`na?e.fir*`, `"Tom"`, true},
+		{`*`, `"star"`, true},
+		{`a*`, `"star"`, true},
+		{`fav?movie`, `"Deer Hunter"`, true},
+		{`q?`, `"question"`, true},
+		{`x*`, ``, false},
+		{`children.?`, ``, false},
+
+		// Counts and per-element paths
+		{`children.#`, `3`, true},
+		{`empty.#`, `0`, true},
+		{`friends.#.first`, `["Dale", "Roger", "Jane"]`, true},
+		{`friends.#.nets.0`, `["ig", "fb", "ig"]`, true},
+		{`friends.#.missing`, `[]`, true},
+		{`name.#`, ``, false},
+
+		// Queries
+		{`friends.#(last=="Murphy").first`, `"Dale"`, true},
+		{`friends.#(last=="Murphy")#.first`, `["Dale", "Jane"]`, true},
+		{`friends.#(age>45)#.last`, `["Craig", "Murphy"]`, true},
+		{`friends.#(age<=44).first`, `"Dale"`, true},
+		{`friends.#(age!=44)#.first`, `["Roger", "Jane"]`, true},
+		{`friends.#(first%"R*").last`, `"Craig"`, true},
+		{`friends.#(first!%"R*")#.first`, `["Dale", "Jane"]`, true},
+		{`friends.#(nets.#(=="ig"))#.first`, `["Dale", "Jane"]`, true},
+		{`friends.#(last=="Lee").first`, ``, false},
+		{`friends.#(last=="Lee")#`, `[]`, true},
+		{`children.#(=="Alex")`, `"Alex"`, true},
+
+		// Modifiers
+		{`children.@reverse`, `["Jack", "Alex", "Sara"]`, true},
+		{`children.@reverse.0`, `"Jack"`, true},
+		{`name.@keys`, `["first", "last"]`, true},
+		{`name.@values`, `["Tom", "Anderson"]`, true},
+		{`matrix.@flatten`, `[1, 2, 3, 4]`, true},
+		{`age.@this`, `37`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if _, err := Compile(tt.path); err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+
+			got, found := Get(doc, tt.path)
+			if found != tt.found {
+				t.Fatalf("found = %v (%#v), want %v", found, got, tt.found)
+			}
+
+			if !found {
+				return
+			}
+
+			// Counts are int64, decoded numbers json.Number
+			if n, ok := got.(int64); ok {
+				got = json.Number(strconv.FormatInt(n, 10))
+			}
+
+			if want := decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, path := range []string{
+		``,
+		`a.`,
+		`.a`,
+		`a..b`,
+		`a\`,
+		`friends.#(last=="Murphy"`,
+		`friends.#(last=="Murphy))`,
+		`friends.#(last==)`,
+		`friends.#(last==Murphy)`,
+		`friends.#(last==["a"])`,
+		`friends.#(age%1)`,
+		`friends.#()`,
+		`a.@unknown`,
+	} {
+		if _, err := Compile(path); err == nil {
+			t.Errorf("Compile(%q) did not fail", path)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{`*`, ``, true},
+		{`a*c`, `abbbc`, true},
+		{`a*c`, `abbbd`, false},
+		{`a**c`, `ac`, true},
+		{`?`, `é`, true},
+		{`??`, `é`, false},
+		{`a\*`, `a*`, true},
+		{`a\*`, `ab`, false},
+		{`a\?`, `ab`, false},
+	}
+
+	for _, tt := range tests {
+		if got := match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
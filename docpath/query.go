@@ -0,0 +1,151 @@
+package docpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Longer operators must come first
+var queryOperators = []string{"==", "!=", "<=", ">=", "!%", "=", "<", ">", "%"}
+
+type query struct {
+	path  *Path // nil == the element itself
+	op    string
+	value interface{}
+}
+
+func parseQuery(s string) (*query, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("query cannot be empty")
+	}
+
+	q := &query{}
+
+	lhs := s
+	opPos := -1
+
+	// Find the first operator outside of quotes/nested queries
+	depth := 0
+
+SCAN:
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+		default:
+			if depth > 0 {
+				continue
+			}
+
+			for _, op := range queryOperators {
+				if strings.HasPrefix(s[i:], op) {
+					opPos = i
+					q.op = op
+					break SCAN
+				}
+			}
+		}
+	}
+
+	if opPos >= 0 {
+		lhs = strings.TrimSpace(s[:opPos])
+
+		rhs := strings.TrimSpace(s[opPos+len(q.op):])
+		if rhs == "" {
+			return nil, errors.Errorf("missing value after '%s'", q.op)
+		}
+
+		dec := json.NewDecoder(bytes.NewReader([]byte(rhs)))
+		dec.UseNumber()
+
+		if err := dec.Decode(&q.value); err != nil {
+			return nil, errors.Errorf("invalid value '%s'; must be a JSON string, number, true, false or null", rhs)
+		}
+
+		if dec.More() {
+			return nil, errors.Errorf("invalid value '%s'", rhs)
+		}
+
+		switch q.value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, errors.Errorf("invalid value '%s'; must be a JSON string, number, true, false or null", rhs)
+		}
+
+		if q.op == "%" || q.op == "!%" {
+			if _, ok := q.value.(string); !ok {
+				return nil, errors.Errorf("operator '%s' requires a string pattern", q.op)
+			}
+		}
+	}
+
+	if lhs != "" {
+		p, err := Compile(lhs)
+		if err != nil {
+			return nil, err
+		}
+
+		q.path = p
+	}
+
+	if q.path == nil && q.op == "" {
+		return nil, errors.New("query must have a path or an operator")
+	}
+
+	return q, nil
+}
+
+func (q *query) matches(el interface{}) bool {
+	v := el
+
+	if q.path != nil {
+		var ok bool
+
+		v, ok = q.path.Get(el)
+		if !ok {
+			return false
+		}
+	}
+
+	// Existence check
+	if q.op == "" {
+		return true
+	}
+
+	switch q.op {
+	case "%", "!%":
+		s, ok := v.(string)
+		if !ok {
+			return q.op == "!%"
+		}
+
+		return match(q.value.(string), s) == (q.op == "%")
+	case "==", "=":
+		return compare(v, q.value) == 0
+	case "!=":
+		return compare(v, q.value) != 0
+	}
+
+	c := compare(v, q.value)
+	if c == incomparable {
+		return false
+	}
+
+	switch q.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
@@ -0,0 +1,166 @@
+package docpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const incomparable = 2
+
+// compare returns -1, 0, 1 or incomparable
+func compare(a, b interface{}) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		}
+
+		return incomparable
+	}
+
+	af, aok := number(a)
+	bf, bok := number(b)
+
+	if aok && bok {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	if ab, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		if !ok {
+			return incomparable
+		}
+
+		if ab == bb {
+			return 0
+		}
+
+		return incomparable
+	}
+
+	as, aok := str(a)
+	bs, bok := str(b)
+
+	if !aok || !bok {
+		return incomparable
+	}
+
+	return strings.Compare(as, bs)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+
+	return 0, false
+}
+
+// str returns the string form of strings and stringers (ie. ObjectIds)
+func str(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case fmt.Stringer:
+		return t.String(), true
+	}
+
+	return "", false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func modThis(v interface{}) (interface{}, bool) {
+	return v, true
+}
+
+func modReverse(v interface{}) (interface{}, bool) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return v, true
+	}
+
+	reversed := make([]interface{}, len(arr))
+	for i, el := range arr {
+		reversed[len(arr)-1-i] = el
+	}
+
+	return reversed, true
+}
+
+func modKeys(v interface{}) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	keys := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		keys = append(keys, k)
+	}
+
+	return keys, true
+}
+
+func modValues(v interface{}) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	values := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		values = append(values, m[k])
+	}
+
+	return values, true
+}
+
+func modFlatten(v interface{}) (interface{}, bool) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return v, true
+	}
+
+	flat := make([]interface{}, 0, len(arr))
+
+	for _, el := range arr {
+		if inner, ok := el.([]interface{}); ok {
+			flat = append(flat, inner...)
+			continue
+		}
+
+		flat = append(flat, el)
+	}
+
+	return flat, true
+}
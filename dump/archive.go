@@ -0,0 +1,244 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+// An archive (mongodump --archive) is laid out as
+//
+//	magic number (uint32 0x8199e26d, little endian)
+//	prelude: header document, one metadata document per collection, terminator
+//	blocks: namespace header document, documents of that namespace, terminator
+//
+// Blocks of different namespaces are interleaved. The last block of a
+// namespace has a namespace header with EOF set and no documents. The
+// terminator is an int32 -1 (where a document length would be).
+const archiveMagic uint32 = 0x8199e26d
+
+var terminator = []byte{0xff, 0xff, 0xff, 0xff}
+
+// ArchiveHeader is the header at the start of an archive's prelude
+type ArchiveHeader struct {
+	ConcurrentCollections int32
+	FormatVersion         string
+	ServerVersion         string
+	ToolVersion           string
+}
+
+// ArchiveCollection is a collection listed in an archive's prelude
+type ArchiveCollection struct {
+	DB         string
+	Collection string
+	Type       string
+	Size       int64
+	Metadata   *Metadata
+}
+
+// Namespace returns "<db>.<collection>"
+func (c *ArchiveCollection) Namespace() string {
+	return c.DB + "." + c.Collection
+}
+
+// Prelude holds the archive's header and the metadata of its collections
+type Prelude struct {
+	Header      ArchiveHeader
+	Collections []*ArchiveCollection
+}
+
+// ReadPrelude reads the magic number and prelude from the start of an archive.
+// Returns the number of bytes read.
+func ReadPrelude(r *bufio.Reader) (*Prelude, int64, error) {
+	var magic [4]byte
+
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, 0, errors.Wrap(err, "unable to read archive magic number")
+	}
+
+	if binary.LittleEndian.Uint32(magic[:]) != archiveMagic {
+		return nil, 0, errors.New("source is not a mongodump archive (bad magic number)")
+	}
+
+	n := int64(len(magic))
+
+	data, err := bson.ReadDocument(r)
+	if err != nil {
+		return nil, n, errors.Wrap(err, "unable to read archive header")
+	}
+
+	n += int64(len(data))
+
+	doc, err := bson.Unmarshal(data)
+	if err != nil {
+		return nil, n, errors.Wrap(err, "unable to decode archive header")
+	}
+
+	p := &Prelude{
+		Header: ArchiveHeader{
+			ConcurrentCollections: int32(integer(doc["concurrent_collections"])),
+			FormatVersion:         str(doc["version"]),
+			ServerVersion:         str(doc["server_version"]),
+			ToolVersion:           str(doc["tool_version"]),
+		},
+	}
+
+	for {
+		end, err := atTerminator(r)
+		if err != nil {
+			return nil, n, errors.Wrap(err, "unable to read archive prelude")
+		}
+
+		if end {
+			n += int64(len(terminator))
+			break
+		}
+
+		data, err := bson.ReadDocument(r)
+		if err != nil {
+			return nil, n, errors.Wrap(err, "unable to read collection metadata")
+		}
+
+		n += int64(len(data))
+
+		doc, err := bson.Unmarshal(data)
+		if err != nil {
+			return nil, n, errors.Wrap(err, "unable to decode collection metadata")
+		}
+
+		c := &ArchiveCollection{
+			DB:         str(doc["db"]),
+			Collection: str(doc["collection"]),
+			Type:       str(doc["type"]),
+			Size:       integer(doc["size"]),
+		}
+
+		if metadata := str(doc["metadata"]); metadata != "" {
+			c.Metadata, err = ParseMetadata([]byte(metadata))
+			if err != nil {
+				return nil, n, errors.Wrapf(err, "unable to parse metadata of '%s'", c.Namespace())
+			}
+		}
+
+		p.Collections = append(p.Collections, c)
+	}
+
+	return p, n, nil
+}
+
+// ArchiveReader reads the documents of an archive's blocks (after the
+// prelude), together with the namespace of each document
+type ArchiveReader struct {
+	r         *bufio.Reader
+	offset    int64
+	namespace string // namespace of the current block; "" between blocks
+}
+
+// NewArchiveReader returns a reader positioned at offset, which is either the
+// end of the prelude or the end of a document of namespace's block
+func NewArchiveReader(r *bufio.Reader, offset int64, namespace string) *ArchiveReader {
+	return &ArchiveReader{r: r, offset: offset, namespace: namespace}
+}
+
+// Next returns the next document. Returns io.EOF at the end of the archive.
+func (a *ArchiveReader) Next() ([]byte, error) {
+	for {
+		end, err := atTerminator(a.r)
+		if err != nil {
+			return nil, err
+		}
+
+		if end {
+			if a.namespace == "" {
+				return nil, errors.Errorf("unexpected terminator at offset '%d'", a.offset)
+			}
+
+			a.offset += int64(len(terminator))
+			a.namespace = ""
+
+			continue
+		}
+
+		data, err := bson.ReadDocument(a.r)
+		if err != nil {
+			return nil, err
+		}
+
+		a.offset += int64(len(data))
+
+		if a.namespace != "" {
+			return data, nil
+		}
+
+		// Between blocks: this is the header of the next block
+		header, err := bson.Unmarshal(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode namespace header before offset '%d'", a.offset)
+		}
+
+		db, collection := str(header["db"]), str(header["collection"])
+		if collection == "" {
+			return nil, errors.Errorf("namespace header before offset '%d' has no collection", a.offset)
+		}
+
+		a.namespace = db + "." + collection
+	}
+}
+
+// Offset returns the position right after the last returned document
+func (a *ArchiveReader) Offset() int64 {
+	return a.offset
+}
+
+// Namespace returns the namespace ("<db>.<collection>") of the last returned
+// document
+func (a *ArchiveReader) Namespace() string {
+	return a.namespace
+}
+
+// atTerminator reports (and consumes) a terminator; returns io.EOF at the end
+// of r
+func atTerminator(r *bufio.Reader) (bool, error) {
+	peek, err := r.Peek(len(terminator))
+	if err != nil {
+		if err == io.EOF && len(peek) == 0 {
+			return false, io.EOF
+		}
+
+		if err == io.EOF {
+			return false, errors.New("truncated archive")
+		}
+
+		return false, err
+	}
+
+	if string(peek) != string(terminator) {
+		return false, nil
+	}
+
+	_, err = r.Discard(len(terminator))
+
+	return true, err
+}
+
+func str(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func integer(v interface{}) int64 {
+	switch t := v.(type) {
+	case int32:
+		return int64(t)
+	case int64:
+		return t
+	case float64:
+		return int64(t)
+	}
+
+	return 0
+}
@@ -0,0 +1,216 @@
+package dump
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	bsonSuffix     = ".bson"
+	gzipSuffix     = ".gz"
+	metadataSuffix = ".metadata.json"
+)
+
+// Collection is a collection of a mongodump output directory
+// (<dir>/<db>/<collection>.bson, optionally gzipped)
+type Collection struct {
+	DB         string
+	Collection string
+
+	// Path of the collection's .bson(.gz) file
+	File string
+	Gzip bool
+
+	// Path of the collection's .metadata.json(.gz) file; empty if there is none
+	MetadataFile string
+}
+
+// Namespace returns "<db>.<collection>"
+func (c *Collection) Namespace() string {
+	return c.DB + "." + c.Collection
+}
+
+// ReadDir lists the collections of a mongodump output directory, sorted by
+// namespace. dir is either the output directory (holding one directory per
+// database) or the directory of a single database. Collections without a
+// .bson file (ie. views) and the oplog (mongodump --oplog) are not listed.
+func ReadDir(dir string) ([]*Collection, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read dump directory")
+	}
+
+	collections, err := readDB(dir, filepath.Base(filepath.Clean(dir)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		db, err := readDB(filepath.Join(dir, e.Name()), e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		collections = append(collections, db...)
+	}
+
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Namespace() < collections[j].Namespace() })
+
+	return collections, nil
+}
+
+// readDB lists the collections in the directory of database db
+func readDB(dir, db string) ([]*Collection, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read database directory '%s'", dir)
+	}
+
+	files := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		files[e.Name()] = struct{}{}
+	}
+
+	var collections []*Collection
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || name == "oplog"+bsonSuffix {
+			continue
+		}
+
+		gz := strings.HasSuffix(name, bsonSuffix+gzipSuffix)
+		if !gz && !strings.HasSuffix(name, bsonSuffix) {
+			continue
+		}
+
+		base := strings.TrimSuffix(strings.TrimSuffix(name, gzipSuffix), bsonSuffix)
+
+		// mongodump escapes collection names that are not valid file names
+		collection, err := url.PathUnescape(base)
+		if err != nil {
+			collection = base
+		}
+
+		c := &Collection{
+			DB:         db,
+			Collection: collection,
+			File:       filepath.Join(dir, name),
+			Gzip:       gz,
+		}
+
+		for _, md := range []string{base + metadataSuffix, base + metadataSuffix + gzipSuffix} {
+			if _, ok := files[md]; ok {
+				c.MetadataFile = filepath.Join(dir, md)
+				break
+			}
+		}
+
+		collections = append(collections, c)
+	}
+
+	return collections, nil
+}
+
+// Open opens the collection's .bson file, decompressing it if it is gzipped
+func (c *Collection) Open() (io.ReadCloser, error) {
+	return OpenFile(c.File, c.Gzip)
+}
+
+// ReadMetadata reads the collection's metadata; nil if it has no metadata
+// file
+func (c *Collection) ReadMetadata() (*Metadata, error) {
+	if c.MetadataFile == "" {
+		return nil, nil
+	}
+
+	r, err := OpenFile(c.MetadataFile, strings.HasSuffix(c.MetadataFile, gzipSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read metadata file '%s'", c.MetadataFile)
+	}
+
+	md, err := ParseMetadata(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse metadata file '%s'", c.MetadataFile)
+	}
+
+	return md, nil
+}
+
+// gzipFile closes both the gzip reader and the underlying file
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// OpenFile opens a file of a dump, decompressing it if gz is set
+func OpenFile(file string, gz bool) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open '%s'", file)
+	}
+
+	if !gz {
+		return f, nil
+	}
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "unable to create gzip reader for '%s'", file)
+	}
+
+	return &gzipFile{Reader: zr, f: f}, nil
+}
+
+// SizeHint returns the uncompressed size of a gzipped file as recorded in its
+// trailer. It is only a hint: the trailer holds the size mod 2^32 of the last
+// gzip member only.
+func SizeHint(file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to open '%s'", file)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to stat '%s'", file)
+	}
+
+	if info.Size() < 4 {
+		return 0, nil
+	}
+
+	var trailer [4]byte
+
+	if _, err := f.ReadAt(trailer[:], info.Size()-4); err != nil {
+		return 0, errors.Wrapf(err, "unable to read the gzip trailer of '%s'", file)
+	}
+
+	return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
@@ -0,0 +1,231 @@
+// Package dump reads the formats written by mongodump: output directories,
+// collection metadata (<collection>.metadata.json, also embedded in archives)
+// and the multiplexed --archive format.
+package dump
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/ejson"
+)
+
+// Metadata describes a dumped collection
+type Metadata struct {
+	CollectionName string
+	Type           string // "collection", "view", "timeseries"; empty in older dumps
+	UUID           string
+	Options        map[string]interface{}
+	Indexes        []*Index
+}
+
+// Index is an index of a dumped collection
+type Index struct {
+	Name   string
+	Key    []IndexKey
+	Unique bool
+	Sparse bool
+
+	// Set for partial indexes; such indexes only cover some documents
+	PartialFilter map[string]interface{}
+}
+
+// IndexKey is a single field of an index key, in index order
+type IndexKey struct {
+	Field string
+
+	// 1/-1 for ascending/descending indexes, otherwise the index type (ie.
+	// "text", "2dsphere", "hashed")
+	Direction interface{}
+}
+
+// String returns the key as it is shown by the mongo shell (ie. "{a: 1, b: -1}")
+func (i *Index) String() string {
+	fields := make([]string, 0, len(i.Key))
+
+	for _, k := range i.Key {
+		fields = append(fields, fmt.Sprintf("%s: %v", k.Field, k.Direction))
+	}
+
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// Fields returns the names of the index's key fields
+func (i *Index) Fields() []string {
+	fields := make([]string, 0, len(i.Key))
+
+	for _, k := range i.Key {
+		fields = append(fields, k.Field)
+	}
+
+	return fields
+}
+
+// Plain reports whether the index is an ascending/descending index over
+// whole documents (ie. not a text, geo, hashed, sparse or partial index)
+func (i *Index) Plain() bool {
+	if i.Sparse || i.PartialFilter != nil {
+		return false
+	}
+
+	for _, k := range i.Key {
+		switch d := k.Direction.(type) {
+		case int32, int64, float64:
+			if fmt.Sprint(d) != "1" && fmt.Sprint(d) != "-1" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return len(i.Key) > 0
+}
+
+// ParseMetadata parses metadata in mongodump's (Extended JSON) format
+func ParseMetadata(data []byte) (*Metadata, error) {
+	var raw struct {
+		CollectionName string            `json:"collectionName"`
+		Type           string            `json:"type"`
+		UUID           string            `json:"uuid"`
+		Options        json.RawMessage   `json:"options"`
+		Indexes        []json.RawMessage `json:"indexes"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrap(err, "unable to decode metadata")
+	}
+
+	md := &Metadata{
+		CollectionName: raw.CollectionName,
+		Type:           raw.Type,
+		UUID:           raw.UUID,
+	}
+
+	if len(raw.Options) > 0 {
+		options, err := decode(raw.Options)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decode options")
+		}
+
+		md.Options, _ = options.(map[string]interface{})
+	}
+
+	for i, data := range raw.Indexes {
+		index, err := parseIndex(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode index %d", i)
+		}
+
+		md.Indexes = append(md.Indexes, index)
+	}
+
+	return md, nil
+}
+
+func parseIndex(data []byte) (*Index, error) {
+	var raw struct {
+		Name          string          `json:"name"`
+		Key           json.RawMessage `json:"key"`
+		Unique        interface{}     `json:"unique"`
+		Sparse        interface{}     `json:"sparse"`
+		PartialFilter json.RawMessage `json:"partialFilterExpression"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	key, err := parseIndexKey(raw.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode key")
+	}
+
+	index := &Index{
+		Name:   raw.Name,
+		Key:    key,
+		Unique: truthy(raw.Unique),
+		Sparse: truthy(raw.Sparse),
+	}
+
+	if len(raw.PartialFilter) > 0 {
+		filter, err := decode(raw.PartialFilter)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decode partialFilterExpression")
+		}
+
+		index.PartialFilter, _ = filter.(map[string]interface{})
+	}
+
+	return index, nil
+}
+
+// parseIndexKey decodes an index key document, keeping the order of its
+// fields
+func parseIndexKey(data []byte) ([]IndexKey, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("key is not an object")
+	}
+
+	var key []IndexKey
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		field, _ := t.(string)
+
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+
+		direction, err := ejson.Unwrap(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if n, ok := direction.(json.Number); ok {
+			direction, _ = n.Float64()
+		}
+
+		key = append(key, IndexKey{Field: field, Direction: direction})
+	}
+
+	return key, nil
+}
+
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return ejson.Unwrap(v)
+}
+
+// truthy interprets an index option the way the server does (ie. unique: 1)
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case nil:
+		return false
+	}
+
+	return true
+}
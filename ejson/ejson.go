@@ -0,0 +1,343 @@
+// Package ejson unwraps MongoDB Extended JSON (canonical and relaxed, v1 and
+// v2) type wrappers such as {"$oid": "..."} or {"$numberLong": "..."} into
+// typed values. Input is a document decoded by encoding/json (with UseNumber).
+package ejson
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+// Unwrap recursively replaces Extended JSON wrappers in v with typed values:
+//
+//	{"$oid": ...}                                 -> bson.ObjectID
+//	{"$date": ...}                                -> time.Time
+//	{"$numberInt": ...}                           -> int32
+//	{"$numberLong": ...}                          -> int64
+//	{"$numberDouble": ...}                        -> float64
+//	{"$numberDecimal": ...}                       -> bson.Decimal128
+//	{"$binary": ...}, {"$uuid": ...}              -> bson.Binary
+//	{"$timestamp": ...}                           -> bson.Timestamp
+//	{"$regularExpression": ...}, {"$regex": ...}  -> bson.Regex
+//	{"$code": ...}                                -> bson.JavaScript
+//	{"$symbol": ...}                              -> string
+//	{"$minKey": 1}, {"$maxKey": 1}                -> bson.MinKey, bson.MaxKey
+//	{"$undefined": true}                          -> nil
+//
+// Objects that merely contain "$"-prefixed keys but are not wrappers are left as is.
+func Unwrap(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if typed, ok, err := unwrapValue(t); ok || err != nil {
+			return typed, err
+		}
+
+		for k, e := range t {
+			unwrapped, err := Unwrap(e)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field '%s'", k)
+			}
+
+			t[k] = unwrapped
+		}
+
+		return t, nil
+	case []interface{}:
+		for i, e := range t {
+			unwrapped, err := Unwrap(e)
+			if err != nil {
+				return nil, errors.Wrapf(err, "element %d", i)
+			}
+
+			t[i] = unwrapped
+		}
+
+		return t, nil
+	default:
+		return v, nil
+	}
+}
+
+// unwrapValue returns ok = true if m is an Extended JSON wrapper
+func unwrapValue(m map[string]interface{}) (interface{}, bool, error) {
+	if len(m) == 0 || len(m) > 2 {
+		return nil, false, nil
+	}
+
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false, nil
+		}
+	}
+
+	if len(m) == 2 {
+		// Legacy (v1) wrappers
+		switch {
+		case has(m, "$binary", "$type"):
+			data, ok1 := m["$binary"].(string)
+			subtype, ok2 := m["$type"].(string)
+
+			if !ok1 || !ok2 {
+				return nil, false, nil
+			}
+
+			b, err := binary(data, subtype)
+			return b, true, err
+		case has(m, "$regex", "$options"):
+			pattern, ok1 := m["$regex"].(string)
+			options, ok2 := m["$options"].(string)
+
+			if !ok1 || !ok2 {
+				return nil, false, nil
+			}
+
+			return bson.Regex{Pattern: pattern, Options: options}, true, nil
+		case has(m, "$code", "$scope"):
+			code, ok := m["$code"].(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			return bson.JavaScript(code), true, nil
+		}
+
+		return nil, false, nil
+	}
+
+	for k, v := range m {
+		switch k {
+		case "$oid":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			oid, err := bson.ObjectIDFromHex(s)
+			return oid, true, err
+		case "$date":
+			t, err := date(v)
+			return t, true, err
+		case "$numberInt":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			i, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				return nil, true, errors.Errorf("invalid $numberInt '%s'", s)
+			}
+
+			return int32(i), true, nil
+		case "$numberLong":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, true, errors.Errorf("invalid $numberLong '%s'", s)
+			}
+
+			return i, true, nil
+		case "$numberDouble":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			f, err := double(s)
+			return f, true, err
+		case "$numberDecimal":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			d, err := bson.ParseDecimal128(s)
+			return d, true, err
+		case "$binary":
+			inner, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+
+			data, ok1 := inner["base64"].(string)
+			subtype, ok2 := inner["subType"].(string)
+
+			if !ok1 || !ok2 {
+				return nil, true, errors.New("invalid $binary; expected base64 and subType")
+			}
+
+			b, err := binary(data, subtype)
+			return b, true, err
+		case "$uuid":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			data, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+			if err != nil || len(data) != 16 {
+				return nil, true, errors.Errorf("invalid $uuid '%s'", s)
+			}
+
+			return bson.Binary{Subtype: bson.BinaryUUID, Data: data}, true, nil
+		case "$timestamp":
+			inner, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+
+			t, err1 := uint32Value(inner["t"])
+			i, err2 := uint32Value(inner["i"])
+
+			if err1 != nil || err2 != nil {
+				return nil, true, errors.New("invalid $timestamp; expected t and i")
+			}
+
+			return bson.Timestamp{T: t, I: i}, true, nil
+		case "$regularExpression":
+			inner, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+
+			pattern, ok1 := inner["pattern"].(string)
+			options, ok2 := inner["options"].(string)
+
+			if !ok1 || !ok2 {
+				return nil, true, errors.New("invalid $regularExpression; expected pattern and options")
+			}
+
+			return bson.Regex{Pattern: pattern, Options: options}, true, nil
+		case "$code":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			return bson.JavaScript(s), true, nil
+		case "$symbol":
+			s, ok := v.(string)
+			if !ok {
+				return nil, false, nil
+			}
+
+			return s, true, nil
+		case "$minKey":
+			return bson.MinKey{}, true, nil
+		case "$maxKey":
+			return bson.MaxKey{}, true, nil
+		case "$undefined":
+			return nil, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// date handles relaxed ({"$date": "<iso-8601>"}), canonical
+// ({"$date": {"$numberLong": "<millis>"}}) and legacy ({"$date": <millis>}) dates
+func date(v interface{}) (time.Time, error) {
+	var millis int64
+
+	switch t := v.(type) {
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return time.Time{}, errors.Errorf("invalid $date '%s'", t)
+		}
+
+		return parsed.UTC(), nil
+	case json.Number:
+		i, err := t.Int64()
+		if err != nil {
+			return time.Time{}, errors.Errorf("invalid $date '%s'", t)
+		}
+
+		millis = i
+	case map[string]interface{}:
+		s, ok := t["$numberLong"].(string)
+		if !ok || len(t) != 1 {
+			return time.Time{}, errors.New("invalid $date; expected {\"$numberLong\": \"...\"}")
+		}
+
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Errorf("invalid $date '%s'", s)
+		}
+
+		millis = i
+	default:
+		return time.Time{}, errors.Errorf("invalid $date '%v'", v)
+	}
+
+	return time.UnixMilli(millis).UTC(), nil
+}
+
+func double(s string) (float64, error) {
+	switch s {
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid $numberDouble '%s'", s)
+	}
+
+	return f, nil
+}
+
+func binary(data, subtype string) (bson.Binary, error) {
+	st, err := strconv.ParseUint(subtype, 16, 8)
+	if err != nil {
+		return bson.Binary{}, errors.Errorf("invalid $binary subType '%s'", subtype)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return bson.Binary{}, errors.Errorf("invalid $binary base64 '%s'", data)
+	}
+
+	return bson.Binary{Subtype: byte(st), Data: b}, nil
+}
+
+func uint32Value(v interface{}) (uint32, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, errors.Errorf("expected a number, got '%v'", v)
+	}
+
+	i, err := strconv.ParseUint(n.String(), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(i), nil
+}
+
+func has(m map[string]interface{}, keys ...string) bool {
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
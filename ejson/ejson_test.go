@@ -0,0 +1,157 @@
+package ejson
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dselans/mmmbop/bson"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	t.Helper()
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+
+	return v
+}
+
+func decimal(t *testing.T, s string) bson.Decimal128 {
+	t.Helper()
+
+	d, err := bson.ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestUnwrap(t *testing.T) {
+	oid := bson.ObjectID{0x50, 0x7f, 0x1f, 0x77, 0xbc, 0xf8, 0x6c, 0xd7, 0x99, 0x43, 0x90, 0x11}
+	date := time.Date(2024, 5, 6, 7, 8, 9, 123000000, time.UTC)
+
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+	}{
+		// $numberLong: canonical is wrapped, relaxed is a plain number
+		{"long canonical", `{"$numberLong": "9007199254740993"}`, int64(9007199254740993)},
+		{"long canonical negative", `{"$numberLong": "-9223372036854775808"}`, int64(math.MinInt64)},
+		{"long relaxed", `9007199254740993`, json.Number("9007199254740993")},
+		{"int canonical", `{"$numberInt": "-7"}`, int32(-7)},
+		{"double canonical", `{"$numberDouble": "-1.5"}`, -1.5},
+		{"double infinity", `{"$numberDouble": "-Infinity"}`, math.Inf(-1)},
+
+		// $numberDecimal has no relaxed form
+		{"decimal", `{"$numberDecimal": "1.50"}`, decimal(t, "1.50")},
+		{"decimal exponent", `{"$numberDecimal": "-1.5E+3"}`, decimal(t, "-1.5E+3")},
+
+		// $date: relaxed ISO-8601, canonical and legacy milliseconds
+		{"date relaxed", `{"$date": "2024-05-06T07:08:09.123Z"}`, date},
+		{"date relaxed offset", `{"$date": "2024-05-06T09:08:09.123+02:00"}`, date},
+		{"date canonical", `{"$date": {"$numberLong": "1714979289123"}}`, date},
+		{"date canonical before epoch", `{"$date": {"$numberLong": "-1"}}`, time.UnixMilli(-1).UTC()},
+		{"date legacy", `{"$date": 1714979289123}`, date},
+
+		{"oid", `{"$oid": "507f1f77bcf86cd799439011"}`, oid},
+
+		// $binary: v2 and legacy v1
+		{"binary", `{"$binary": {"base64": "3q0=", "subType": "00"}}`, bson.Binary{Subtype: bson.BinaryGeneric, Data: []byte{0xde, 0xad}}},
+		{"binary uuid", `{"$binary": {"base64": "AAECAwQFBgcICQoLDA0ODw==", "subType": "04"}}`,
+			bson.Binary{Subtype: bson.BinaryUUID, Data: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}}},
+		{"binary user subtype", `{"$binary": {"base64": "", "subType": "80"}}`, bson.Binary{Subtype: 0x80, Data: []byte{}}},
+		{"binary legacy", `{"$binary": "3q0=", "$type": "00"}`, bson.Binary{Subtype: bson.BinaryGeneric, Data: []byte{0xde, 0xad}}},
+		{"uuid", `{"$uuid": "00010203-0405-0607-0809-0a0b0c0d0e0f"}`,
+			bson.Binary{Subtype: bson.BinaryUUID, Data: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}}},
+
+		{"timestamp", `{"$timestamp": {"t": 1700000000, "i": 3}}`, bson.Timestamp{T: 1700000000, I: 3}},
+		{"regex", `{"$regularExpression": {"pattern": "^a", "options": "i"}}`, bson.Regex{Pattern: "^a", Options: "i"}},
+		{"regex legacy", `{"$regex": "^a", "$options": "i"}`, bson.Regex{Pattern: "^a", Options: "i"}},
+		{"code", `{"$code": "return 1"}`, bson.JavaScript("return 1")},
+		{"code with scope", `{"$code": "return x", "$scope": {"x": 1}}`, bson.JavaScript("return x")},
+		{"symbol", `{"$symbol": "sym"}`, "sym"},
+		{"min key", `{"$minKey": 1}`, bson.MinKey{}},
+		{"max key", `{"$maxKey": 1}`, bson.MaxKey{}},
+		{"undefined", `{"$undefined": true}`, nil},
+
+		// Nested arrays and objects are unwrapped recursively
+		{"nested", `{"a": [{"$numberLong": "1"}, [{"$oid": "507f1f77bcf86cd799439011"}]], "b": {"c": {"$date": {"$numberLong": "1714979289123"}}, "d": "x"}}`,
+			map[string]interface{}{
+				"a": []interface{}{int64(1), []interface{}{oid}},
+				"b": map[string]interface{}{"c": date, "d": "x"},
+			}},
+		{"array of wrappers", `[{"$numberInt": "1"}, null, "s", {"$numberDecimal": "0.1"}]`, []interface{}{int32(1), nil, "s", decimal(t, "0.1")}},
+
+		// Objects with "$" keys that are not wrappers are left as is
+		{"unknown dollar key", `{"$foo": {"$numberLong": "1"}}`, map[string]interface{}{"$foo": int64(1)}},
+		{"wrapper key with wrong type", `{"$oid": 1}`, map[string]interface{}{"$oid": json.Number("1")}},
+		{"mixed keys", `{"$oid": "507f1f77bcf86cd799439011", "x": 1}`,
+			map[string]interface{}{"$oid": "507f1f77bcf86cd799439011", "x": json.Number("1")}},
+		{"three dollar keys", `{"$binary": "3q0=", "$type": "00", "$x": 1}`,
+			map[string]interface{}{"$binary": "3q0=", "$type": "00", "$x": json.Number("1")}},
+		{"empty object", `{}`, map[string]interface{}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Unwrap(decode(t, tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnwrapNaN(t *testing.T) {
+	got, err := Unwrap(decode(t, `{"$numberDouble": "NaN"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f, ok := got.(float64); !ok || !math.IsNaN(f) {
+		t.Fatalf("got %#v, want NaN", got)
+	}
+}
+
+func TestUnwrapErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"$numberLong": "1.5"}`,
+		`{"$numberLong": "9223372036854775808"}`,
+		`{"$numberInt": "2147483648"}`,
+		`{"$numberDouble": "abc"}`,
+		`{"$numberDecimal": "abc"}`,
+		`{"$date": "2024-05-06"}`,
+		`{"$date": {"$numberLong": "x"}}`,
+		`{"$date": {"$numberLong": "1", "x": 1}}`,
+		`{"$date": 1.5}`,
+		`{"$date": true}`,
+		`{"$oid": "507f1f77"}`,
+		`{"$oid": "zz7f1f77bcf86cd799439011"}`,
+		`{"$binary": {"base64": "3q0="}}`,
+		`{"$binary": {"base64": "!", "subType": "00"}}`,
+		`{"$binary": {"base64": "3q0=", "subType": "100"}}`,
+		`{"$uuid": "0001"}`,
+		`{"$timestamp": {"t": -1, "i": 0}}`,
+		`{"$regularExpression": {"pattern": "a"}}`,
+		`{"a": [1, {"$numberLong": "x"}]}`,
+	} {
+		if v, err := Unwrap(decode(t, in)); err == nil {
+			t.Errorf("Unwrap(%s) = %#v, want an error", in, v)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package expr
+
+import (
+	"cmp"
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/conv"
+)
+
+type node interface {
+	eval(resolve Resolver) (interface{}, error)
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n *literalNode) eval(_ Resolver) (interface{}, error) {
+	return n.val, nil
+}
+
+type fieldNode struct {
+	path string
+}
+
+// Missing fields evaluate to null
+func (n *fieldNode) eval(resolve Resolver) (interface{}, error) {
+	v, _ := resolve(n.path)
+	return v, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(resolve Resolver) (interface{}, error) {
+	v, err := n.operand.eval(resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "!":
+		return !truthy(v), nil
+	case "-":
+		if v == nil {
+			return nil, nil
+		}
+
+		if i, ok := toInt(v); ok && i != math.MinInt64 {
+			return -i, nil
+		}
+
+		f, err := conv.Convert("float", v)
+		if err != nil {
+			return nil, errors.Wrap(err, "unary '-'")
+		}
+
+		return normalize(-f.(float64)), nil
+	}
+
+	return nil, errors.Errorf("unknown operator '%s'", n.op)
+}
+
+type binaryNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *binaryNode) eval(resolve Resolver) (interface{}, error) {
+	left, err := n.left.eval(resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit logical operators
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+
+		right, err := n.right.eval(resolve)
+		if err != nil {
+			return nil, err
+		}
+
+		return truthy(right), nil
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+
+		right, err := n.right.eval(resolve)
+		if err != nil {
+			return nil, err
+		}
+
+		return truthy(right), nil
+	}
+
+	right, err := n.right.eval(resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n.op, left, right)
+	case "+":
+		// String concatenation if either side is a string
+		_, ls := left.(string)
+		_, rs := right.(string)
+
+		if ls || rs {
+			return toString(left) + toString(right), nil
+		}
+
+		return arithmetic(n.op, left, right)
+	case "-", "*", "/", "%":
+		return arithmetic(n.op, left, right)
+	}
+
+	return nil, errors.Errorf("unknown operator '%s'", n.op)
+}
+
+type callNode struct {
+	name string
+	fn   *function
+	args []node
+}
+
+func (n *callNode) eval(resolve Resolver) (interface{}, error) {
+	// Lazy functions (ie. if()) evaluate their own arguments
+	if n.fn.lazy != nil {
+		v, err := n.fn.lazy(resolve, n.args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s()", n.name)
+		}
+
+		return v, nil
+	}
+
+	args := make([]interface{}, len(n.args))
+
+	for i, a := range n.args {
+		v, err := a.eval(resolve)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = v
+	}
+
+	v, err := n.fn.call(args)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s()", n.name)
+	}
+
+	return v, nil
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+
+	if f, ok := toNumber(v); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+func equal(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	if ai, bi, ok := toInts(a, b); ok {
+		return ai == bi
+	}
+
+	af, aok := toNumber(a)
+	bf, bok := toNumber(b)
+
+	if aok && bok {
+		return af == bf
+	}
+
+	_, as := a.(string)
+	_, bs := b.(string)
+
+	if as || bs {
+		return as && bs && a.(string) == b.(string)
+	}
+
+	if ab, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		return ok && ab == bb
+	}
+
+	return toString(a) == toString(b)
+}
+
+func compare(op string, a, b interface{}) (interface{}, error) {
+	if a == nil || b == nil {
+		return false, nil
+	}
+
+	var c int
+
+	ai, bi, iok := toInts(a, b)
+	af, aok := toNumber(a)
+	bf, bok := toNumber(b)
+
+	switch {
+	case iok:
+		c = cmp.Compare(ai, bi)
+	case aok && bok:
+		switch {
+		case af < bf:
+			c = -1
+		case af > bf:
+			c = 1
+		}
+	default:
+		c = strings.Compare(toString(a), toString(b))
+	}
+
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	if a == nil || b == nil {
+		return nil, nil
+	}
+
+	// Integers (ie. NumberLong ids) would lose precision above 2^53 as floats
+	if ai, bi, ok := toInts(a, b); ok {
+		return intArithmetic(op, ai, bi)
+	}
+
+	af, aok := toNumber(a)
+	bf, bok := toNumber(b)
+
+	if !aok || !bok {
+		return nil, errors.Errorf("operator '%s' requires numbers, got '%T' and '%T'", op, a, b)
+	}
+
+	switch op {
+	case "+":
+		return normalize(af + bf), nil
+	case "-":
+		return normalize(af - bf), nil
+	case "*":
+		return normalize(af * bf), nil
+	case "/":
+		if bf == 0 {
+			return nil, errors.New("division by zero")
+		}
+
+		return normalize(af / bf), nil
+	default:
+		if bf == 0 {
+			return nil, errors.New("division by zero")
+		}
+
+		return normalize(math.Mod(af, bf)), nil
+	}
+}
+
+// intArithmetic is arithmetic for two integers; results that do not fit in an
+// int64 are an error. Division only returns an integer if there is no
+// remainder.
+func intArithmetic(op string, a, b int64) (interface{}, error) {
+	switch op {
+	case "+":
+		if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+			return nil, errors.Errorf("integer overflow in %d + %d", a, b)
+		}
+
+		return a + b, nil
+	case "-":
+		if (b < 0 && a > math.MaxInt64+b) || (b > 0 && a < math.MinInt64+b) {
+			return nil, errors.Errorf("integer overflow in %d - %d", a, b)
+		}
+
+		return a - b, nil
+	case "*":
+		if a != 0 && b != 0 {
+			p := a * b
+			if p/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+				return nil, errors.Errorf("integer overflow in %d * %d", a, b)
+			}
+
+			return p, nil
+		}
+
+		return int64(0), nil
+	case "/":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+
+		if a == math.MinInt64 && b == -1 {
+			return nil, errors.Errorf("integer overflow in %d / %d", a, b)
+		}
+
+		if a%b == 0 {
+			return a / b, nil
+		}
+
+		return normalize(float64(a) / float64(b)), nil
+	default:
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+
+		return a % b, nil
+	}
+}
+
+// normalize returns integral floats as int64 so that (ie.) 1 + 1 is "2", not "2.0"
+func normalize(f float64) interface{} {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+
+	return f
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case json.Number, int, int32, int64, float32, float64:
+		f, err := conv.Convert("float", t)
+		if err != nil {
+			return 0, false
+		}
+
+		return f.(float64), true
+	}
+
+	return 0, false
+}
+
+// toInt returns v as an int64 if it is an integer (not a float, even an
+// integral one)
+func toInt(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	case json.Number:
+		i, err := t.Int64()
+		return i, err == nil
+	}
+
+	return 0, false
+}
+
+func toInts(a, b interface{}) (int64, int64, bool) {
+	ai, aok := toInt(a)
+	bi, bok := toInt(b)
+
+	return ai, bi, aok && bok
+}
+
+func toString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	s, err := conv.Convert("string", v)
+	if err != nil {
+		return ""
+	}
+
+	return s.(string)
+}
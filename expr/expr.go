@@ -0,0 +1,73 @@
+// Package expr implements a small, sandboxed expression language used for
+// derived columns in mappings (ie. `expr = "lower(concat(first, ' ', last))"`).
+//
+// Expressions can only read fields from the document they are evaluated
+// against and call the built-in functions (see functions.go); they cannot
+// loop, perform I/O or otherwise touch anything outside of the document.
+//
+// Syntax:
+//
+//	literals     "str", 'str', 123, 1.5, true, false, null
+//	fields       foo, foo.bar, items.0.sku, `field with spaces`
+//	operators    + - * / % == != < <= > >= && || !
+//	functions    concat(a, b, ...), coalesce(a, b, ...), if(cond, a, b) ...
+package expr
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Resolver returns the value of the field at path and whether it was found
+type Resolver func(path string) (interface{}, bool)
+
+// Program is a compiled expression
+type Program struct {
+	src    string
+	root   node
+	fields []string
+}
+
+// Compile parses src and validates function names and arity so that errors
+// surface when the config is loaded rather than part way through a migration.
+func Compile(src string) (*Program, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse expression '%s'", src)
+	}
+
+	p := &parser{tokens: tokens}
+
+	root, err := p.parseExpr(1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse expression '%s'", src)
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, errors.Errorf("unable to parse expression '%s': unexpected '%s' at position %d", src, t.val, t.pos)
+	}
+
+	return &Program{
+		src:    src,
+		root:   root,
+		fields: p.fields,
+	}, nil
+}
+
+// Eval evaluates the program; fields are looked up via resolve
+func (p *Program) Eval(resolve Resolver) (interface{}, error) {
+	v, err := p.root.eval(resolve)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to evaluate expression '%s'", p.src)
+	}
+
+	return v, nil
+}
+
+// Fields returns the field paths referenced by the program
+func (p *Program) Fields() []string {
+	return p.fields
+}
+
+func (p *Program) String() string {
+	return p.src
+}
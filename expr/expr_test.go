@@ -0,0 +1,293 @@
+package expr
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dselans/mmmbop/docpath"
+)
+
+const testDoc = `{
+	"first": "Tom",
+	"last": "Anderson",
+	"age": 37,
+	"score": 1.5,
+	"id": 9007199254740993,
+	"name": {"first": "Tom", "last": "Anderson"},
+	"children": ["Sara", "Alex", "Jack"],
+	"first name": "Tom A.",
+	"empty": "",
+	"nothing": null
+}`
+
+func resolver(t *testing.T) Resolver {
+	t.Helper()
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(testDoc)))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	return func(path string) (interface{}, bool) {
+		return docpath.Get(doc, path)
+	}
+}
+
+func eval(t *testing.T, resolve Resolver, src string) (interface{}, error) {
+	t.Helper()
+
+	p, err := Compile(src)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", src, err)
+	}
+
+	return p.Eval(resolve)
+}
+
+func TestEval(t *testing.T) {
+	resolve := resolver(t)
+
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// Literals and fields
+		{`"a\"b"`, `a"b`},
+		{`'it\'s\n'`, "it's\n"},
+		{`123`, json.Number("123")},
+		{`true`, true},
+		{`null`, nil},
+		{`first`, "Tom"},
+		{`name.last`, "Anderson"},
+		{`children.1`, "Alex"},
+		{"`first name`", "Tom A."},
+		{`missing`, nil},
+
+		// Precedence and associativity
+		{`1 + 2 * 3`, int64(7)},
+		{`(1 + 2) * 3`, int64(9)},
+		{`10 - 4 - 3`, int64(3)},
+		{`2 * 3 % 4`, int64(2)},
+		{`1 + 2 == 3`, true},
+		{`1 < 2 == 2 < 3`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!true || true`, true},
+		{`-2 * 3`, int64(-6)},
+		{`- -2`, int64(2)},
+		{`!!1`, true},
+		{`1 + 2 + 'a'`, "3a"},
+		{`'a' + 1 + 2`, "a12"},
+
+		// Arithmetic
+		{`7 / 2`, 3.5},
+		{`6 / 3`, int64(2)},
+		{`7 % 3`, int64(1)},
+		{`-7 % 3`, int64(-1)},
+		{`1.5 * 2`, int64(3)},
+		{`score + 1`, 2.5},
+		{`0.1 + 0.2`, 0.30000000000000004},
+		{`7.5 % 2`, 1.5},
+		{`1e3 + 1`, int64(1001)},
+		{`age - 7`, int64(30)},
+
+		// Integers are exact beyond 2^53
+		{`id + 1`, int64(9007199254740994)},
+		{`id - 1`, int64(9007199254740992)},
+		{`id * 1`, int64(9007199254740993)},
+		{`id / 1`, int64(9007199254740993)},
+		{`-id`, int64(-9007199254740993)},
+		{`id == 9007199254740992`, false},
+		{`id > 9007199254740992`, true},
+		{`9223372036854775807 - 1`, int64(math.MaxInt64 - 1)},
+		{`-9223372036854775807 - 1`, int64(math.MinInt64)},
+		{`-9223372036854775807 * -1`, int64(math.MaxInt64)},
+
+		// Comparisons
+		{`'b' > 'a'`, true},
+		{`2 < 10`, true},
+		{`'2' < '10'`, false},
+		{`'1' == 1`, false},
+		{`age == 37.0`, true},
+		{`age >= 37`, true},
+		{`age != 37`, false},
+		{`true == 1`, false},
+
+		// Null propagation
+		{`missing + 1`, nil},
+		{`1 - nothing`, nil},
+		{`-missing`, nil},
+		{`null * 2`, nil},
+		{`missing == null`, true},
+		{`missing != 0`, true},
+		{`missing < 1`, false},
+		{`missing >= 1`, false},
+		{`!missing`, true},
+		{`missing && true`, false},
+		{`missing || 'x'`, true},
+		{`missing + 'x'`, "x"},
+		{`!empty`, true},
+
+		// Functions
+		{`concat(1, 'a', true, null, missing)`, "1atrue"},
+		{`concat(first, ' ', last)`, "Tom Anderson"},
+		{`coalesce(null, missing, 'x', 'y')`, "x"},
+		{`coalesce(null, missing)`, nil},
+		{`if(age >= 18, 'adult', 'minor')`, "adult"},
+		{`if(false, 'y')`, nil},
+		{`if(true, 'y', 1 / 0)`, "y"},
+		{`if(false, 1 / 0, 'n')`, "n"},
+		{`lower('AbC')`, "abc"},
+		{`upper('AbC')`, "ABC"},
+		{`trim('  a b  ')`, "a b"},
+		{`lower(missing)`, nil},
+		{`md5('abc')`, "900150983cd24fb0d6963f7d28e17f72"},
+		{`sha1('abc')`, "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{`sha256('abc')`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{`sha256(missing)`, nil},
+		{`replace('a-b-c', '-', '+')`, "a+b+c"},
+		{`replace(missing, 'a', 'b')`, nil},
+		{`substr('héllo', 1, 3)`, "éll"},
+		{`substr('abc', 1)`, "bc"},
+		{`substr('abc', -1)`, "abc"},
+		{`substr('abc', 5)`, ""},
+		{`substr('abc', 2, -5)`, ""},
+		{`substr(missing, 1)`, nil},
+		{`len('héllo')`, int64(5)},
+		{`len(children)`, int64(3)},
+		{`len(name)`, int64(2)},
+		{`len(missing)`, int64(0)},
+		{`string(12)`, "12"},
+		{`int('42')`, int64(42)},
+		{`float('1.5')`, 1.5},
+		{`bool('true')`, true},
+		{`lower(concat(substr(first, 0, 1), last))`, "tanderson"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got, err := eval(t, resolve, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	resolve := resolver(t)
+
+	for _, src := range []string{
+		`1 / 0`,
+		`1 % 0`,
+		`1.5 / 0`,
+		`1 - 'a'`,
+		`first * 2`,
+		`-'a'`,
+		`9223372036854775807 + 1`,
+		`-9223372036854775807 - 2`,
+		`id * id`,
+		`(-9223372036854775807 - 1) / -1`,
+		`(-9223372036854775807 - 1) * -1`,
+		`substr('abc', 'x')`,
+		`substr('abc', 0, 'x')`,
+		`int('x')`,
+		`if(true, 1 / 0)`,
+		`concat(1 / 0)`,
+	} {
+		if v, err := eval(t, resolve, src); err == nil {
+			t.Errorf("Eval(%q) = %#v, want an error", src, v)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`1 +`,
+		`(1`,
+		`1)`,
+		`()`,
+		`lower(`,
+		`nofn(1)`,
+		`lower()`,
+		`lower(1, 2)`,
+		`if(1)`,
+		`if(1, 2, 3, 4)`,
+		`replace('a', 'b')`,
+		`concat()`,
+		`concat(1,)`,
+		`concat(,1)`,
+		`'abc`,
+		`"abc\`,
+		"`field",
+		`1 @ 2`,
+		`1.2.3`,
+		`a b`,
+		`1 2`,
+		`* 1`,
+		`,`,
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("Compile(%q) did not fail", src)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	resolve := resolver(t)
+
+	tests := []struct {
+		name string
+		src  func(n int) string
+	}{
+		{"parentheses", func(n int) string { return strings.Repeat("(", n) + "1" + strings.Repeat(")", n) }},
+		{"not", func(n int) string { return strings.Repeat("!", n) + "true" }},
+		{"calls", func(n int) string { return strings.Repeat("lower(", n) + "'A'" + strings.Repeat(")", n) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := eval(t, resolve, tt.src(MaxDepth-1)); err != nil {
+				t.Fatalf("nesting %d levels: %v", MaxDepth-1, err)
+			}
+
+			if _, err := Compile(tt.src(MaxDepth)); err == nil {
+				t.Fatalf("nesting %d levels did not fail", MaxDepth)
+			}
+		})
+	}
+
+	// Long chains of operators are not nested
+	v, err := eval(t, resolve, strings.TrimSuffix(strings.Repeat("1 + ", 1000), " + "))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != int64(1000) {
+		t.Fatalf("got %#v, want 1000", v)
+	}
+}
+
+func TestFields(t *testing.T) {
+	p, err := Compile("concat(name.first, `first name`, if(age > 1, last, null), 'lit', name.first)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"name.first", "first name", "age", "last", "name.first"}
+	if got := p.Fields(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
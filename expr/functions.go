@@ -0,0 +1,169 @@
+package expr
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/conv"
+)
+
+type function struct {
+	minArgs int
+	maxArgs int // -1 == variadic
+
+	// Exactly one of call or lazy is set
+	call func(args []interface{}) (interface{}, error)
+	lazy func(resolve Resolver, args []node) (interface{}, error)
+}
+
+func (f *function) arity() string {
+	switch {
+	case f.maxArgs < 0:
+		return fmt.Sprintf("expected at least %d argument(s)", f.minArgs)
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("expected %d argument(s)", f.minArgs)
+	default:
+		return fmt.Sprintf("expected %d to %d arguments", f.minArgs, f.maxArgs)
+	}
+}
+
+// Built-in functions; also see the README
+var functions = map[string]*function{
+	"concat": {minArgs: 1, maxArgs: -1, call: func(args []interface{}) (interface{}, error) {
+		var sb strings.Builder
+
+		for _, a := range args {
+			sb.WriteString(toString(a))
+		}
+
+		return sb.String(), nil
+	}},
+	"coalesce": {minArgs: 1, maxArgs: -1, call: func(args []interface{}) (interface{}, error) {
+		for _, a := range args {
+			if a != nil {
+				return a, nil
+			}
+		}
+
+		return nil, nil
+	}},
+	"if": {minArgs: 2, maxArgs: 3, lazy: func(resolve Resolver, args []node) (interface{}, error) {
+		cond, err := args[0].eval(resolve)
+		if err != nil {
+			return nil, err
+		}
+
+		if truthy(cond) {
+			return args[1].eval(resolve)
+		}
+
+		if len(args) == 3 {
+			return args[2].eval(resolve)
+		}
+
+		return nil, nil
+	}},
+	"lower": stringFunc(strings.ToLower),
+	"upper": stringFunc(strings.ToUpper),
+	"trim":  stringFunc(strings.TrimSpace),
+	"md5": stringFunc(func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}),
+	"sha1": stringFunc(func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}),
+	"sha256": stringFunc(func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}),
+	"replace": {minArgs: 3, maxArgs: 3, call: func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		return strings.ReplaceAll(toString(args[0]), toString(args[1]), toString(args[2])), nil
+	}},
+	"substr": {minArgs: 2, maxArgs: 3, call: func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		runes := []rune(toString(args[0]))
+
+		start, err := conv.Convert("int", args[1])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid start")
+		}
+
+		from := clamp(int(start.(int64)), len(runes))
+		to := len(runes)
+
+		if len(args) == 3 {
+			length, err := conv.Convert("int", args[2])
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid length")
+			}
+
+			to = clamp(from+int(length.(int64)), len(runes))
+		}
+
+		if to < from {
+			return "", nil
+		}
+
+		return string(runes[from:to]), nil
+	}},
+	"len": {minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		switch t := args[0].(type) {
+		case nil:
+			return int64(0), nil
+		case []interface{}:
+			return int64(len(t)), nil
+		case map[string]interface{}:
+			return int64(len(t)), nil
+		default:
+			return int64(len([]rune(toString(t)))), nil
+		}
+	}},
+	"string": castFunc("string"),
+	"int":    castFunc("int"),
+	"float":  castFunc("float"),
+	"bool":   castFunc("bool"),
+}
+
+// stringFunc wraps a string -> string func; null in is null out
+func stringFunc(f func(string) string) *function {
+	return &function{minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		return f(toString(args[0])), nil
+	}}
+}
+
+func castFunc(to string) *function {
+	return &function{minArgs: 1, maxArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		return conv.Convert(to, args[0])
+	}}
+}
+
+func clamp(i, max int) int {
+	if i < 0 {
+		return 0
+	}
+
+	if i > max {
+		return max
+	}
+
+	return i
+}
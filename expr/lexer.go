@@ -0,0 +1,152 @@
+package expr
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	val  string
+	pos  int
+}
+
+// Multi-character operators must come before their single character prefixes
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "!"}
+
+func lex(src string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(src)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokLParen, val: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokRParen, val: ")", pos: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokComma, val: ",", pos: i})
+			i++
+		case r == '"' || r == '\'':
+			s, n, err := lexString(runes[i:], r)
+			if err != nil {
+				return nil, errors.Wrapf(err, "position %d", i)
+			}
+
+			tokens = append(tokens, token{kind: tokString, val: s, pos: i})
+			i += n
+		case r == '`':
+			// Quoted field reference; allows any character in field names
+			s, n, err := lexString(runes[i:], r)
+			if err != nil {
+				return nil, errors.Wrapf(err, "position %d", i)
+			}
+
+			tokens = append(tokens, token{kind: tokIdent, val: s, pos: i})
+			i += n
+		case unicode.IsDigit(r):
+			start := i
+
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '-' || runes[i] == '+') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokNumber, val: string(runes[start:i]), pos: start})
+		case isIdentStart(r):
+			start := i
+
+			for i < len(runes) && isIdentPart(runes[i]) {
+				// Escaped characters (ie. "foo\.bar") are part of the identifier
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokIdent, val: string(runes[start:i]), pos: start})
+		default:
+			op := ""
+
+			for _, o := range operators {
+				if strings.HasPrefix(string(runes[i:]), o) {
+					op = o
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, errors.Errorf("unexpected character '%c' at position %d", r, i)
+			}
+
+			tokens = append(tokens, token{kind: tokOp, val: op, pos: i})
+			i += len([]rune(op))
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokEOF, pos: len(runes)})
+
+	return tokens, nil
+}
+
+// lexString reads a quoted string starting at runes[0]; returns the unquoted
+// string and the number of runes consumed.
+func lexString(runes []rune, quote rune) (string, int, error) {
+	var sb strings.Builder
+
+	for i := 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '\\':
+			if i+1 >= len(runes) {
+				return "", 0, errors.New("unterminated escape sequence")
+			}
+
+			i++
+
+			switch runes[i] {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			default:
+				sb.WriteRune(runes[i])
+			}
+		case quote:
+			return sb.String(), i + 1, nil
+		default:
+			sb.WriteRune(runes[i])
+		}
+	}
+
+	return "", 0, errors.New("unterminated string")
+}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '$'
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r) || r == '.' || r == '\\' || r == '#'
+}
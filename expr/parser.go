@@ -0,0 +1,201 @@
+package expr
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxDepth limits how deeply expressions can be nested
+	MaxDepth = 64
+)
+
+// Binary operator precedence; higher binds tighter
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+	fields []string
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, val string) error {
+	t := p.next()
+
+	if t.kind != kind {
+		if t.kind == tokEOF {
+			return errors.Errorf("expected '%s' but reached end of expression", val)
+		}
+
+		return errors.Errorf("expected '%s' at position %d, got '%s'", val, t.pos, t.val)
+	}
+
+	return nil
+}
+
+func (p *parser) parseExpr(minPrec int) (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if p.depth > MaxDepth {
+		return nil, errors.Errorf("expression nested deeper than %d levels", MaxDepth)
+	}
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+
+		prec, ok := precedence[t.val]
+		if t.kind != tokOp || !ok || prec < minPrec {
+			return left, nil
+		}
+
+		p.next()
+
+		right, err := p.parseExpr(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op: t.val, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	t := p.peek()
+
+	if t.kind == tokOp && (t.val == "!" || t.val == "-") {
+		p.next()
+
+		p.depth++
+		defer func() { p.depth-- }()
+
+		if p.depth > MaxDepth {
+			return nil, errors.Errorf("expression nested deeper than %d levels", MaxDepth)
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &unaryNode{op: t.val, operand: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokString:
+		return &literalNode{val: t.val}, nil
+	case tokNumber:
+		n := json.Number(t.val)
+
+		if _, err := n.Float64(); err != nil {
+			return nil, errors.Errorf("invalid number '%s' at position %d", t.val, t.pos)
+		}
+
+		return &literalNode{val: n}, nil
+	case tokLParen:
+		n, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+
+		return n, nil
+	case tokIdent:
+		switch t.val {
+		case "true":
+			return &literalNode{val: true}, nil
+		case "false":
+			return &literalNode{val: false}, nil
+		case "null":
+			return &literalNode{val: nil}, nil
+		}
+
+		// Function call
+		if p.peek().kind == tokLParen {
+			return p.parseCall(t)
+		}
+
+		p.fields = append(p.fields, t.val)
+
+		return &fieldNode{path: t.val}, nil
+	case tokEOF:
+		return nil, errors.New("unexpected end of expression")
+	default:
+		return nil, errors.Errorf("unexpected '%s' at position %d", t.val, t.pos)
+	}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.val]
+	if !ok {
+		return nil, errors.Errorf("unknown function '%s' at position %d", name.val, name.pos)
+	}
+
+	p.next() // (
+
+	args := make([]node, 0)
+
+	if p.peek().kind != tokRParen {
+		for {
+			arg, err := p.parseExpr(1)
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, arg)
+
+			if p.peek().kind != tokComma {
+				break
+			}
+
+			p.next()
+		}
+	}
+
+	if err := p.expect(tokRParen, ")"); err != nil {
+		return nil, err
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, errors.Errorf("function '%s' at position %d: %s", name.val, name.pos, fn.arity())
+	}
+
+	return &callNode{name: name.val, fn: fn, args: args}, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -25,6 +27,45 @@ func main() {
 
 	displayConfig(cfg)
 
+	if cfg.CLI.Infer {
+		logrus.Info("Inferring mapping from source...")
+
+		if err := migrator.Infer(cfg); err != nil {
+			logrus.Errorf("Unable to infer mapping: %s", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if cfg.CLI.Verify {
+		logrus.Info("Verifying destination against source...")
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if err := migrator.Verify(ctx, cfg); err != nil {
+			logrus.Errorf("Verification failed: %s", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if cfg.CLI.Checksum {
+		logrus.Info("Computing destination checksums...")
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if err := migrator.Checksum(ctx, cfg); err != nil {
+			logrus.Errorf("Checksum comparison failed: %s", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	logrus.Info("Starting migrator...")
 
 	// Load config, checkpoint file, generate/load index etc.
@@ -34,24 +75,54 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Context used for facilitating shutdown
+	// First signal drains (ctx), second signal forces an immediate stop
+	// (forceCtx)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Detect ctrl-c and kill signals for graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
+	forceCtx, force := context.WithCancel(context.Background())
+	defer force()
+
+	if cfg.CLI.RestoreIndexes {
+		if err := m.RestoreIndexes(ctx); err != nil {
+			logrus.Errorf("Unable to restore deferred indexes: %s", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Detect ctrl-c and termination signals for graceful shutdown (SIGKILL
+	// cannot be caught)
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		sig := <-c
-		logrus.Debugf("Received system call: %+v", sig)
-		logrus.Debug("Telling migrator to stop...")
+		logrus.Infof("Received %s, finishing in-flight documents (send again to stop immediately)", sig)
 		cancel()
+
+		sig = <-c
+		logrus.Warnf("Received %s again, stopping immediately", sig)
+		force()
+	}()
+
+	// SIGUSR1 pauses, SIGUSR2 resumes the migration
+	p := make(chan os.Signal, 1)
+	signal.Notify(p, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range p {
+			if sig == syscall.SIGUSR1 {
+				m.Pause()
+			} else {
+				m.Resume()
+			}
+		}
 	}()
 
 	// Run the migrator
-	if err := m.Run(ctx, cancel); err != nil {
+	if err := m.Run(ctx, forceCtx); err != nil {
 		logrus.Errorf("Error during migrator run: %s", err)
 		os.Exit(1)
 	}
@@ -73,13 +144,46 @@ func displayConfig(cfg *config.Config) {
 	logrus.Infof("  migrate: %v", cfg.CLI.Migrate)
 	logrus.Infof("  disable resume: %v", cfg.CLI.DisableResume)
 	logrus.Infof("  disable color: %v", cfg.CLI.DisableColor)
+	logrus.Infof("  restore indexes: %v", cfg.CLI.RestoreIndexes)
+	logrus.Infof("  control addr: %s", cfg.CLI.ControlAddr)
 	logrus.Infof("  quiet: %v", cfg.CLI.Quiet)
+
+	if cfg.CLI.Infer {
+		logrus.Infof("  infer samples: %d", cfg.CLI.InferSamples)
+		logrus.Infof("  infer table: %s", cfg.CLI.InferTable)
+		logrus.Infof("  infer mapping file: %s", cfg.CLI.InferMappingFile)
+		logrus.Infof("  infer ddl file: %s", cfg.CLI.InferDDLFile)
+		logrus.Infof("  infer indexes: %v", cfg.CLI.InferIndexes)
+	}
+
+	if cfg.CLI.Verify {
+		logrus.Infof("  verify sample: %d", cfg.CLI.VerifySample)
+		logrus.Infof("  verify output: %s", cfg.CLI.VerifyOutput)
+		logrus.Infof("  verify max reported: %d", cfg.CLI.VerifyMaxReported)
+	}
+
+	if cfg.CLI.Checksum {
+		logrus.Infof("  checksum output: %s", cfg.CLI.ChecksumOutput)
+	}
+
 	logrus.Info("")
 	logrus.Info("  [CONFIG]")
 	logrus.Infof("  config.num_workers: %d", cfg.TOML.Config.NumProcessors)
+	logrus.Infof("  config.num_writers: %d", cfg.TOML.Config.NumWriters)
 	logrus.Infof("  config.batch_size: %d", cfg.TOML.Config.BatchSize)
 	logrus.Infof("  config.checkpoint_file: %s", cfg.TOML.Config.CheckpointFile)
 	logrus.Infof("  config.checkpoint_index: %s", cfg.TOML.Config.CheckpointIndex)
+	logrus.Infof("  config.max_inflight_bytes: %d", cfg.TOML.Config.MaxInflightBytes)
+	logrus.Infof("  config.drain_timeout: %s", time.Duration(cfg.TOML.Config.DrainTimeout))
+	logrus.Infof("  config.shutdown_timeout: %s", time.Duration(cfg.TOML.Config.ShutdownTimeout))
+
+	if a := cfg.TOML.Config.Adaptive; a.Enabled {
+		logrus.Infof("  config.adaptive.interval: %s", time.Duration(a.Interval))
+		logrus.Infof("  config.adaptive.target_latency: %s", time.Duration(a.TargetLatency))
+		logrus.Infof("  config.adaptive.writers: %d-%d", a.MinWriters, a.MaxWriters)
+		logrus.Infof("  config.adaptive.batch_size: %d-%d", a.MinBatchSize, a.MaxBatchSize)
+		logrus.Infof("  config.adaptive.max_replication_lag: %s", time.Duration(a.MaxReplicationLag))
+	}
 	logrus.Info("")
 	logrus.Info("  [SOURCE]")
 	logrus.Infof("  source.file: %s", cfg.TOML.Source.File)
@@ -89,6 +193,28 @@ func displayConfig(cfg *config.Config) {
 	logrus.Info("  [DESTINATION]")
 	logrus.Infof("  destination.type: %s", cfg.TOML.Destination.Type)
 	logrus.Infof("  destination.dsn: %s", cfg.TOML.Destination.DSN)
+	logrus.Infof("  destination.schema_mode: %s", cfg.TOML.Destination.SchemaMode)
+	logrus.Infof("  destination.defer_indexes: %v", cfg.TOML.Destination.DeferIndexes)
+	logrus.Infof("  destination.max_rows_per_sec: %d", cfg.TOML.Destination.MaxRowsPerSec)
+	logrus.Infof("  destination.max_bytes_per_sec: %d", cfg.TOML.Destination.MaxBytesPerSec)
+
+	if r := cfg.TOML.Destination.Retry; r.Disable {
+		logrus.Info("  destination.retry: disabled")
+	} else {
+		logrus.Infof("  destination.retry.max_retries: %d", r.MaxRetries)
+		logrus.Infof("  destination.retry.backoff: %s-%s (x%g, jitter %g)",
+			time.Duration(r.InitialBackoff), time.Duration(r.MaxBackoff), r.Multiplier, r.Jitter)
+	}
+
+	if cfg.TOML.Destination.DupeCheckIndex != "" {
+		logrus.Infof("  destination.dupe_check_index: %s", cfg.TOML.Destination.DupeCheckIndex)
+	}
+
+	if cfg.TOML.Destination.IsFile() {
+		logrus.Infof("  destination.path: %s", cfg.TOML.Destination.Path)
+		logrus.Infof("  destination.max_file_bytes: %d", cfg.TOML.Destination.MaxFileBytes)
+		logrus.Infof("  destination.codec: %s", cfg.TOML.Destination.Codec)
+	}
 	logrus.Info("")
 	logrus.Info("  [MAPPING]")
 
@@ -97,6 +223,11 @@ func displayConfig(cfg *config.Config) {
 
 		for i, m := range v {
 			logrus.Infof("    [%d] src: %s ", i, m.Src)
+
+			if m.Expr != "" {
+				logrus.Infof("    [%d] expr: %s ", i, m.Expr)
+			}
+
 			logrus.Infof("    [%d] dst: %s ", i, m.Dst)
 			logrus.Infof("    [%d] conv: %s ", i, m.Conv)
 
@@ -108,10 +239,66 @@ func displayConfig(cfg *config.Config) {
 				logrus.Infof("    [%d] dupe_check: %v ", i, *m.DupeCheck)
 			}
 
+			if len(m.Values) > 0 {
+				logrus.Infof("    [%d] values: %q ", i, m.Values)
+			}
+
+			if m.Format != nil {
+				logrus.Infof("    [%d] format: %v ", i, m.Format)
+			}
+
+			if m.Unit != "" {
+				logrus.Infof("    [%d] unit: %s ", i, m.Unit)
+			}
+
+			if m.Timezone != "" {
+				logrus.Infof("    [%d] timezone: %s ", i, m.Timezone)
+			}
+
+			if m.Default != nil {
+				logrus.Infof("    [%d] default: %v ", i, m.Default)
+			}
+
+			if len(m.NullIf) > 0 {
+				logrus.Infof("    [%d] null_if: %q ", i, m.NullIf)
+			}
+
+			if m.OnMissing != "" {
+				logrus.Infof("    [%d] on_missing: %s ", i, m.OnMissing)
+			}
+
+			if m.OnConvError != "" {
+				logrus.Infof("    [%d] on_conv_error: %s ", i, m.OnConvError)
+			}
+
 			// If NOT last entry, print separator
 			if i != len(v)-1 {
 				logrus.Info("    ---")
 			}
 		}
 	}
+
+	if len(*cfg.TOML.Tables) > 0 {
+		logrus.Info("")
+		logrus.Info("  [TABLES]")
+	}
+
+	for k, v := range *cfg.TOML.Tables {
+		logrus.Infof("  tables.%s:", k)
+		logrus.Infof("    parent: %s", v.Parent)
+		logrus.Infof("    explode: %s", v.Explode)
+		logrus.Infof("    on_delete: %s", v.OnDelete)
+
+		if v.OnDelete == config.OnDeleteSoft {
+			logrus.Infof("    soft_delete_column: %s", v.SoftDeleteColumn)
+			logrus.Infof("    soft_delete_value: %v", v.SoftDeleteValue)
+		}
+	}
+
+	if d := cfg.TOML.Delta; d.Enabled {
+		logrus.Info("")
+		logrus.Info("  [DELTA]")
+		logrus.Infof("  delta.delete_missing: %v", d.DeleteMissing)
+		logrus.Infof("  delta.keys_table: %s", d.KeysTable)
+	}
 }
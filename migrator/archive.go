@@ -0,0 +1,175 @@
+package migrator
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/dump"
+)
+
+// DumpReport describes the collections of an archive or directory source
+// and the mappings they are routed to
+type DumpReport struct {
+	ServerVersion string                  `json:"server_version,omitempty"`
+	ToolVersion   string                  `json:"tool_version,omitempty"`
+	Collections   []*DumpCollectionReport `json:"collections"`
+}
+
+type DumpCollectionReport struct {
+	Namespace string `json:"namespace"`
+	Type      string `json:"type,omitempty"`
+
+	// Mapping the collection's documents are written with; empty if they are
+	// skipped
+	Mapping string `json:"mapping"`
+
+	Indexes []string `json:"indexes,omitempty"`
+}
+
+// namespaces routes the documents of a source holding several collections
+// (archives and directories) to the mapping named after their namespace
+// ("<db>.<collection>") or collection
+type namespaces struct {
+	log   *logrus.Entry
+	plans map[string][]*tablePlan
+
+	mu       sync.Mutex
+	unmapped map[string]struct{}
+}
+
+func newNamespaces(cfg *config.Config, log *logrus.Entry) (*namespaces, error) {
+	n := &namespaces{
+		log:      log,
+		plans:    make(map[string][]*tablePlan),
+		unmapped: make(map[string]struct{}),
+	}
+
+	for name, entries := range *cfg.TOML.Mapping {
+		plan, err := buildPlan(&config.TOMLMapping{name: entries}, cfg.TOML.Tables)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to build plan for mapping '%s'", name)
+		}
+
+		n.plans[name] = plan
+	}
+
+	return n, nil
+}
+
+// mapping returns the name of the mapping for namespace ("" if none)
+func (n *namespaces) mapping(namespace string) string {
+	if _, ok := n.plans[namespace]; ok {
+		return namespace
+	}
+
+	if i := strings.Index(namespace, "."); i >= 0 {
+		if _, ok := n.plans[namespace[i+1:]]; ok {
+			return namespace[i+1:]
+		}
+	}
+
+	return ""
+}
+
+// plan returns the plan for the documents of namespace; false (after logging
+// a warning the first time) if the namespace has no mapping
+func (n *namespaces) plan(namespace string) ([]*tablePlan, bool) {
+	if name := n.mapping(namespace); name != "" {
+		return n.plans[name], true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.unmapped[namespace]; !ok {
+		n.unmapped[namespace] = struct{}{}
+		n.log.Warnf("Namespace '%s' has no mapping; its documents are skipped", namespace)
+	}
+
+	return nil, false
+}
+
+// readArchivePrelude reads the prelude from the start of an archive source and
+// returns the offset right after it
+func (m *Migrator) readArchivePrelude(src io.ReadSeeker) (int64, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "unable to seek to start of source")
+	}
+
+	// Streams cannot seek back after the prelude, so it must be read without
+	// buffering beyond it
+	br := bufio.NewReader(src)
+	if s, ok := src.(*streamSource); ok {
+		br = s.br
+	}
+
+	prelude, n, err := dump.ReadPrelude(br)
+	if err != nil {
+		return 0, err
+	}
+
+	m.preludeEnd = n
+
+	if m.namespaces != nil {
+		m.dump.Store(m.archiveReport(prelude))
+	}
+
+	return n, nil
+}
+
+// archiveReport returns the report of an archive's collections
+func (m *Migrator) archiveReport(prelude *dump.Prelude) *DumpReport {
+	r := &DumpReport{
+		ServerVersion: prelude.Header.ServerVersion,
+		ToolVersion:   prelude.Header.ToolVersion,
+	}
+
+	for _, c := range prelude.Collections {
+		r.Collections = append(r.Collections, m.collectionReport(c.Namespace(), c.Type, c.Metadata))
+	}
+
+	sort.Slice(r.Collections, func(i, j int) bool { return r.Collections[i].Namespace < r.Collections[j].Namespace })
+
+	return r
+}
+
+// collectionReport logs a collection, its indexes and the mapping it is
+// written with and returns its report; md may be nil
+func (m *Migrator) collectionReport(namespace, typ string, md *dump.Metadata) *DumpCollectionReport {
+	cr := &DumpCollectionReport{
+		Namespace: namespace,
+		Type:      typ,
+		Mapping:   m.namespaces.mapping(namespace),
+	}
+
+	if md != nil {
+		if cr.Type == "" {
+			cr.Type = md.Type
+		}
+
+		for _, index := range md.Indexes {
+			desc := index.Name + " " + index.String()
+			if index.Unique {
+				desc += " unique"
+			}
+
+			cr.Indexes = append(cr.Indexes, desc)
+		}
+	}
+
+	if cr.Mapping == "" {
+		m.log.Infof("Collection '%s' has no mapping; its documents are skipped", cr.Namespace)
+	} else {
+		m.log.Infof("Collection '%s' is written with mapping '%s' (indexes: %s)",
+			cr.Namespace, cr.Mapping, strings.Join(cr.Indexes, "; "))
+	}
+
+	return cr
+}
@@ -0,0 +1,87 @@
+package migrator
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memBudget bounds the number of bytes of documents that have been read but
+// not yet written (config.max_inflight_bytes). The reader acquires a
+// document's size before handing it to the processors and writers release it
+// once the document has been written (or skipped), so a slow destination
+// throttles the reader instead of growing memory usage.
+type memBudget struct {
+	limit int64
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{} // closed (and replaced) on every release
+	blocked  time.Duration
+}
+
+// BudgetReport is the in-flight memory section of the progress report
+type BudgetReport struct {
+	InflightBytes    int64  `json:"inflight_bytes"`
+	MaxInflightBytes int64  `json:"max_inflight_bytes"`
+	ReaderBlockedFor string `json:"reader_blocked_for"`
+}
+
+func newMemBudget(limit int64) *memBudget {
+	return &memBudget{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes fit into the budget (or ctx is done). A
+// document larger than the whole budget is admitted once nothing else is in
+// flight.
+func (b *memBudget) acquire(ctx context.Context, n int64) error {
+	n = min(n, b.limit)
+	started := time.Now()
+
+	for {
+		b.mu.Lock()
+
+		if b.used+n <= b.limit {
+			b.used += n
+			b.blocked += time.Since(started)
+			b.mu.Unlock()
+
+			return nil
+		}
+
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (b *memBudget) release(n int64) {
+	n = min(n, b.limit)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used = max(b.used-n, 0)
+
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+func (b *memBudget) report() *BudgetReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &BudgetReport{
+		InflightBytes:    b.used,
+		MaxInflightBytes: b.limit,
+		ReaderBlockedFor: b.blocked.Round(time.Millisecond).String(),
+	}
+}
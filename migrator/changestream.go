@@ -0,0 +1,208 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/config"
+)
+
+// Change stream operation types (see the MongoDB change events documentation)
+const (
+	opInsert  = "insert"
+	opUpdate  = "update"
+	opReplace = "replace"
+	opDelete  = "delete"
+)
+
+// changeEvent is a single change stream event; a source with
+// file_contents 'changestream' holds one (extended JSON) event per line, eg.
+// as written by a watch() loop or a change stream export
+type changeEvent struct {
+	op           string
+	fullDocument interface{}
+	documentKey  interface{}
+}
+
+// decodeChangeEvent picks the fields mmmbop needs out of a decoded event
+func decodeChangeEvent(doc interface{}) (*changeEvent, error) {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("change event is not an object")
+	}
+
+	op, ok := m["operationType"].(string)
+	if !ok || op == "" {
+		return nil, errors.New("change event is missing 'operationType'")
+	}
+
+	return &changeEvent{
+		op:           op,
+		fullDocument: m["fullDocument"],
+		documentKey:  m["documentKey"],
+	}, nil
+}
+
+// resumeToken returns the resume token (ie. the event's _id, as decoded from
+// JSON without unwrapping) as a string: its '_data' field if it has one, its
+// JSON encoding otherwise
+func resumeToken(id interface{}) (string, error) {
+	if id == nil {
+		return "", errors.New("change event is missing its resume token ('_id')")
+	}
+
+	if m, ok := id.(map[string]interface{}); ok {
+		if data, ok := m["_data"].(string); ok {
+			return data, nil
+		}
+	}
+
+	data, err := json.Marshal(id)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode resume token")
+	}
+
+	return string(data), nil
+}
+
+// eventToken returns the resume token of a raw change event
+func (m *Migrator) eventToken(data string) (string, error) {
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return "", err
+	}
+
+	event, ok := doc.(map[string]interface{})
+	if !ok {
+		return "", errors.New("change event is not an object")
+	}
+
+	return resumeToken(event["_id"])
+}
+
+// processChangeEvent turns a change event into a writer job: inserts,
+// replacements and updates (with their post-image in 'fullDocument') are
+// written like delta rows, deletes remove the root rows matching the event's
+// 'documentKey' (and their children). Other events are skipped.
+func (m *Migrator) processChangeEvent(j *ProcessorJob, doc interface{}) (*WriterJob, error) {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "processChangeEvent",
+	})
+
+	ev, err := decodeChangeEvent(doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decode change event at offset '%d'", j.Offset)
+	}
+
+	token, err := m.eventToken(j.Data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read resume token of change event at offset '%d'", j.Offset)
+	}
+
+	wj := &WriterJob{
+		Offset:      j.Offset,
+		Size:        j.Size(),
+		ResumeToken: token,
+	}
+
+	switch {
+	case ev.op == opDelete:
+		rows, err := m.keyRows(ev.documentKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to build delete for change event at offset '%d'", j.Offset)
+		}
+
+		wj.Rows = rows
+		wj.Delete = true
+	case (ev.op == opInsert || ev.op == opReplace || ev.op == opUpdate) && ev.fullDocument != nil:
+		for _, p := range m.plan {
+			row, err := m.buildRow(p, ev.fullDocument, -1)
+			if err != nil {
+				if errors.Is(err, errSkipDocument) {
+					llog.Debugf("Skipping change event at offset '%d': %s", j.Offset, err)
+					m.stats.DocumentsSkipped.Inc()
+
+					return &WriterJob{Offset: j.Offset, Size: j.Size(), ResumeToken: token}, nil
+				}
+
+				return nil, errors.Wrapf(err, "unable to build row for table '%s' at offset '%d'", p.table, j.Offset)
+			}
+
+			if row != nil {
+				wj.Rows = append(wj.Rows, row)
+			}
+		}
+	default:
+		// Updates without a post-image (ie. not watched with
+		// fullDocument: 'updateLookup') and events that do not change
+		// documents (drop, rename, invalidate, ...) cannot be applied
+		llog.Debugf("Skipping '%s' change event at offset '%d'", ev.op, j.Offset)
+		m.stats.DocumentsSkipped.Inc()
+	}
+
+	return wj, nil
+}
+
+// keyRows builds the root rows identified by a delete event's document key;
+// the rows only hold their dupe check columns
+func (m *Migrator) keyRows(key interface{}) ([]*Row, error) {
+	if key == nil {
+		return nil, errors.New("change event is missing 'documentKey'")
+	}
+
+	rows := make([]*Row, 0, len(m.plan))
+
+	for _, p := range m.plan {
+		keyPlan := &tablePlan{
+			table:     p.table,
+			dupeCheck: p.dupeCheck,
+		}
+
+		for _, e := range p.entries {
+			_, column := config.ParseDst(e.Dst)
+			if indexOf(p.dupeCheck, column) >= 0 {
+				keyPlan.entries = append(keyPlan.entries, e)
+			}
+		}
+
+		row, err := m.buildRow(keyPlan, key, -1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to build key for table '%s'", p.table)
+		}
+
+		// Deleting by a partial key could delete unrelated rows
+		for _, dc := range p.dupeCheck {
+			i := -1
+			if row != nil {
+				i = indexOf(row.Columns, dc)
+			}
+
+			if i < 0 || row.Values[i] == nil {
+				return nil, errors.Errorf("document key has no value for dupe check column '%s' of table '%s'", dc, p.table)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// deleteRow deletes the destination row matching the dupe check key of row
+// (built by keyRows) and its children
+func (m *Migrator) deleteRow(shutdownCtx context.Context, tx pgx.Tx, row *Row, counts *deltaCounts) error {
+	where, args := keyWhere(row, row.Columns, row.Values, nil)
+
+	n, err := m.deleteRows(shutdownCtx, tx, m.delta.plans[row.Table], where, args)
+	if err != nil {
+		return errors.Wrapf(err, "unable to delete from table '%s'", row.Table)
+	}
+
+	counts.deleted += n
+
+	return nil
+}
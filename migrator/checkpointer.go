@@ -1,17 +1,18 @@
 package migrator
 
 import (
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-// runCheckpointer is responsible for writing checkpoints to disk and for
-// reporting progress to the user.
+// runCheckpointer is responsible for writing checkpoints to disk.
 //
-// NOTE: This is a custom ctx that is created by Run() - it will only be closed
-// once all workers have exited.
+// NOTE: The checkpointer does not listen to any context; it exits (after
+// writing the final checkpoint) once Run() sends the exit state on
+// cpControlCh, which only happens after all writers have exited.
 func (m *Migrator) runCheckpointer(cpControlCh <-chan bool, cpChan <-chan *CheckpointJob) error {
 	llog := m.log.WithFields(logrus.Fields{
 		"method": "runCheckpointer",
@@ -20,14 +21,8 @@ func (m *Migrator) runCheckpointer(cpControlCh <-chan bool, cpChan <-chan *Check
 	llog.Debug("Start")
 	defer llog.Debug("Exit")
 
-	var (
-		// We need the last job so that when checkpointer exits it is able to
-		// write the final checkpoint data to disk.
-		lastJob *CheckpointJob
-
-		// Indicates whether this was a clean exit (ie. completed) or we were interrupted
-		exitState bool
-	)
+	// Indicates whether this was a clean exit (ie. completed) or we were interrupted
+	var exitState bool
 
 MAIN:
 	for {
@@ -37,21 +32,56 @@ MAIN:
 			exitState = state
 			llog.Debug("Received shutdown signal")
 			break MAIN
+		case <-m.cpFlushCh:
+			llog.Debug("Received flush request")
+
+			// Save regardless of config.checkpoint_interval
+			if err := m.saveCheckpoint(m.offsets.safe(), false); err != nil {
+				llog.Errorf("Error saving checkpoint for offset '%v': %v", m.offsets.safe(), err)
+			}
 		case cp := <-cpChan:
 			llog.Debugf("Received checkpoint at offset '%v' worker id '%v'", cp.Offset, cp.WorkerID)
 
-			if err := m.saveCheckpoint(cp); err != nil {
-				llog.Errorf("Error saving checkpoint for offset '%v' worker id '%d': %v", cp.Offset, cp.WorkerID, err)
-			}
+			offset, sums, last := m.offsets.complete(cp)
+			m.foldChecksums(sums)
+			m.setPosition(last)
 
-			lastJob = cp
+			if err := m.saveCheckpoint(offset); err != nil {
+				llog.Errorf("Error saving checkpoint for offset '%v' worker id '%d': %v", offset, cp.WorkerID, err)
+			}
 		}
 	}
 
-	return m.saveCheckpoint(lastJob, exitState)
+	// Pick up checkpoints sent by writers right before they exited
+	for len(cpChan) > 0 {
+		cp := <-cpChan
+		_, sums, last := m.offsets.complete(cp)
+		m.foldChecksums(sums)
+		m.setPosition(last)
+	}
+
+	return m.saveCheckpoint(m.offsets.safe(), exitState)
+}
+
+// setPosition records where in the source the last checkpointed document is,
+// beyond its offset: the resume token of a change event and the namespace of
+// an archive document
+func (m *Migrator) setPosition(last *CheckpointJob) {
+	if last == nil {
+		return
+	}
+
+	m.cp.Lock()
+	defer m.cp.Unlock()
+
+	if last.ResumeToken != "" {
+		m.cp.ResumeToken = last.ResumeToken
+	}
+
+	m.cp.ArchiveNamespace = last.Namespace
 }
 
-func (m *Migrator) saveCheckpoint(cp *CheckpointJob, cleanExit ...bool) error {
+func (m *Migrator) saveCheckpoint(offset int64, cleanExit ...bool) error {
 	llog := m.log.WithFields(logrus.Fields{
 		"method": "saveCheckpoint",
 	})
@@ -65,17 +95,12 @@ func (m *Migrator) saveCheckpoint(cp *CheckpointJob, cleanExit ...bool) error {
 		}
 	}
 
-	if cp == nil {
-		llog.Debug("Received nil checkpoint - skipping save")
-		return nil
-	}
-
 	llog.Debugf("Saving checkpoint to '%s'", m.cfg.TOML.Config.CheckpointFile)
 
 	// Update checkpoint
 	m.cp.Lock()
 
-	m.cp.IndexOffset = cp.Offset
+	m.cp.IndexOffset = offset
 	m.cp.LastUpdated = time.Now()
 
 	if len(cleanExit) > 0 && cleanExit[0] {
@@ -93,6 +118,86 @@ func (m *Migrator) saveCheckpoint(cp *CheckpointJob, cleanExit ...bool) error {
 
 	// Note that a checkpoint save has occurred
 	m.last = time.Now()
+	m.stats.CheckpointsSaved.Inc()
 
 	return nil
 }
+
+// offsetTracker computes the offset that is safe to checkpoint: the reader
+// adds the offset of every document it hands out (in read order) and the
+// checkpointer completes them as writers finish, possibly out of order. The
+// safe offset is the end of the last document before which everything has
+// been written.
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending []int64
+	done    map[int64]*CheckpointJob
+	last    int64
+}
+
+func newOffsetTracker(start int64) *offsetTracker {
+	return &offsetTracker{
+		done: make(map[int64]*CheckpointJob),
+		last: start,
+	}
+}
+
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = append(t.pending, offset)
+}
+
+// complete marks the job's offset as written and returns the safe offset plus
+// the checksums of the documents that became safe and the last of them (nil
+// if none did)
+func (t *offsetTracker) complete(cp *CheckpointJob) (int64, tableSums, *CheckpointJob) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if cp.Committed != nil {
+		for _, j := range cp.Committed {
+			t.done[j.Offset] = j
+		}
+	} else {
+		t.done[cp.Offset] = cp
+	}
+
+	var (
+		safe tableSums
+		last *CheckpointJob
+	)
+
+	for len(t.pending) > 0 {
+		done, ok := t.done[t.pending[0]]
+		if !ok {
+			break
+		}
+
+		safe = safe.add(done.Sums)
+		last = done
+
+		delete(t.done, t.pending[0])
+		t.last = t.pending[0]
+		t.pending = t.pending[1:]
+	}
+
+	return t.last, safe, last
+}
+
+// numPending returns the number of documents that were handed out but not yet
+// written
+func (t *offsetTracker) numPending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.pending)
+}
+
+func (t *offsetTracker) safe() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.last
+}
@@ -0,0 +1,727 @@
+package migrator
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/checkpoint"
+	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/conv"
+)
+
+// A row is hashed as md5 over the canonical text of its mapped columns (sorted
+// by name) joined by checksumColumnSep; array elements are joined by
+// checksumElementSep and NULLs are rendered as checksumNull. The first 8 bytes
+// of the md5 are the row hash; a table's checksum is the sum of its row hashes
+// (mod 2^64) plus the number of rows, so the order in which rows are written
+// does not matter. checksumQuery computes the same on the destination.
+const (
+	checksumColumnSep  = "\x1f"
+	checksumElementSep = "\x1e"
+	checksumNull       = `\N`
+)
+
+// tableSum is the checksum of (some of) a table's rows
+type tableSum struct {
+	rows int64
+	sum  uint64
+}
+
+// tableSums are the checksums of the rows built from one or more documents
+type tableSums map[Table]*tableSum
+
+func (s tableSums) add(other tableSums) tableSums {
+	if len(other) == 0 {
+		return s
+	}
+
+	if s == nil {
+		s = make(tableSums, len(other))
+	}
+
+	for table, o := range other {
+		if _, ok := s[table]; !ok {
+			s[table] = &tableSum{}
+		}
+
+		s[table].rows += o.rows
+		s[table].sum += o.sum
+	}
+
+	return s
+}
+
+type checksumColumn struct {
+	name string
+	conv string
+}
+
+// rowHasher hashes rows; holds the hashed columns of every table
+type rowHasher struct {
+	columns map[Table][]checksumColumn
+
+	// Soft deleted rows are not part of a table's checksum
+	live map[Table]string
+}
+
+func newRowHasher(plan []*tablePlan) *rowHasher {
+	h := &rowHasher{
+		columns: make(map[Table][]checksumColumn),
+		live:    liveConditions(plan),
+	}
+
+	var walk func(p *tablePlan)
+
+	walk = func(p *tablePlan) {
+		columns := make([]checksumColumn, 0, len(p.entries))
+
+		// Parent refs are generated by the destination and not hashed
+		for _, e := range p.entries {
+			if strings.HasPrefix(e.Src, config.SrcParentPrefix) {
+				continue
+			}
+
+			_, column := config.ParseDst(e.Dst)
+			columns = append(columns, checksumColumn{name: column, conv: e.Converter.Name()})
+		}
+
+		sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+
+		h.columns[p.table] = columns
+
+		for _, child := range p.children {
+			walk(child)
+		}
+	}
+
+	for _, p := range plan {
+		walk(p)
+	}
+
+	return h
+}
+
+// columnNames returns the hashed columns of table
+func (h *rowHasher) columnNames(table Table) []string {
+	names := make([]string, 0, len(h.columns[table]))
+
+	for _, c := range h.columns[table] {
+		names = append(names, c.name)
+	}
+
+	return names
+}
+
+// sum returns the checksums of rows and (recursively) their children
+func (h *rowHasher) sum(rows []*Row) (tableSums, error) {
+	sums := make(tableSums)
+
+	var walk func(row *Row) error
+
+	walk = func(row *Row) error {
+		hash, err := h.hashRow(row)
+		if err != nil {
+			return errors.Wrapf(err, "unable to hash row for table '%s'", row.Table)
+		}
+
+		if _, ok := sums[row.Table]; !ok {
+			sums[row.Table] = &tableSum{}
+		}
+
+		sums[row.Table].rows++
+		sums[row.Table].sum += hash
+
+		for _, child := range row.Children {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, row := range rows {
+		if err := walk(row); err != nil {
+			return nil, err
+		}
+	}
+
+	return sums, nil
+}
+
+// hashRow hashes the mapped columns of row; columns that were skipped (see
+// on_missing) are hashed as NULL
+func (h *rowHasher) hashRow(row *Row) (uint64, error) {
+	text, err := h.joinText(row.Table, h.columnNames(row.Table), row.Columns, row.Values)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := md5.Sum([]byte(text))
+
+	return binary.BigEndian.Uint64(sum[:8]), nil
+}
+
+// checksumText returns the canonical text of a converted (non-nil) value
+func checksumText(convName string, v interface{}) (string, error) {
+	if name := strings.TrimSuffix(convName, conv.ArraySuffix); name != convName {
+		arr, ok := v.(conv.Array)
+		if !ok {
+			return "", errors.Errorf("unexpected type '%T' for conv '%s'", v, convName)
+		}
+
+		parts := make([]string, len(arr))
+
+		for i, el := range arr {
+			parts[i] = checksumNull
+
+			if el == nil {
+				continue
+			}
+
+			text, err := checksumText(name, el)
+			if err != nil {
+				return "", err
+			}
+
+			parts[i] = text
+		}
+
+		return strings.Join(parts, checksumElementSep), nil
+	}
+
+	switch t := v.(type) {
+	case string:
+		switch convName {
+		case "uuid":
+			return strings.ToLower(t), nil
+		case "numeric":
+			return decimalText(t, true), nil
+		case "json", "jsonb":
+			return jsonbText(t)
+		case "inet":
+			return inetText(t), nil
+		case "time":
+			tm, err := time.Parse("15:04:05.999999999", t)
+			if err != nil {
+				return "", errors.Wrapf(err, "unable to parse time '%s'", t)
+			}
+
+			return tm.Round(time.Microsecond).Format("15:04:05.000000"), nil
+		}
+
+		return t, nil
+	case int64:
+		return strconv.FormatInt(t, 10), nil
+	case float64:
+		return floatText(t), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case []byte:
+		return hex.EncodeToString(t), nil
+	case time.Time:
+		if convName == "date" {
+			return t.Format("2006-01-02"), nil
+		}
+
+		// Postgres rounds to the microsecond
+		return t.UTC().Round(time.Microsecond).Format("2006-01-02T15:04:05.000000"), nil
+	default:
+		return "", errors.Errorf("unexpected type '%T' for conv '%s'", v, convName)
+	}
+}
+
+// checksumSQL returns the SQL expression for the canonical text of expr (a
+// column of conv convName); must match checksumText
+func checksumSQL(convName, expr string) string {
+	if name := strings.TrimSuffix(convName, conv.ArraySuffix); name != convName {
+		return fmt.Sprintf(`CASE WHEN %s IS NULL THEN NULL ELSE (SELECT coalesce(string_agg(coalesce(%s, '%s'), chr(30) ORDER BY e.n), '') FROM unnest(%s) WITH ORDINALITY AS e(v, n)) END`,
+			expr, checksumSQL(name, "e.v"), checksumNull, expr)
+	}
+
+	switch convName {
+	case "int":
+		return expr + "::bigint::text"
+	case "float":
+		// Postgres converts float8 to numeric with 15 significant digits
+		return expr + "::float8::numeric::text"
+	case "numeric":
+		// trim_scale was added in PostgreSQL 13
+		return "trim_scale(" + expr + "::numeric)::text"
+	case "bool":
+		return expr + "::bool::text"
+	case "uuid":
+		return "lower(" + expr + "::text)"
+	case "json", "jsonb":
+		return expr + "::jsonb::text"
+	case "inet":
+		return "abbrev(" + expr + "::inet)"
+	case "bytea", "base64", "bson":
+		return "encode(" + expr + "::bytea, 'hex')"
+	case "date":
+		return "to_char(" + expr + "::date, 'YYYY-MM-DD')"
+	case "datetime", "timestamp":
+		return "to_char(" + expr + `::timestamp, 'YYYY-MM-DD"T"HH24:MI:SS.US')`
+	case "timestamptz":
+		return "to_char(" + expr + `::timestamptz AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US')`
+	case "time":
+		return "to_char(" + expr + "::time::interval, 'HH24:MI:SS.US')"
+	default:
+		return expr + "::text"
+	}
+}
+
+// checksumQuery returns the query that computes the row count and checksum of
+// table on the destination
+func (h *rowHasher) checksumQuery(table Table) string {
+	where := ""
+	if live, ok := h.live[table]; ok {
+		where = " WHERE " + live
+	}
+
+	return fmt.Sprintf("SELECT count(*), %s FROM (SELECT %s::numeric AS h FROM %s%s) r",
+		sumSQL, h.rowHashSQL(table), pgx.Identifier{string(table)}.Sanitize(), where)
+}
+
+// sumSQL sums the (signed) row hashes h of a subquery mod 2^64, as text
+const sumSQL = "mod(mod(coalesce(sum(h), 0), 18446744073709551616) + 18446744073709551616, 18446744073709551616)::text"
+
+// rowHashSQL returns the SQL expression for the hash of a row of table (as a
+// signed bigint)
+func (h *rowHasher) rowHashSQL(table Table) string {
+	return fmt.Sprintf("('x' || left(md5(%s), 16))::bit(64)::bigint", h.joinSQL(table, h.columnNames(table)))
+}
+
+// joinSQL returns the SQL expression for the canonical text of columns of
+// table joined by checksumColumnSep
+func (h *rowHasher) joinSQL(table Table, columns []string) string {
+	if len(columns) == 0 {
+		return "''"
+	}
+
+	parts := make([]string, 0, len(columns))
+
+	for _, c := range columns {
+		parts = append(parts, fmt.Sprintf("coalesce(%s, '%s')", checksumSQL(h.conv(table, c), pgx.Identifier{c}.Sanitize()), checksumNull))
+	}
+
+	return "concat_ws(chr(31), " + strings.Join(parts, ", ") + ")"
+}
+
+// joinText is the Go counterpart of joinSQL for the values of row
+func (h *rowHasher) joinText(table Table, columns []string, rowColumns []string, values []interface{}) (string, error) {
+	parts := make([]string, len(columns))
+
+	for i, c := range columns {
+		parts[i] = checksumNull
+
+		j := indexOf(rowColumns, c)
+		if j < 0 || values[j] == nil {
+			continue
+		}
+
+		text, err := checksumText(h.conv(table, c), values[j])
+		if err != nil {
+			return "", errors.Wrapf(err, "column '%s'", c)
+		}
+
+		parts[i] = text
+	}
+
+	return strings.Join(parts, checksumColumnSep), nil
+}
+
+// conv returns the conv of a hashed column ("string" for other columns)
+func (h *rowHasher) conv(table Table, column string) string {
+	for _, c := range h.columns[table] {
+		if c.name == column {
+			return c.conv
+		}
+	}
+
+	return "string"
+}
+
+// floatText renders f like Postgres' float8 -> numeric cast: 15 significant
+// digits, no exponent
+func floatText(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	return decimalText(strconv.FormatFloat(f, 'e', 14, 64), true)
+}
+
+// decimalText renders a decimal literal (ie. "1.50e1") like Postgres' numeric
+// output: without exponent, keeping the literal's scale ("15.0") or, with
+// trim, without trailing fractional zeros ("15")
+func decimalText(s string, trim bool) string {
+	s = strings.TrimSpace(s)
+
+	var neg bool
+
+	switch {
+	case strings.HasPrefix(s, "-"):
+		neg, s = true, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+
+	mantissa, exp := s, 0
+
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return s
+		}
+
+		mantissa, exp = s[:i], e
+	}
+
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+
+	// Not a number (ie. NaN/Infinity)
+	if strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return s
+	}
+
+	digits := intPart + fracPart
+	point := len(intPart) + exp
+
+	if point < 0 {
+		digits = strings.Repeat("0", -point) + digits
+		point = 0
+	}
+
+	if point > len(digits) {
+		digits += strings.Repeat("0", point-len(digits))
+	}
+
+	intPart, fracPart = strings.TrimLeft(digits[:point], "0"), digits[point:]
+
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	if trim {
+		fracPart = strings.TrimRight(fracPart, "0")
+	}
+
+	if strings.Trim(intPart+fracPart, "0") == "" {
+		neg = false
+	}
+
+	out := intPart
+	if fracPart != "" {
+		out += "." + fracPart
+	}
+
+	if neg {
+		out = "-" + out
+	}
+
+	return out
+}
+
+// jsonbText renders a JSON document like Postgres' jsonb output: object keys
+// deduplicated and sorted by length then bytes, ", " and ": " separators and
+// numbers as numeric
+func jsonbText(s string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	var v interface{}
+
+	if err := dec.Decode(&v); err != nil {
+		return "", errors.Wrap(err, "unable to decode json")
+	}
+
+	b := &strings.Builder{}
+	writeJSONB(b, v)
+
+	return b.String(), nil
+}
+
+func writeJSONB(b *strings.Builder, v interface{}) {
+	switch t := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(t))
+	case json.Number:
+		b.WriteString(decimalText(t.String(), false))
+	case string:
+		writeJSONBString(b, t)
+	case []interface{}:
+		b.WriteByte('[')
+
+		for i, el := range t {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+
+			writeJSONB(b, el)
+		}
+
+		b.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+
+			return keys[i] < keys[j]
+		})
+
+		b.WriteByte('{')
+
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+
+			writeJSONBString(b, k)
+			b.WriteString(": ")
+			writeJSONB(b, t[k])
+		}
+
+		b.WriteByte('}')
+	}
+}
+
+// writeJSONBString escapes s like Postgres' escape_json
+func writeJSONBString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(b, `\u%04x`, r)
+				continue
+			}
+
+			b.WriteRune(r)
+		}
+	}
+
+	b.WriteByte('"')
+}
+
+// inetText renders an address like Postgres' abbrev(inet): host addresses
+// without their netmask
+func inetText(s string) string {
+	addr, bits, found := strings.Cut(s, "/")
+	if !found {
+		return s
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return s
+	}
+
+	if (ip.To4() != nil && bits == "32") || (ip.To4() == nil && bits == "128") {
+		return addr
+	}
+
+	return s
+}
+
+// foldChecksums adds the checksums of documents that are now below the
+// checkpointed offset to the checkpoint
+func (m *Migrator) foldChecksums(sums tableSums) {
+	if len(sums) == 0 {
+		return
+	}
+
+	m.cp.Lock()
+	defer m.cp.Unlock()
+
+	if m.cp.Checksums == nil {
+		m.cp.Checksums = make(map[string]*types.TableChecksum)
+	}
+
+	for table, s := range sums {
+		c, ok := m.cp.Checksums[string(table)]
+		if !ok {
+			c = &types.TableChecksum{Columns: m.hasher.columnNames(table)}
+			m.cp.Checksums[string(table)] = c
+		}
+
+		c.Rows += s.rows
+		c.Sum += s.sum
+	}
+}
+
+// checkChecksumColumns warns if the checkpoint's checksums were computed over
+// different columns than the current mapping hashes
+func (m *Migrator) checkChecksumColumns() {
+	for table, c := range m.cp.Checksums {
+		if strings.Join(c.Columns, ",") != strings.Join(m.hasher.columnNames(Table(table)), ",") {
+			m.log.Warnf("Mapping of table '%s' changed since the checkpoint's checksum was started; "+
+				"the checksum will not match the destination", table)
+		}
+	}
+}
+
+// ChecksumResult is the result of Checksum (--checksum-output)
+type ChecksumResult struct {
+	CheckpointFile string `json:"checkpoint_file"`
+
+	// Whether the checkpoint's migration has completed; checksums of an
+	// incomplete migration only cover the documents up to its offset
+	Completed bool                      `json:"completed"`
+	Tables    map[string]*ChecksumTable `json:"tables"`
+	OK        bool                      `json:"ok"`
+}
+
+// ChecksumTable compares the checksum of a table's source rows (from the
+// checkpoint) with the checksum computed over the destination table
+type ChecksumTable struct {
+	Columns         []string `json:"columns"`
+	SourceRows      int64    `json:"source_rows"`
+	SourceSum       string   `json:"source_sum"`
+	DestinationRows int64    `json:"destination_rows"`
+	DestinationSum  string   `json:"destination_sum"`
+	Match           bool     `json:"match"`
+
+	// Computes destination_rows and destination_sum
+	Query string `json:"query"`
+}
+
+// Checksum computes the checksum of every mapped table on the destination and
+// compares it with the checksum of the source rows recorded in the
+// checkpoint. The result is written to --checksum-output; returns an error if
+// any table differs.
+func Checksum(ctx context.Context, cfg *config.Config) error {
+	llog := logrus.WithFields(logrus.Fields{
+		"pkg":    "migrator",
+		"method": "Checksum",
+	})
+
+	if cfg.TOML.Destination.IsFile() {
+		return errors.Errorf("checksum does not support destination.type '%s'", cfg.TOML.Destination.Type)
+	}
+
+	plan, err := buildPlan(cfg.TOML.Mapping, cfg.TOML.Tables)
+	if err != nil {
+		return errors.Wrap(err, "unable to build mapping plan")
+	}
+
+	cp, err := checkpoint.Read(cfg.TOML.Config.CheckpointFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to read checkpoint")
+	}
+
+	m := &Migrator{
+		cfg:    cfg,
+		cp:     cp,
+		plan:   plan,
+		hasher: newRowHasher(plan),
+		log:    logrus.WithField("pkg", "migrator"),
+	}
+
+	m.checkChecksumColumns()
+
+	pool, err := m.createPGPool(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error creating postgres connection pool")
+	}
+	defer pool.Close()
+
+	result := &ChecksumResult{
+		CheckpointFile: cfg.TOML.Config.CheckpointFile,
+		Completed:      cp.CompletedAt != nil && !cp.CompletedAt.IsZero(),
+		Tables:         make(map[string]*ChecksumTable),
+		OK:             true,
+	}
+
+	for table := range m.hasher.columns {
+		t := &ChecksumTable{
+			Columns:   m.hasher.columnNames(table),
+			SourceSum: "0",
+			Query:     m.hasher.checksumQuery(table),
+		}
+
+		if c, ok := cp.Checksums[string(table)]; ok {
+			t.SourceRows = c.Rows
+			t.SourceSum = strconv.FormatUint(c.Sum, 10)
+		}
+
+		if err := pool.QueryRow(ctx, t.Query).Scan(&t.DestinationRows, &t.DestinationSum); err != nil {
+			return errors.Wrapf(err, "unable to compute checksum of table '%s'", table)
+		}
+
+		t.Match = t.SourceRows == t.DestinationRows && t.SourceSum == t.DestinationSum
+
+		if !t.Match {
+			result.OK = false
+		}
+
+		llog.Infof("Table '%s': source %d rows (sum %s), destination %d rows (sum %s), match: %v",
+			table, t.SourceRows, t.SourceSum, t.DestinationRows, t.DestinationSum, t.Match)
+
+		result.Tables[string(table)] = t
+	}
+
+	if !result.Completed {
+		llog.Warn("Migration has not completed; source checksums only cover the documents migrated so far")
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal checksum result")
+	}
+
+	if err := writeOutput(cfg.CLI.ChecksumOutput, string(data)); err != nil {
+		return errors.Wrap(err, "unable to write checksum result")
+	}
+
+	if !result.OK {
+		return errors.New("destination checksums do not match source")
+	}
+
+	llog.Info("Destination checksums match source")
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package migrator
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dselans/mmmbop/conv"
+)
+
+// Expected values are the output of the SQL in checksumSQL on PostgreSQL
+
+func TestFloatText(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string // SELECT <in>::float8::numeric::text
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "0"},
+		{100, "100"},
+		{0.1, "0.1"},
+		{0.1 + 0.2, "0.3"},
+		{1.0 / 3, "0.333333333333333"},
+		{2.0 / 3, "0.666666666666667"},
+		{-1.5, "-1.5"},
+		{123456789.123456789, "123456789.123457"},
+		{9007199254740993, "9007199254740990"},
+		{1e20, "100000000000000000000"},
+		{1e-7, "0.0000001"},
+		{-2.5e-5, "-0.000025"},
+		{math.NaN(), "NaN"},
+		{math.Inf(1), "Infinity"},
+		{math.Inf(-1), "-Infinity"},
+	}
+
+	for _, tt := range tests {
+		if got := floatText(tt.in); got != tt.want {
+			t.Errorf("floatText(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecimalText(t *testing.T) {
+	tests := []struct {
+		in   string
+		trim bool
+		want string
+	}{
+		// SELECT trim_scale('<in>'::numeric)::text
+		{"1.500", true, "1.5"},
+		{"1500", true, "1500"},
+		{"0.000", true, "0"},
+		{"-0.0", true, "0"},
+		{"1.5e3", true, "1500"},
+		{"1.5E+3", true, "1500"},
+		{"-1E-33", true, "-0.000000000000000000000000000000001"},
+		{"00012.340", true, "12.34"},
+		{"+7", true, "7"},
+		{".5", true, "0.5"},
+		{"1234567890123456789012345678901234", true, "1234567890123456789012345678901234"},
+		{"NaN", true, "NaN"},
+
+		// SELECT '<in>'::numeric::text (jsonb numbers keep their scale)
+		{"1.50", false, "1.50"},
+		{"1e2", false, "100"},
+		{"1.0e1", false, "10"},
+		{"1.50e1", false, "15.0"},
+		{"1.5e-3", false, "0.0015"},
+		{"-0", false, "0"},
+		{"0.00", false, "0.00"},
+		{"12345678901234567890.123456789", false, "12345678901234567890.123456789"},
+	}
+
+	for _, tt := range tests {
+		if got := decimalText(tt.in, tt.trim); got != tt.want {
+			t.Errorf("decimalText(%q, %v) = %q, want %q", tt.in, tt.trim, got, tt.want)
+		}
+	}
+}
+
+func TestJSONBText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // SELECT '<in>'::jsonb::text
+	}{
+		{`{}`, `{}`},
+		{`[]`, `[]`},
+		{`"abc"`, `"abc"`},
+		{`1e2`, `100`},
+		{`null`, `null`},
+		{`{"b":1,"aa":2,"a":3}`, `{"a": 3, "b": 1, "aa": 2}`},
+		{`{"a":1,"a":2}`, `{"a": 2}`},
+		{`{"é":1,"ab":2,"z":3}`, `{"z": 3, "ab": 2, "é": 1}`},
+		{`[1,"x",null,true,{"y":1.10,"x":false}]`, `[1, "x", null, true, {"x": false, "y": 1.10}]`},
+		{`{"n":1e2,"m":-0.0,"f":1.5E-3}`, `{"f": 0.0015, "m": 0.0, "n": 100}`},
+		{`{"k\"":"a\"b\\c\n\t\u0001é/<>&"}`, `{"k\"": "a\"b\\c\n\t\u0001é/<>&"}`},
+		{` { "nested" : { "b" : [ ] , "a" : { } } } `, `{"nested": {"a": {}, "b": []}}`},
+	}
+
+	for _, tt := range tests {
+		got, err := jsonbText(tt.in)
+		if err != nil {
+			t.Errorf("jsonbText(%q): %v", tt.in, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("jsonbText(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := jsonbText(`{"a":`); err == nil {
+		t.Error("jsonbText of invalid json did not fail")
+	}
+}
+
+func TestInetText(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // SELECT abbrev('<in>'::inet)
+	}{
+		{"10.1.2.3", "10.1.2.3"},
+		{"10.1.2.3/32", "10.1.2.3"},
+		{"10.1.0.0/16", "10.1.0.0/16"},
+		{"2001:db8::1/128", "2001:db8::1"},
+		{"2001:db8::/32", "2001:db8::/32"},
+	}
+
+	for _, tt := range tests {
+		if got := inetText(tt.in); got != tt.want {
+			t.Errorf("inetText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumText(t *testing.T) {
+	ts := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.FixedZone("", 2*3600))
+
+	tests := []struct {
+		conv string
+		in   interface{}
+		want string
+	}{
+		{"int", int64(-42), "-42"},
+		{"bool", true, "true"},
+		{"uuid", "0B0E8A2C-6F0E-4B8E-9A8E-1C2D3E4F5A6B", "0b0e8a2c-6f0e-4b8e-9a8e-1c2d3e4f5a6b"},
+		{"numeric", "1.500", "1.5"},
+		{"bytea", []byte{0xde, 0xad}, "dead"},
+		{"date", time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC), "2024-05-06"},
+		{"timestamptz", ts, "2024-05-06T05:08:09.123456"},
+		{"timestamp", ts.UTC(), "2024-05-06T05:08:09.123456"},
+		{"timestamptz", time.Date(2024, 5, 6, 7, 8, 9, 123456500, time.UTC), "2024-05-06T07:08:09.123457"},
+		{"timestamptz", time.Date(2024, 5, 6, 7, 8, 9, 123456499, time.UTC), "2024-05-06T07:08:09.123456"},
+		{"time", "07:08:09.5", "07:08:09.500000"},
+		{"time", "07:08:09.9999995", "07:08:10.000000"},
+		{"int[]", conv.Array{int64(1), nil, int64(3)}, "1" + checksumElementSep + checksumNull + checksumElementSep + "3"},
+		{"string[]", conv.Array{}, ""},
+	}
+
+	for _, tt := range tests {
+		got, err := checksumText(tt.conv, tt.in)
+		if err != nil {
+			t.Errorf("checksumText(%q, %#v): %v", tt.conv, tt.in, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("checksumText(%q, %#v) = %q, want %q", tt.conv, tt.in, got, tt.want)
+		}
+	}
+}
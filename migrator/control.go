@@ -0,0 +1,140 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Limits is the request/response body of the /limits control endpoint
+type Limits struct {
+	MaxRowsPerSec  *int64 `json:"max_rows_per_sec,omitempty"`
+	MaxBytesPerSec *int64 `json:"max_bytes_per_sec,omitempty"`
+}
+
+// runControlServer serves the control endpoint on --control-addr (a loopback
+// address, as the endpoint is unauthenticated) until shutdownCtx is done:
+//
+//	GET  /limits - current destination write limits
+//	POST /limits - update limits (omitted fields are left unchanged, 0 = unlimited)
+//	GET  /report - latest progress report
+//	GET  /pause  - paused state
+//	POST /pause  - pause: stop reading, let writers drain and save a checkpoint
+//	POST /resume - resume a paused migration
+func (m *Migrator) runControlServer(shutdownCtx context.Context) error {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "runControlServer",
+	})
+
+	if m.cfg.CLI.ControlAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limits", m.handleLimits)
+	mux.HandleFunc("/report", m.handleReport)
+	mux.HandleFunc("/pause", m.handlePause)
+	mux.HandleFunc("/resume", m.handlePause)
+
+	ln, err := net.Listen("tcp", m.cfg.CLI.ControlAddr)
+	if err != nil {
+		return errors.Wrapf(err, "unable to listen on '%s'", m.cfg.CLI.ControlAddr)
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-shutdownCtx.Done()
+		srv.Close()
+	}()
+
+	llog.Infof("Control endpoint listening on '%s'", ln.Addr())
+
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "control endpoint error")
+	}
+
+	return nil
+}
+
+func (m *Migrator) handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		req := &Limits{}
+
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows, bytes := m.throttle.Limits()
+
+		if req.MaxRowsPerSec != nil {
+			rows = *req.MaxRowsPerSec
+		}
+
+		if req.MaxBytesPerSec != nil {
+			bytes = *req.MaxBytesPerSec
+		}
+
+		if rows < 0 || bytes < 0 {
+			http.Error(w, "limits cannot be negative", http.StatusBadRequest)
+			return
+		}
+
+		m.throttle.Set(rows, bytes)
+
+		m.log.Infof("Destination write limits changed to %d rows/sec, %d bytes/sec", rows, bytes)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, bytes := m.throttle.Limits()
+
+	writeJSON(w, &Limits{MaxRowsPerSec: &rows, MaxBytesPerSec: &bytes})
+}
+
+func (m *Migrator) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := m.lastReport.Load()
+	if report == nil {
+		http.Error(w, "no report available yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(w, report)
+}
+
+func (m *Migrator) handlePause(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet:
+	case r.Method != http.MethodPost:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case r.URL.Path == "/pause":
+		m.Pause()
+	default:
+		m.Resume()
+	}
+
+	writeJSON(w, m.pauser.report())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
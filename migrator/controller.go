@@ -0,0 +1,335 @@
+package migrator
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/config"
+)
+
+const (
+	// How often idle (inactive) writers check whether they were activated
+	idleWriterPoll = 250 * time.Millisecond
+
+	// Latency band (relative to the target) within which the controller holds
+	latencyLowWater  = 0.8
+	latencyHighWater = 1.2
+
+	replicationLagQuery = `SELECT COALESCE(EXTRACT(EPOCH FROM MAX(replay_lag)), 0)::float8 FROM pg_stat_replication`
+)
+
+// Postgres error codes that indicate contention; the controller backs off
+// when it sees them
+var lockErrorCodes = map[string]struct{}{
+	"55P03": {}, // lock_not_available (lock_timeout)
+	"40P01": {}, // deadlock_detected
+}
+
+// controller tunes the number of active writers and the batch size towards
+// config.adaptive.target_latency (AIMD): it grows slowly while batches are
+// fast and writers are the bottleneck and halves both on lock timeouts,
+// deadlocks or excessive replication lag. When config.adaptive is disabled
+// it simply returns the static num_writers/batch_size.
+type controller struct {
+	cfg *config.TOMLAdaptive
+	log *logrus.Entry
+
+	writers   atomic.Int64
+	batchSize atomic.Int64
+
+	// Number of jobs waiting for a writer; used to tell whether writers are
+	// the bottleneck
+	backlog func() int
+
+	mu sync.Mutex
+
+	// Observations since the last decision
+	batches      int64
+	docs         int64
+	latency      time.Duration
+	lockTimeouts int64
+
+	lockTimeoutsTotal int64
+	replicationLag    time.Duration
+	lagUnavailable    bool
+	last              *ControllerDecision
+}
+
+// ControllerDecision is a single adjustment made by the controller
+type ControllerDecision struct {
+	At         time.Time     `json:"at"`
+	Writers    int           `json:"writers"`
+	BatchSize  int           `json:"batch_size"`
+	AvgLatency time.Duration `json:"-"`
+	Throughput float64       `json:"docs_per_sec"`
+	Reason     string        `json:"reason"`
+}
+
+func newController(cfg *config.TOMLConfig, backlog func() int) *controller {
+	c := &controller{
+		cfg:     cfg.Adaptive,
+		log:     logrus.WithFields(logrus.Fields{"pkg": "migrator", "method": "controller"}),
+		backlog: backlog,
+	}
+
+	writers, batchSize := cfg.NumWriters, cfg.BatchSize
+
+	if c.cfg.Enabled {
+		writers = clamp(writers, c.cfg.MinWriters, c.cfg.MaxWriters)
+		batchSize = clamp(batchSize, c.cfg.MinBatchSize, c.cfg.MaxBatchSize)
+	}
+
+	c.writers.Store(int64(writers))
+	c.batchSize.Store(int64(batchSize))
+
+	return c
+}
+
+// maxWriters is the number of writer goroutines to launch
+func (c *controller) maxWriters() int {
+	if !c.cfg.Enabled {
+		return int(c.writers.Load())
+	}
+
+	return c.cfg.MaxWriters
+}
+
+// active reports whether writer id should currently be writing
+func (c *controller) active(id int) bool {
+	return int64(id) < c.writers.Load()
+}
+
+func (c *controller) BatchSize() int {
+	return int(c.batchSize.Load())
+}
+
+// observe records the outcome of a single batch write
+func (c *controller) observe(docs int, latency time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		if isLockError(err) {
+			c.lockTimeouts++
+			c.lockTimeoutsTotal++
+		}
+
+		return
+	}
+
+	c.batches++
+	c.docs += int64(docs)
+	c.latency += latency
+}
+
+// runController runs the controller (if config.adaptive is enabled) until
+// shutdownCtx is done
+func (m *Migrator) runController(shutdownCtx context.Context) {
+	if !m.ctrl.cfg.Enabled {
+		return
+	}
+
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "runController",
+	})
+
+	llog.Debug("Start")
+	defer llog.Debug("Exit")
+
+	var pool *pgxpool.Pool
+
+	// Only needed for checking replication lag
+	if m.ctrl.cfg.MaxReplicationLag > 0 {
+		p, err := m.createPGPool(shutdownCtx)
+		if err != nil {
+			llog.Warnf("Unable to create connection pool, replication lag will not be checked: %s", err)
+		} else {
+			pool = p
+			defer pool.Close()
+		}
+	}
+
+	m.ctrl.run(shutdownCtx, pool)
+}
+
+// run re-evaluates settings every config.adaptive.interval until ctx is done.
+// pool is used for checking replication lag and may be nil.
+func (c *controller) run(ctx context.Context, pool *pgxpool.Pool) {
+	ticker := time.NewTicker(time.Duration(c.cfg.Interval))
+	defer ticker.Stop()
+
+	lastTick := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if c.cfg.MaxReplicationLag > 0 && pool != nil {
+				c.checkReplicationLag(ctx, pool)
+			}
+
+			c.decide(now.Sub(lastTick))
+			lastTick = now
+		}
+	}
+}
+
+func (c *controller) checkReplicationLag(ctx context.Context, pool *pgxpool.Pool) {
+	var lag float64
+
+	if err := pool.QueryRow(ctx, replicationLagQuery).Scan(&lag); err != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if !c.lagUnavailable {
+			c.log.Warnf("Unable to determine replication lag: %s", err)
+		}
+
+		c.lagUnavailable = true
+
+		return
+	}
+
+	c.mu.Lock()
+	c.replicationLag = time.Duration(lag * float64(time.Second))
+	c.lagUnavailable = false
+	c.mu.Unlock()
+}
+
+// decide applies one control step based on the observations made during the
+// last interval
+func (c *controller) decide(elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writers := int(c.writers.Load())
+	batchSize := int(c.batchSize.Load())
+	target := time.Duration(c.cfg.TargetLatency)
+
+	var avg time.Duration
+	if c.batches > 0 {
+		avg = c.latency / time.Duration(c.batches)
+	}
+
+	throughput := float64(c.docs) / elapsed.Seconds()
+
+	var reason string
+
+	switch {
+	case c.lockTimeouts > 0:
+		reason = "backoff: lock timeouts/deadlocks"
+		writers, batchSize = writers/2, batchSize/2
+	case c.cfg.MaxReplicationLag > 0 && c.replicationLag > time.Duration(c.cfg.MaxReplicationLag):
+		reason = "backoff: replication lag " + c.replicationLag.Round(time.Millisecond).String()
+		writers, batchSize = writers/2, batchSize/2
+	case c.batches == 0:
+		reason = "hold: no batches written"
+	case avg > time.Duration(float64(target)*latencyHighWater):
+		reason = "decrease: latency " + avg.Round(time.Millisecond).String() + " above target"
+
+		// Smaller batches first; fewer writers once batches are minimal
+		if batchSize > c.cfg.MinBatchSize {
+			batchSize -= max(batchSize/4, 1)
+		} else {
+			writers--
+		}
+	case avg < time.Duration(float64(target)*latencyLowWater) && c.backlog() > 0:
+		reason = "increase: latency " + avg.Round(time.Millisecond).String() + " below target with backlog"
+
+		if batchSize < c.cfg.MaxBatchSize {
+			batchSize += max(batchSize/4, 1)
+		} else {
+			writers++
+		}
+	default:
+		reason = "hold: latency " + avg.Round(time.Millisecond).String() + " within target"
+	}
+
+	writers = clamp(writers, c.cfg.MinWriters, c.cfg.MaxWriters)
+	batchSize = clamp(batchSize, c.cfg.MinBatchSize, c.cfg.MaxBatchSize)
+
+	if writers != int(c.writers.Load()) || batchSize != int(c.batchSize.Load()) {
+		c.log.Infof("Adjusting writers %d -> %d, batch size %d -> %d (%s)",
+			c.writers.Load(), writers, c.batchSize.Load(), batchSize, reason)
+	}
+
+	c.writers.Store(int64(writers))
+	c.batchSize.Store(int64(batchSize))
+
+	c.last = &ControllerDecision{
+		At:         time.Now(),
+		Writers:    writers,
+		BatchSize:  batchSize,
+		AvgLatency: avg,
+		Throughput: throughput,
+		Reason:     reason,
+	}
+
+	c.batches, c.docs, c.latency, c.lockTimeouts = 0, 0, 0, 0
+}
+
+// ControllerReport is the controller section of the progress report
+type ControllerReport struct {
+	Adaptive          bool                `json:"adaptive"`
+	ActiveWriters     int                 `json:"active_writers"`
+	BatchSize         int                 `json:"batch_size"`
+	TargetLatency     string              `json:"target_latency,omitempty"`
+	AvgBatchLatency   string              `json:"avg_batch_latency,omitempty"`
+	ReplicationLag    string              `json:"replication_lag,omitempty"`
+	LockTimeoutsTotal int64               `json:"lock_timeouts_total"`
+	LastDecision      *ControllerDecision `json:"last_decision,omitempty"`
+}
+
+func (c *controller) report() *ControllerReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := &ControllerReport{
+		Adaptive:          c.cfg.Enabled,
+		ActiveWriters:     int(c.writers.Load()),
+		BatchSize:         int(c.batchSize.Load()),
+		LockTimeoutsTotal: c.lockTimeoutsTotal,
+	}
+
+	if !c.cfg.Enabled {
+		return r
+	}
+
+	r.TargetLatency = time.Duration(c.cfg.TargetLatency).String()
+
+	if c.cfg.MaxReplicationLag > 0 && !c.lagUnavailable {
+		r.ReplicationLag = c.replicationLag.Round(time.Millisecond).String()
+	}
+
+	if c.last != nil {
+		decision := *c.last
+		r.LastDecision = &decision
+		r.AvgBatchLatency = c.last.AvgLatency.Round(time.Millisecond).String()
+	}
+
+	return r
+}
+
+func isLockError(err error) bool {
+	var pgErr *pgconn.PgError
+
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	_, ok := lockErrorCodes[pgErr.Code]
+
+	return ok
+}
+
+func clamp(v, lo, hi int) int {
+	return min(max(v, lo), hi)
+}
@@ -0,0 +1,338 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/checkpoint/types"
+)
+
+// Mapped tables ($1) are resolved through the search_path, the same way the
+// unqualified statements that write to them are
+const (
+	// Non-unique indexes that do not back a constraint. Indexes whose leading
+	// column is a dupe-check column are kept so that dupe checks stay fast.
+	deferrableIndexesQuery = `
+        SELECT c.relname, i.indexrelid::regclass::text, pg_get_indexdef(i.indexrelid),
+               COALESCE((SELECT a.attname FROM pg_attribute a
+                         WHERE a.attrelid = i.indrelid AND a.attnum = i.indkey[0]), '')
+        FROM pg_index i
+        JOIN pg_class c ON c.oid = i.indrelid
+        WHERE c.oid IN (SELECT to_regclass(quote_ident(t)) FROM unnest($1::text[]) t)
+          AND NOT i.indisprimary AND NOT i.indisunique
+          AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid)
+        ORDER BY 1, 2
+    `
+
+	deferrableForeignKeysQuery = `
+        SELECT c.oid::regclass::text, con.conname, pg_get_constraintdef(con.oid)
+        FROM pg_constraint con
+        JOIN pg_class c ON c.oid = con.conrelid
+        WHERE con.contype = 'f' AND c.oid IN (SELECT to_regclass(quote_ident(t)) FROM unnest($1::text[]) t)
+        ORDER BY 1, 2
+    `
+)
+
+// deferIndexes records the non-essential indexes and foreign keys of all
+// mapped tables in the checkpoint and then drops them. Objects recorded by a
+// previous (interrupted) run are kept so that they are restored as well.
+func (m *Migrator) deferIndexes(shutdownCtx context.Context, pool *pgxpool.Pool) error {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "deferIndexes",
+	})
+
+	tables, dupeChecks := m.mappedTables()
+
+	found := &types.DeferredDDL{}
+
+	if err := queryDeferrable(shutdownCtx, pool, deferrableIndexesQuery, tables, func(values []string) {
+		table, name, def, leading := values[0], values[1], values[2], values[3]
+
+		if contains(dupeChecks[table], leading) {
+			llog.Debugf("Keeping index '%s' used by dupe checks", name)
+			return
+		}
+
+		found.Indexes = append(found.Indexes, &types.DeferredObject{Table: table, Name: name, Definition: def})
+	}); err != nil {
+		return errors.Wrap(err, "unable to query indexes")
+	}
+
+	if err := queryDeferrable(shutdownCtx, pool, deferrableForeignKeysQuery, tables, func(values []string) {
+		found.ForeignKeys = append(found.ForeignKeys, &types.DeferredObject{Table: values[0], Name: values[1], Definition: values[2]})
+	}); err != nil {
+		return errors.Wrap(err, "unable to query foreign keys")
+	}
+
+	if len(found.Indexes) == 0 && len(found.ForeignKeys) == 0 {
+		llog.Debug("No indexes or foreign keys to defer")
+		return nil
+	}
+
+	if m.cfg.CLI.DryRun {
+		for _, idx := range found.Indexes {
+			llog.Infof("Dry run: would drop index '%s' on '%s'", idx.Name, idx.Table)
+		}
+
+		for _, fk := range found.ForeignKeys {
+			llog.Infof("Dry run: would drop foreign key '%s' on '%s'", fk.Name, fk.Table)
+		}
+
+		return nil
+	}
+
+	// Persist the DDL *before* dropping anything so that a crash in between
+	// cannot lose it
+	m.cp.Lock()
+
+	if m.cp.DeferredDDL == nil {
+		m.cp.DeferredDDL = &types.DeferredDDL{}
+	}
+
+	m.cp.DeferredDDL.Indexes = mergeDeferred(m.cp.DeferredDDL.Indexes, found.Indexes)
+	m.cp.DeferredDDL.ForeignKeys = mergeDeferred(m.cp.DeferredDDL.ForeignKeys, found.ForeignKeys)
+
+	m.cp.Unlock()
+
+	if err := m.cp.Save(m.cfg.TOML.Config.CheckpointFile); err != nil {
+		return errors.Wrap(err, "unable to save deferred ddl to checkpoint")
+	}
+
+	tx, err := pool.Begin(shutdownCtx)
+	if err != nil {
+		return errors.Wrap(err, "unable to begin transaction")
+	}
+
+	// No-op if tx has been committed
+	defer tx.Rollback(shutdownCtx)
+
+	// Foreign keys first; they may depend on indexes
+	for _, fk := range found.ForeignKeys {
+		llog.Infof("Dropping foreign key '%s' on '%s'", fk.Name, fk.Table)
+
+		query := fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", fk.Table, pgx.Identifier{fk.Name}.Sanitize())
+
+		if _, err := tx.Exec(shutdownCtx, query); err != nil {
+			return errors.Wrapf(err, "unable to drop foreign key '%s'", fk.Name)
+		}
+	}
+
+	for _, idx := range found.Indexes {
+		llog.Infof("Dropping index '%s' on '%s'", idx.Name, idx.Table)
+
+		if _, err := tx.Exec(shutdownCtx, "DROP INDEX IF EXISTS "+idx.Name); err != nil {
+			return errors.Wrapf(err, "unable to drop index '%s'", idx.Name)
+		}
+	}
+
+	if err := tx.Commit(shutdownCtx); err != nil {
+		return errors.Wrap(err, "unable to commit transaction")
+	}
+
+	return nil
+}
+
+// RestoreIndexes recreates indexes and foreign keys recorded in the checkpoint
+// by destination.defer_indexes. Indexes are created concurrently and foreign
+// keys are added as NOT VALID and validated afterwards, so that neither blocks
+// writes to the tables for long. Each restored object is removed from the
+// checkpoint, so an interrupted restore can simply be re-run.
+func (m *Migrator) RestoreIndexes(ctx context.Context) error {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "RestoreIndexes",
+	})
+
+	if !m.cp.HasDeferredDDL() {
+		llog.Debug("No deferred indexes or foreign keys to restore")
+		return nil
+	}
+
+	if m.cfg.CLI.DryRun {
+		llog.Info("Dry run: skipping restore of deferred indexes and foreign keys")
+		return nil
+	}
+
+	pool, err := m.createPGPool(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error creating postgres connection pool")
+	}
+	defer pool.Close()
+
+	// Indexes first; foreign keys validate faster with indexes in place
+	for len(m.cp.DeferredDDL.Indexes) > 0 {
+		idx := m.cp.DeferredDDL.Indexes[0]
+
+		llog.Infof("Recreating index '%s' on '%s'", idx.Name, idx.Table)
+
+		if err := restoreIndex(ctx, pool, idx); err != nil {
+			return errors.Wrapf(err, "unable to recreate index '%s'", idx.Name)
+		}
+
+		if err := m.saveDeferred(func(d *types.DeferredDDL) { d.Indexes = d.Indexes[1:] }); err != nil {
+			return err
+		}
+	}
+
+	for len(m.cp.DeferredDDL.ForeignKeys) > 0 {
+		fk := m.cp.DeferredDDL.ForeignKeys[0]
+
+		llog.Infof("Recreating foreign key '%s' on '%s'", fk.Name, fk.Table)
+
+		if err := restoreForeignKey(ctx, pool, fk); err != nil {
+			return errors.Wrapf(err, "unable to recreate foreign key '%s'", fk.Name)
+		}
+
+		if err := m.saveDeferred(func(d *types.DeferredDDL) { d.ForeignKeys = d.ForeignKeys[1:] }); err != nil {
+			return err
+		}
+	}
+
+	return m.saveDeferred(func(*types.DeferredDDL) { m.cp.DeferredDDL = nil })
+}
+
+func (m *Migrator) saveDeferred(update func(d *types.DeferredDDL)) error {
+	m.cp.Lock()
+	update(m.cp.DeferredDDL)
+	m.cp.Unlock()
+
+	if err := m.cp.Save(m.cfg.TOML.Config.CheckpointFile); err != nil {
+		return errors.Wrap(err, "unable to save checkpoint")
+	}
+
+	return nil
+}
+
+func restoreIndex(ctx context.Context, pool *pgxpool.Pool, idx *types.DeferredObject) error {
+	// A failed concurrent build leaves an invalid index behind; drop it so
+	// that IF NOT EXISTS does not skip the rebuild
+	var valid bool
+
+	err := pool.QueryRow(ctx, "SELECT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1)", idx.Name).Scan(&valid)
+
+	switch {
+	case err == pgx.ErrNoRows:
+	case err != nil:
+		return errors.Wrap(err, "unable to check for existing index")
+	case valid:
+		return nil
+	default:
+		if _, err := pool.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+idx.Name); err != nil {
+			return errors.Wrap(err, "unable to drop invalid index")
+		}
+	}
+
+	if !strings.HasPrefix(idx.Definition, "CREATE INDEX ") {
+		return errors.Errorf("unexpected index definition '%s'", idx.Definition)
+	}
+
+	query := "CREATE INDEX CONCURRENTLY IF NOT EXISTS " + strings.TrimPrefix(idx.Definition, "CREATE INDEX ")
+
+	if _, err := pool.Exec(ctx, query); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func restoreForeignKey(ctx context.Context, pool *pgxpool.Pool, fk *types.DeferredObject) error {
+	var exists bool
+
+	if err := pool.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM pg_constraint WHERE conrelid = to_regclass($1) AND conname = $2)",
+		fk.Table, fk.Name,
+	).Scan(&exists); err != nil {
+		return errors.Wrap(err, "unable to check for existing foreign key")
+	}
+
+	name := pgx.Identifier{fk.Name}.Sanitize()
+
+	if !exists {
+		// Constraints that were NOT VALID to begin with stay that way
+		def := strings.TrimSuffix(fk.Definition, " NOT VALID")
+
+		query := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s NOT VALID", fk.Table, name, def)
+
+		if _, err := pool.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	if strings.HasSuffix(fk.Definition, " NOT VALID") {
+		return nil
+	}
+
+	if _, err := pool.Exec(ctx, fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s", fk.Table, name)); err != nil {
+		return errors.Wrap(err, "unable to validate constraint")
+	}
+
+	return nil
+}
+
+// mappedTables returns the names of all mapped tables and their dupe-check
+// columns
+func (m *Migrator) mappedTables() ([]string, map[string][]string) {
+	tables := make([]string, 0)
+	dupeChecks := make(map[string][]string)
+
+	var walk func(plans []*tablePlan)
+
+	walk = func(plans []*tablePlan) {
+		for _, p := range plans {
+			tables = append(tables, string(p.table))
+			dupeChecks[string(p.table)] = p.dupeCheck
+
+			walk(p.children)
+		}
+	}
+
+	walk(m.plan)
+
+	return tables, dupeChecks
+}
+
+func queryDeferrable(ctx context.Context, pool *pgxpool.Pool, query string, tables []string, f func(values []string)) error {
+	rows, err := pool.Query(ctx, query, tables)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		values := make([]string, len(rows.FieldDescriptions()))
+
+		dest := make([]interface{}, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+
+		f(values)
+	}
+
+	return rows.Err()
+}
+
+// mergeDeferred appends objects from found that are not in saved yet
+func mergeDeferred(saved, found []*types.DeferredObject) []*types.DeferredObject {
+FOUND:
+	for _, f := range found {
+		for _, s := range saved {
+			if s.Table == f.Table && s.Name == f.Name {
+				continue FOUND
+			}
+		}
+
+		saved = append(saved, f)
+	}
+
+	return saved
+}
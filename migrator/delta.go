@@ -0,0 +1,604 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/config"
+)
+
+// delta holds what is needed to write a delta migration (see config.TOMLDelta)
+type delta struct {
+	cfg   *config.TOMLDelta
+	plans map[Table]*tablePlan
+}
+
+// deltaCounts counts what a delta write did within a single transaction; added
+// to the stats once the transaction has been committed
+type deltaCounts struct {
+	updated   int64
+	unchanged int64
+	deleted   int64
+}
+
+func newDelta(cfg *config.TOMLDelta, plan []*tablePlan, log *logrus.Entry) *delta {
+	d := &delta{
+		cfg:   cfg,
+		plans: make(map[Table]*tablePlan),
+	}
+
+	var walk func(p *tablePlan)
+
+	walk = func(p *tablePlan) {
+		d.plans[p.table] = p
+
+		for _, child := range p.children {
+			if len(parentRefs(child)) == 0 {
+				log.Warnf("Table '%s' has no $parent.<column> entries; delta migrations only write its rows for new '%s' rows",
+					child.table, p.table)
+			}
+
+			walk(child)
+		}
+	}
+
+	for _, p := range plan {
+		walk(p)
+	}
+
+	return d
+}
+
+// parentRefs returns the child column -> parent column references of p
+func parentRefs(p *tablePlan) map[string]string {
+	refs := make(map[string]string)
+
+	for _, e := range p.entries {
+		if strings.HasPrefix(e.Src, config.SrcParentPrefix) {
+			_, column := config.ParseDst(e.Dst)
+			refs[column] = strings.TrimPrefix(e.Src, config.SrcParentPrefix)
+		}
+	}
+
+	return refs
+}
+
+// writeRowDelta inserts row (and its children) if no row with its dupe check
+// key exists; otherwise the row is updated if its hash changed and its
+// children are reconciled with the destination (see syncChildren)
+func (m *Migrator) writeRowDelta(shutdownCtx context.Context, tx pgx.Tx, row *Row, parent map[string]interface{}, counts *deltaCounts) error {
+	columns, values, err := withParentRefs(row, parent)
+	if err != nil {
+		return err
+	}
+
+	if len(row.DupeCheck) == 0 {
+		return m.insertTree(shutdownCtx, tx, row, parent)
+	}
+
+	if parent == nil && m.delta.cfg.DeleteMissing {
+		if err := m.recordKey(shutdownCtx, tx, row); err != nil {
+			return errors.Wrapf(err, "unable to record dupe check key of table '%s'", row.Table)
+		}
+	}
+
+	where, args := keyWhere(row, columns, values, nil)
+
+	p := m.delta.plans[row.Table]
+
+	// Soft deleted rows are looked up too; writing them restores them
+	live := "true"
+	if p.softDelete != "" {
+		live = liveWhere(p)
+	}
+
+	names := append([]string{"$hash", "$live"}, row.Returning...)
+	selects := []string{m.hasher.rowHashSQL(row.Table), live}
+
+	if len(row.Returning) > 0 {
+		selects = append(selects, selectList(row.Returning))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s LIMIT 1",
+		strings.Join(selects, ", "), pgx.Identifier{string(row.Table)}.Sanitize(), where)
+
+	found, err := queryReturning(shutdownCtx, tx, names, query, args...)
+	if err != nil {
+		return errors.Wrapf(err, "unable to look up row in table '%s'", row.Table)
+	}
+
+	if found == nil {
+		return m.insertTree(shutdownCtx, tx, row, parent)
+	}
+
+	hash, err := m.hasher.hashRow(row)
+	if err != nil {
+		return errors.Wrapf(err, "unable to hash row for table '%s'", row.Table)
+	}
+
+	returned := found
+
+	// Restoring a soft deleted row clears its soft delete column
+	isLive, _ := found["$live"].(bool)
+	if !isLive {
+		columns = append(append(make([]string, 0, len(columns)+1), columns...), p.softDelete)
+		values = append(append(make([]interface{}, 0, len(values)+1), values...), nil)
+	}
+
+	if dst, _ := found["$hash"].(int64); uint64(dst) == hash && isLive {
+		counts.unchanged++
+	} else {
+		updated, err := updateRow(shutdownCtx, tx, row, columns, values, where, args)
+		if err != nil {
+			return errors.Wrapf(err, "unable to update table '%s'", row.Table)
+		}
+
+		if updated != nil {
+			returned = updated
+		}
+
+		counts.updated++
+	}
+
+	return m.syncChildren(shutdownCtx, tx, row, returned, counts)
+}
+
+// syncChildren makes the destination children of row match the source.
+// Children with dupe check columns (besides their parent references) are
+// written with writeRowDelta and children that are no longer in the source are
+// deleted. Children without are compared as a set and replaced if any of them
+// changed.
+func (m *Migrator) syncChildren(shutdownCtx context.Context, tx pgx.Tx, row *Row, returned map[string]interface{}, counts *deltaCounts) error {
+	for _, cp := range m.delta.plans[row.Table].children {
+		refs := parentRefs(cp)
+		if len(refs) == 0 {
+			continue
+		}
+
+		var children []*Row
+
+		for _, child := range row.Children {
+			if child.Table == cp.table {
+				children = append(children, child)
+			}
+		}
+
+		where, args, err := refsWhere(refs, returned)
+		if err != nil {
+			return errors.Wrapf(err, "unable to reference children in table '%s'", cp.table)
+		}
+
+		var keyColumns []string
+
+		for _, dc := range cp.dupeCheck {
+			if _, ok := refs[dc]; !ok {
+				keyColumns = append(keyColumns, dc)
+			}
+		}
+
+		if len(keyColumns) > 0 {
+			keys := make([]string, 0, len(children))
+
+			for _, child := range children {
+				key, err := m.hasher.joinText(cp.table, keyColumns, child.Columns, child.Values)
+				if err != nil {
+					return errors.Wrapf(err, "unable to build dupe check key for table '%s'", cp.table)
+				}
+
+				keys = append(keys, key)
+
+				if err := m.writeRowDelta(shutdownCtx, tx, child, returned, counts); err != nil {
+					return err
+				}
+			}
+
+			args = append(args, keys)
+			where = fmt.Sprintf("%s AND NOT (%s = ANY($%d::text[]))", where, m.hasher.joinSQL(cp.table, keyColumns), len(args))
+
+			deleted, err := m.deleteRows(shutdownCtx, tx, cp, where, args)
+			if err != nil {
+				return errors.Wrapf(err, "unable to delete children from table '%s'", cp.table)
+			}
+
+			counts.deleted += deleted
+
+			continue
+		}
+
+		changed, err := m.childrenChanged(shutdownCtx, tx, cp.table, children, where, args)
+		if err != nil {
+			return errors.Wrapf(err, "unable to compare children in table '%s'", cp.table)
+		}
+
+		if !changed {
+			counts.unchanged += int64(len(children))
+			continue
+		}
+
+		deleted, err := m.deleteRows(shutdownCtx, tx, cp, where, args)
+		if err != nil {
+			return errors.Wrapf(err, "unable to delete children from table '%s'", cp.table)
+		}
+
+		counts.deleted += deleted
+
+		for _, child := range children {
+			if err := m.insertTree(shutdownCtx, tx, child, returned); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// childrenChanged compares the hashes of children with the hashes of the
+// destination rows matching where
+func (m *Migrator) childrenChanged(shutdownCtx context.Context, tx pgx.Tx, table Table, children []*Row, where string, args []interface{}) (bool, error) {
+	var src tableSum
+
+	for _, child := range children {
+		hash, err := m.hasher.hashRow(child)
+		if err != nil {
+			return false, err
+		}
+
+		src.rows++
+		src.sum += hash
+	}
+
+	query := fmt.Sprintf("SELECT count(*), %s FROM (SELECT %s::numeric AS h FROM %s WHERE %s) r",
+		sumSQL, m.hasher.rowHashSQL(table), pgx.Identifier{string(table)}.Sanitize(), where)
+
+	var (
+		rows int64
+		sum  string
+	)
+
+	if err := tx.QueryRow(shutdownCtx, query, args...).Scan(&rows, &sum); err != nil {
+		return false, err
+	}
+
+	dst, err := strconv.ParseUint(sum, 10, 64)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse sum '%s'", sum)
+	}
+
+	return rows != src.rows || dst != src.sum, nil
+}
+
+// insertTree inserts row and (recursively) its children without dupe checks
+func (m *Migrator) insertTree(shutdownCtx context.Context, tx pgx.Tx, row *Row, parent map[string]interface{}) error {
+	columns, values, err := withParentRefs(row, parent)
+	if err != nil {
+		return err
+	}
+
+	returned, err := insertRow(shutdownCtx, tx, row, columns, values)
+	if err != nil {
+		return errors.Wrapf(err, "unable to insert into table '%s'", row.Table)
+	}
+
+	for _, child := range row.Children {
+		if err := m.insertTree(shutdownCtx, tx, child, returned); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateRow sets all (non dupe check) columns of the rows matching where.
+// Returns the returning columns of the updated row, or nil if there was
+// nothing to update.
+func updateRow(shutdownCtx context.Context, tx pgx.Tx, row *Row, columns []string, values []interface{}, where string, args []interface{}) (map[string]interface{}, error) {
+	sets := make([]string, 0, len(columns))
+
+	for i, c := range columns {
+		if contains(row.DupeCheck, c) {
+			continue
+		}
+
+		args = append(args, values[i])
+		sets = append(sets, fmt.Sprintf("%s = $%d", pgx.Identifier{c}.Sanitize(), len(args)))
+	}
+
+	if len(sets) == 0 {
+		return nil, nil
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s",
+		pgx.Identifier{string(row.Table)}.Sanitize(), strings.Join(sets, ", "), where)
+
+	if len(row.Returning) == 0 {
+		_, err := tx.Exec(shutdownCtx, query, args...)
+		return nil, err
+	}
+
+	return queryReturning(shutdownCtx, tx, row.Returning, query+" RETURNING "+selectList(row.Returning), args...)
+}
+
+// deleteRows deletes the rows of p matching where and (recursively) their
+// children. Returns the number of deleted rows.
+func (m *Migrator) deleteRows(shutdownCtx context.Context, tx pgx.Tx, p *tablePlan, where string, args []interface{}) (int64, error) {
+	table := pgx.Identifier{string(p.table)}.Sanitize()
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", table, where)
+
+	// Soft deleting only marks (and counts) rows that are not deleted yet
+	if p.softDelete != "" {
+		value := "now()"
+
+		if p.softDeleteValue != nil {
+			args = append(args[:len(args):len(args)], p.softDeleteValue)
+			value = fmt.Sprintf("$%d", len(args))
+		}
+
+		query = fmt.Sprintf("UPDATE %s SET %s = %s WHERE (%s) AND %s",
+			table, pgx.Identifier{p.softDelete}.Sanitize(), value, where, liveWhere(p))
+	}
+
+	if len(p.returning) == 0 || len(p.children) == 0 {
+		tag, err := tx.Exec(shutdownCtx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+
+		return tag.RowsAffected(), nil
+	}
+
+	rows, err := tx.Query(shutdownCtx, query+" RETURNING "+selectList(p.returning), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted []map[string]interface{}
+
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "unable to read returned values")
+		}
+
+		returned := make(map[string]interface{}, len(p.returning))
+		for i, col := range p.returning {
+			returned[col] = values[i]
+		}
+
+		deleted = append(deleted, returned)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := int64(len(deleted))
+
+	for _, returned := range deleted {
+		for _, child := range p.children {
+			refs := parentRefs(child)
+			if len(refs) == 0 {
+				continue
+			}
+
+			childWhere, childArgs, err := refsWhere(refs, returned)
+			if err != nil {
+				return 0, err
+			}
+
+			deletedChildren, err := m.deleteRows(shutdownCtx, tx, child, childWhere, childArgs)
+			if err != nil {
+				return 0, errors.Wrapf(err, "unable to delete children from table '%s'", child.table)
+			}
+
+			n += deletedChildren
+		}
+	}
+
+	return n, nil
+}
+
+// liveWhere returns the condition matching the rows of p that are not soft
+// deleted ("" if p does not soft delete)
+func liveWhere(p *tablePlan) string {
+	if p.softDelete == "" {
+		return ""
+	}
+
+	return pgx.Identifier{p.softDelete}.Sanitize() + " IS NULL"
+}
+
+// liveConditions returns liveWhere for every soft deleting table of plan
+func liveConditions(plan []*tablePlan) map[Table]string {
+	live := make(map[Table]string)
+
+	var walk func(p *tablePlan)
+
+	walk = func(p *tablePlan) {
+		if p.softDelete != "" {
+			live[p.table] = liveWhere(p)
+		}
+
+		for _, child := range p.children {
+			walk(child)
+		}
+	}
+
+	for _, p := range plan {
+		walk(p)
+	}
+
+	return live
+}
+
+// recordKey records the dupe check key of a root row in delta.keys_table
+func (m *Migrator) recordKey(shutdownCtx context.Context, tx pgx.Tx, row *Row) error {
+	key, err := m.hasher.joinText(row.Table, row.DupeCheck, row.Columns, row.Values)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (mmmbop_table, mmmbop_key) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		pgx.Identifier{m.delta.cfg.KeysTable}.Sanitize())
+
+	_, err = tx.Exec(shutdownCtx, query, string(row.Table), key)
+
+	return err
+}
+
+// prepareDelta creates delta.keys_table (emptying it when the migration
+// starts from the beginning) and marks the checkpoint as having rows to
+// delete once the migration completes
+func (m *Migrator) prepareDelta(shutdownCtx context.Context, pool *pgxpool.Pool) error {
+	if m.delta == nil || !m.delta.cfg.DeleteMissing {
+		return nil
+	}
+
+	table := pgx.Identifier{m.delta.cfg.KeysTable}.Sanitize()
+
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (mmmbop_table text NOT NULL, mmmbop_key text NOT NULL, PRIMARY KEY (mmmbop_table, mmmbop_key))", table)
+
+	if _, err := pool.Exec(shutdownCtx, query); err != nil {
+		return errors.Wrapf(err, "unable to create table '%s'", m.delta.cfg.KeysTable)
+	}
+
+	m.cp.Lock()
+	fresh := m.cp.IndexOffset == 0
+	m.cp.DeltaDeletePending = true
+	m.cp.Unlock()
+
+	if fresh {
+		if _, err := pool.Exec(shutdownCtx, "TRUNCATE "+table); err != nil {
+			return errors.Wrapf(err, "unable to truncate table '%s'", m.delta.cfg.KeysTable)
+		}
+	}
+
+	return nil
+}
+
+// deleteMissing deletes the rows of root tables (and their children) whose
+// dupe check key was not seen in the source, then drops delta.keys_table.
+// Runs once the migration has completed.
+func (m *Migrator) deleteMissing(shutdownCtx context.Context) error {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "deleteMissing",
+	})
+
+	if m.delta == nil || !m.delta.cfg.DeleteMissing || m.cfg.CLI.DryRun {
+		return nil
+	}
+
+	m.cp.Lock()
+	pending := m.cp.DeltaDeletePending
+	m.cp.Unlock()
+
+	if !pending {
+		return nil
+	}
+
+	pool, err := m.createPGPool(shutdownCtx)
+	if err != nil {
+		return errors.Wrap(err, "error creating postgres connection pool")
+	}
+	defer pool.Close()
+
+	keysTable := pgx.Identifier{m.delta.cfg.KeysTable}.Sanitize()
+
+	for _, p := range m.plan {
+		where := fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s k WHERE k.mmmbop_table = $1 AND k.mmmbop_key = %s)",
+			keysTable, m.hasher.joinSQL(p.table, p.dupeCheck))
+
+		var deleted int64
+
+		err := pool.BeginFunc(shutdownCtx, func(tx pgx.Tx) error {
+			var err error
+			deleted, err = m.deleteRows(shutdownCtx, tx, p, where, []interface{}{string(p.table)})
+
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "unable to delete missing rows from table '%s'", p.table)
+		}
+
+		m.stats.RowsDeleted.Add(deleted)
+
+		llog.Infof("Deleted %d row(s) missing from the source from table '%s' (including children)", deleted, p.table)
+	}
+
+	if _, err := pool.Exec(shutdownCtx, "DROP TABLE "+keysTable); err != nil {
+		return errors.Wrapf(err, "unable to drop table '%s'", m.delta.cfg.KeysTable)
+	}
+
+	return m.saveDeltaState(func(cp *types.Checkpoint) { cp.DeltaDeletePending = false })
+}
+
+func (m *Migrator) saveDeltaState(update func(cp *types.Checkpoint)) error {
+	m.cp.Lock()
+	update(m.cp)
+	m.cp.Unlock()
+
+	if err := m.cp.Save(m.cfg.TOML.Config.CheckpointFile); err != nil {
+		return errors.Wrap(err, "unable to save checkpoint")
+	}
+
+	return nil
+}
+
+// keyWhere returns the condition matching row's dupe check columns; its
+// placeholders follow args
+func keyWhere(row *Row, columns []string, values []interface{}, args []interface{}) (string, []interface{}) {
+	where := make([]string, 0, len(row.DupeCheck))
+
+	for _, dc := range row.DupeCheck {
+		// Dupe check column is missing from the source document or NULL (ie.
+		// on_missing = "null"); "= NULL" never matches and, unlike IS NOT
+		// DISTINCT FROM, IS NULL can use the dupe check index
+		i := indexOf(columns, dc)
+		if i < 0 || values[i] == nil {
+			where = append(where, pgx.Identifier{dc}.Sanitize()+" IS NULL")
+			continue
+		}
+
+		args = append(args, values[i])
+		where = append(where, fmt.Sprintf("%s = $%d", pgx.Identifier{dc}.Sanitize(), len(args)))
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// refsWhere returns the condition matching the children of the parent row
+// whose returning columns are returned
+func refsWhere(refs map[string]string, returned map[string]interface{}) (string, []interface{}, error) {
+	columns := make([]string, 0, len(refs))
+	for col := range refs {
+		columns = append(columns, col)
+	}
+
+	sort.Strings(columns)
+
+	where := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+
+	for _, col := range columns {
+		v, ok := returned[refs[col]]
+		if !ok {
+			return "", nil, errors.Errorf("parent column '%s' for '%s' was not returned", refs[col], col)
+		}
+
+		args = append(args, v)
+		where = append(where, fmt.Sprintf("%s = $%d", pgx.Identifier{col}.Sanitize(), len(args)))
+	}
+
+	return strings.Join(where, " AND "), args, nil
+}
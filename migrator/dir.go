@@ -0,0 +1,232 @@
+package migrator
+
+import (
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/dump"
+)
+
+// dirSource reads the collection files of a mongodump directory as if they
+// were a single (uncompressed) file; offsets are offsets into their
+// concatenation. The sizes of gzipped files are recorded in the checkpoint
+// once they have been read; until then, the file and the ones after it have
+// no known end.
+type dirSource struct {
+	files  []*types.DumpFile
+	mu     sync.Locker // guards the Size of files, which the checkpoint saves
+	sizes  []int64     // copy of the sizes of files
+	starts []int64     // offset each file starts at
+	known  int         // number of leading files with a known size
+
+	i   int           // index of the file being read
+	r   io.ReadCloser // nil until file i is opened
+	pos int64
+}
+
+func newDirSource(files []*types.DumpFile, mu sync.Locker) *dirSource {
+	d := &dirSource{
+		files:  files,
+		mu:     mu,
+		sizes:  make([]int64, len(files)),
+		starts: make([]int64, len(files)),
+	}
+
+	mu.Lock()
+	for i, f := range files {
+		d.sizes[i] = f.Size
+	}
+	mu.Unlock()
+
+	d.setStarts()
+
+	return d
+}
+
+// setStarts computes the start of every file up to the first one of unknown
+// size
+func (d *dirSource) setStarts() {
+	var start int64
+
+	for d.known = 0; d.known < len(d.files); d.known++ {
+		d.starts[d.known] = start
+
+		if d.sizes[d.known] < 0 {
+			break
+		}
+
+		start += d.sizes[d.known]
+	}
+}
+
+// setSize records the size of file i once it is known
+func (d *dirSource) setSize(i int, size int64) {
+	d.sizes[i] = size
+
+	d.mu.Lock()
+	d.files[i].Size = size
+	d.mu.Unlock()
+
+	d.setStarts()
+}
+
+// end returns the offset file i ends at (math.MaxInt64 if it is unknown)
+func (d *dirSource) end(i int) int64 {
+	if i >= d.known {
+		return math.MaxInt64
+	}
+
+	return d.starts[i] + d.sizes[i]
+}
+
+func (d *dirSource) Read(p []byte) (int, error) {
+	for d.i < len(d.files) {
+		if d.r == nil {
+			r, err := dump.OpenFile(d.files[d.i].File, d.files[d.i].Gzip)
+			if err != nil {
+				return 0, err
+			}
+
+			d.r = r
+		}
+
+		n, err := d.r.Read(p)
+		d.pos += int64(n)
+
+		if err == io.EOF {
+			d.r.Close()
+			d.r = nil
+
+			// Files before i have all been read (or skipped by Seek), so
+			// its start is known
+			if d.sizes[d.i] < 0 {
+				d.setSize(d.i, d.pos-d.starts[d.i])
+			}
+
+			d.i++
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+
+	return 0, io.EOF
+}
+
+// Seek opens the file holding offset; gzipped files are decompressed from
+// their start (and skipped over by decompressing them entirely if their size
+// is unknown)
+func (d *dirSource) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return d.pos, errors.New("directory sources can only seek from the start")
+	}
+
+	if d.r != nil {
+		d.r.Close()
+		d.r = nil
+	}
+
+	d.pos = offset
+
+	// First file that ends after offset
+	for d.i = sort.Search(len(d.files), func(i int) bool { return d.end(i) > offset }); d.i < len(d.files); d.i++ {
+		f := d.files[d.i]
+
+		r, err := dump.OpenFile(f.File, f.Gzip)
+		if err != nil {
+			return 0, err
+		}
+
+		skip := offset - d.starts[d.i]
+
+		if file, ok := r.(*os.File); ok {
+			_, err = file.Seek(skip, io.SeekStart)
+		} else {
+			var n int64
+
+			n, err = io.CopyN(io.Discard, r, skip)
+			if err == io.EOF && d.sizes[d.i] < 0 {
+				// offset is past the end of the file
+				r.Close()
+				d.setSize(d.i, n)
+
+				continue
+			}
+		}
+
+		if err != nil {
+			r.Close()
+			return 0, errors.Wrapf(err, "unable to seek to offset '%d' of '%s'", skip, f.File)
+		}
+
+		d.r = r
+
+		break
+	}
+
+	return offset, nil
+}
+
+func (d *dirSource) Close() error {
+	if d.r == nil {
+		return nil
+	}
+
+	return d.r.Close()
+}
+
+// namespace returns the namespace of the document ending at offset
+func (d *dirSource) namespace(offset int64) string {
+	i := sort.Search(len(d.files), func(i int) bool { return d.end(i) >= offset })
+	if i == len(d.files) {
+		return ""
+	}
+
+	return d.files[i].Namespace
+}
+
+// dirReader adds the namespace of each document to a directory source's
+// documentReader
+type dirReader struct {
+	documentReader
+	src *dirSource
+}
+
+func (d *dirReader) Namespace() string {
+	return d.src.namespace(d.Offset())
+}
+
+// readDumpDir logs the collections of a directory source, their indexes and
+// the mappings they are written with
+func (m *Migrator) readDumpDir() error {
+	collections, err := dump.ReadDir(m.cfg.TOML.Source.File)
+	if err != nil {
+		return err
+	}
+
+	r := &DumpReport{}
+
+	for _, c := range collections {
+		md, err := c.ReadMetadata()
+		if err != nil {
+			return err
+		}
+
+		r.Collections = append(r.Collections, m.collectionReport(c.Namespace(), "", md))
+	}
+
+	m.dump.Store(r)
+
+	return nil
+}
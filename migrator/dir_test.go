@@ -0,0 +1,107 @@
+package migrator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dselans/mmmbop/checkpoint/types"
+)
+
+// testDumpFiles writes the contents as collection files, gzipping all but the
+// last one; gzipped files have an unknown size
+func testDumpFiles(t *testing.T, contents ...string) []*types.DumpFile {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	var files []*types.DumpFile
+
+	for i, c := range contents {
+		f := &types.DumpFile{Namespace: string(rune('a' + i)), Size: int64(len(c))}
+		data := []byte(c)
+
+		if i < len(contents)-1 {
+			var buf bytes.Buffer
+
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data)
+			zw.Close()
+
+			f.Gzip, f.Size, data = true, -1, buf.Bytes()
+		}
+
+		f.File = filepath.Join(dir, f.Namespace+".bson")
+		if err := os.WriteFile(f.File, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, f)
+	}
+
+	return files
+}
+
+func TestDirSourceRead(t *testing.T) {
+	files := testDumpFiles(t, "aaaa", "", "bbbbbb", "cc")
+
+	d := newDirSource(files, &sync.Mutex{})
+	defer d.Close()
+
+	data, err := io.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "aaaabbbbbbcc" {
+		t.Fatalf("read %q", data)
+	}
+
+	for i, want := range []int64{4, 0, 6, 2} {
+		if files[i].Size != want {
+			t.Errorf("file %d: got size %d, want %d", i, files[i].Size, want)
+		}
+	}
+
+	for offset, want := range map[int64]string{0: "a", 4: "a", 5: "c", 10: "c", 12: "d", 13: ""} {
+		if got := d.namespace(offset); got != want {
+			t.Errorf("namespace(%d) = %q, want %q", offset, got, want)
+		}
+	}
+}
+
+func TestDirSourceSeek(t *testing.T) {
+	for offset, want := range map[int64]string{
+		0:  "aaaabbbbbbcc",
+		3:  "abbbbbbcc",
+		4:  "bbbbbbcc",
+		7:  "bbbcc",
+		10: "cc",
+		11: "c",
+		12: "",
+	} {
+		// Sizes are unknown on every seek
+		files := testDumpFiles(t, "aaaa", "", "bbbbbb", "cc")
+
+		d := newDirSource(files, &sync.Mutex{})
+
+		if _, err := d.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Seek(%d): %v", offset, err)
+		}
+
+		data, err := io.ReadAll(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != want {
+			t.Errorf("Seek(%d): read %q, want %q", offset, data, want)
+		}
+
+		d.Close()
+	}
+}
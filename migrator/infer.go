@@ -0,0 +1,868 @@
+package migrator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/bson"
+	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/conv"
+	"github.com/dselans/mmmbop/dump"
+	"github.com/dselans/mmmbop/schema"
+)
+
+const (
+	// Stop tracking distinct values of a field after this many
+	inferMaxDistinct = 1000
+
+	// Used for paths whose values are objects, mixed arrays or have
+	// conflicting types
+	inferConvJSON = "jsonb"
+)
+
+var (
+	uuidRegex     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	bareKeyRegex  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	nonIdentRegex = regexp.MustCompile(`[^a-z0-9_]+`)
+)
+
+// fieldStats is what we learned about a single source path
+type fieldStats struct {
+	path     string
+	present  int
+	nulls    int
+	convs    map[string]int
+	distinct map[string]struct{}
+	overflow bool // more than inferMaxDistinct distinct values
+
+	// Set for arrays
+	isArray    bool
+	hasObjects bool
+	minLen     int
+	maxLen     int
+}
+
+type inferrer struct {
+	csv     bool
+	samples int
+	fields  map[string]*fieldStats
+}
+
+// Infer samples up to --infer-samples documents from source.file, infers the
+// paths, types, nullability and cardinality of their fields and writes a
+// draft [mapping] section and CREATE TABLE DDL for destination.type.
+func Infer(cfg *config.Config) error {
+	llog := logrus.WithFields(logrus.Fields{
+		"pkg":    "migrator",
+		"method": "Infer",
+	})
+
+	// Archives hold several collections, each needing its own mapping
+	if cfg.TOML.Source.FileContents == "archive" {
+		return errors.New("infer does not support archive sources")
+	}
+
+	if cfg.TOML.Source.IsDir() {
+		return inferDir(cfg)
+	}
+
+	// Inference does not checkpoint; an empty index means gzip sources are
+	// read from the start.
+	m := &Migrator{
+		cfg:   cfg,
+		cp:    &types.Checkpoint{},
+		stats: &Stats{},
+		log:   logrus.WithField("pkg", "migrator"),
+	}
+
+	src, err := m.openSource()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var offset int64
+
+	if cfg.TOML.Source.FileContents == "csv" {
+		offset, err = m.readCSVHeader(src)
+		if err != nil {
+			return err
+		}
+
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrap(err, "unable to seek past csv header")
+		}
+	}
+
+	reader := m.newDocumentReader(src, offset)
+
+	inf := &inferrer{
+		csv:    cfg.TOML.Source.FileContents == "csv",
+		fields: make(map[string]*fieldStats),
+	}
+
+	if err := m.sample(inf, reader, cfg.CLI.InferSamples); err != nil {
+		return err
+	}
+
+	if inf.samples == 0 {
+		return errors.New("source contains no documents")
+	}
+
+	llog.Infof("Sampled %d documents, found %d fields", inf.samples, len(inf.fields))
+
+	table := cfg.CLI.InferTable
+	if table == "" {
+		table = tableName(cfg.TOML.Source.File)
+	}
+
+	columns := inf.columns()
+
+	mapping := inf.mapping(cfg, table, columns)
+
+	ddl, err := inf.ddl(cfg.TOML.Destination.Type, table, columns, nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to generate ddl")
+	}
+
+	if err := writeOutput(cfg.CLI.InferMappingFile, mapping); err != nil {
+		return errors.Wrap(err, "unable to write inferred mapping")
+	}
+
+	if err := writeOutput(cfg.CLI.InferDDLFile, ddl); err != nil {
+		return errors.Wrap(err, "unable to write inferred ddl")
+	}
+
+	return nil
+}
+
+// sample adds up to n documents read from reader to inf
+func (m *Migrator) sample(inf *inferrer, reader documentReader, n int) error {
+	for inf.samples < n {
+		data, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return errors.Wrapf(err, "unable to read document after offset '%d'", reader.Offset())
+		}
+
+		doc, err := m.decodeDocument(string(data))
+		if err != nil {
+			return errors.Wrapf(err, "unable to decode document at offset '%d'", reader.Offset())
+		}
+
+		inf.add(doc)
+	}
+
+	return nil
+}
+
+func writeOutput(file, data string) error {
+	if file == "" {
+		_, err := fmt.Fprintln(os.Stdout, data)
+		return err
+	}
+
+	return os.WriteFile(file, []byte(data+"\n"), 0644)
+}
+
+func (inf *inferrer) add(doc interface{}) {
+	inf.samples++
+
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	inf.walk("", m)
+}
+
+func (inf *inferrer) walk(prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		path := escapePathKey(k)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		// Recurse into (non-empty) sub-documents; leaves become columns
+		if sub, ok := v.(map[string]interface{}); ok && len(sub) > 0 {
+			inf.walk(path, sub)
+			continue
+		}
+
+		inf.observe(path, v)
+	}
+}
+
+func (inf *inferrer) observe(path string, v interface{}) {
+	f, ok := inf.fields[path]
+	if !ok {
+		f = &fieldStats{
+			path:     path,
+			convs:    make(map[string]int),
+			distinct: make(map[string]struct{}),
+			minLen:   -1,
+		}
+
+		inf.fields[path] = f
+	}
+
+	f.present++
+
+	if v == nil {
+		f.nulls++
+		return
+	}
+
+	if arr, ok := v.([]interface{}); ok {
+		f.isArray = true
+
+		if f.minLen < 0 || len(arr) < f.minLen {
+			f.minLen = len(arr)
+		}
+
+		if len(arr) > f.maxLen {
+			f.maxLen = len(arr)
+		}
+
+		// Empty arrays tell us nothing about the element type
+		if c := inf.arrayConv(f, arr); c != "" {
+			f.convs[c]++
+		}
+
+		return
+	}
+
+	f.convs[inf.valueConv(v)]++
+
+	if !f.overflow {
+		f.distinct[fmt.Sprint(v)] = struct{}{}
+
+		if len(f.distinct) > inferMaxDistinct {
+			f.overflow = true
+			f.distinct = nil
+		}
+	}
+}
+
+// arrayConv returns "<conv>[]" for arrays of scalars and jsonb for arrays of
+// objects or mixed arrays. An empty string is returned for empty arrays.
+func (inf *inferrer) arrayConv(f *fieldStats, arr []interface{}) string {
+	elem := ""
+
+	for _, el := range arr {
+		switch el.(type) {
+		case nil:
+			continue
+		case map[string]interface{}, []interface{}:
+			f.hasObjects = true
+			return inferConvJSON
+		}
+
+		elem = mergeConvs(elem, inf.valueConv(el))
+	}
+
+	if elem == "" || elem == inferConvJSON {
+		return elem
+	}
+
+	return elem + conv.ArraySuffix
+}
+
+// valueConv returns the conv that best fits a scalar value
+func (inf *inferrer) valueConv(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return inf.stringConv(t)
+	case bool:
+		return "bool"
+	case int, int32, int64:
+		return "int"
+	case float32, float64:
+		return "float"
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return "int"
+		}
+
+		if !strings.ContainsAny(t.String(), ".eE") {
+			// Integer that does not fit in an int64
+			return "numeric"
+		}
+
+		return "float"
+	case bson.Decimal128:
+		return "numeric"
+	case time.Time, bson.Timestamp:
+		return "timestamptz"
+	case bson.Binary:
+		if (t.Subtype == bson.BinaryUUID || t.Subtype == bson.BinaryUUIDOld) && len(t.Data) == 16 {
+			return "uuid"
+		}
+
+		return "bytea"
+	case map[string]interface{}:
+		// Empty sub-document
+		return inferConvJSON
+	default:
+		// ObjectIds, regexes, code etc.
+		return "string"
+	}
+}
+
+// stringConv sniffs the type of a string value; CSV values are always strings
+// so numbers and bools are only detected for CSV sources.
+func (inf *inferrer) stringConv(s string) string {
+	if inf.csv {
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return "int"
+		}
+
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return "float"
+		}
+
+		if _, err := strconv.ParseBool(s); err == nil {
+			return "bool"
+		}
+	}
+
+	if uuidRegex.MatchString(s) {
+		return "uuid"
+	}
+
+	if _, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return "timestamptz"
+	}
+
+	if _, err := time.Parse("2006-01-02", s); err == nil {
+		return "date"
+	}
+
+	return "string"
+}
+
+// mergeConvs returns a conv that can hold values of both a and b
+func mergeConvs(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	}
+
+	pair := map[string]bool{a: true, b: true}
+
+	switch {
+	case pair["int"] && pair["float"]:
+		return "float"
+	case (pair["int"] || pair["float"]) && pair["numeric"]:
+		return "numeric"
+	case pair["date"] && pair["timestamptz"]:
+		return "timestamptz"
+	case pair[inferConvJSON]:
+		return inferConvJSON
+	}
+
+	aArray := strings.HasSuffix(a, conv.ArraySuffix)
+	bArray := strings.HasSuffix(b, conv.ArraySuffix)
+
+	switch {
+	case aArray && bArray:
+		return mergeConvs(strings.TrimSuffix(a, conv.ArraySuffix), strings.TrimSuffix(b, conv.ArraySuffix)) + conv.ArraySuffix
+	case aArray || bArray:
+		return inferConvJSON
+	}
+
+	return "string"
+}
+
+// inferredColumn is a single inferred mapping entry + column
+type inferredColumn struct {
+	*fieldStats
+	column    string
+	conv      string
+	required  bool
+	dupeCheck bool
+}
+
+func (inf *inferrer) columns() []*inferredColumn {
+	paths := make([]string, 0, len(inf.fields))
+	for p := range inf.fields {
+		paths = append(paths, p)
+	}
+
+	// _id first, everything else sorted
+	sort.Slice(paths, func(i, j int) bool {
+		if (paths[i] == "_id") != (paths[j] == "_id") {
+			return paths[i] == "_id"
+		}
+
+		return paths[i] < paths[j]
+	})
+
+	names := make(map[string]int)
+	columns := make([]*inferredColumn, 0, len(paths))
+
+	for _, p := range paths {
+		f := inf.fields[p]
+
+		c := &inferredColumn{
+			fieldStats: f,
+			column:     columnName(p, names),
+			required:   f.present == inf.samples && f.nulls == 0,
+		}
+
+		for name := range f.convs {
+			c.conv = mergeConvs(c.conv, name)
+		}
+
+		// Only NULLs (or empty arrays) were seen
+		if c.conv == "" {
+			c.conv = "string"
+
+			if f.isArray {
+				c.conv += conv.ArraySuffix
+			}
+		}
+
+		columns = append(columns, c)
+	}
+
+	// Use _id (or a unique id column) for dupe checks
+	for _, c := range columns {
+		if !c.required || c.isArray {
+			continue
+		}
+
+		if c.path == "_id" || (c.path == "id" && !c.overflow && len(c.distinct) == c.present) {
+			c.dupeCheck = true
+			break
+		}
+	}
+
+	return columns
+}
+
+func (inf *inferrer) mapping(cfg *config.Config, table string, columns []*inferredColumn) string {
+	sb := &strings.Builder{}
+
+	fmt.Fprintf(sb, "## Draft mapping inferred from %d sampled document(s) of '%s' (%s).\n",
+		inf.samples, cfg.TOML.Source.File, cfg.TOML.Source.FileContents)
+	sb.WriteString("## Review column names, convs and nullability before migrating.\n")
+	sb.WriteString("[mapping]\n")
+
+	inf.writeMapping(sb, table, table, columns)
+
+	return sb.String()
+}
+
+// writeMapping writes the mapping entries of columns as mapping name
+func (inf *inferrer) writeMapping(sb *strings.Builder, name, table string, columns []*inferredColumn) {
+	key := name
+	if !bareKeyRegex.MatchString(key) {
+		key = tomlQuote(key)
+	}
+
+	fmt.Fprintf(sb, "%s = [\n", key)
+
+	for i, c := range columns {
+		fmt.Fprintf(sb, "    # %s\n", inf.describe(c))
+
+		entry := fmt.Sprintf("src = %s, dst = %s, conv = %s",
+			tomlQuote(c.path), tomlQuote(table+"."+c.column), tomlQuote(c.conv))
+
+		if c.required {
+			entry += ", required = true"
+		}
+
+		if c.dupeCheck {
+			entry += ", dupe_check = true"
+		}
+
+		sep := ","
+		if i == len(columns)-1 {
+			sep = ""
+		}
+
+		fmt.Fprintf(sb, "    { %s }%s\n", entry, sep)
+	}
+
+	sb.WriteString("]\n")
+}
+
+// describe returns a human readable summary of a field's stats
+func (inf *inferrer) describe(c *inferredColumn) string {
+	pct := func(n int) string {
+		return strconv.FormatFloat(float64(n)*100/float64(inf.samples), 'f', 1, 64) + "%"
+	}
+
+	parts := []string{
+		"present: " + pct(c.present),
+		"null: " + pct(c.nulls),
+	}
+
+	switch {
+	case c.isArray:
+		parts = append(parts, fmt.Sprintf("array of %d-%d elements", max(c.minLen, 0), c.maxLen))
+
+		if c.hasObjects {
+			parts = append(parts, "consider exploding into a child table via [tables]")
+		}
+	case c.overflow:
+		parts = append(parts, fmt.Sprintf("distinct: >%d", inferMaxDistinct))
+	default:
+		parts = append(parts, fmt.Sprintf("distinct: %d", len(c.distinct)))
+	}
+
+	if len(c.convs) > 1 {
+		seen := make([]string, 0, len(c.convs))
+		for name := range c.convs {
+			seen = append(seen, name)
+		}
+
+		sort.Strings(seen)
+
+		parts = append(parts, "seen: "+strings.Join(seen, ", "))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (inf *inferrer) ddl(dstType, table string, columns []*inferredColumn, indexes []*schema.Index) (string, error) {
+	t := &schema.Table{Name: table}
+
+	for _, c := range columns {
+		t.Columns = append(t.Columns, &schema.Column{
+			Name:    c.column,
+			Conv:    c.conv,
+			NotNull: c.required,
+		})
+
+		if c.dupeCheck {
+			t.Unique = append(t.Unique, c.column)
+		}
+	}
+
+	ddl, err := schema.CreateTable(dstType, t)
+	if err != nil {
+		return "", err
+	}
+
+	for _, index := range indexes {
+		ddl += "\n" + schema.CreateIndex(dstType, table, index)
+	}
+
+	return ddl, nil
+}
+
+// escapePathKey escapes characters that have a special meaning in src paths
+func escapePathKey(k string) string {
+	sb := &strings.Builder{}
+
+	for i, r := range k {
+		switch {
+		case r == '.' || r == '*' || r == '?' || r == '\\':
+			sb.WriteByte('\\')
+		case i == 0 && (r == '#' || r == '@'):
+			sb.WriteByte('\\')
+		}
+
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
+
+// columnName turns a src path into a unique snake_case column name
+func columnName(path string, names map[string]int) string {
+	sb := &strings.Builder{}
+
+	var prev rune
+
+	for _, r := range strings.ReplaceAll(path, `\`, "") {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			sb.WriteByte('_')
+		}
+
+		sb.WriteRune(unicode.ToLower(r))
+		prev = r
+	}
+
+	name := strings.Trim(nonIdentRegex.ReplaceAllString(sb.String(), "_"), "_")
+
+	switch {
+	case name == "":
+		name = "column"
+	case name[0] >= '0' && name[0] <= '9':
+		name = "c_" + name
+	}
+
+	names[name]++
+
+	if n := names[name]; n > 1 {
+		name = fmt.Sprintf("%s_%d", name, n)
+	}
+
+	return name
+}
+
+// tableName derives a table name from the source file name
+func tableName(file string) string {
+	base := filepath.Base(file)
+
+	for _, ext := range []string{".gz", ".gzip", ".json", ".ejson", ".bson", ".csv"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+
+	name := strings.Trim(nonIdentRegex.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if name == "" {
+		return "documents"
+	}
+
+	return name
+}
+
+// tomlQuote returns s as a TOML basic string
+func tomlQuote(s string) string {
+	sb := &strings.Builder{}
+	sb.WriteByte('"')
+
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(sb, "\\u%04X", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+// inferDir infers a mapping (named after the collection) and DDL for each
+// collection of a mongodump directory source. With --infer-indexes the
+// collections' indexes are used for dupe-check columns and destination indexes.
+func inferDir(cfg *config.Config) error {
+	llog := logrus.WithFields(logrus.Fields{
+		"pkg":    "migrator",
+		"method": "inferDir",
+	})
+
+	collections, err := dump.ReadDir(cfg.TOML.Source.File)
+	if err != nil {
+		return err
+	}
+
+	if len(collections) == 0 {
+		return errors.New("source directory contains no collections")
+	}
+
+	// Collections with the same name in several databases are mapped by
+	// namespace
+	names := make(map[string]int)
+	for _, c := range collections {
+		names[c.Collection]++
+	}
+
+	m := &Migrator{
+		cfg:   cfg,
+		cp:    &types.Checkpoint{},
+		stats: &Stats{},
+		log:   logrus.WithField("pkg", "migrator"),
+	}
+
+	mapping := &strings.Builder{}
+
+	fmt.Fprintf(mapping, "## Draft mappings inferred from the collections of '%s'.\n", cfg.TOML.Source.File)
+	mapping.WriteString("## Review column names, convs and nullability before migrating.\n")
+	mapping.WriteString("[mapping]\n")
+
+	ddls := make([]string, 0, len(collections))
+
+	for _, c := range collections {
+		name, table := c.Collection, tableName(c.Collection)
+		if names[c.Collection] > 1 {
+			name, table = c.Namespace(), tableName(c.DB+"_"+c.Collection)
+		}
+
+		inf, err := m.sampleCollection(c)
+		if err != nil {
+			return err
+		}
+
+		if inf.samples == 0 {
+			llog.Infof("Collection '%s' contains no documents; skipping", c.Namespace())
+			continue
+		}
+
+		llog.Infof("Sampled %d documents of '%s', found %d fields", inf.samples, c.Namespace(), len(inf.fields))
+
+		columns := inf.columns()
+
+		var indexes []*schema.Index
+
+		if cfg.CLI.InferIndexes {
+			md, err := c.ReadMetadata()
+			if err != nil {
+				return err
+			}
+
+			indexes = inf.indexes(table, columns, md)
+		}
+
+		fmt.Fprintf(mapping, "\n## %s: %d sampled document(s)\n", c.Namespace(), inf.samples)
+		inf.writeMapping(mapping, name, table, columns)
+
+		ddl, err := inf.ddl(cfg.TOML.Destination.Type, table, columns, indexes)
+		if err != nil {
+			return errors.Wrapf(err, "unable to generate ddl for '%s'", c.Namespace())
+		}
+
+		ddls = append(ddls, ddl)
+	}
+
+	if err := writeOutput(cfg.CLI.InferMappingFile, mapping.String()); err != nil {
+		return errors.Wrap(err, "unable to write inferred mapping")
+	}
+
+	if err := writeOutput(cfg.CLI.InferDDLFile, strings.Join(ddls, "\n\n")); err != nil {
+		return errors.Wrap(err, "unable to write inferred ddl")
+	}
+
+	return nil
+}
+
+// sampleCollection samples up to --infer-samples documents of a collection
+func (m *Migrator) sampleCollection(c *dump.Collection) (*inferrer, error) {
+	r, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	inf := &inferrer{
+		fields: make(map[string]*fieldStats),
+	}
+
+	reader := &bsonReader{r: bufio.NewReaderSize(r, readerBufferSize)}
+
+	if err := m.sample(inf, reader, m.cfg.CLI.InferSamples); err != nil {
+		return nil, errors.Wrapf(err, "unable to sample '%s'", c.File)
+	}
+
+	return inf, nil
+}
+
+// indexes uses a collection's (plain) indexes whose fields are all columns:
+// the first unique index over required scalar columns (or else the _id index)
+// provides the dupe-check columns, the others become destination indexes
+func (inf *inferrer) indexes(table string, columns []*inferredColumn, md *dump.Metadata) []*schema.Index {
+	if md == nil {
+		return nil
+	}
+
+	byPath := make(map[string]*inferredColumn, len(columns))
+	for _, c := range columns {
+		byPath[c.path] = c
+	}
+
+	type candidate struct {
+		index   *dump.Index
+		columns []*inferredColumn
+	}
+
+	var (
+		candidates []*candidate
+		dupeCheck  *candidate
+	)
+
+	for _, index := range md.Indexes {
+		if !index.Plain() {
+			continue
+		}
+
+		cand := &candidate{index: index}
+		keyable := true
+
+		for _, field := range index.Fields() {
+			c, ok := byPath[field]
+			if !ok {
+				cand = nil
+				break
+			}
+
+			keyable = keyable && c.required && !c.isArray
+			cand.columns = append(cand.columns, c)
+		}
+
+		if cand == nil {
+			continue
+		}
+
+		candidates = append(candidates, cand)
+
+		if !keyable {
+			continue
+		}
+
+		switch {
+		case index.Unique && (dupeCheck == nil || dupeCheck.index.Name == "_id_"):
+			dupeCheck = cand
+		case index.Name == "_id_" && dupeCheck == nil:
+			dupeCheck = cand
+		}
+	}
+
+	if dupeCheck != nil {
+		for _, c := range columns {
+			c.dupeCheck = false
+		}
+
+		for _, c := range dupeCheck.columns {
+			c.dupeCheck = true
+		}
+	}
+
+	var indexes []*schema.Index
+
+	for _, cand := range candidates {
+		if cand == dupeCheck {
+			continue
+		}
+
+		index := &schema.Index{
+			Name:   table + "_" + strings.Trim(nonIdentRegex.ReplaceAllString(strings.ToLower(cand.index.Name), "_"), "_"),
+			Unique: cand.index.Unique || cand.index.Name == "_id_",
+		}
+
+		for _, c := range cand.columns {
+			index.Columns = append(index.Columns, c.column)
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	return indexes
+}
@@ -0,0 +1,380 @@
+package migrator
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/bson"
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/conv"
+	"github.com/dselans/mmmbop/docpath"
+	"github.com/dselans/mmmbop/ejson"
+)
+
+// Row is a single destination row produced from a source document.
+//
+// Child rows are produced by exploding an array in the parent's source element
+// (see config.TOMLTable). They are written after their parent so that values
+// generated by the destination for the parent row (ie. serial IDs) can be
+// carried into them via ParentRefs.
+type Row struct {
+	Table   Table
+	Columns []string
+	Values  []interface{}
+
+	// Child column -> parent column; filled in by the writer once the parent
+	// row has been written.
+	ParentRefs map[string]string
+
+	// Columns that must be read back from the destination after this row is
+	// written because children reference them.
+	Returning []string
+
+	// Dupe check columns (subset of Columns + ParentRefs keys)
+	DupeCheck []string
+
+	Children []*Row
+}
+
+// tablePlan describes how rows for a single destination table are built
+type tablePlan struct {
+	table     Table
+	explode   string
+	entries   []*config.TOMLMappingEntry
+	dupeCheck []string
+	returning []string
+	children  []*tablePlan
+
+	// Set for tables.<table>.on_delete = "soft"
+	softDelete      string
+	softDeleteValue interface{}
+}
+
+// buildPlan groups mapping entries by destination table and arranges the
+// tables into parent -> children trees. Returned plans are the root tables.
+func buildPlan(mapping *config.TOMLMapping, tables *config.TOMLTables) ([]*tablePlan, error) {
+	plans := make(map[Table]*tablePlan)
+
+	// Sort mapping names so that column order is stable between runs
+	names := make([]string, 0, len(*mapping))
+	for name := range *mapping {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, e := range (*mapping)[name] {
+			tStr, cStr := config.ParseDst(e.Dst)
+			if tStr == "" || cStr == "" {
+				return nil, errors.Errorf("unable to determine destination table or column for mapping '%s'", name)
+			}
+
+			t := Table(tStr)
+
+			p, ok := plans[t]
+			if !ok {
+				p = &tablePlan{table: t}
+				plans[t] = p
+			}
+
+			p.entries = append(p.entries, e)
+
+			if e.DupeCheck != nil && *e.DupeCheck {
+				p.dupeCheck = append(p.dupeCheck, cStr)
+			}
+		}
+	}
+
+	roots := make([]*tablePlan, 0)
+
+	// Sort table names so that parents/children are written in a stable order
+	tableNames := make([]string, 0, len(plans))
+	for t := range plans {
+		tableNames = append(tableNames, string(t))
+	}
+
+	sort.Strings(tableNames)
+
+	for _, name := range tableNames {
+		p := plans[Table(name)]
+
+		tc, ok := (*tables)[name]
+
+		if ok && tc != nil && tc.OnDelete == config.OnDeleteSoft {
+			p.softDelete = tc.SoftDeleteColumn
+			p.softDeleteValue = tc.SoftDeleteValue
+		}
+
+		if !ok || tc == nil || tc.Parent == "" {
+			roots = append(roots, p)
+			continue
+		}
+
+		parent, ok := plans[Table(tc.Parent)]
+		if !ok {
+			return nil, errors.Errorf("parent table '%s' for table '%s' has no mapping entries", tc.Parent, name)
+		}
+
+		p.explode = tc.Explode
+		parent.children = append(parent.children, p)
+
+		// Parent must read back any column a child references
+		for _, e := range p.entries {
+			if !strings.HasPrefix(e.Src, config.SrcParentPrefix) {
+				continue
+			}
+
+			col := strings.TrimPrefix(e.Src, config.SrcParentPrefix)
+
+			if !contains(parent.returning, col) {
+				parent.returning = append(parent.returning, col)
+			}
+		}
+	}
+
+	return roots, nil
+}
+
+// errSkipDocument is returned by buildRow when a mapping entry's policy says
+// that the whole document should be skipped.
+var errSkipDocument = errors.New("document skipped")
+
+// buildRow builds a row for table plan p from the source element el. index is
+// the position of el in the exploded array (or -1 for root tables).
+func (m *Migrator) buildRow(p *tablePlan, el interface{}, index int) (*Row, error) {
+	row := &Row{
+		Table:     p.table,
+		Returning: p.returning,
+		DupeCheck: p.dupeCheck,
+	}
+
+	for _, e := range p.entries {
+		_, column := config.ParseDst(e.Dst)
+
+		if strings.HasPrefix(e.Src, config.SrcParentPrefix) {
+			if row.ParentRefs == nil {
+				row.ParentRefs = make(map[string]string)
+			}
+
+			row.ParentRefs[column] = strings.TrimPrefix(e.Src, config.SrcParentPrefix)
+
+			continue
+		}
+
+		var (
+			v     interface{}
+			found bool
+		)
+
+		switch {
+		case e.Program != nil:
+			result, err := e.Program.Eval(func(path string) (interface{}, bool) {
+				return docpath.Get(el, path)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			// An expression evaluating to null is treated like a missing field
+			v, found = result, result != nil
+		case e.Src == config.SrcIndex:
+			v, found = index, true
+		default:
+			v, found = docpath.Get(el, e.Src)
+		}
+
+		if found && v != nil && isNullIf(e, v) {
+			v = nil
+		}
+
+		if !found || (v == nil && e.OnMissing != "") {
+			policy := e.OnMissing
+
+			// Legacy behavior: skip missing fields unless they are required
+			if policy == "" {
+				policy = config.OnMissingSkip
+
+				if e.Required != nil && *e.Required {
+					policy = config.OnMissingFail
+				}
+			}
+
+			switch policy {
+			case config.OnMissingSkip:
+				continue
+			case config.OnMissingNull:
+				v = nil
+			case config.OnMissingDefault:
+				v = e.Default
+			case config.OnMissingSkipDoc:
+				return nil, errors.Wrapf(errSkipDocument, "field '%s' is missing", source(e))
+			default:
+				return nil, errors.Errorf("required field '%s' not found", source(e))
+			}
+		}
+
+		converted, err := e.Converter.Convert(v)
+		if err != nil {
+			if e.OnConvError == "" || e.OnConvError == config.OnMissingFail {
+				return nil, errors.Wrapf(err, "unable to convert field '%s'", source(e))
+			}
+
+			m.stats.ErrorsConv.Inc()
+
+			switch e.OnConvError {
+			case config.OnMissingNull:
+				converted = nil
+			case config.OnMissingDefault:
+				// Default is validated to be convertible at config load
+				converted, _ = e.Converter.Convert(e.Default)
+			case config.OnMissingSkipDoc:
+				return nil, errors.Wrapf(errSkipDocument, "unable to convert field '%s': %s", source(e), err)
+			}
+		}
+
+		row.Columns = append(row.Columns, column)
+		row.Values = append(row.Values, converted)
+	}
+
+	for _, child := range p.children {
+		v, found := docpath.Get(el, child.explode)
+		if !found || v == nil {
+			continue
+		}
+
+		elements, ok := v.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("field '%s' exploded into table '%s' is not an array", child.explode, child.table)
+		}
+
+		for i, childEl := range elements {
+			childRow, err := m.buildRow(child, childEl, i)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to build row for table '%s'", child.table)
+			}
+
+			if childRow != nil {
+				row.Children = append(row.Children, childRow)
+			}
+		}
+	}
+
+	// Nothing to write; a row that only has children is still written (with
+	// its column defaults) so that they have a parent
+	if len(row.Columns) == 0 && len(row.ParentRefs) == 0 && len(row.Children) == 0 {
+		return nil, nil
+	}
+
+	return row, nil
+}
+
+// decodeDocument decodes a single source document according to
+// source.file_contents
+func (m *Migrator) decodeDocument(data string) (interface{}, error) {
+	switch m.cfg.TOML.Source.FileContents {
+	case "bson", "archive":
+		doc, err := bson.Unmarshal([]byte(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decode bson document")
+		}
+
+		return doc, nil
+	case "csv":
+		return m.decodeCSV(data)
+	}
+
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Change events are extended JSON
+	if m.cfg.TOML.Source.FileContents == "ejson" || m.cfg.TOML.Source.FileContents == "changestream" {
+		doc, err = ejson.Unwrap(doc)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to unwrap extended json")
+		}
+	}
+
+	return doc, nil
+}
+
+// decodeCSV decodes a single CSV record into a document keyed by the header
+// columns; all values are strings
+func (m *Migrator) decodeCSV(data string) (interface{}, error) {
+	cr := csv.NewReader(strings.NewReader(data))
+	cr.FieldsPerRecord = len(m.csvHeader)
+
+	record, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode csv record")
+	}
+
+	doc := make(map[string]interface{}, len(record))
+
+	for i, v := range record {
+		doc[m.csvHeader[i]] = v
+	}
+
+	return doc, nil
+}
+
+// decodeJSON decodes a single JSON document; numbers are decoded as
+// json.Number so that large integers do not lose precision.
+func decodeJSON(data string) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(data)))
+	dec.UseNumber()
+
+	var doc interface{}
+
+	if err := dec.Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "unable to decode json document")
+	}
+
+	return doc, nil
+}
+
+// isNullIf reports whether the (scalar) source value v matches one of the
+// entry's null_if values
+func isNullIf(e *config.TOMLMappingEntry, v interface{}) bool {
+	if len(e.NullIf) == 0 {
+		return false
+	}
+
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+
+	s, err := conv.Convert("string", v)
+	if err != nil {
+		return false
+	}
+
+	return contains(e.NullIf, s.(string))
+}
+
+// source describes where an entry's value comes from (for error messages)
+func source(e *config.TOMLMappingEntry) string {
+	if e.Expr != "" {
+		return e.Expr
+	}
+
+	return e.Src
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
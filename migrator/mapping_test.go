@@ -0,0 +1,66 @@
+package migrator
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// A parent whose mapped fields are all missing is still written when it has
+// exploded children
+func TestBuildRowChildrenOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	m := newTestMigrator(t, fmt.Sprintf(`
+[config]
+checkpoint_file = %q
+
+[source]
+file = "-"
+file_type = "plain"
+file_contents = "json"
+
+[destination]
+type = "avro"
+path = %q
+
+[mapping]
+orders = [
+    { src = "total", dst = "orders.total", conv = "float" },
+    { src = "$index", dst = "order_items.position", conv = "int" },
+    { src = "sku", dst = "order_items.sku", conv = "string" },
+]
+
+[tables.order_items]
+parent = "orders"
+explode = "items"
+`, filepath.Join(dir, "checkpoint.json"), filepath.Join(dir, "out")))
+
+	doc, err := decodeJSON(`{"items": [{"sku": "a"}, {"sku": "b"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := m.buildRow(m.plan[0], doc, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row == nil {
+		t.Fatal("parent row was dropped")
+	}
+
+	if len(row.Columns) != 0 || len(row.Children) != 2 {
+		t.Fatalf("got columns %v and %d children, want no columns and 2 children", row.Columns, len(row.Children))
+	}
+
+	// Without children there is nothing to write
+	doc, err = decodeJSON(`{"items": []}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row, err = m.buildRow(m.plan[0], doc, -1); err != nil || row != nil {
+		t.Fatalf("got %#v (%v), want no row", row, err)
+	}
+}
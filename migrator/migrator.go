@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,20 +18,58 @@ import (
 type ProcessorJob struct {
 	Data   string
 	Offset int64
+
+	// Namespace ("<db>.<collection>") of the document; only set for sources
+	// holding several collections (ie. archives and directories)
+	Namespace string
+}
+
+// Size is the number of bytes the job counts against config.max_inflight_bytes
+func (p *ProcessorJob) Size() int64 {
+	return int64(len(p.Data))
 }
 
 type CheckpointJob struct {
 	WorkerID int
 	Offset   int64
+
+	// Checksums of the document's rows
+	Sums tableSums
+
+	// Resume token of the change stream event (if any)
+	ResumeToken string
+
+	// Namespace of the document (archive and directory sources)
+	Namespace string
+
+	// File destinations: checkpoints of all documents whose files were
+	// committed together; they are checkpointed at once (instead of this job)
+	Committed []*CheckpointJob
 }
 
 type Migrator struct {
-	cfg         *config.Config
-	log         *logrus.Entry
-	cp          *types.Checkpoint
-	last        time.Time
-	checksums   map[string]struct{}
-	checksumsMu *sync.Mutex
+	cfg        *config.Config
+	log        *logrus.Entry
+	cp         *types.Checkpoint
+	plan       []*tablePlan
+	hasher     *rowHasher
+	delta      *delta
+	sink       *fileSink
+	stats      *Stats
+	ctrl       *controller
+	throttle   *throttle
+	offsets    *offsetTracker
+	wjClosed   chan struct{}
+	pauser     *pauser
+	cpFlushCh  chan struct{}
+	commitCh   chan struct{} // file destinations: commit the open files
+	budget     *memBudget
+	lastReport atomic.Pointer[Report]
+	csvHeader  []string
+	namespaces *namespaces
+	preludeEnd int64
+	dump       atomic.Pointer[DumpReport]
+	last       time.Time
 }
 
 func New(cfg *config.Config) (*Migrator, error) {
@@ -39,95 +78,192 @@ func New(cfg *config.Config) (*Migrator, error) {
 	}
 
 	// Load checkpoint (or create if it doesn't exist)
-	cp, err := checkpoint.Load(cfg.TOML.Config.CheckpointFile, cfg.TOML.Source.File, cfg.TOML.Source.FileType)
+	stream := cfg.TOML.Source.IsStream()
+
+	cp, err := checkpoint.Load(cfg.TOML.Config.CheckpointFile, cfg.TOML.Source.File, cfg.TOML.Source.FileType, stream)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to load checkpoint file")
 	}
 
-	return &Migrator{
-		cfg:         cfg,
-		cp:          cp,
-		last:        time.Time{},
-		log:         logrus.WithField("pkg", "migrator"),
-		checksums:   make(map[string]struct{}),
-		checksumsMu: &sync.Mutex{},
-	}, nil
+	// Stream checkpoints count documents, file checkpoints bytes
+	if cp.Stream != stream && cp.IndexOffset > 0 {
+		if stream {
+			return nil, errors.New("checkpoint was written for a file source, not a stream")
+		}
+
+		return nil, errors.New("checkpoint was written for a stream source, not a file")
+	}
+
+	// Directory checkpoints are offsets into the recorded collection files
+	if dir := cfg.TOML.Source.IsDir(); dir != (cp.DumpFiles != nil) {
+		if dir {
+			return nil, errors.New("checkpoint was not written for a directory source")
+		}
+
+		return nil, errors.New("checkpoint was written for a directory source")
+	}
+
+	// Figure out how mapping entries translate into (parent/child) table rows
+	plan, err := buildPlan(cfg.TOML.Mapping, cfg.TOML.Tables)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to build mapping plan")
+	}
+
+	m := &Migrator{
+		cfg:       cfg,
+		cp:        cp,
+		plan:      plan,
+		hasher:    newRowHasher(plan),
+		stats:     &Stats{},
+		budget:    newMemBudget(cfg.TOML.Config.MaxInflightBytes),
+		offsets:   newOffsetTracker(cp.IndexOffset),
+		pauser:    &pauser{},
+		cpFlushCh: make(chan struct{}, 1),
+		commitCh:  make(chan struct{}, 1),
+		throttle:  newThrottle(cfg.TOML.Destination.MaxRowsPerSec, cfg.TOML.Destination.MaxBytesPerSec),
+		last:      time.Time{},
+		log:       logrus.WithField("pkg", "migrator"),
+	}
+
+	m.checkChecksumColumns()
+
+	if cfg.TOML.Destination.IsFile() {
+		m.sink, err = newFileSink(cfg.TOML.Destination, plan, cp.IndexOffset, m.log)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to prepare file destination")
+		}
+	}
+
+	if cfg.TOML.Source.FileContents == "archive" || cfg.TOML.Source.IsDir() {
+		m.namespaces, err = newNamespaces(cfg, m.log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Change events are applied like delta rows
+	if cfg.TOML.Delta.Enabled || cfg.TOML.Source.FileContents == "changestream" {
+		m.delta = newDelta(cfg.TOML.Delta, plan, m.log)
+	}
+
+	return m, nil
 }
 
 // Run is the main entry point for the migrator.
 //
 // [Overview]
 //
-// Run will launch 1 reader, N processors, 1 writer and 1 checkpointer.
+// Run will launch 1 reader, N processors, N writers, 1 checkpointer, 1
+// reporter and (if config.adaptive is enabled) 1 controller.
 //
 // The reader will read data from the source and send the data in a *ProcessorJob
-// to the processor goroutines via the 'jobCh' channel.
+// to the processor goroutines via the 'pjCh' channel.
 //
-// The processors will process the source data and send it to the writer as a
-// *WriterJob via the 'writerCh' channel.
+// The processors will process the source data and send it to the writers as a
+// *WriterJob via the 'wjCh' channel.
 //
-// The writer will write the data to the destination and upon completion will
-// send a *CheckpointJob to the checkpointer via the 'cpCh' channel.
+// The writers will write the data to the destination and upon completion will
+// send a *CheckpointJob to the checkpointer via the 'cpjCh' channel.
 //
-// [Shutdown]
+// With config.adaptive enabled, config.adaptive.max_writers writers are
+// launched but only as many as the controller decides are active; it also
+// picks the batch size (see controller).
 //
-// Shutdown is complex.
+// All channels are bounded, so a slow destination throttles the reader (see
+// also config.max_inflight_bytes).
 //
-//	Here's the gist:
+// [Shutdown]
+//
+// The pipeline shuts down front to back: each stage closes the channel it
+// writes to once it exits, so the next stage finishes everything that is
+// already queued and then exits as well. Once all writers have exited, the
+// checkpointer writes the final checkpoint.
 //
 // A shutdown can be initiated in 3 ways:
-//  1. CTRL-C or sent SIGKILL
+//  1. drainCtx is cancelled (ie. SIGINT/SIGTERM)
 //  2. The reader has finished reading all data
 //  3. An unrecoverable error has occurred
 //
-// For (1): main() catches signals and cancels the main context which is passed
-// to Run(). Reader, processors and writer listen to the context.Done() channel
-// and will exit when it's closed.
-//
-// However! The checkpointer is a bit special. It can only shutdown once it knows
-// that reader is finished and all processors are done working (as in, there won't
-// be anything else sent down the checkpoint channel). For this reason, checkpointer
-// has its own shutdown context that is triggered only when reader AND all processors
-// have finished.
+// For (1): the reader stops and processors + writers flush documents that were
+// already read, for up to config.drain_timeout. If the drain does not finish in
+// time or forceCtx is cancelled (ie. a second signal), processors and writers
+// are stopped immediately.
 //
-// For (2): Reader will hit EOF and upon exit will send a signal on the finCh.
-// Run() listens on finCh and will trigger shutdown of processors, writer and
-// lastly, the checkpointer. This is considered a "clean" exit.
+// For (2): same as (1) but without a deadline; this is considered a "clean"
+// exit and the checkpoint is marked as completed.
 //
-// For (3): If any of the goroutines encounter an unrecoverable error, they will
-// exit and write to the errCh that Run() listens on. Run() will then trigger
-// a shutdown of all components.
+// For (3): everything is stopped immediately.
 //
-// ^ Take all of that with a grain of salt. That's the general idea. Actual
-// implementation may vary. GLHF!
-func (m *Migrator) Run(shutdownCtx context.Context, shutdownCancel context.CancelFunc) error {
+// In every case the checkpoint only advances past documents that have been
+// written, even if writers finish out of order, so a resumed run never skips
+// a document.
+func (m *Migrator) Run(drainCtx, forceCtx context.Context) error {
+	// Stops the reader
+	readCtx, stopReading := context.WithCancel(drainCtx)
+	defer stopReading()
+
+	// Stops processors and writers
+	workCtx, stopWorking := context.WithCancel(forceCtx)
+	defer stopWorking()
+
+	// Stops reporter, controller and control endpoint once Run returns
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
 	// processor wait group
 	pWg := &sync.WaitGroup{}
 
 	// writer wait group
 	wWg := &sync.WaitGroup{}
 
-	// checkpointer wait group
-	cpWg := &sync.WaitGroup{}
-
-	// Error channel that Run() listens on; all goroutines launched by Run()
-	// write to this channel if they encounter an unrecoverable error.
-	errCh := make(chan error, m.cfg.TOML.Config.NumProcessors)
-
-	// processor job channel
+	// processor job channel; closed by the reader
 	pjCh := make(chan *ProcessorJob, m.cfg.TOML.Config.NumProcessors)
 
-	// writer job channel
+	// writer job channel; closed once all processors have exited
 	wjCh := make(chan *WriterJob, m.cfg.TOML.Config.NumWriters)
 
-	// checkpoint job channel
-	cpjCh := make(chan *CheckpointJob, 10_000)
+	// checkpoint job channel; writers block (and stop taking jobs) if the
+	// checkpointer falls behind
+	cpjCh := make(chan *CheckpointJob, m.cfg.TOML.Config.BatchSize*m.cfg.TOML.Config.NumWriters)
 
 	// special channel for checkpointer used for shutdown
 	cpControlCh := make(chan bool, 1)
 
-	// "clean exit" shutdown channel
-	finCh := make(chan bool, 1)
+	// closed once the reader has read the whole source
+	finCh := make(chan struct{})
+
+	// closed once all writers have exited
+	writersDone := make(chan struct{})
+
+	// closed once the checkpointer has exited
+	cpDone := make(chan struct{})
+
+	// Create/validate destination tables once, before any rows are written
+	if err := m.prepareDestination(drainCtx); err != nil {
+		return errors.Wrap(err, "unable to prepare destination")
+	}
+
+	// Tunes active writers + batch size; backlog is the number of jobs waiting
+	// for a writer
+	m.ctrl = newController(m.cfg.TOML.Config, func() int { return len(wjCh) })
+
+	// Inactive writers exit once this is closed
+	m.wjClosed = make(chan struct{})
+
+	// Error channel that Run() listens on; all goroutines launched by Run()
+	// write to this channel if they encounter an unrecoverable error.
+	errCh := make(chan error, m.cfg.TOML.Config.NumProcessors+m.ctrl.maxWriters()+3)
+
+	go m.runController(bgCtx)
+
+	go m.runReporter(bgCtx)
+
+	// Launch control endpoint (if --control-addr is set)
+	go func() {
+		if err := m.runControlServer(bgCtx); err != nil {
+			errCh <- fmt.Errorf("error in control endpoint: %v", err)
+		}
+	}()
 
 	// Launch processors
 	for i := 0; i < m.cfg.TOML.Config.NumProcessors; i++ {
@@ -138,31 +274,41 @@ func (m *Migrator) Run(shutdownCtx context.Context, shutdownCancel context.Cance
 			defer m.log.Debugf("Worker %d exit", i)
 			defer pWg.Done()
 
-			if err := m.runProcessor(shutdownCtx, i, pjCh, wjCh); err != nil {
+			if err := m.runProcessor(workCtx, i, pjCh, wjCh); err != nil {
 				errCh <- fmt.Errorf("error in worker %d: %v", i, err)
 			}
 		}()
 	}
 
+	go func() {
+		pWg.Wait()
+		close(wjCh)
+		close(m.wjClosed)
+	}()
+
 	m.log.Debug("Launching reader")
 
 	// Launch reader
 	go func() {
 		m.log.Debug("Reader start")
 		defer m.log.Debug("Reader exit")
+		defer close(pjCh)
 
-		if err := m.runReader(shutdownCtx, pjCh); err != nil {
+		if err := m.runReader(readCtx, pjCh); err != nil {
 			errCh <- fmt.Errorf("error in reader: %v", err)
+			return
 		}
 
-		// Reader has finished
-		m.log.Debug("Reader finished, nothing else to do")
-		finCh <- true
+		// Reader only returns early if it was told to stop
+		if readCtx.Err() == nil {
+			m.log.Debug("Reader finished, nothing else to do")
+			close(finCh)
+		}
 	}()
 
 	m.log.Debug("Launching writers")
 
-	for i := 0; i < m.cfg.TOML.Config.NumWriters; i++ {
+	for i := 0; i < m.ctrl.maxWriters(); i++ {
 		wWg.Add(1)
 
 		go func() {
@@ -170,21 +316,24 @@ func (m *Migrator) Run(shutdownCtx context.Context, shutdownCancel context.Cance
 			defer m.log.Debugf("Writer %d exit", i)
 			defer wWg.Done()
 
-			if err := m.runWriter(shutdownCtx, i, wjCh, cpjCh); err != nil {
+			if err := m.runWriter(workCtx, i, wjCh, cpjCh); err != nil {
 				errCh <- fmt.Errorf("error in writer %d: %v", i, err)
 			}
 		}()
 	}
 
+	go func() {
+		wWg.Wait()
+		close(writersDone)
+	}()
+
 	m.log.Debug("Launching checkpointer")
 
 	// Launch checkpointer
 	go func() {
 		m.log.Debug("Checkpointer start")
 		defer m.log.Debug("Checkpointer exit")
-
-		cpWg.Add(1)
-		defer cpWg.Done()
+		defer close(cpDone)
 
 		if err := m.runCheckpointer(cpControlCh, cpjCh); err != nil {
 			errCh <- fmt.Errorf("error in checkpointer: %v", err)
@@ -193,43 +342,141 @@ func (m *Migrator) Run(shutdownCtx context.Context, shutdownCancel context.Cance
 
 	m.log.Debug("Continuously watching shutdown and finch")
 
-	// Read from errCh to detect errors
+	s := &shutdown{
+		stopReading: stopReading,
+		stopWorking: stopWorking,
+		drainCtx:    drainCtx,
+		forceCtx:    forceCtx,
+		writersDone: writersDone,
+		cpDone:      cpDone,
+		cpControlCh: cpControlCh,
+		errCh:       errCh,
+	}
+
 	select {
-	case <-shutdownCtx.Done():
-		m.log.Debug("Received context done, waiting for workers to stop")
-		return m.shutdown(pWg, cpWg, shutdownCancel, cpControlCh, false)
+	case <-drainCtx.Done():
+		m.log.Infof("Shutting down: draining documents that were already read (up to %s)",
+			time.Duration(m.cfg.TOML.Config.DrainTimeout))
+
+		if err := m.shutdown(s, time.Duration(m.cfg.TOML.Config.DrainTimeout), false); err != nil {
+			return errors.Wrap(err, "unable to drain (resume will re-process documents that were not written)")
+		}
+
+		m.log.Info("Drain completed, all documents that were read have been written")
+
+		return nil
 	case <-finCh:
-		m.log.Debug("Received completion signal, stopping workers and checkpointer")
+		m.log.Debug("Received completion signal, waiting for writers to finish")
+
+		// No deadline, unless we are told to stop while finishing up
+		if err := m.shutdown(s, 0, true); err != nil {
+			return errors.Wrap(err, "migration did not complete")
+		}
+
 		m.log.Info("Migrator run completed")
-		return m.shutdown(pWg, cpWg, shutdownCancel, cpControlCh, true)
+
+		// Delete rows that are missing from a delta migration's source
+		if err := m.deleteMissing(forceCtx); err != nil {
+			return errors.Wrap(err, "unable to delete rows missing from the source (re-run to retry)")
+		}
+
+		// Recreate indexes/foreign keys dropped by destination.defer_indexes
+		if err := m.RestoreIndexes(forceCtx); err != nil {
+			return errors.Wrap(err, "unable to restore deferred indexes (re-run with --restore-indexes)")
+		}
+
+		return nil
 	case err := <-errCh:
-		if err != nil {
-			return errors.Wrap(err, "received component error")
+		stopReading()
+		stopWorking()
+
+		if shutdownErr := m.shutdown(s, time.Duration(m.cfg.TOML.Config.ShutdownTimeout), false); shutdownErr != nil {
+			m.log.Error(shutdownErr)
 		}
 
-		return m.shutdown(pWg, cpWg, shutdownCancel, cpControlCh, false)
+		return errors.Wrap(err, "received component error")
 	}
 }
 
-// shutdown
-func (m *Migrator) shutdown(wWg, cpWg *sync.WaitGroup, shutdownCancel context.CancelFunc, cpControlCh chan<- bool, cleanExit bool) error {
-	// Tell workers to exit
-	if err := timeout(func() {
-		shutdownCancel()
-		wWg.Wait()
-	}, 5*time.Second); err != nil {
-		return errors.New("timed out waiting for workers to exit")
+// shutdown holds everything needed to stop the pipeline started by Run
+type shutdown struct {
+	stopReading context.CancelFunc
+	stopWorking context.CancelFunc
+	drainCtx    context.Context
+	forceCtx    context.Context
+	writersDone <-chan struct{}
+	cpDone      <-chan struct{}
+	cpControlCh chan<- bool
+	errCh       <-chan error
+}
+
+// shutdown stops the reader and waits for processors and writers to flush
+// what was already read. drainTimeout of 0 means no deadline (unless drainCtx
+// is cancelled meanwhile, in which case config.drain_timeout applies). The
+// checkpoint is marked as completed if completed is true and the drain
+// finished without being cut short. Returns why the drain was cut short.
+func (m *Migrator) shutdown(s *shutdown, drainTimeout time.Duration, completed bool) error {
+	s.stopReading()
+
+	var deadline <-chan time.Time
+
+	if drainTimeout > 0 {
+		deadline = time.After(drainTimeout)
 	}
 
-	// Tell checkpointers to exit
-	if err := timeout(func() {
-		cpControlCh <- cleanExit
-		cpWg.Wait()
-	}, 5*time.Second); err != nil {
+	drainDone := s.drainCtx.Done()
+
+	var drainErr error
+
+DRAIN:
+	for {
+		select {
+		case <-s.writersDone:
+			m.log.Debug("All writers finished")
+			break DRAIN
+		case <-drainDone:
+			drainDone = nil
+
+			if deadline == nil {
+				drainTimeout = time.Duration(m.cfg.TOML.Config.DrainTimeout)
+				deadline = time.After(drainTimeout)
+
+				m.log.Infof("Shutting down: waiting up to %s for writers to finish", drainTimeout)
+			}
+		case <-deadline:
+			drainErr = errors.Errorf("drain did not finish within %s", drainTimeout)
+			break DRAIN
+		case <-s.forceCtx.Done():
+			drainErr = errors.New("forced shutdown")
+			break DRAIN
+		case err := <-s.errCh:
+			drainErr = errors.Wrap(err, "error while draining")
+			break DRAIN
+		}
+	}
+
+	if drainErr != nil {
+		m.log.Warnf("Stopping processors and writers: %s", drainErr)
+		completed = false
+	}
+
+	// Tell workers to exit (no-op if they already have)
+	s.stopWorking()
+
+	shutdownTimeout := time.Duration(m.cfg.TOML.Config.ShutdownTimeout)
+
+	if err := timeout(func() { <-s.writersDone }, shutdownTimeout); err != nil {
+		m.log.Errorf("Timed out waiting for workers to exit; final checkpoint only covers finished writes")
+	}
+
+	// Tell checkpointer to write the final checkpoint and exit
+	s.cpControlCh <- completed
+
+	if err := timeout(func() { <-s.cpDone }, shutdownTimeout); err != nil {
 		return errors.New("timed out waiting for checkpointer to exit")
 	}
 
-	return nil
+	return drainErr
 }
 
 // Wrapper for executing func with a timeout
@@ -0,0 +1,151 @@
+package migrator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often a paused reader checks whether writers have drained
+const pauseDrainPoll = 100 * time.Millisecond
+
+// pauser holds the paused state of the migration. While paused, the reader
+// stops reading; processors and writers finish what was already read, after
+// which a checkpoint is saved.
+type pauser struct {
+	mu      sync.Mutex
+	resumed chan struct{} // nil while running; closed on resume
+	since   time.Time
+	total   time.Duration
+}
+
+// PauseReport is the paused state section of the progress report
+type PauseReport struct {
+	Paused      bool       `json:"paused"`
+	PausedSince *time.Time `json:"paused_since,omitempty"`
+	PausedFor   string     `json:"paused_for"`
+}
+
+// Pause pauses the migration; returns false if it was already paused
+func (m *Migrator) Pause() bool {
+	p := m.pauser
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resumed != nil {
+		return false
+	}
+
+	p.resumed = make(chan struct{})
+	p.since = time.Now()
+
+	m.log.Info("Pausing migration")
+
+	return true
+}
+
+// Resume resumes a paused migration; returns false if it was not paused
+func (m *Migrator) Resume() bool {
+	p := m.pauser
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resumed == nil {
+		return false
+	}
+
+	close(p.resumed)
+
+	p.resumed = nil
+	p.total += time.Since(p.since)
+
+	m.log.Info("Resuming migration")
+
+	return true
+}
+
+// state returns a channel that is closed on resume, or nil if not paused
+func (p *pauser) state() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.resumed
+}
+
+func (p *pauser) report() *PauseReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r := &PauseReport{
+		Paused: p.resumed != nil,
+	}
+
+	total := p.total
+
+	if r.Paused {
+		since := p.since
+		r.PausedSince = &since
+		total += time.Since(p.since)
+	}
+
+	r.PausedFor = total.Round(time.Second).String()
+
+	return r
+}
+
+// waitWhilePaused is called by the reader before handing out a document; if
+// the migration is paused it waits for writers to drain, has the checkpointer
+// save a checkpoint and blocks until the migration is resumed (or ctx is done).
+func (m *Migrator) waitWhilePaused(ctx context.Context) error {
+	resumed := m.pauser.state()
+	if resumed == nil {
+		return nil
+	}
+
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "waitWhilePaused",
+	})
+
+	llog.Info("Paused: reader stopped, waiting for writers to finish in-flight documents")
+
+	ticker := time.NewTicker(pauseDrainPoll)
+	defer ticker.Stop()
+
+	for m.offsets.numPending() > 0 {
+		// File destinations only checkpoint documents once their files are
+		// committed, which otherwise waits for the files to fill up
+		if m.sink != nil {
+			select {
+			case m.commitCh <- struct{}{}:
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resumed:
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	// Ask the checkpointer to save right away
+	select {
+	case m.cpFlushCh <- struct{}{}:
+	default:
+	}
+
+	llog.Infof("Paused: all read documents written, checkpoint at offset '%d'", m.offsets.safe())
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
@@ -0,0 +1,172 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/config"
+)
+
+// newTestMigrator builds a migrator from a TOML config the way main does
+func newTestMigrator(t *testing.T, toml string) *Migrator {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(file, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	os.Args = []string{"mmmbop", "--migrate", "--quiet", "--report-interval", "1h", "--config-file", file}
+
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readCheckpoint(t *testing.T, file string) *types.Checkpoint {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	cp := &types.Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	return cp
+}
+
+// Pausing a migration to a file destination commits the open files so that
+// the read documents are checkpointed (they are otherwise held back until the
+// files are full)
+func TestPauseFileSink(t *testing.T) {
+	dir := t.TempDir()
+	cpFile := filepath.Join(dir, "checkpoint.json")
+	out := filepath.Join(dir, "out")
+
+	// The source is stdin so that the test controls when documents arrive
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+
+	os.Stdin = r
+
+	m := newTestMigrator(t, fmt.Sprintf(`
+[config]
+batch_size = 1
+checkpoint_file = %q
+checkpoint_interval = "1h"
+
+[source]
+file = "-"
+file_type = "plain"
+file_contents = "json"
+
+[destination]
+type = "avro"
+path = %q
+
+[mapping]
+users = [
+    { src = "id", dst = "users.id", conv = "int" },
+]
+`, cpFile, out))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- m.Run(ctx, ctx)
+	}()
+
+	const n = 10
+
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(w, `{"id": %d}`+"\n", i)
+	}
+
+	waitFor(t, "documents to be written", func() bool { return m.stats.DocumentsWritten.Count() == n })
+
+	// Files are far from full, so nothing is committed yet
+	parts, _ := filepath.Glob(filepath.Join(out, "users", "part-*.avro"))
+	if len(parts) != 0 {
+		t.Fatalf("got committed files %v before pausing", parts)
+	}
+
+	m.Pause()
+
+	// The reader notices the pause once it reads the next document
+	fmt.Fprintf(w, `{"id": %d}`+"\n", n+1)
+
+	waitFor(t, "the pause checkpoint", func() bool {
+		cp := readCheckpoint(t, cpFile)
+		return cp != nil && cp.IndexOffset == n
+	})
+
+	parts, _ = filepath.Glob(filepath.Join(out, "users", "part-*.avro"))
+	if len(parts) != 1 {
+		t.Fatalf("got committed files %v, want 1", parts)
+	}
+
+	m.Resume()
+	w.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the migration to finish")
+	}
+
+	if cp := readCheckpoint(t, cpFile); cp.CompletedAt == nil || cp.IndexOffset != n+1 {
+		t.Fatalf("got checkpoint at offset %d (completed: %v), want %d", cp.IndexOffset, cp.CompletedAt != nil, n+1)
+	}
+
+	parts, _ = filepath.Glob(filepath.Join(out, "users", "part-*.avro"))
+	if len(parts) != 2 {
+		t.Fatalf("got committed files %v, want 2", parts)
+	}
+}
@@ -2,15 +2,39 @@ package migrator
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/csv"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/timpalpant/gzran"
+
+	"github.com/dselans/mmmbop/bson"
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/dump"
 )
 
+// Size of the buffer documents are read through
+const readerBufferSize = 1024 * 1024
+
+// documentReader reads one raw document at a time from the source. Offset is
+// the (uncompressed) position right after the last returned document; it is
+// what gets checkpointed and where a resumed run starts reading.
+type documentReader interface {
+	Next() ([]byte, error)
+	Offset() int64
+}
+
+// namespaceReader is a documentReader for sources holding several collections
+type namespaceReader interface {
+	Namespace() string
+}
+
 func (m *Migrator) runReader(shutdownCtx context.Context, workCh chan<- *ProcessorJob) error {
 	llog := m.log.WithFields(logrus.Fields{
 		"method": "runReader",
@@ -18,58 +42,475 @@ func (m *Migrator) runReader(shutdownCtx context.Context, workCh chan<- *Process
 	llog.Debug("Start")
 	defer llog.Debug("Exit")
 
-	f, err := os.Open(m.cfg.TOML.Source.File)
+	src, err := m.openSource()
 	if err != nil {
-		return errors.Wrap(err, "unable to open source file")
+		return err
 	}
+	defer src.Close()
 
-	reader, err := gzran.NewReader(f)
-	if err != nil {
-		return errors.Wrap(err, "unable to create reader")
+	// Where to start reading from; stream sources are read from the start and
+	// skip the documents that were already written instead
+	offset := m.cp.IndexOffset
+
+	var skip int64
+
+	stream := m.cfg.TOML.Source.IsStream()
+	if stream {
+		llog.Info("Source is a stream; it is not indexed and checkpoints count documents")
+
+		skip, offset = offset, 0
 	}
 
-	reader.Index = m.cp.Index
-	defer reader.Close()
+	// Change stream sources resume after the event with the checkpointed
+	// resume token, wherever it is in the source; this allows a resumed run
+	// to read a newer export of the same stream
+	m.cp.Lock()
+	token := m.cp.ResumeToken
+	m.cp.Unlock()
 
-	scanner := bufio.NewScanner(reader)
+	if m.cfg.TOML.Source.FileContents != "changestream" {
+		token = ""
+	}
+
+	if token != "" {
+		offset, skip = 0, 0
+	}
+
+	if m.cfg.TOML.Source.FileContents == "csv" {
+		headerEnd, err := m.readCSVHeader(src)
+		if err != nil {
+			return err
+		}
+
+		if offset < headerEnd {
+			offset = headerEnd
+		}
+	}
+
+	if _, ok := src.(*dirSource); ok {
+		if err := m.readDumpDir(); err != nil {
+			return err
+		}
+	}
+
+	if m.cfg.TOML.Source.FileContents == "archive" {
+		preludeEnd, err := m.readArchivePrelude(src)
+		if err != nil {
+			return err
+		}
+
+		if offset < preludeEnd {
+			offset = preludeEnd
+		}
+	}
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "unable to seek to offset '%d'", offset)
+	}
+
+	llog.Debugf("Reading source from offset '%d'", offset)
+
+	m.stats.SourceOffset.Store(offset)
+
+	reader := m.newDocumentReader(src, offset)
+	if stream {
+		reader = &documentCounter{documentReader: reader}
+	}
+
+	if d, ok := src.(*dirSource); ok {
+		reader = &dirReader{documentReader: reader, src: d}
+	}
 
-	// Where to start reading from
-	offset := m.cp.IndexOffset
 	numProcessed := 0
 
 MAIN:
-	for scanner.Scan() {
+	for {
+		data, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				if token != "" {
+					return errors.Errorf("resume token '%s' not found in source", token)
+				}
+
+				// Once reader exits, migrator will signal workers and
+				// checkpointer to exit.
+				llog.Debug("EOF reached")
+				break MAIN
+			}
+
+			m.stats.ErrorsSrcRead.Inc()
+
+			return errors.Wrapf(err, "unable to read document after offset '%d'", reader.Offset())
+		}
+
+		// Skip the documents of a re-piped stream that were already written
+		if reader.Offset() <= skip {
+			m.stats.SourceOffset.Store(reader.Offset())
+			continue
+		}
+
+		// Skip change events up to (and including) the checkpointed one
+		if token != "" {
+			eventToken, err := m.eventToken(string(data))
+			if err != nil {
+				return errors.Wrapf(err, "unable to read resume token of change event before offset '%d'", reader.Offset())
+			}
+
+			if eventToken == token {
+				llog.Debugf("Resuming after change event ending at offset '%d'", reader.Offset())
+				token = ""
+			}
+
+			m.stats.SourceOffset.Store(reader.Offset())
+
+			continue
+		}
+
+		m.stats.DocumentsRead.Inc()
+		m.stats.SourceOffset.Store(reader.Offset())
+
+		job := &ProcessorJob{
+			Data:   string(data),
+			Offset: reader.Offset(),
+		}
+
+		if r, ok := reader.(namespaceReader); ok {
+			job.Namespace = r.Namespace()
+		}
+
+		// Blocks while the migration is paused
+		if err := m.waitWhilePaused(shutdownCtx); err != nil {
+			llog.Debug("Received shutdown signal while paused")
+			break MAIN
+		}
+
+		// Wait for writers to catch up if too much data is in flight
+		if err := m.budget.acquire(shutdownCtx, job.Size()); err != nil {
+			llog.Debug("Received shutdown signal while waiting for in-flight budget")
+			break MAIN
+		}
+
+		// Tracked before it is handed out so the checkpoint cannot move past
+		// it before it has been written
+		m.offsets.add(job.Offset)
+
 		select {
 		case <-shutdownCtx.Done():
 			llog.Debug("Received shutdown signal")
 			break MAIN
-		default:
-			line := scanner.Text()
+		case workCh <- job:
+		}
 
-			// Determine where we are in the file for checkpointing
-			offset, err = reader.Seek(0, io.SeekCurrent)
-			if err != nil {
-				if err == io.EOF {
-					// Once reader exits, migrator will signal workers and
-					// checkpointer to exit.
-					llog.Debug("EOF reached")
-					break MAIN
-				}
+		numProcessed += 1
 
-				return errors.Wrap(err, "unable to seek to current offset")
-			}
+		llog.Debugf("Proccessed '%d' jobs", numProcessed)
+	}
 
-			llog.Debugf("Sending job at offset: %d", offset)
-			workCh <- &ProcessorJob{
-				Data:   line,
-				Offset: offset,
-			}
+	return nil
+}
 
-			numProcessed += 1
+// openSource opens source.file for reading; gzip sources use the checkpoint's
+// index so that seeking does not require decompressing from the start. Stream
+// sources cannot seek (see streamSource).
+func (m *Migrator) openSource() (io.ReadSeekCloser, error) {
+	if m.cfg.TOML.Source.IsStream() {
+		return m.openStream()
+	}
 
-			llog.Debugf("Proccessed '%d' jobs", numProcessed)
+	if m.cfg.TOML.Source.IsDir() {
+		return newDirSource(m.cp.DumpFiles, m.cp), nil
+	}
+
+	f, err := os.Open(m.cfg.TOML.Source.File)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open source file")
+	}
+
+	if m.cfg.TOML.Source.FileType != "gzip" {
+		return f, nil
+	}
+
+	reader, err := gzran.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "unable to create reader")
+	}
+
+	reader.Index = m.cp.Index
+
+	return &gzipSource{Reader: reader, f: f}, nil
+}
+
+// gzipSource closes both the gzran reader and the underlying file
+type gzipSource struct {
+	*gzran.Reader
+	f *os.File
+}
+
+func (g *gzipSource) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// openStream opens stdin or a named pipe; gzip streams are decompressed
+// sequentially
+func (m *Migrator) openStream() (io.ReadSeekCloser, error) {
+	f := os.Stdin
+
+	if m.cfg.TOML.Source.File != config.SourceStdin {
+		var err error
+
+		f, err = os.Open(m.cfg.TOML.Source.File)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open source file")
 		}
 	}
 
-	return nil
+	counter := &byteCounter{r: f}
+	s := &streamSource{br: bufio.NewReaderSize(counter, readerBufferSize), read: counter, f: f}
+
+	if m.cfg.TOML.Source.FileType != "gzip" {
+		return s, nil
+	}
+
+	zr, err := gzip.NewReader(bufio.NewReaderSize(f, readerBufferSize))
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "unable to create reader")
+	}
+
+	counter.r = zr
+	s.zr = zr
+
+	return s, nil
+}
+
+// streamSource is a source that can only be read once, from the start.
+// Seeking is only possible to the current position, which lets streams be
+// read like files that are never resumed from an offset.
+type streamSource struct {
+	br   *bufio.Reader
+	read *byteCounter
+	zr   *gzip.Reader
+	f    *os.File
+}
+
+func (s *streamSource) Read(p []byte) (int, error) {
+	return s.br.Read(p)
+}
+
+func (s *streamSource) Seek(offset int64, whence int) (int64, error) {
+	pos := s.read.n - int64(s.br.Buffered())
+
+	if whence != io.SeekStart || offset != pos {
+		return pos, errors.New("stream sources cannot seek")
+	}
+
+	return pos, nil
+}
+
+func (s *streamSource) Close() error {
+	if s.zr != nil {
+		s.zr.Close()
+	}
+
+	return s.f.Close()
+}
+
+// byteCounter counts the bytes read from r
+type byteCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+
+	return n, err
+}
+
+// documentCounter makes Offset() the number of documents read; stream
+// sources are checkpointed by document count
+type documentCounter struct {
+	documentReader
+	n int64
+}
+
+func (d *documentCounter) Next() ([]byte, error) {
+	data, err := d.documentReader.Next()
+	if err == nil {
+		d.n++
+	}
+
+	return data, err
+}
+
+func (d *documentCounter) Offset() int64 {
+	return d.n
+}
+
+func (d *documentCounter) Namespace() string {
+	if r, ok := d.documentReader.(namespaceReader); ok {
+		return r.Namespace()
+	}
+
+	return ""
+}
+
+func (m *Migrator) newDocumentReader(r io.Reader, offset int64) documentReader {
+	br := bufio.NewReaderSize(r, readerBufferSize)
+
+	switch m.cfg.TOML.Source.FileContents {
+	case "bson":
+		return &bsonReader{r: br, offset: offset}
+	case "csv":
+		cr := csv.NewReader(br)
+		cr.FieldsPerRecord = len(m.csvHeader)
+		cr.ReuseRecord = true
+
+		return &csvReader{r: cr, start: offset}
+	case "archive":
+		// A resumed run starts inside the block of the checkpointed document
+		var namespace string
+
+		if offset > m.preludeEnd {
+			m.cp.Lock()
+			namespace = m.cp.ArchiveNamespace
+			m.cp.Unlock()
+		}
+
+		return dump.NewArchiveReader(br, offset, namespace)
+	default:
+		return &lineReader{r: br, offset: offset}
+	}
+}
+
+// readCSVHeader reads the header record from the start of the source and
+// returns the offset right after it
+func (m *Migrator) readCSVHeader(src io.ReadSeeker) (int64, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "unable to seek to start of source")
+	}
+
+	// Streams cannot seek back after the header, so it must be read without
+	// buffering beyond it
+	var r io.Reader = bufio.NewReader(src)
+	if s, ok := src.(*streamSource); ok {
+		r = s.br
+	}
+
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return 0, errors.New("csv source is missing a header")
+		}
+
+		return 0, errors.Wrap(err, "unable to read csv header")
+	}
+
+	seen := make(map[string]struct{}, len(header))
+
+	for i, name := range header {
+		// Strip a UTF-8 BOM from the first column
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+			header[0] = name
+		}
+
+		if name == "" {
+			return 0, errors.Errorf("csv header column %d is empty", i+1)
+		}
+
+		if _, ok := seen[name]; ok {
+			return 0, errors.Errorf("csv header column '%s' is duplicated", name)
+		}
+
+		seen[name] = struct{}{}
+	}
+
+	m.csvHeader = header
+
+	return cr.InputOffset(), nil
+}
+
+// lineReader reads newline delimited (JSON) documents; blank lines are skipped
+type lineReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (l *lineReader) Next() ([]byte, error) {
+	for {
+		line, err := l.r.ReadBytes('\n')
+		l.offset += int64(len(line))
+
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			return trimmed, nil
+		}
+
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+}
+
+func (l *lineReader) Offset() int64 {
+	return l.offset
+}
+
+// bsonReader reads concatenated BSON documents (ie. mongodump .bson files)
+type bsonReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (b *bsonReader) Next() ([]byte, error) {
+	data, err := bson.ReadDocument(b.r)
+	if err != nil {
+		return nil, err
+	}
+
+	b.offset += int64(len(data))
+
+	return data, nil
+}
+
+func (b *bsonReader) Offset() int64 {
+	return b.offset
+}
+
+// csvReader reads CSV records; each record is re-encoded as a single CSV line
+// so that it can be passed (and decoded) like any other document
+type csvReader struct {
+	r     *csv.Reader
+	start int64
+}
+
+func (c *csvReader) Next() ([]byte, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+
+	if err := w.Write(record); err != nil {
+		return nil, errors.Wrap(err, "unable to encode csv record")
+	}
+
+	w.Flush()
+
+	return bytes.TrimRight(buf.Bytes(), "\n"), w.Error()
+}
+
+func (c *csvReader) Offset() int64 {
+	return c.start + c.r.InputOffset()
 }
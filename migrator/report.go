@@ -0,0 +1,236 @@
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Report is the periodic progress report (see README "Output")
+type Report struct {
+	Progress   *ReportProgress   `json:"progress"`
+	Pause      *PauseReport      `json:"pause"`
+	Stats      *ReportStats      `json:"stats"`
+	Errors     *ReportErrors     `json:"errors"`
+	Controller *ControllerReport `json:"controller"`
+	Throttle   *ThrottleReport   `json:"throttle"`
+	Inflight   *BudgetReport     `json:"inflight"`
+	Dump       *DumpReport       `json:"dump,omitempty"`
+}
+
+type ReportProgress struct {
+	PercentComplete    float64   `json:"percent_complete"`
+	MigrationStartedAt time.Time `json:"migration_started_at"`
+	ElapsedTime        string    `json:"elapsed_time"`
+	EstimatedDuration  string    `json:"estimated_duration"`
+}
+
+type ReportStats struct {
+	QPSSrc            string `json:"qps_src"`
+	QPSDst            string `json:"qps_dst"`
+	DocumentsTotal    int64  `json:"documents_total"`
+	DocumentsMigrated int64  `json:"documents_migrated"`
+	RowsWritten       int64  `json:"rows_written"`
+	RowsUpdated       int64  `json:"rows_updated,omitempty"`
+	RowsUnchanged     int64  `json:"rows_unchanged,omitempty"`
+	RowsDeleted       int64  `json:"rows_deleted,omitempty"`
+	CheckpointTotal   int64  `json:"checkpoint_total"`
+	CheckpointSecAgo  int64  `json:"checkpoint_sec_ago"`
+}
+
+type ReportErrors struct {
+	DocumentsSkipped       int64 `json:"documents_skipped"`
+	DocumentsSkippedSecAgo int64 `json:"documents_skipped_sec_ago"`
+	ErrorsConv             int64 `json:"errors_conv"`
+	ErrorsConvSecAgo       int64 `json:"errors_conv_sec_ago"`
+	ErrorsSrcRead          int64 `json:"errors_src_read"`
+	ErrorsSrcReadSecAgo    int64 `json:"errors_src_read_sec_ago"`
+	ErrorsDstWrite         int64 `json:"errors_dst_write"`
+	ErrorsDstWriteSecAgo   int64 `json:"errors_dst_write_sec_ago"`
+	ConnSrcRetries         int64 `json:"conn_src_retries"`
+	ConnSrcRetriesSecAgo   int64 `json:"conn_src_retries_sec_ago"`
+	ConnDstRetries         int64 `json:"conn_dst_retries"`
+	ConnDstRetriesSecAgo   int64 `json:"conn_dst_retries_sec_ago"`
+}
+
+// runReporter writes a progress report every --report-interval (and once more
+// on exit) until shutdownCtx is done
+func (m *Migrator) runReporter(shutdownCtx context.Context) {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "runReporter",
+	})
+
+	llog.Debug("Start")
+	defer llog.Debug("Exit")
+
+	if m.cfg.CLI.ReportInterval <= 0 {
+		llog.Debug("Reporting disabled")
+		return
+	}
+
+	ticker := time.NewTicker(m.cfg.CLI.ReportInterval)
+	defer ticker.Stop()
+
+	total := m.sourceSize()
+	lastTick := time.Now()
+	lastRead, lastWritten := m.stats.DocumentsRead.Count(), m.stats.DocumentsWritten.Count()
+
+	report := func(now time.Time) {
+		read, written := m.stats.DocumentsRead.Count(), m.stats.DocumentsWritten.Count()
+		elapsed := now.Sub(lastTick).Seconds()
+
+		r := m.report(now, total, float64(read-lastRead)/elapsed, float64(written-lastWritten)/elapsed)
+		m.lastReport.Store(r)
+
+		if err := m.writeReport(r); err != nil {
+			llog.Warnf("Unable to write report: %s", err)
+		}
+
+		lastTick, lastRead, lastWritten = now, read, written
+	}
+
+	for {
+		select {
+		case <-shutdownCtx.Done():
+			report(time.Now())
+			return
+		case now := <-ticker.C:
+			report(now)
+		}
+	}
+}
+
+func (m *Migrator) report(now time.Time, total int64, qpsSrc, qpsDst float64) *Report {
+	s := m.stats
+
+	m.cp.Lock()
+	startedAt := m.cp.StartedAt
+	m.cp.Unlock()
+
+	r := &Report{
+		Progress: &ReportProgress{
+			MigrationStartedAt: startedAt,
+			ElapsedTime:        now.Sub(startedAt).Round(time.Second).String(),
+		},
+		Pause: m.pauser.report(),
+		Stats: &ReportStats{
+			QPSSrc:            fmt.Sprintf("%.0f", qpsSrc),
+			QPSDst:            fmt.Sprintf("%.0f", qpsDst),
+			DocumentsMigrated: s.DocumentsWritten.Count(),
+			RowsWritten:       s.RowsWritten.Count(),
+			RowsUpdated:       s.RowsUpdated.Count(),
+			RowsUnchanged:     s.RowsUnchanged.Count(),
+			RowsDeleted:       s.RowsDeleted.Count(),
+			CheckpointTotal:   s.CheckpointsSaved.Count(),
+			CheckpointSecAgo:  secAgo(now, s.CheckpointsSaved.Last()),
+		},
+		Errors: &ReportErrors{
+			DocumentsSkipped:       s.DocumentsSkipped.Count(),
+			DocumentsSkippedSecAgo: secAgo(now, s.DocumentsSkipped.Last()),
+			ErrorsConv:             s.ErrorsConv.Count(),
+			ErrorsConvSecAgo:       secAgo(now, s.ErrorsConv.Last()),
+			ErrorsSrcRead:          s.ErrorsSrcRead.Count(),
+			ErrorsSrcReadSecAgo:    secAgo(now, s.ErrorsSrcRead.Last()),
+			ErrorsDstWrite:         s.ErrorsDstWrite.Count(),
+			ErrorsDstWriteSecAgo:   secAgo(now, s.ErrorsDstWrite.Last()),
+			ConnSrcRetries:         s.ConnSrcRetries.Count(),
+			ConnSrcRetriesSecAgo:   secAgo(now, s.ConnSrcRetries.Last()),
+			ConnDstRetries:         s.ConnDstRetries.Count(),
+			ConnDstRetriesSecAgo:   secAgo(now, s.ConnDstRetries.Last()),
+		},
+		Controller: m.ctrl.report(),
+		Throttle:   m.throttle.report(),
+		Inflight:   m.budget.report(),
+		Dump:       m.dump.Load(),
+	}
+
+	// Progress is based on the (uncompressed) source offset; documents_total
+	// and the estimated duration are extrapolated from it
+	offset := s.SourceOffset.Load()
+
+	if total > 0 && offset > 0 {
+		fraction := min(float64(offset)/float64(total), 1)
+
+		r.Progress.PercentComplete = float64(int(fraction*10_000)) / 100
+		r.Progress.EstimatedDuration = time.Duration(float64(now.Sub(startedAt)) / fraction).Round(time.Second).String()
+		r.Stats.DocumentsTotal = int64(float64(s.DocumentsRead.Count()) / fraction)
+	}
+
+	return r
+}
+
+// writeReport writes r to --report-output (replacing the previous report) or
+// to stdout
+func (m *Migrator) writeReport(r *Report) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal report")
+	}
+
+	if m.cfg.CLI.ReportOutput == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	tmp := m.cfg.CLI.ReportOutput + ".tmp"
+
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return errors.Wrap(err, "unable to write report file")
+	}
+
+	if err := os.Rename(tmp, m.cfg.CLI.ReportOutput); err != nil {
+		return errors.Wrap(err, "unable to rename report file")
+	}
+
+	return nil
+}
+
+// sourceSize returns the uncompressed size of the source (0 if unknown);
+// gzipped directory sources are estimated until they have been read
+func (m *Migrator) sourceSize() int64 {
+	var size int64
+
+	m.cp.Lock()
+	files := m.cp.DumpFiles
+
+	for _, f := range files {
+		if f.Size < 0 {
+			size += f.SizeHint
+		} else {
+			size += f.Size
+		}
+	}
+	m.cp.Unlock()
+
+	if len(files) > 0 {
+		return size
+	}
+
+	if m.cfg.TOML.Source.FileType == "gzip" {
+		if len(m.cp.Index) == 0 {
+			return 0
+		}
+
+		return m.cp.Index[len(m.cp.Index)-1].UncompressedOffset
+	}
+
+	info, err := os.Stat(m.cfg.TOML.Source.File)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+func secAgo(now, last time.Time) int64 {
+	if last.IsZero() {
+		return 0
+	}
+
+	return int64(now.Sub(last).Seconds())
+}
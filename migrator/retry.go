@@ -0,0 +1,118 @@
+package migrator
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/config"
+)
+
+// errorClass is the result of classifying a destination error
+type errorClass int
+
+const (
+	// Retrying will not help (ie. constraint violations, bad data, shutdown)
+	errorPermanent errorClass = iota
+
+	// Retry the batch on the same connection pool (ie. deadlocks)
+	errorTransient
+
+	// Retry the batch on a new connection pool (ie. connection reset, failover)
+	errorReconnect
+)
+
+// Postgres SQLSTATEs that are safe to retry. Class 08 (connection exception)
+// is handled separately.
+var pgTransientCodes = map[string]errorClass{
+	"40001": errorTransient, // serialization_failure
+	"40P01": errorTransient, // deadlock_detected
+	"55P03": errorTransient, // lock_not_available
+	"53300": errorTransient, // too_many_connections
+	"57P01": errorReconnect, // admin_shutdown
+	"57P02": errorReconnect, // crash_shutdown
+	"57P03": errorReconnect, // cannot_connect_now
+	"25006": errorReconnect, // read_only_sql_transaction (connected to a demoted primary)
+}
+
+// classifyError decides whether a failed batch write can be retried
+func classifyError(err error) errorClass {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return errorPermanent
+	}
+
+	var pgErr *pgconn.PgError
+
+	if errors.As(err, &pgErr) {
+		if strings.HasPrefix(pgErr.Code, "08") {
+			return errorReconnect
+		}
+
+		if class, ok := pgTransientCodes[pgErr.Code]; ok {
+			return class
+		}
+
+		return errorPermanent
+	}
+
+	// Connection level errors
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &netErr),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, context.DeadlineExceeded),
+		pgconn.Timeout(err),
+		pgconn.SafeToRetry(errors.Cause(err)):
+		return errorReconnect
+	}
+
+	return errorPermanent
+}
+
+// commitError is returned when COMMIT fails. Unless the server rejected the
+// commit (or it was never sent), the transaction may have been committed
+// before the connection failed.
+type commitError struct {
+	error
+}
+
+func (e *commitError) Cause() error  { return e.error }
+func (e *commitError) Unwrap() error { return e.error }
+
+// commitUnknown reports whether err leaves it unknown if the batch was
+// committed
+func commitUnknown(err error) bool {
+	var (
+		cErr  *commitError
+		pgErr *pgconn.PgError
+	)
+
+	return errors.As(err, &cErr) && !errors.As(err, &pgErr) && !pgconn.SafeToRetry(errors.Cause(err))
+}
+
+// backoff returns how long to wait before retry attempt (starting at 1)
+func backoff(cfg *config.TOMLRetry, attempt int) time.Duration {
+	d := float64(cfg.InitialBackoff) * math.Pow(cfg.Multiplier, float64(attempt-1))
+	d = min(d, float64(cfg.MaxBackoff))
+
+	// Spread retries of writers that failed at the same time
+	if cfg.Jitter > 0 {
+		d += d * cfg.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(max(d, 0))
+}
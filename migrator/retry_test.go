@@ -0,0 +1,49 @@
+package migrator
+
+import (
+	"context"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		class   errorClass
+		unknown bool // commitUnknown
+	}{
+		{"nil", nil, errorPermanent, false},
+		{"canceled", context.Canceled, errorPermanent, false},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, errorTransient, false},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, errorPermanent, false},
+		{"connection exception", &pgconn.PgError{Code: "08006"}, errorReconnect, false},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, errorReconnect, false},
+		{"reset", errors.Wrap(syscall.ECONNRESET, "write"), errorReconnect, false},
+		{"other", errors.New("boom"), errorPermanent, false},
+
+		// The server rejected the commit, so nothing was written
+		{"commit serialization failure", &commitError{errors.Wrap(&pgconn.PgError{Code: "40001"}, "commit")}, errorTransient, false},
+
+		// The connection failed after COMMIT may have been sent
+		{"commit eof", &commitError{errors.Wrap(io.ErrUnexpectedEOF, "commit")}, errorReconnect, true},
+		{"commit reset", &commitError{errors.Wrap(syscall.ECONNRESET, "commit")}, errorReconnect, true},
+		{"commit timeout", &commitError{errors.Wrap(context.DeadlineExceeded, "commit")}, errorReconnect, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.class {
+				t.Errorf("classifyError = %d, want %d", got, tt.class)
+			}
+
+			if got := commitUnknown(tt.err); got != tt.unknown {
+				t.Errorf("commitUnknown = %v, want %v", got, tt.unknown)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package migrator
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/schema"
+)
+
+// prepareDestination applies destination.schema_mode and validates that all
+// mapped tables and columns exist. Runs once, before any rows are written.
+func (m *Migrator) prepareDestination(shutdownCtx context.Context) error {
+	// File destinations are prepared by newFileSink
+	if m.sink != nil {
+		return nil
+	}
+
+	pool, err := m.createPGPool(shutdownCtx)
+	if err != nil {
+		return errors.Wrap(err, "error creating postgres connection pool")
+	}
+	defer pool.Close()
+
+	planned, err := m.applySchemaMode(shutdownCtx, pool)
+	if err != nil {
+		return errors.Wrapf(err, "unable to apply schema mode '%s'", m.cfg.TOML.Destination.SchemaMode)
+	}
+
+	// Tables/columns were not actually created
+	if m.cfg.CLI.DryRun && planned > 0 {
+		m.log.Warn("Dry run: skipping destination validation as schema changes were not applied")
+		return nil
+	}
+
+	// Ensure that destination tables and columns exist + have correct types
+	if err := m.validateDestinationMappings(shutdownCtx, pool); err != nil {
+		return errors.Wrap(err, "error validating destination mappings")
+	}
+
+	if m.cfg.TOML.Destination.DeferIndexes {
+		if err := m.deferIndexes(shutdownCtx, pool); err != nil {
+			return errors.Wrap(err, "unable to defer indexes")
+		}
+	}
+
+	if !m.cfg.CLI.DryRun {
+		if err := m.prepareDelta(shutdownCtx, pool); err != nil {
+			return errors.Wrap(err, "unable to prepare delta migration")
+		}
+	}
+
+	return nil
+}
+
+// applySchemaMode creates missing tables and adds missing columns ("create",
+// "migrate") and adds dupe-check indexes to existing tables ("migrate") in a
+// single transaction.
+// Returns the number of DDL statements that were (or, in dry-run mode, would
+// have been) executed.
+func (m *Migrator) applySchemaMode(shutdownCtx context.Context, pool *pgxpool.Pool) (int, error) {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "applySchemaMode",
+	})
+
+	mode := m.cfg.TOML.Destination.SchemaMode
+	if mode == config.SchemaModeValidate {
+		return 0, nil
+	}
+
+	tables, err := m.destinationTables()
+	if err != nil {
+		return 0, err
+	}
+
+	statements := make([]string, 0)
+
+	for _, t := range tables {
+		exists, err := checkTableExists(shutdownCtx, pool, Table(t.Name))
+		if err != nil {
+			return 0, errors.Wrapf(err, "error checking if table '%s' exists", t.Name)
+		}
+
+		if !exists {
+			ddl, err := schema.CreateTable(schema.Postgres, t)
+			if err != nil {
+				return 0, err
+			}
+
+			statements = append(statements, ddl)
+
+			continue
+		}
+
+		existing, err := getColumns(shutdownCtx, pool, Table(t.Name))
+		if err != nil {
+			return 0, errors.Wrapf(err, "unable to get columns of table '%s'", t.Name)
+		}
+
+		for _, c := range t.Columns {
+			if _, ok := existing[c.Name]; ok {
+				continue
+			}
+
+			ddl, err := schema.AddColumn(schema.Postgres, t.Name, c)
+			if err != nil {
+				return 0, err
+			}
+
+			statements = append(statements, ddl)
+		}
+
+		if mode != config.SchemaModeMigrate {
+			continue
+		}
+
+		// Primary keys cannot be added to existing tables without rewriting
+		// them; a unique index serves the same purpose for dupe checks.
+		keys := t.Unique
+		if len(t.PrimaryKey) > 0 && len(t.Unique) == 0 {
+			keys = t.PrimaryKey
+		}
+
+		if len(keys) > 0 && !isIdentityKey(t, keys) {
+			statements = append(statements, schema.CreateUniqueIndex(schema.Postgres, &schema.Table{
+				Name:   t.Name,
+				Unique: keys,
+			}))
+		}
+	}
+
+	if len(statements) == 0 {
+		llog.Debug("Destination schema is up to date")
+		return 0, nil
+	}
+
+	if m.cfg.CLI.DryRun {
+		for _, s := range statements {
+			llog.Infof("Dry run: would execute:\n%s", s)
+		}
+
+		return len(statements), nil
+	}
+
+	tx, err := pool.Begin(shutdownCtx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to begin transaction")
+	}
+
+	// No-op if tx has been committed
+	defer tx.Rollback(shutdownCtx)
+
+	for _, s := range statements {
+		llog.Infof("Executing:\n%s", s)
+
+		if _, err := tx.Exec(shutdownCtx, s); err != nil {
+			return 0, errors.Wrapf(err, "unable to execute '%s'", s)
+		}
+	}
+
+	if err := tx.Commit(shutdownCtx); err != nil {
+		return 0, errors.Wrap(err, "unable to commit schema changes")
+	}
+
+	return len(statements), nil
+}
+
+// destinationTables describes the destination tables needed by the mapping;
+// column types are derived from the entries' convs. Parent columns that are
+// referenced by children (via $parent.) but not mapped are created as identity
+// columns.
+func (m *Migrator) destinationTables() ([]*schema.Table, error) {
+	tables := make([]*schema.Table, 0)
+
+	var walk func(p *tablePlan, parent *schema.Table) error
+
+	walk = func(p *tablePlan, parent *schema.Table) error {
+		t := &schema.Table{Name: string(p.table)}
+
+		for _, e := range p.entries {
+			_, column := config.ParseDst(e.Dst)
+
+			if hasColumn(t, column) {
+				continue
+			}
+
+			t.Columns = append(t.Columns, &schema.Column{
+				Name:    column,
+				Conv:    e.Conv,
+				NotNull: isNotNull(e),
+			})
+
+			// Generate the referenced parent column if it is not mapped
+			ref := parentRef(e)
+			if ref == "" || parent == nil || hasColumn(parent, ref) {
+				continue
+			}
+
+			if e.Conv != "int" {
+				return errors.Errorf("column '%s.%s' referenced by '%s' is not mapped and can only be generated for conv 'int'",
+					parent.Name, ref, e.Dst)
+			}
+
+			parent.Columns = append([]*schema.Column{{Name: ref, Conv: "int", Identity: true, NotNull: true}}, parent.Columns...)
+
+			if len(parent.PrimaryKey) == 0 {
+				parent.PrimaryKey = []string{ref}
+			}
+		}
+
+		// Soft delete columns are not mapped (see tables.<name>.on_delete)
+		if p.softDelete != "" && !hasColumn(t, p.softDelete) {
+			t.Columns = append(t.Columns, &schema.Column{
+				Name: p.softDelete,
+				Conv: (*m.cfg.TOML.Tables)[string(p.table)].SoftDeleteConv(),
+			})
+		}
+
+		switch m.cfg.TOML.Destination.DupeCheckIndex {
+		case config.DupeCheckIndexPrimaryKey:
+			if len(p.dupeCheck) > 0 {
+				t.PrimaryKey = p.dupeCheck
+			}
+		case config.DupeCheckIndexUnique:
+			t.Unique = p.dupeCheck
+		}
+
+		tables = append(tables, t)
+
+		for _, child := range p.children {
+			if err := walk(child, t); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, p := range m.plan {
+		if err := walk(p, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// Primary key columns are always NOT NULL
+	for _, t := range tables {
+		for _, c := range t.Columns {
+			if contains(t.PrimaryKey, c.Name) {
+				c.NotNull = true
+			}
+		}
+	}
+
+	return tables, nil
+}
+
+// searchPathSchema is the schema that the unqualified table name $1 resolves
+// to through the search_path, ie. the table that is written to. Matching on
+// table_name alone would also match same-named tables in other schemas.
+const searchPathSchema = `(
+        SELECT n.nspname FROM pg_class c
+        JOIN pg_namespace n ON n.oid = c.relnamespace
+        WHERE c.oid = to_regclass(quote_ident($1))
+    )`
+
+func getColumns(shutdownCtx context.Context, pool *pgxpool.Pool, t Table) (map[string]struct{}, error) {
+	rows, err := pool.Query(
+		shutdownCtx,
+		"SELECT column_name FROM information_schema.columns WHERE table_name=$1 AND table_schema="+searchPathSchema,
+		string(t),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying information_schema.columns")
+	}
+	defer rows.Close()
+
+	columns := make(map[string]struct{})
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "unable to scan column name")
+		}
+
+		columns[name] = struct{}{}
+	}
+
+	return columns, rows.Err()
+}
+
+// isNotNull reports whether an entry always produces a (non-NULL) value
+func isNotNull(e *config.TOMLMappingEntry) bool {
+	if parentRef(e) != "" {
+		return true
+	}
+
+	if e.OnConvError == config.OnMissingNull || e.NullIf != nil {
+		return false
+	}
+
+	switch e.OnMissing {
+	case config.OnMissingFail:
+		return true
+	case "":
+		return e.Required != nil && *e.Required
+	default:
+		return false
+	}
+}
+
+// parentRef returns the referenced parent column for "$parent." entries
+func parentRef(e *config.TOMLMappingEntry) string {
+	if !strings.HasPrefix(e.Src, config.SrcParentPrefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(e.Src, config.SrcParentPrefix)
+}
+
+func hasColumn(t *schema.Table, name string) bool {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isIdentityKey reports whether keys is just the generated identity column,
+// which already is the primary key
+func isIdentityKey(t *schema.Table, keys []string) bool {
+	if len(keys) != 1 {
+		return false
+	}
+
+	for _, c := range t.Columns {
+		if c.Name == keys[0] {
+			return c.Identity
+		}
+	}
+
+	return false
+}
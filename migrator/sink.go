@@ -0,0 +1,443 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/avro"
+	"github.com/dselans/mmmbop/config"
+	"github.com/dselans/mmmbop/conv"
+)
+
+const (
+	sinkFilePrefix = "part-"
+	sinkFileSuffix = ".avro"
+	sinkTempFile   = "part-inprogress.avro.tmp"
+)
+
+var nonAvroNameRegex = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// fileSink writes rows to Avro files, one directory per table under
+// destination.path.
+//
+// Rows are appended to one (temporary) file per table. Once any of them
+// reaches destination.max_file_bytes, and when the writer exits, all open
+// files are committed together: synced and renamed to part-<offset>.avro,
+// where offset is the source offset of the last document they hold. Documents
+// are only checkpointed once their files are committed, so files with a
+// higher offset than the checkpoint (committed right before a crash) are
+// removed when the migration is resumed and no row is ever written twice.
+type fileSink struct {
+	dir      string
+	maxBytes int64
+	codec    string
+	schemas  map[Table]*avro.Schema
+	files    map[Table]*sinkFile
+	log      *logrus.Entry
+}
+
+type sinkFile struct {
+	f *os.File
+	w *avro.Writer
+}
+
+// newFileSink derives the schema of every planned table and removes files
+// that were not checkpointed (offset is the checkpointed source offset)
+func newFileSink(cfg *config.TOMLDestination, plan []*tablePlan, offset int64, log *logrus.Entry) (*fileSink, error) {
+	s := &fileSink{
+		dir:      cfg.Path,
+		maxBytes: cfg.MaxFileBytes,
+		codec:    cfg.Codec,
+		schemas:  make(map[Table]*avro.Schema),
+		files:    make(map[Table]*sinkFile),
+		log:      log,
+	}
+
+	if err := s.addSchemas(plan, nil); err != nil {
+		return nil, err
+	}
+
+	for table := range s.schemas {
+		if err := os.MkdirAll(s.tableDir(table), 0755); err != nil {
+			return nil, errors.Wrapf(err, "unable to create directory for table '%s'", table)
+		}
+
+		if err := s.cleanup(table, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) addSchemas(plan []*tablePlan, parent *tablePlan) error {
+	for _, p := range plan {
+		fields := make([]*avro.Field, 0, len(p.entries))
+
+		for _, e := range p.entries {
+			_, column := config.ParseDst(e.Dst)
+
+			// Values generated by a database cannot be read back from a file
+			if ref, ok := strings.CutPrefix(e.Src, config.SrcParentPrefix); ok && !plansColumn(parent, ref) {
+				return errors.Errorf("table '%s' references column '%s' of its parent, which is not mapped", p.table, ref)
+			}
+
+			fields = append(fields, avroField(column, e.Conv))
+		}
+
+		name := nonAvroNameRegex.ReplaceAllString(string(p.table), "_")
+		if name[0] >= '0' && name[0] <= '9' {
+			name = "_" + name
+		}
+
+		schema, err := avro.NewSchema(name, fields)
+		if err != nil {
+			return errors.Wrapf(err, "unable to derive avro schema of table '%s'", p.table)
+		}
+
+		s.schemas[p.table] = schema
+
+		if err := s.addSchemas(p.children, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func plansColumn(p *tablePlan, column string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, e := range p.entries {
+		if _, c := config.ParseDst(e.Dst); c == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// avroField returns the (nullable) field a column of conv c is written as
+func avroField(column, c string) *avro.Field {
+	f := &avro.Field{
+		Name:  column,
+		Array: strings.HasSuffix(c, conv.ArraySuffix),
+	}
+
+	switch strings.TrimSuffix(c, conv.ArraySuffix) {
+	case "int":
+		f.Type = avro.Long
+	case "float":
+		f.Type = avro.Double
+	case "bool":
+		f.Type = avro.Boolean
+	case "uuid":
+		f.Type = avro.UUID
+	case "bytea", "base64", "bson":
+		f.Type = avro.Bytes
+	case "date":
+		f.Type = avro.Date
+	case "datetime", "timestamp":
+		f.Type = avro.LocalTimestamp
+	case "timestamptz":
+		f.Type = avro.Timestamp
+	default:
+		// string, json(b), numeric (to keep its precision), time, inet, enum
+		f.Type = avro.String
+	}
+
+	return f
+}
+
+func (s *fileSink) tableDir(table Table) string {
+	return filepath.Join(s.dir, string(table))
+}
+
+// cleanup removes the temporary file and committed files beyond offset from
+// the directory of table
+func (s *fileSink) cleanup(table Table, offset int64) error {
+	entries, err := os.ReadDir(s.tableDir(table))
+	if err != nil {
+		return errors.Wrapf(err, "unable to read directory of table '%s'", table)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+
+		if name != sinkTempFile {
+			end, ok := strings.CutPrefix(strings.TrimSuffix(name, sinkFileSuffix), sinkFilePrefix)
+			if !ok || !strings.HasSuffix(name, sinkFileSuffix) {
+				continue
+			}
+
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n <= offset {
+				continue
+			}
+
+			s.log.Warnf("Removing '%s' of table '%s': its documents were not checkpointed and are written again", name, table)
+		}
+
+		if err := os.Remove(filepath.Join(s.tableDir(table), name)); err != nil {
+			return errors.Wrapf(err, "unable to remove '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// write appends row (and its children) to the files of their tables
+func (s *fileSink) write(row *Row, parent map[string]interface{}) error {
+	columns, values, err := withParentRefs(row, parent)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.file(row.Table)
+	if err != nil {
+		return err
+	}
+
+	if err := f.w.Append(columns, values); err != nil {
+		return errors.Wrapf(err, "unable to write row of table '%s'", row.Table)
+	}
+
+	if len(row.Children) == 0 {
+		return nil
+	}
+
+	// Children reference the values of the row itself; missing values are
+	// NULL, as they would be when read back from a database
+	own := make(map[string]interface{}, len(columns)+len(row.Returning))
+
+	for _, c := range row.Returning {
+		own[c] = nil
+	}
+
+	for i, c := range columns {
+		own[c] = values[i]
+	}
+
+	for _, child := range row.Children {
+		if err := s.write(child, own); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// file returns the open file of table, creating it if needed
+func (s *fileSink) file(table Table) (*sinkFile, error) {
+	if f, ok := s.files[table]; ok {
+		return f, nil
+	}
+
+	schema, ok := s.schemas[table]
+	if !ok {
+		return nil, errors.Errorf("table '%s' has no schema", table)
+	}
+
+	f, err := os.Create(filepath.Join(s.tableDir(table), sinkTempFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create file for table '%s'", table)
+	}
+
+	w, err := avro.NewWriter(f, schema, s.codec)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "unable to create avro writer for table '%s'", table)
+	}
+
+	s.files[table] = &sinkFile{f: f, w: w}
+
+	return s.files[table], nil
+}
+
+// full reports whether any open file reached destination.max_file_bytes
+func (s *fileSink) full() bool {
+	for _, f := range s.files {
+		if f.w.Size() >= s.maxBytes {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commit syncs all open files and renames them after offset, the source
+// offset of the last document they hold
+func (s *fileSink) commit(offset int64) error {
+	name := fmt.Sprintf("%s%020d%s", sinkFilePrefix, offset, sinkFileSuffix)
+
+	for table, f := range s.files {
+		if err := f.w.Flush(); err != nil {
+			return errors.Wrapf(err, "unable to flush file of table '%s'", table)
+		}
+
+		if err := f.f.Sync(); err != nil {
+			return errors.Wrapf(err, "unable to sync file of table '%s'", table)
+		}
+
+		if err := f.f.Close(); err != nil {
+			return errors.Wrapf(err, "unable to close file of table '%s'", table)
+		}
+
+		delete(s.files, table)
+
+		if err := os.Rename(f.f.Name(), filepath.Join(s.tableDir(table), name)); err != nil {
+			return errors.Wrapf(err, "unable to commit file of table '%s'", table)
+		}
+
+		if err := syncDir(s.tableDir(table)); err != nil {
+			return errors.Wrapf(err, "unable to sync directory of table '%s'", table)
+		}
+	}
+
+	return nil
+}
+
+// abort removes the files that were not committed
+func (s *fileSink) abort() {
+	for table, f := range s.files {
+		f.f.Close()
+		os.Remove(f.f.Name())
+		delete(s.files, table)
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// runSinkWriter is runWriter for file destinations. Checkpoints are held back
+// until the files holding the documents' rows are committed and then sent as
+// a single CheckpointJob, so that checkpoints always fall between committed
+// files. Files are committed once they are full, when the writer channel is
+// closed and when a paused migration drains (commitCh).
+func (m *Migrator) runSinkWriter(shutdownCtx context.Context, id int, writerCh <-chan *WriterJob, cpChan chan<- *CheckpointJob) error {
+	llog := m.log.WithFields(logrus.Fields{
+		"method": "runSinkWriter",
+		"id":     id,
+	})
+
+	llog.Debug("Start")
+	defer llog.Debug("Exit")
+
+	// Uncommitted files are written again by a resumed run
+	defer m.sink.abort()
+
+	// Checkpoints of documents whose rows are in uncommitted files
+	var pending []*CheckpointJob
+
+	commit := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		last := pending[len(pending)-1]
+
+		if !m.cfg.CLI.DryRun {
+			if err := m.sink.commit(last.Offset); err != nil {
+				return err
+			}
+		}
+
+		llog.Debugf("Committed files up to offset '%d'", last.Offset)
+
+		select {
+		case <-shutdownCtx.Done():
+			llog.Debug("Received shutdown signal while sending checkpoints")
+		case cpChan <- &CheckpointJob{WorkerID: id, Offset: last.Offset, Committed: pending}:
+		}
+
+		pending = nil
+
+		return nil
+	}
+
+	var numWritten int
+
+MAIN:
+	for {
+		select {
+		case <-shutdownCtx.Done():
+			llog.Debug("Received shutdown signal")
+			break MAIN
+		case <-m.commitCh:
+			if err := commit(); err != nil {
+				return errors.Wrap(err, "error committing files")
+			}
+		case job, open := <-writerCh:
+			if !open {
+				llog.Debug("Writer channel closed - exiting writer")
+
+				if err := commit(); err != nil {
+					return errors.Wrap(err, "error committing files")
+				}
+
+				break MAIN
+			}
+
+			batch := m.collectBatch(job, writerCh)
+
+			// Honor destination.max_rows_per_sec/max_bytes_per_sec
+			if err := m.throttle.Wait(shutdownCtx, int64(countRows(batch)), batchBytes(batch)); err != nil {
+				llog.Debug("Received shutdown signal while throttled")
+				break MAIN
+			}
+
+			for _, j := range batch {
+				if !m.cfg.CLI.DryRun {
+					for _, row := range j.Rows {
+						if err := m.sink.write(row, nil); err != nil {
+							llog.Errorf("Error writing job at offset '%d': %v", j.Offset, err)
+							return errors.Wrapf(err, "unable to write job at offset '%d'", j.Offset)
+						}
+					}
+				}
+
+				pending = append(pending, &CheckpointJob{
+					WorkerID:    id,
+					Offset:      j.Offset,
+					Sums:        j.Sums,
+					ResumeToken: j.ResumeToken,
+					Namespace:   j.Namespace,
+				})
+
+				m.budget.release(j.Size)
+			}
+
+			m.stats.DocumentsWritten.Add(int64(len(batch)))
+			m.stats.RowsWritten.Add(int64(countRows(batch)))
+
+			numWritten += len(batch)
+
+			if m.sink.full() {
+				if err := commit(); err != nil {
+					return errors.Wrap(err, "error committing files")
+				}
+			}
+		}
+	}
+
+	llog.Debugf("Handled '%d' jobs", numWritten)
+
+	return nil
+}
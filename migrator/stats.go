@@ -0,0 +1,56 @@
+package migrator
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters that are shared by all migrator components
+type Stats struct {
+	DocumentsRead    counter
+	DocumentsWritten counter
+	DocumentsSkipped counter
+	RowsWritten      counter
+	RowsUpdated      counter // delta migrations
+	RowsUnchanged    counter // delta migrations
+	RowsDeleted      counter // delta migrations
+	CheckpointsSaved counter
+
+	ErrorsConv     counter
+	ErrorsSrcRead  counter
+	ErrorsDstWrite counter
+	ConnSrcRetries counter
+	ConnDstRetries counter
+
+	// Offset (in the uncompressed source) of the last read document
+	SourceOffset atomic.Int64
+}
+
+// counter is a thread-safe counter that remembers when it was last incremented
+type counter struct {
+	count atomic.Int64
+	last  atomic.Int64 // unix nanoseconds
+}
+
+func (c *counter) Inc() {
+	c.Add(1)
+}
+
+func (c *counter) Add(n int64) {
+	c.count.Add(n)
+	c.last.Store(time.Now().UnixNano())
+}
+
+func (c *counter) Count() int64 {
+	return c.count.Load()
+}
+
+// Last returns when the counter was last incremented (zero if never)
+func (c *counter) Last() time.Time {
+	last := c.last.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, last)
+}
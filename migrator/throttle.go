@@ -0,0 +1,181 @@
+package migrator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dselans/mmmbop/conv"
+)
+
+// throttle limits destination writes to destination.max_rows_per_sec and
+// destination.max_bytes_per_sec. It is shared by all writers; limits can be
+// changed while the migration is running (see control endpoint).
+type throttle struct {
+	rows  *tokenBucket
+	bytes *tokenBucket
+}
+
+// ThrottleReport is the throttle section of the progress report
+type ThrottleReport struct {
+	MaxRowsPerSec  int64  `json:"max_rows_per_sec"`
+	MaxBytesPerSec int64  `json:"max_bytes_per_sec"`
+	ThrottledFor   string `json:"throttled_for"`
+}
+
+func newThrottle(rowsPerSec, bytesPerSec int64) *throttle {
+	return &throttle{
+		rows:  newTokenBucket(rowsPerSec),
+		bytes: newTokenBucket(bytesPerSec),
+	}
+}
+
+// Wait blocks until rows and bytes can be written (or ctx is done)
+func (t *throttle) Wait(ctx context.Context, rows, bytes int64) error {
+	if err := t.rows.wait(ctx, rows); err != nil {
+		return err
+	}
+
+	return t.bytes.wait(ctx, bytes)
+}
+
+// Set updates the limits; 0 means unlimited
+func (t *throttle) Set(rowsPerSec, bytesPerSec int64) {
+	t.rows.setRate(rowsPerSec)
+	t.bytes.setRate(bytesPerSec)
+}
+
+// Limits returns the current limits
+func (t *throttle) Limits() (int64, int64) {
+	return t.rows.getRate(), t.bytes.getRate()
+}
+
+func (t *throttle) report() *ThrottleReport {
+	rows, bytes := t.Limits()
+
+	return &ThrottleReport{
+		MaxRowsPerSec:  rows,
+		MaxBytesPerSec: bytes,
+		ThrottledFor:   (t.rows.waited() + t.bytes.waited()).Round(time.Millisecond).String(),
+	}
+}
+
+// tokenBucket holds up to 1s worth of tokens. Requests larger than that go
+// into debt so that a single large batch is delayed rather than rejected.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64 // tokens per second; 0 = unlimited
+	tokens float64
+	last   time.Time
+	total  time.Duration // time spent waiting
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n int64) error {
+	b.mu.Lock()
+
+	if b.rate <= 0 || n <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	rate := float64(b.rate)
+
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	var delay time.Duration
+
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / rate * float64(time.Second))
+		b.total += delay
+	}
+
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Keep any debt; saved tokens cannot exceed the new burst size
+	b.rate = rate
+	b.tokens = min(b.tokens, float64(rate))
+	b.last = time.Now()
+}
+
+func (b *tokenBucket) getRate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rate
+}
+
+func (b *tokenBucket) waited() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.total
+}
+
+// rowBytes estimates the number of bytes written for rows (including
+// children)
+func rowBytes(rows []*Row) int64 {
+	var n int64
+
+	for _, r := range rows {
+		for _, v := range r.Values {
+			n += valueBytes(v)
+		}
+
+		n += rowBytes(r.Children)
+	}
+
+	return n
+}
+
+func valueBytes(v interface{}) int64 {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(t))
+	case []byte:
+		return int64(len(t))
+	case bool:
+		return 1
+	case []interface{}:
+		var n int64
+
+		for _, e := range t {
+			n += valueBytes(e)
+		}
+
+		return n
+	case conv.Array:
+		return valueBytes([]interface{}(t))
+	default:
+		// Numbers, times, UUIDs etc.
+		return 8
+	}
+}
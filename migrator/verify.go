@@ -0,0 +1,717 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dselans/mmmbop/checkpoint"
+	"github.com/dselans/mmmbop/checkpoint/types"
+	"github.com/dselans/mmmbop/config"
+)
+
+// Stop recording (but keep counting) document errors after this many
+const verifyMaxErrors = 100
+
+// VerifyResult is the machine-readable result of Verify (--verify-output)
+type VerifyResult struct {
+	StartedAt        time.Time               `json:"started_at"`
+	CompletedAt      time.Time               `json:"completed_at"`
+	SourceFile       string                  `json:"source_file"`
+	Sampled          bool                    `json:"sampled"`
+	DocumentsChecked int64                   `json:"documents_checked"`
+	DocumentsSkipped int64                   `json:"documents_skipped"`
+	DocumentsFailed  int64                   `json:"documents_failed"`
+	Errors           []string                `json:"errors,omitempty"`
+	Tables           map[string]*VerifyTable `json:"tables"`
+	OK               bool                    `json:"ok"`
+}
+
+// VerifyTable holds the per-table verification counts
+type VerifyTable struct {
+	// Rows the mapping produces for the checked documents (distinct by dupe
+	// check key)
+	ExpectedRows int64 `json:"expected_rows"`
+
+	FoundRows      int64 `json:"found_rows"`
+	MissingRows    int64 `json:"missing_rows"`
+	MismatchedRows int64 `json:"mismatched_rows"`
+
+	// Rows that cannot be looked up because the table has no dupe_check columns
+	UnverifiableRows int64 `json:"unverifiable_rows"`
+
+	// Rows in the destination table
+	DestinationRows int64 `json:"destination_rows"`
+
+	// Destination rows that no source document produces; only known when the
+	// whole source was verified
+	ExtraRows *int64 `json:"extra_rows,omitempty"`
+
+	// Up to --verify-max-reported dupe check keys of missing rows and
+	// mismatched rows
+	Missing    []map[string]interface{} `json:"missing,omitempty"`
+	Mismatches []*VerifyMismatch        `json:"mismatches,omitempty"`
+}
+
+// VerifyMismatch is a destination row whose columns differ from the source
+type VerifyMismatch struct {
+	Key     map[string]interface{} `json:"key"`
+	Columns []*VerifyColumn        `json:"columns"`
+}
+
+type VerifyColumn struct {
+	Column   string      `json:"column"`
+	Expected interface{} `json:"expected"`
+	Actual   *string     `json:"actual"`
+}
+
+type verifier struct {
+	m           *Migrator
+	pool        *pgxpool.Pool
+	convs       map[Table]map[string]string
+	maxReported int
+
+	// Conditions excluding soft deleted rows (see tables.<name>.on_delete)
+	live map[Table]string
+
+	mu     sync.Mutex
+	result *VerifyResult
+
+	// Hashes of dupe check keys that were already verified; nil when sampling
+	seen map[uint64]struct{}
+}
+
+// Verify re-reads the source (or --verify-sample random documents), rebuilds
+// the rows the mapping produces and compares them with the destination by
+// their dupe check keys. Missing rows, extra rows and column mismatches are
+// reported per table and written to --verify-output. Returns an error if any
+// differences were found.
+func Verify(ctx context.Context, cfg *config.Config) error {
+	llog := logrus.WithFields(logrus.Fields{
+		"pkg":    "migrator",
+		"method": "Verify",
+	})
+
+	// Change events describe changes, not the documents to compare with
+	if cfg.TOML.Source.FileContents == "changestream" {
+		return errors.New("verify does not support change stream sources")
+	}
+
+	if cfg.TOML.Destination.IsFile() {
+		return errors.Errorf("verify does not support destination.type '%s'", cfg.TOML.Destination.Type)
+	}
+
+	if cfg.TOML.Source.FileContents == "archive" || cfg.TOML.Source.IsDir() {
+		return errors.New("verify does not support archive and directory sources")
+	}
+
+	plan, err := buildPlan(cfg.TOML.Mapping, cfg.TOML.Tables)
+	if err != nil {
+		return errors.Wrap(err, "unable to build mapping plan")
+	}
+
+	// Verification does not checkpoint
+	m := &Migrator{
+		cfg:   cfg,
+		cp:    &types.Checkpoint{},
+		plan:  plan,
+		stats: &Stats{},
+		log:   logrus.WithField("pkg", "migrator"),
+	}
+
+	sampled := cfg.CLI.VerifySample > 0
+
+	// Random access into gzip sources requires the migration's index
+	if sampled && cfg.TOML.Source.FileType == "gzip" && !cfg.TOML.Source.IsStream() {
+		if index, err := checkpoint.LoadIndex(cfg.TOML.Config.CheckpointIndex); err == nil {
+			m.cp.Index = index
+		} else {
+			llog.Warnf("Unable to load gzip index, sample will be taken by reading the whole source: %s", err)
+		}
+	}
+
+	pool, err := m.createPGPool(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error creating postgres connection pool")
+	}
+	defer pool.Close()
+
+	v := &verifier{
+		m:           m,
+		pool:        pool,
+		convs:       make(map[Table]map[string]string),
+		maxReported: cfg.CLI.VerifyMaxReported,
+		live:        liveConditions(plan),
+		result: &VerifyResult{
+			StartedAt:  time.Now(),
+			SourceFile: cfg.TOML.Source.File,
+			Sampled:    sampled,
+			Tables:     make(map[string]*VerifyTable),
+		},
+	}
+
+	if !sampled {
+		v.seen = make(map[uint64]struct{})
+	}
+
+	for _, entries := range *cfg.TOML.Mapping {
+		for _, e := range entries {
+			table, column := config.ParseDst(e.Dst)
+
+			if v.convs[Table(table)] == nil {
+				v.convs[Table(table)] = make(map[string]string)
+				v.result.Tables[table] = &VerifyTable{}
+			}
+
+			v.convs[Table(table)][column] = e.Conv
+		}
+	}
+
+	docCh := make(chan []byte, cfg.TOML.Config.NumWriters)
+	errCh := make(chan error, cfg.TOML.Config.NumWriters+1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		defer close(docCh)
+
+		if err := v.read(ctx, docCh); err != nil {
+			errCh <- errors.Wrap(err, "unable to read source")
+			cancel()
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < cfg.TOML.Config.NumWriters; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for data := range docCh {
+				if err := v.verifyDocument(ctx, data); err != nil {
+					errCh <- err
+					cancel()
+
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+	}
+
+	if ctx.Err() != nil {
+		return errors.New("verification interrupted")
+	}
+
+	if err := v.finish(ctx); err != nil {
+		return err
+	}
+
+	r := v.result
+
+	for name, t := range r.Tables {
+		llog.Infof("Table '%s': expected %d, found %d, missing %d, mismatched %d, unverifiable %d, destination %d",
+			name, t.ExpectedRows, t.FoundRows, t.MissingRows, t.MismatchedRows, t.UnverifiableRows, t.DestinationRows)
+
+		if t.ExtraRows != nil {
+			llog.Infof("Table '%s': extra %d", name, *t.ExtraRows)
+		}
+	}
+
+	llog.Infof("Checked %d documents (%d skipped, %d failed)", r.DocumentsChecked, r.DocumentsSkipped, r.DocumentsFailed)
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal verify result")
+	}
+
+	if err := writeOutput(cfg.CLI.VerifyOutput, string(data)); err != nil {
+		return errors.Wrap(err, "unable to write verify result")
+	}
+
+	if !r.OK {
+		return errors.New("destination does not match source")
+	}
+
+	llog.Info("Destination matches source")
+
+	return nil
+}
+
+// read sends either every document or --verify-sample random documents to
+// docCh
+func (v *verifier) read(ctx context.Context, docCh chan<- []byte) error {
+	m := v.m
+
+	src, err := m.openSource()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var start int64
+
+	if m.cfg.TOML.Source.FileContents == "csv" {
+		start, err = m.readCSVHeader(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := src.Seek(start, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "unable to seek to offset '%d'", start)
+	}
+
+	n := v.m.cfg.CLI.VerifySample
+
+	// Line delimited documents can be sampled by seeking to random offsets
+	// (gzip sources only if the migration's index is available, never streams)
+	lines := m.cfg.TOML.Source.FileContents == "json" || m.cfg.TOML.Source.FileContents == "ejson"
+	seekable := !m.cfg.TOML.Source.IsStream() && (m.cfg.TOML.Source.FileType != "gzip" || len(m.cp.Index) > 0)
+
+	if n > 0 && lines && seekable {
+		return v.sampleLines(ctx, src, n, docCh)
+	}
+
+	reader := m.newDocumentReader(src, start)
+
+	// Reservoir sample of n documents
+	var (
+		reservoir [][]byte
+		seen      int
+	)
+
+	for {
+		data, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return errors.Wrapf(err, "unable to read document after offset '%d'", reader.Offset())
+		}
+
+		if n == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case docCh <- data:
+			}
+
+			continue
+		}
+
+		seen++
+
+		if len(reservoir) < n {
+			reservoir = append(reservoir, data)
+		} else if i := rand.Intn(seen); i < n {
+			reservoir[i] = data
+		}
+	}
+
+	for _, data := range reservoir {
+		select {
+		case <-ctx.Done():
+			return nil
+		case docCh <- data:
+		}
+	}
+
+	return nil
+}
+
+// sampleLines reads the first complete line after n random offsets. Longer
+// documents are somewhat more likely to be picked.
+func (v *verifier) sampleLines(ctx context.Context, src io.ReadSeeker, n int, docCh chan<- []byte) error {
+	size := v.m.sourceSize()
+	if size <= 0 {
+		return nil
+	}
+
+	offsets := make([]int64, n)
+	for i := range offsets {
+		offsets[i] = rand.Int63n(size)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	br := bufio.NewReaderSize(src, 64*1024)
+	lastEnd := int64(-1)
+
+	for _, offset := range offsets {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "unable to seek to offset '%d'", offset)
+		}
+
+		br.Reset(src)
+
+		pos := offset
+
+		// Skip the (partial) line we landed in
+		if offset > 0 {
+			partial, err := br.ReadBytes('\n')
+			pos += int64(len(partial))
+
+			if err == io.EOF {
+				continue
+			}
+
+			if err != nil {
+				return errors.Wrapf(err, "unable to read after offset '%d'", offset)
+			}
+		}
+
+		// Already sampled
+		if pos < lastEnd {
+			continue
+		}
+
+		lr := &lineReader{r: br, offset: pos}
+
+		data, err := lr.Next()
+		if err != nil {
+			if err == io.EOF {
+				continue
+			}
+
+			return errors.Wrapf(err, "unable to read document after offset '%d'", pos)
+		}
+
+		lastEnd = lr.Offset()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case docCh <- data:
+		}
+	}
+
+	return nil
+}
+
+// verifyDocument rebuilds the rows for a single document and verifies them.
+// Only destination errors are returned; document errors are recorded.
+func (v *verifier) verifyDocument(ctx context.Context, data []byte) error {
+	m := v.m
+
+	doc, err := m.decodeDocument(string(data))
+	if err != nil {
+		v.docError(errors.Wrap(err, "unable to decode document"))
+		return nil
+	}
+
+	rows := make([]*Row, 0, len(m.plan))
+
+	for _, p := range m.plan {
+		row, err := m.buildRow(p, doc, -1)
+		if err != nil {
+			if errors.Is(err, errSkipDocument) {
+				v.mu.Lock()
+				v.result.DocumentsSkipped++
+				v.mu.Unlock()
+
+				return nil
+			}
+
+			v.docError(errors.Wrapf(err, "unable to build row for table '%s'", p.table))
+
+			return nil
+		}
+
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+
+	v.mu.Lock()
+	v.result.DocumentsChecked++
+	v.mu.Unlock()
+
+	for _, row := range rows {
+		if err := v.verifyRow(ctx, row, nil); err != nil {
+			return errors.Wrapf(err, "unable to verify row in table '%s'", row.Table)
+		}
+	}
+
+	return nil
+}
+
+// verifyRow looks up row by its dupe check key and compares all columns;
+// children are verified against the parent's destination values
+func (v *verifier) verifyRow(ctx context.Context, row *Row, parent map[string]interface{}) error {
+	if len(row.DupeCheck) == 0 {
+		v.countTree(row, func(t *VerifyTable) { t.UnverifiableRows++ })
+		return nil
+	}
+
+	columns, values, err := withParentRefs(row, parent)
+	if err != nil {
+		return err
+	}
+
+	key := make(map[string]interface{}, len(row.DupeCheck))
+	where := make([]string, 0, len(row.DupeCheck))
+	args := make([]interface{}, 0, len(row.DupeCheck)+len(columns))
+
+	for _, dc := range row.DupeCheck {
+		i := indexOf(columns, dc)
+		if i < 0 {
+			key[dc] = nil
+			where = append(where, pgx.Identifier{dc}.Sanitize()+" IS NULL")
+
+			continue
+		}
+
+		key[dc] = displayValue(values[i])
+		args = append(args, values[i])
+		where = append(where, fmt.Sprintf("%s IS NOT DISTINCT FROM $%d", pgx.Identifier{dc}.Sanitize(), len(args)))
+	}
+
+	if live, ok := v.live[row.Table]; ok {
+		where = append(where, live)
+	}
+
+	// The same row produced by duplicate source documents is verified once
+	if v.seen != nil && !v.markSeen(row.Table, key) {
+		return nil
+	}
+
+	// For every column: whether it matches + its actual value (as text)
+	selects := make([]string, 0, len(columns)*2+len(row.Returning))
+
+	for i, c := range columns {
+		args = append(args, values[i])
+
+		lhs, rhs := pgx.Identifier{c}.Sanitize(), fmt.Sprintf("$%d", len(args))
+
+		// json has no equality operator
+		if conv := v.convs[row.Table][c]; conv == "json" || conv == "jsonb" {
+			lhs, rhs = lhs+"::jsonb", rhs+"::jsonb"
+		}
+
+		selects = append(selects, lhs+" IS NOT DISTINCT FROM "+rhs, pgx.Identifier{c}.Sanitize()+"::text")
+	}
+
+	for _, r := range row.Returning {
+		selects = append(selects, pgx.Identifier{r}.Sanitize())
+	}
+
+	if len(selects) == 0 {
+		selects = append(selects, "1")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s LIMIT 1",
+		strings.Join(selects, ", "), pgx.Identifier{string(row.Table)}.Sanitize(), strings.Join(where, " AND "))
+
+	rows, err := v.pool.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Children are written with their parent, so they are missing too
+		v.count(row.Table, func(t *VerifyTable) {
+			t.ExpectedRows++
+			t.MissingRows++
+
+			if len(t.Missing) < v.maxReported {
+				t.Missing = append(t.Missing, key)
+			}
+		})
+
+		for _, child := range row.Children {
+			v.countTree(child, func(t *VerifyTable) { t.MissingRows++ })
+		}
+
+		return nil
+	}
+
+	actual, err := rows.Values()
+	if err != nil {
+		return errors.Wrap(err, "unable to read destination row")
+	}
+
+	rows.Close()
+
+	mismatch := &VerifyMismatch{Key: key}
+
+	for i, c := range columns {
+		if equal, _ := actual[i*2].(bool); equal {
+			continue
+		}
+
+		col := &VerifyColumn{Column: c, Expected: displayValue(values[i])}
+
+		if s, ok := actual[i*2+1].(string); ok {
+			col.Actual = &s
+		}
+
+		mismatch.Columns = append(mismatch.Columns, col)
+	}
+
+	v.count(row.Table, func(t *VerifyTable) {
+		t.ExpectedRows++
+		t.FoundRows++
+
+		if len(mismatch.Columns) == 0 {
+			return
+		}
+
+		t.MismatchedRows++
+
+		if len(t.Mismatches) < v.maxReported {
+			t.Mismatches = append(t.Mismatches, mismatch)
+		}
+	})
+
+	returned := make(map[string]interface{}, len(row.Returning))
+
+	for i, r := range row.Returning {
+		returned[r] = actual[len(columns)*2+i]
+	}
+
+	for _, child := range row.Children {
+		if err := v.verifyRow(ctx, child, returned); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finish counts destination rows and determines extra rows and the outcome
+func (v *verifier) finish(ctx context.Context) error {
+	r := v.result
+	r.CompletedAt = time.Now()
+	r.OK = r.DocumentsFailed == 0
+
+	for name, t := range r.Tables {
+		query := "SELECT count(*) FROM " + pgx.Identifier{name}.Sanitize()
+
+		if live, ok := v.live[Table(name)]; ok {
+			query += " WHERE " + live
+		}
+
+		if err := v.pool.QueryRow(ctx, query).Scan(&t.DestinationRows); err != nil {
+			return errors.Wrapf(err, "unable to count rows in table '%s'", name)
+		}
+
+		if !r.Sampled && t.UnverifiableRows == 0 {
+			extra := max(t.DestinationRows-t.FoundRows, 0)
+			t.ExtraRows = &extra
+
+			if extra > 0 {
+				r.OK = false
+			}
+		}
+
+		if t.MissingRows > 0 || t.MismatchedRows > 0 {
+			r.OK = false
+		}
+	}
+
+	return nil
+}
+
+// markSeen records a dupe check key; returns false if it was already seen
+func (v *verifier) markSeen(table Table, key map[string]interface{}) bool {
+	data, _ := json.Marshal(key)
+
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	h.Write([]byte{0})
+	h.Write(data)
+
+	sum := h.Sum64()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.seen[sum]; ok {
+		return false
+	}
+
+	v.seen[sum] = struct{}{}
+
+	return true
+}
+
+func (v *verifier) count(table Table, f func(t *VerifyTable)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.result.Tables[string(table)]
+	if !ok {
+		t = &VerifyTable{}
+		v.result.Tables[string(table)] = t
+	}
+
+	f(t)
+}
+
+// countTree applies f to row's table and (recursively) its children's tables
+func (v *verifier) countTree(row *Row, f func(t *VerifyTable)) {
+	v.count(row.Table, func(t *VerifyTable) {
+		t.ExpectedRows++
+		f(t)
+	})
+
+	for _, child := range row.Children {
+		v.countTree(child, f)
+	}
+}
+
+func (v *verifier) docError(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.result.DocumentsFailed++
+
+	if len(v.result.Errors) < verifyMaxErrors {
+		v.result.Errors = append(v.result.Errors, err.Error())
+	}
+}
+
+// displayValue makes a converted value readable in the JSON result
+func displayValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil, string, bool, int, int32, int64, float32, float64:
+		return t
+	case []byte:
+		return `\x` + hex.EncodeToString(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
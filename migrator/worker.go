@@ -2,8 +2,6 @@ package migrator
 
 import (
 	"context"
-	"crypto/sha256"
-	"fmt"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -44,10 +42,16 @@ MAIN:
 				return errors.Wrap(err, "error processing job")
 			}
 
-			// Send job in goroutine to avoid blocking
-			go func() {
-				wjCh <- wj
-			}()
+			// Blocks while writers are busy; this (together with
+			// config.max_inflight_bytes) is what throttles the reader
+			select {
+			case <-shutdownCtx.Done():
+				llog.Debug("Received shutdown signal")
+				break MAIN
+			case wjCh <- wj:
+			}
+
+			numProcessed++
 		}
 	}
 
@@ -63,26 +67,60 @@ func (m *Migrator) processJob(j *ProcessorJob) (*WriterJob, error) {
 
 	llog.Debugf("Processing job at offset '%v'", j.Offset)
 
-	// BEGIN Temporary dupe checks
-	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte(j.Data)))
+	doc, err := m.decodeDocument(j.Data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decode document at offset '%d'", j.Offset)
+	}
+
+	if m.cfg.TOML.Source.FileContents == "changestream" {
+		return m.processChangeEvent(j, doc)
+	}
+
+	// Documents of archive sources are written with the mapping of their
+	// namespace
+	plan := m.plan
 
-	m.checksumsMu.Lock()
-	defer m.checksumsMu.Unlock()
+	if m.namespaces != nil {
+		var ok bool
 
-	if _, ok := m.checksums[checksum]; ok {
-		llog.Debugf("CHECKSUM %s ALREADY IN MAP (offset '%d')", checksum, j.Offset)
-		return nil, errors.New("checksum already in map")
+		plan, ok = m.namespaces.plan(j.Namespace)
+		if !ok {
+			m.stats.DocumentsSkipped.Inc()
+			return &WriterJob{Offset: j.Offset, Size: j.Size(), Namespace: j.Namespace}, nil
+		}
 	}
 
-	m.checksums[checksum] = struct{}{}
+	rows := make([]*Row, 0, len(plan))
 
-	// END Temporary dupe checks
+	for _, p := range plan {
+		row, err := m.buildRow(p, doc, -1)
+		if err != nil {
+			if errors.Is(err, errSkipDocument) {
+				llog.Debugf("Skipping document at offset '%d': %s", j.Offset, err)
+				m.stats.DocumentsSkipped.Inc()
 
-	// TODO: Verify that src contains all fields in mapping
-	// TODO: Convert src fields to dst fields
-	// TODO: Add writer job
+				// Still checkpoint the skipped document
+				return &WriterJob{Offset: j.Offset, Size: j.Size(), Namespace: j.Namespace}, nil
+			}
+
+			return nil, errors.Wrapf(err, "unable to build row for table '%s' at offset '%d'", p.table, j.Offset)
+		}
+
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+
+	sums, err := m.hasher.sum(rows)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to compute checksums at offset '%d'", j.Offset)
+	}
 
 	return &WriterJob{
-		Offset: j.Offset,
+		Offset:    j.Offset,
+		Size:      j.Size(),
+		Rows:      rows,
+		Sums:      sums,
+		Namespace: j.Namespace,
 	}, nil
 }
@@ -3,9 +3,11 @@ package migrator
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -15,6 +17,25 @@ import (
 
 type WriterJob struct {
 	Offset int64
+	Rows   []*Row
+
+	// Size of the source document; released from the in-flight budget once
+	// the job has been written
+	Size int64
+
+	// Checksums of Rows; added to the checkpoint once the document is
+	// checkpointed
+	Sums tableSums
+
+	// Change stream sources: Rows only hold the dupe check columns of the
+	// root rows to delete
+	Delete bool
+
+	// Change stream sources: resume token of the event
+	ResumeToken string
+
+	// Namespace of the document (archive and directory sources)
+	Namespace string
 }
 
 func (m *Migrator) runWriter(shutdownCtx context.Context, id int, writerCh <-chan *WriterJob, cpChan chan<- *CheckpointJob) error {
@@ -23,25 +44,42 @@ func (m *Migrator) runWriter(shutdownCtx context.Context, id int, writerCh <-cha
 		"id":     id,
 	})
 
+	if m.sink != nil {
+		return m.runSinkWriter(shutdownCtx, id, writerCh, cpChan)
+	}
+
 	llog.Debug("Start")
 	defer llog.Debug("Exit")
 
-	// Create connection pool
-	pool, err := m.createPGPool(shutdownCtx)
-	if err != nil {
-		return errors.Wrap(err, "error creating postgres connection pool")
-	}
+	// Connection pool; created once the writer is first activated (and
+	// re-created after connection errors) so that idle writers do not hold
+	// destination connections
+	var pool *pgxpool.Pool
 
-	// Ensure that destination tables and columns exist + have correct types
-	if err := m.validateDestinationMappings(shutdownCtx, pool); err != nil {
-		return errors.Wrap(err, "error validating destination mappings")
-	}
+	defer func() {
+		if pool != nil {
+			pool.Close()
+		}
+	}()
 
 	var numWritten int
-	fmt.Println("Writer loop starting...")
 
 MAIN:
 	for {
+		// Writers beyond the controller's active count wait to be activated
+		if !m.ctrl.active(id) {
+			select {
+			case <-shutdownCtx.Done():
+				llog.Debug("Received shutdown signal")
+				break MAIN
+			case <-m.wjClosed:
+				llog.Debug("Writer channel closed - exiting inactive writer")
+				break MAIN
+			case <-time.After(idleWriterPoll):
+				continue MAIN
+			}
+		}
+
 		select {
 		case <-shutdownCtx.Done():
 			llog.Debug("Received shutdown signal")
@@ -52,18 +90,42 @@ MAIN:
 				break MAIN
 			}
 
-			if err := m.writeJob(shutdownCtx, pool, job); err != nil {
-				llog.Errorf("Error writing job: %v", err)
-				return errors.Wrap(err, "error writing job")
+			// Write up to the (current) batch size jobs in a single transaction
+			batch := m.collectBatch(job, writerCh)
+
+			// Honor destination.max_rows_per_sec/max_bytes_per_sec
+			if err := m.throttle.Wait(shutdownCtx, int64(countRows(batch)), batchBytes(batch)); err != nil {
+				llog.Debug("Received shutdown signal while throttled")
+				break MAIN
+			}
+
+			if err := m.writeBatchRetry(shutdownCtx, llog, &pool, batch); err != nil {
+				llog.Errorf("Error writing batch: %v", err)
+				return errors.Wrap(err, "error writing batch")
 			}
 
+			m.stats.DocumentsWritten.Add(int64(len(batch)))
+			m.stats.RowsWritten.Add(int64(countRows(batch)))
+
 			// Write checkpoint
-			cpChan <- &CheckpointJob{
-				Offset: job.Offset,
+			for _, j := range batch {
+				select {
+				case <-shutdownCtx.Done():
+					llog.Debug("Received shutdown signal while sending checkpoints")
+					break MAIN
+				case cpChan <- &CheckpointJob{
+					WorkerID:    id,
+					Offset:      j.Offset,
+					Sums:        j.Sums,
+					ResumeToken: j.ResumeToken,
+					Namespace:   j.Namespace,
+				}:
+				}
+
+				m.budget.release(j.Size)
 			}
-			fmt.Println("END: Sending checkpoint job")
 
-			numWritten += 1
+			numWritten += len(batch)
 		}
 	}
 
@@ -72,11 +134,362 @@ MAIN:
 	return nil
 }
 
-// TODO: Implement
-func (m *Migrator) writeJob(shutdownCtx context.Context, pool *pgxpool.Pool, j *WriterJob) error {
+// collectBatch returns first + as many jobs as are immediately available on
+// writerCh without exceeding the controller's batch size.
+func (m *Migrator) collectBatch(first *WriterJob, writerCh <-chan *WriterJob) []*WriterJob {
+	batch := []*WriterJob{first}
+	batchSize := m.ctrl.BatchSize()
+
+	for len(batch) < batchSize {
+		select {
+		case j, open := <-writerCh:
+			if !open {
+				return batch
+			}
+
+			batch = append(batch, j)
+		default:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// batchBytes estimates the number of bytes written for batch
+func batchBytes(batch []*WriterJob) int64 {
+	var n int64
+
+	for _, j := range batch {
+		n += rowBytes(j.Rows)
+	}
+
+	return n
+}
+
+// countRows returns the number of rows (including children) in batch
+func countRows(batch []*WriterJob) int {
+	var count func(rows []*Row) int
+
+	count = func(rows []*Row) int {
+		n := len(rows)
+
+		for _, r := range rows {
+			n += count(r.Children)
+		}
+
+		return n
+	}
+
+	var n int
+
+	for _, j := range batch {
+		n += count(j.Rows)
+	}
+
+	return n
+}
+
+// writeBatchRetry writes batch, retrying transient errors according to
+// destination.retry. *pool is created when nil and replaced when an error
+// indicates that its connections are no longer usable (ie. after a failover).
+func (m *Migrator) writeBatchRetry(shutdownCtx context.Context, llog *logrus.Entry, pool **pgxpool.Pool, batch []*WriterJob) error {
+	cfg := m.cfg.TOML.Destination.Retry
+
+	for attempt := 1; ; attempt++ {
+		var err error
+
+		if *pool == nil {
+			*pool, err = m.createPGPool(shutdownCtx)
+		}
+
+		if err == nil {
+			started := time.Now()
+			err = m.writeBatch(shutdownCtx, *pool, batch)
+
+			m.ctrl.observe(len(batch), time.Since(started), err)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		m.stats.ErrorsDstWrite.Inc()
+
+		class := classifyError(err)
+
+		if class == errorPermanent || shutdownCtx.Err() != nil {
+			return err
+		}
+
+		// Replaying a batch that may have been committed duplicates rows that
+		// the dupe check cannot find
+		if commitUnknown(err) && !m.replayable(batch) {
+			return errors.Wrap(err, "connection failed during commit, batch may have been written; not retrying "+
+				"because its rows have no dupe check columns")
+		}
+
+		if cfg.Disable || attempt > cfg.MaxRetries {
+			return errors.Wrapf(err, "giving up after %d attempt(s)", attempt)
+		}
+
+		if class == errorReconnect && *pool != nil {
+			(*pool).Close()
+			*pool = nil
+		}
+
+		delay := backoff(cfg, attempt)
+
+		m.stats.ConnDstRetries.Inc()
+		llog.Warnf("Transient error writing batch (attempt %d/%d), retrying in %s: %s",
+			attempt, cfg.MaxRetries+1, delay.Round(time.Millisecond), err)
+
+		select {
+		case <-shutdownCtx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// replayable reports whether batch can be written again without duplicating
+// rows: delta (and change stream) writes are upserts and root rows with dupe
+// check columns are skipped, together with their children, if they exist
+func (m *Migrator) replayable(batch []*WriterJob) bool {
+	if m.delta != nil {
+		return true
+	}
+
+	if m.cfg.TOML.Config.DisableDupecheck {
+		return false
+	}
+
+	for _, j := range batch {
+		for _, row := range j.Rows {
+			if len(row.DupeCheck) == 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// writeBatch writes all rows in batch in a single transaction. Parent rows are
+// always written before their children. Jobs are applied in the order they
+// were read, so deletes and upserts of the same key (ie. change events) take
+// effect in source order.
+func (m *Migrator) writeBatch(shutdownCtx context.Context, pool *pgxpool.Pool, batch []*WriterJob) error {
+	if m.cfg.CLI.DryRun {
+		return nil
+	}
+
+	tx, err := pool.Begin(shutdownCtx)
+	if err != nil {
+		return errors.Wrap(err, "unable to begin transaction")
+	}
+
+	// No-op if tx has been committed
+	defer tx.Rollback(shutdownCtx)
+
+	counts := &deltaCounts{}
+
+	for _, j := range batch {
+		for _, row := range j.Rows {
+			switch {
+			case j.Delete:
+				err = m.deleteRow(shutdownCtx, tx, row, counts)
+			case m.delta != nil:
+				err = m.writeRowDelta(shutdownCtx, tx, row, nil, counts)
+			default:
+				err = m.writeRow(shutdownCtx, tx, row, nil)
+			}
+
+			if err != nil {
+				return errors.Wrapf(err, "unable to write job at offset '%d'", j.Offset)
+			}
+		}
+	}
+
+	if err := tx.Commit(shutdownCtx); err != nil {
+		return &commitError{errors.Wrap(err, "unable to commit transaction")}
+	}
+
+	m.stats.RowsUpdated.Add(counts.updated)
+	m.stats.RowsUnchanged.Add(counts.unchanged)
+	m.stats.RowsDeleted.Add(counts.deleted)
+
 	return nil
 }
 
+// writeRow inserts row (unless the dupe check finds it already exists) and
+// then recursively writes its children. parent contains the values of the
+// parent row's returned columns.
+func (m *Migrator) writeRow(shutdownCtx context.Context, tx pgx.Tx, row *Row, parent map[string]interface{}) error {
+	columns, values, err := withParentRefs(row, parent)
+	if err != nil {
+		return err
+	}
+
+	// Children are always written in the same transaction as their parent, so
+	// if the parent already exists, so do its children.
+	if !m.cfg.TOML.Config.DisableDupecheck && len(row.DupeCheck) > 0 {
+		exists, err := rowExists(shutdownCtx, tx, row, columns, values)
+		if err != nil {
+			return errors.Wrapf(err, "unable to perform dupe check on table '%s'", row.Table)
+		}
+
+		if exists {
+			return nil
+		}
+	}
+
+	returned, err := insertRow(shutdownCtx, tx, row, columns, values)
+	if err != nil {
+		return errors.Wrapf(err, "unable to insert into table '%s'", row.Table)
+	}
+
+	for _, child := range row.Children {
+		if err := m.writeRow(shutdownCtx, tx, child, returned); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withParentRefs returns row's columns and values with the parent columns
+// referenced by ParentRefs carried into them
+func withParentRefs(row *Row, parent map[string]interface{}) ([]string, []interface{}, error) {
+	if len(row.ParentRefs) == 0 {
+		return row.Columns, row.Values, nil
+	}
+
+	columns := append(make([]string, 0, len(row.Columns)+len(row.ParentRefs)), row.Columns...)
+	values := append(make([]interface{}, 0, len(row.Values)+len(row.ParentRefs)), row.Values...)
+
+	refs := make([]string, 0, len(row.ParentRefs))
+	for col := range row.ParentRefs {
+		refs = append(refs, col)
+	}
+
+	sort.Strings(refs)
+
+	for _, col := range refs {
+		v, ok := parent[row.ParentRefs[col]]
+		if !ok {
+			return nil, nil, errors.Errorf("parent column '%s' for '%s.%s' was not returned", row.ParentRefs[col], row.Table, col)
+		}
+
+		columns = append(columns, col)
+		values = append(values, v)
+	}
+
+	return columns, values, nil
+}
+
+// rowExists looks up a row by its dupe check columns
+func rowExists(shutdownCtx context.Context, tx pgx.Tx, row *Row, columns []string, values []interface{}) (bool, error) {
+	where, args := keyWhere(row, columns, values, nil)
+
+	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE %s)",
+		pgx.Identifier{string(row.Table)}.Sanitize(), where)
+
+	var exists bool
+
+	if err := tx.QueryRow(shutdownCtx, query, args...).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func insertRow(shutdownCtx context.Context, tx pgx.Tx, row *Row, columns []string, values []interface{}) (map[string]interface{}, error) {
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+
+	for i, c := range columns {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		pgx.Identifier{string(row.Table)}.Sanitize(), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+
+	if len(columns) == 0 {
+		query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", pgx.Identifier{string(row.Table)}.Sanitize())
+	}
+
+	if len(row.Returning) == 0 {
+		if _, err := tx.Exec(shutdownCtx, query, values...); err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{}, nil
+	}
+
+	query += " RETURNING " + selectList(row.Returning)
+
+	returned, err := queryReturning(shutdownCtx, tx, row.Returning, query, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	if returned == nil {
+		return nil, errors.New("insert did not return a row")
+	}
+
+	return returned, nil
+}
+
+// queryReturning runs query and maps the first result row to the returning
+// columns. Returns nil if the query produced no rows.
+func queryReturning(shutdownCtx context.Context, tx pgx.Tx, returning []string, query string, args ...interface{}) (map[string]interface{}, error) {
+	rows, err := tx.Query(shutdownCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values, err := rows.Values()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read returned values")
+	}
+
+	returned := make(map[string]interface{}, len(returning))
+
+	for i, col := range returning {
+		returned[col] = values[i]
+	}
+
+	rows.Close()
+
+	return returned, rows.Err()
+}
+
+func selectList(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+func indexOf(s []string, v string) int {
+	for i, e := range s {
+		if e == v {
+			return i
+		}
+	}
+
+	return -1
+}
+
 func (m *Migrator) createPGPool(shutdownCtx context.Context) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig(m.cfg.TOML.Destination.DSN)
 	if err != nil {
@@ -100,23 +513,13 @@ func (m *Migrator) validateDestinationMappings(shutdownCtx context.Context, pool
 	}
 
 	// Validate that destination columns exist + have correct types
-	if err := m.validateDstColumns(pool); err != nil {
+	if err := m.validateDstColumns(shutdownCtx, pool); err != nil {
 		return errors.Wrap(err, "error validating destination columns")
 	}
 
 	return nil
 }
 
-func parseDestination(dst string) (string, string) {
-	// dst is in the format "table:column"
-	parts := strings.Split(dst, ":")
-	if len(parts) != 2 {
-		return "", ""
-	}
-
-	return parts[0], parts[1]
-}
-
 type Table string
 
 type Column struct {
@@ -127,10 +530,10 @@ type Column struct {
 func getDestinationMappings(input *config.TOMLMapping) (map[Table][]Column, error) {
 	mappings := make(map[Table][]Column)
 
-MAIN:
 	for mName, mEntries := range *input {
+	ENTRIES:
 		for _, entry := range mEntries {
-			tStr, cStr := parseDestination(entry.Dst)
+			tStr, cStr := config.ParseDst(entry.Dst)
 			if tStr == "" || cStr == "" {
 				return nil, errors.Errorf("unable to determine destination table or column for mapping '%s'", mName)
 			}
@@ -144,7 +547,7 @@ MAIN:
 			// Get rid of dupes
 			for _, col := range mappings[t] {
 				if col.Name == cStr {
-					continue MAIN
+					continue ENTRIES
 				}
 			}
 
@@ -179,8 +582,7 @@ func (m *Migrator) validateDstTables(shutdownCtx context.Context, pool *pgxpool.
 	return nil
 }
 
-// TODO: Implement
-func (m *Migrator) validateDstColumns(pool *pgxpool.Pool) error {
+func (m *Migrator) validateDstColumns(shutdownCtx context.Context, pool *pgxpool.Pool) error {
 	dstMappings, err := getDestinationMappings(m.cfg.TOML.Mapping)
 	if err != nil {
 		return errors.Wrap(err, "error getting destination mappings")
@@ -188,7 +590,7 @@ func (m *Migrator) validateDstColumns(pool *pgxpool.Pool) error {
 
 	for table, columns := range dstMappings {
 		for _, c := range columns {
-			if err := checkColumn(pool, table, c); err != nil {
+			if err := checkColumn(shutdownCtx, pool, table, c); err != nil {
 				return errors.Wrapf(err, "error during column check for '%s.%s'", table, c.Name)
 			}
 		}
@@ -197,21 +599,23 @@ func (m *Migrator) validateDstColumns(pool *pgxpool.Pool) error {
 	return nil
 }
 
-func checkColumn(pool *pgxpool.Pool, t Table, c Column) error {
+func checkColumn(shutdownCtx context.Context, pool *pgxpool.Pool, t Table, c Column) error {
 	var dtype string
 	query := `
-        SELECT data_type FROM information_schema.columns 
-        WHERE table_name=$1 AND column_name=$2
-    `
-	err := pool.QueryRow(context.Background(), query, t, c).Scan(&dtype)
+        SELECT data_type FROM information_schema.columns
+        WHERE table_name=$1 AND column_name=$2 AND table_schema=` + searchPathSchema
+	err := pool.QueryRow(shutdownCtx, query, string(t), c.Name).Scan(&dtype)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return errors.Errorf("column '%s' does not exist in table '%s'", c.Name, t)
+		}
+
 		return errors.Wrap(err, "error querying information_schema.columns")
 	}
 
-	// Check if column type matches
-	fmt.Println("our dtype is: ", dtype)
+	// TODO: Check if column type matches conv
 
-	return errors.New("tmp error return")
+	return nil
 }
 
 func checkTableExists(shutdownCtx context.Context, pool *pgxpool.Pool, t Table) (bool, error) {
@@ -219,7 +623,8 @@ func checkTableExists(shutdownCtx context.Context, pool *pgxpool.Pool, t Table)
 
 	err := pool.QueryRow(
 		shutdownCtx,
-		"SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name=$1)", string(t),
+		"SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_name=$1 AND table_schema="+searchPathSchema+")",
+		string(t),
 	).Scan(&exists)
 
 	return exists, err
@@ -0,0 +1,278 @@
+// Package schema maps mapping convs to destination column types and generates
+// DDL for destination tables.
+package schema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/dselans/mmmbop/conv"
+)
+
+const (
+	Postgres = "postgres"
+	MySQL    = "mysql"
+)
+
+// Column describes a single destination column
+type Column struct {
+	Name    string
+	Conv    string
+	NotNull bool
+
+	// Identity columns are generated by the destination (ie. serial IDs that
+	// child tables reference); Conv must be "int".
+	Identity bool
+}
+
+// Table describes a destination table
+type Table struct {
+	Name    string
+	Columns []*Column
+
+	// Optional primary key columns
+	PrimaryKey []string
+
+	// Optional columns of a unique constraint (ie. dupe-check columns)
+	Unique []string
+}
+
+// Index is a secondary index of a table
+type Index struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+
+var (
+	postgresTypes = map[string]string{
+		"string":      "text",
+		"int":         "bigint",
+		"float":       "double precision",
+		"bool":        "boolean",
+		"time":        "time",
+		"json":        "json",
+		"jsonb":       "jsonb",
+		"date":        "date",
+		"datetime":    "timestamp",
+		"timestamp":   "timestamp",
+		"timestamptz": "timestamptz",
+		"uuid":        "uuid",
+		"numeric":     "numeric",
+		"bytea":       "bytea",
+		"base64":      "bytea",
+		"bson":        "bytea",
+		"inet":        "inet",
+		"enum":        "text",
+	}
+
+	mysqlTypes = map[string]string{
+		"string":      "text",
+		"int":         "bigint",
+		"float":       "double",
+		"bool":        "boolean",
+		"time":        "time(6)",
+		"json":        "json",
+		"jsonb":       "json",
+		"date":        "date",
+		"datetime":    "datetime(6)",
+		"timestamp":   "datetime(6)",
+		"timestamptz": "datetime(6)",
+		"uuid":        "char(36)",
+		"numeric":     "decimal(65,30)",
+		"bytea":       "longblob",
+		"base64":      "longblob",
+		"bson":        "longblob",
+		"inet":        "varchar(45)",
+		"enum":        "varchar(255)",
+	}
+
+	// MySQL cannot index text/blob columns without a prefix length
+	mysqlIndexableTypes = map[string]string{
+		"text":     "varchar(255)",
+		"longblob": "varbinary(255)",
+	}
+)
+
+// ColumnType returns the destination column type for conv. MySQL has no array
+// types; arrays are stored as json.
+func ColumnType(dstType, c string, unique bool) (string, error) {
+	name := strings.TrimSuffix(c, conv.ArraySuffix)
+	array := name != c
+
+	switch dstType {
+	case Postgres:
+		t, ok := postgresTypes[name]
+		if !ok {
+			return "", errors.Errorf("unknown conv '%s'", c)
+		}
+
+		if array {
+			t += "[]"
+		}
+
+		return t, nil
+	case MySQL:
+		t, ok := mysqlTypes[name]
+		if !ok {
+			return "", errors.Errorf("unknown conv '%s'", c)
+		}
+
+		if array {
+			t = "json"
+		}
+
+		if indexable, ok := mysqlIndexableTypes[t]; ok && unique {
+			t = indexable
+		}
+
+		return t, nil
+	default:
+		return "", errors.Errorf("unsupported destination type '%s'", dstType)
+	}
+}
+
+// QuoteIdent quotes an identifier
+func QuoteIdent(dstType, name string) string {
+	if dstType == MySQL {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteIdents(dstType string, names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = QuoteIdent(dstType, n)
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// ColumnDefinition returns the column definition used in CREATE TABLE and
+// ALTER TABLE ... ADD COLUMN statements. indexed should be set for columns
+// that are part of a key.
+func ColumnDefinition(dstType string, c *Column, indexed bool) (string, error) {
+	if c.Identity {
+		if c.Conv != "int" {
+			return "", errors.Errorf("identity column '%s' must use conv 'int'", c.Name)
+		}
+
+		if dstType == MySQL {
+			return QuoteIdent(dstType, c.Name) + " bigint NOT NULL AUTO_INCREMENT", nil
+		}
+
+		return QuoteIdent(dstType, c.Name) + " bigint GENERATED BY DEFAULT AS IDENTITY", nil
+	}
+
+	t, err := ColumnType(dstType, c.Conv, indexed)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to determine type of column '%s'", c.Name)
+	}
+
+	def := QuoteIdent(dstType, c.Name) + " " + t
+
+	if c.NotNull {
+		def += " NOT NULL"
+	}
+
+	return def, nil
+}
+
+// CreateTable returns a CREATE TABLE statement for t
+func CreateTable(dstType string, t *Table) (string, error) {
+	if len(t.Columns) == 0 {
+		return "", errors.Errorf("table '%s' has no columns", t.Name)
+	}
+
+	lines := make([]string, 0, len(t.Columns)+2)
+
+	for _, c := range t.Columns {
+		indexed := contains(t.PrimaryKey, c.Name) || contains(t.Unique, c.Name)
+
+		def, err := ColumnDefinition(dstType, c, indexed)
+		if err != nil {
+			return "", err
+		}
+
+		lines = append(lines, "    "+def)
+	}
+
+	if len(t.PrimaryKey) > 0 {
+		lines = append(lines, fmt.Sprintf("    PRIMARY KEY (%s)", quoteIdents(dstType, t.PrimaryKey)))
+	}
+
+	if len(t.Unique) > 0 {
+		lines = append(lines, fmt.Sprintf("    CONSTRAINT %s UNIQUE (%s)",
+			QuoteIdent(dstType, UniqueIndexName(t.Name)), quoteIdents(dstType, t.Unique)))
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n%s\n);",
+		QuoteIdent(dstType, t.Name), strings.Join(lines, ",\n")), nil
+}
+
+// AddColumn returns an ALTER TABLE statement that adds c to table. Added
+// columns are always nullable so that existing rows remain valid.
+func AddColumn(dstType, table string, c *Column) (string, error) {
+	nullable := *c
+	nullable.NotNull = false
+
+	def, err := ColumnDefinition(dstType, &nullable, false)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", QuoteIdent(dstType, table), def), nil
+}
+
+// CreateUniqueIndex returns a statement creating the unique index on t.Unique
+// (if it does not exist yet)
+func CreateUniqueIndex(dstType string, t *Table) string {
+	ifNotExists := "IF NOT EXISTS "
+
+	// MySQL does not support IF NOT EXISTS for indexes
+	if dstType == MySQL {
+		ifNotExists = ""
+	}
+
+	return fmt.Sprintf("CREATE UNIQUE INDEX %s%s ON %s (%s);", ifNotExists,
+		QuoteIdent(dstType, UniqueIndexName(t.Name)), QuoteIdent(dstType, t.Name), quoteIdents(dstType, t.Unique))
+}
+
+// CreateIndex returns a statement creating index on table (if it does not
+// exist yet)
+func CreateIndex(dstType, table string, index *Index) string {
+	ifNotExists := "IF NOT EXISTS "
+
+	// MySQL does not support IF NOT EXISTS for indexes
+	if dstType == MySQL {
+		ifNotExists = ""
+	}
+
+	unique := ""
+	if index.Unique {
+		unique = "UNIQUE "
+	}
+
+	return fmt.Sprintf("CREATE %sINDEX %s%s ON %s (%s);", unique, ifNotExists,
+		QuoteIdent(dstType, index.Name), QuoteIdent(dstType, table), quoteIdents(dstType, index.Columns))
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UniqueIndexName is the name of the unique index/constraint created on a
+// table's dupe-check columns
+func UniqueIndexName(table string) string {
+	return strings.ReplaceAll(table, ".", "_") + "_dupe_check_key"
+}